@@ -2,68 +2,933 @@ package arcsek
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
-// A method to adda file to a tar.gz
-func addFileToTar(filePath string, tarWriter *tar.Writer) error {
+// ErrDuplicateEntry is returned when two files would have
+// the same name in the archive
+var ErrDuplicateEntry = errors.New("arcsek: duplicate entry in the archive")
+
+// ErrFileNotFound is returned when a file to archive does
+// not exist. The error also matches fs.ErrNotExist
+var ErrFileNotFound = errors.New("arcsek: file not found")
+
+// ErrEmptyFileList is returned when a vault is built from
+// no files at all
+var ErrEmptyFileList = errors.New("arcsek: no files to archive")
+
+// ErrFileTooLarge is returned when a file is bigger than
+// VaultBuilder.MaxFileSize
+var ErrFileTooLarge = errors.New("arcsek: file larger than the limit")
+
+// ErrQuotaExceeded is returned when the files add up to more
+// than VaultBuilder.MaxVaultSize
+var ErrQuotaExceeded = errors.New("arcsek: the files exceed the vault quota")
+
+// ErrFileChanged is returned when the size of a file changed
+// while it was archived, see VaultBuilder.AllowChangedFiles
+var ErrFileChanged = errors.New("arcsek: file changed while it was archived")
+
+// Tell missing files apart from other errors
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrFileNotFound, err)
+	}
+	return err
+}
+
+// A method to adda file to a tar.gz with the name.
+// It returns the number of bytes of the file.
+//
+// If fill is not nil, it can complete the header. If wrap
+// is not nil, the contents are written through what it
+// returns instead of the tar directly. If the file doesn't
+// have the size of its header once read, it fails with
+// ErrFileChanged unless allowChanged
+func addFileToTar(filePath, name string, tarWriter *tar.Writer, fill func(*tar.Header, string) error, wrap func(io.Writer) io.Writer, allowChanged bool) (int64, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return 0, notFound(err)
 	}
 	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	header := &tar.Header{
-		Name:    filePath,
-		Size:    stat.Size(),
-		Mode:    int64(stat.Mode()),
-		ModTime: stat.ModTime(),
+	return writeFileToTar(filePath, name, stat, file, tarWriter, fill, wrap, allowChanged)
+}
+
+// Write a file entry with the contents, which hold the
+// stat.Size() bytes of the file at filePath. If they hold
+// more or less the entry gets stat.Size() bytes anyway,
+// with zeros for the missing ones, if allowChanged
+func writeFileToTar(filePath, name string, stat os.FileInfo, contents io.Reader, tarWriter *tar.Writer, fill func(*tar.Header, string) error, wrap func(io.Writer) io.Writer, allowChanged bool) (int64, error) {
+	// The header gets the mode, the modification time and
+	// the owner of the file
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return 0, err
+	}
+	header.Name = name
+
+	if fill != nil {
+		if err = fill(header, filePath); err != nil {
+			return 0, err
+		}
 	}
 
+	paxLongNames(header)
 	err = tarWriter.WriteHeader(header)
 	if err != nil {
+		return 0, &partialEntryError{err}
+	}
+
+	var body io.Writer = tarWriter
+	if wrap != nil {
+		body = wrap(tarWriter)
+	}
+
+	// Whatever it grew by would not fit in the entry
+	n, err := copyBuffer(body, io.LimitReader(contents, header.Size))
+	if err != nil {
+		return n, &partialEntryError{err}
+	}
+
+	switch {
+	case n < header.Size:
+		if !allowChanged {
+			return n, &partialEntryError{fmt.Errorf("%w: %s shrank from %d to %d bytes", ErrFileChanged, filePath, header.Size, n)}
+		}
+
+		// The tar needs the whole entry
+		if _, err = io.CopyN(body, zeroReader{}, header.Size-n); err != nil {
+			return n, &partialEntryError{err}
+		}
+
+	case !allowChanged:
+		var extra [1]byte
+		if m, _ := io.ReadFull(contents, extra[:]); m > 0 {
+			return n, &partialEntryError{fmt.Errorf("%w: %s grew past %d bytes", ErrFileChanged, filePath, header.Size)}
+		}
+	}
+
+	return header.Size, nil
+}
+
+// Reads zeros forever
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// FileInfoHeader records the owner of the file where the
+// platform has one. Unless it is wanted it is removed, the
+// vault may be extracted in a machine with other users
+func setOwner(header *tar.Header, keep bool) {
+	if keep {
+		return
+	}
+
+	header.Uid, header.Gid = 0, 0
+	header.Uname, header.Gname = "", ""
+}
+
+// The longest name a ustar header holds without its prefix
+const ustarNameLen = 100
+
+// A name too long for a ustar header is written whole in a
+// PAX record. archive/tar would pick the GNU format for some
+// entries, which not every reader takes
+func paxLongNames(header *tar.Header) {
+	if header.Format == tar.FormatUnknown && (len(header.Name) > ustarNameLen || len(header.Linkname) > ustarNameLen) {
+		header.Format = tar.FormatPAX
+	}
+}
+
+// Counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// A temporary archive, on disk or in memory
+type archive struct {
+	path string
+
+	// The archive if it is kept in memory
+	data []byte
+
+	// Size of the compressed tar
+	size int64
+
+	// What went into the tar
+	info VaultInfo
+
+	// Why files were left out, nil if none was
+	skipped error
+}
+
+// Writes the contents of a vault to the tar and keeps
+// track of what went into it
+type archiveWriter struct {
+	tw   *tar.Writer
+	info VaultInfo
+
+	// The names already in the tar
+	names map[string]bool
+
+	// Whether the owner of the files is recorded
+	keepOwner bool
+
+	// Whether the extended attributes are recorded
+	xattrs bool
+
+	// Whether the times of the entries are left out, for
+	// reproducible vaults
+	fixedTime bool
+
+	// Whether the files whose size changed are archived, see
+	// VaultBuilder.AllowChangedFiles
+	allowChanged bool
+
+	// The largest file that can be archived, if not zero
+	maxFileSize int64
+
+	// The most bytes of files in the archive, if not zero,
+	// and how many were written so far
+	maxVaultSize, archived int64
+
+	// The ids the entries are written with if the names are
+	// obfuscated, see writeNames
+	ids map[string]string
+
+	// The files archived so far, if duplicates are written
+	// as copies
+	dedup *dedup
+
+	// The SHA-256 of the files in the manifest, by name, if
+	// the vault has one
+	sums map[string][sha256.Size]byte
+
+	// Where the bytes archived are counted, if not nil
+	progress *progress
+
+	// Told about every entry before it is written, if not
+	// nil, with how many were written and will be
+	onFile       func(name string, index, total int, size int64)
+	index, total int
+
+	// Cancels the archiving, if not nil
+	ctx context.Context
+
+	// The errors of the files that were left out
+	skipped []error
+}
+
+// Start writing an entry, unless the context is done, and
+// tell onFile about it
+func (a *archiveWriter) begin(name string, size int64) error {
+	if err := a.ctxErr(); err != nil {
 		return err
 	}
 
-	_, err = io.Copy(tarWriter, file)
+	if a.onFile != nil {
+		a.index++
+		a.onFile(name, a.index, a.total, size)
+	}
+	return nil
+}
+
+// Check the size of a file before reading any of it
+func (a *archiveWriter) checkSize(size int64) error {
+	if a.maxFileSize > 0 && size > a.maxFileSize {
+		return fmt.Errorf("%w: %d bytes, at most %d are allowed", ErrFileTooLarge, size, a.maxFileSize)
+	}
+	return nil
+}
+
+// Fails the archiving once the files written through it add
+// up to more than the quota, counting what is copied and not
+// the sizes the files had when they were listed
+type quotaWriter struct {
+	w io.Writer
+	a *archiveWriter
+}
+
+func (q quotaWriter) Write(p []byte) (int, error) {
+	if q.a.archived+int64(len(p)) > q.a.maxVaultSize {
+		return 0, fmt.Errorf("%w of %d bytes", ErrQuotaExceeded, q.a.maxVaultSize)
+	}
+
+	n, err := q.w.Write(p)
+	q.a.archived += int64(n)
+	return n, err
+}
+
+// The error of the context, if there is one
+func (a *archiveWriter) ctxErr() error {
+	if a.ctx == nil {
+		return nil
+	}
+
+	return a.ctx.Err()
+}
+
+// Wrap the writer of the contents of an entry so they are
+// counted and can be cancelled
+func (a *archiveWriter) body(w io.Writer) io.Writer {
+	if a.ctx != nil {
+		w = ctxWriter{a.ctx, w}
+	}
+
+	if a.maxVaultSize > 0 {
+		w = quotaWriter{w, a}
+	}
+
+	return a.progress.writer(w)
+}
+
+// Reserve a name in the tar. Two entries with the same name
+// would overwrite each other when extracted
+func (a *archiveWriter) claim(name string) error {
+	if a.names == nil {
+		a.names = make(map[string]bool)
+	}
+
+	if a.names[name] {
+		return fmt.Errorf("%w: %s", ErrDuplicateEntry, name)
+	}
+
+	a.names[name] = true
+	return nil
+}
+
+// Add a file of the disk to the archive with the name.
+// Symlinks are archived as links unless follow is set,
+// then the file they point to is archived instead.
+// Directories are added without their contents
+func (a *archiveWriter) addFile(path, name string, follow bool) error {
+	stat, err := os.Lstat(path)
 	if err != nil {
+		return notFound(err)
+	}
+
+	if follow && stat.Mode()&os.ModeSymlink != 0 {
+		if stat, err = os.Stat(path); err != nil {
+			return notFound(err)
+		}
+	}
+
+	switch {
+	case stat.Mode()&os.ModeSymlink != 0:
+		return a.addSymlink(path, name, stat)
+	case stat.IsDir():
+		return a.addDir(path, name, stat)
+	}
+
+	if err = a.checkSize(stat.Size()); err != nil {
+		return err
+	}
+
+	if err = a.claim(name); err != nil {
+		return err
+	}
+
+	if err = a.begin(name, stat.Size()); err != nil {
 		return err
 	}
 
+	if a.dedup != nil && stat.Mode().IsRegular() {
+		target, err := a.dedup.find(stat.Size(), func() ([sha256.Size]byte, error) { return hashFile(path) })
+		if err != nil {
+			return err
+		}
+
+		if target != "" {
+			return a.addCopy(path, name, stat, target)
+		}
+	}
+
+	// Hash the file as it is archived, for the copies and
+	// the manifest
+	wrap := a.body
+	var sum hash.Hash
+	if (a.dedup != nil || a.sums != nil) && stat.Mode().IsRegular() {
+		sum = sha256.New()
+		wrap = func(w io.Writer) io.Writer { return io.MultiWriter(a.body(w), sum) }
+	}
+
+	n, err := addFileToTar(path, a.entryName(name), a.tw, a.fill, wrap, a.allowChanged)
+	if err != nil {
+		return err
+	}
+
+	if sum != nil {
+		got := [sha256.Size]byte(sum.Sum(nil))
+		if err = a.checkSum(name, got); err != nil {
+			return err
+		}
+
+		if a.dedup != nil {
+			a.dedup.add(a.entryName(name), n, got)
+		}
+	}
+
+	a.info.Files++
+	a.info.Size += n
 	return nil
 }
 
-// Create a temporary .tar.gz file in disk and return its path
-func createTemporaryTarGz(files []string) (string, error) {
-	// Create the temporary file to store the .tar.gz
-	tmp, err := ioutil.TempFile("", "*.tar.gz")
+// Add a symlink to the archive, recording its target
+func (a *archiveWriter) addSymlink(path, name string, stat os.FileInfo) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(stat, target)
+	if err != nil {
+		return err
+	}
+	header.Name = a.entryName(name)
+
+	// Symlinks can't have user xattrs
+	setOwner(header, a.keepOwner)
+	a.setTime(header)
+
+	return a.writeHeader(header)
+}
+
+// Add a directory entry, so it exists even if it is empty
+func (a *archiveWriter) addDir(path, name string, stat os.FileInfo) error {
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	header.Name = a.entryName(name) + "/"
+
+	if err = a.fill(header, path); err != nil {
+		return err
+	}
+
+	return a.writeHeader(header)
+}
+
+// Complete the header of the file at path with what the
+// builder asks to record
+func (a *archiveWriter) fill(header *tar.Header, path string) error {
+	setOwner(header, a.keepOwner)
+	a.setTime(header)
+
+	if !a.xattrs {
+		return nil
+	}
+
+	return addXattrs(header, path)
+}
+
+// Write the header of an entry without contents
+func (a *archiveWriter) writeHeader(header *tar.Header) error {
+	name := strings.TrimSuffix(header.Name, "/")
+	if err := a.claim(name); err != nil {
+		return err
+	}
+
+	if err := a.begin(name, 0); err != nil {
+		return err
+	}
+
+	paxLongNames(header)
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	a.info.Files++
+	return nil
+}
+
+// Fills an archive with its contents
+type archiveContents func(a *archiveWriter) error
+
+// The contents, cancelled when ctx is done
+func withContext(ctx context.Context, contents archiveContents) archiveContents {
+	return func(a *archiveWriter) error {
+		a.ctx = ctx
+		return contents(a)
+	}
+}
+
+// The contents of an archive with the files of the disk,
+// archived with the settings of the builder
+func (b *VaultBuilder) addFiles(files []string) archiveContents {
+	return func(a *archiveWriter) error {
+		a.keepOwner = b.PreserveOwnership
+		a.xattrs = b.IncludeXattrs
+		a.fixedTime = b.nonce != nil
+		a.allowChanged = b.AllowChangedFiles
+		a.maxFileSize, a.maxVaultSize = b.MaxFileSize, b.MaxVaultSize
+
+		if b.Deduplicate {
+			a.dedup = newDedup()
+		}
+
+		base, err := b.baseDir(files)
+		if err != nil {
+			return err
+		}
+
+		if b.Progress != nil || b.OnFile != nil {
+			count, size, err := b.measure(base, files)
+			if err != nil {
+				return err
+			}
+
+			a.progress = newProgress(b.Progress, size)
+			a.onFile, a.total = b.OnFile, count
+		}
+
+		if b.Concurrency > 1 || b.ObfuscateNames || b.Manifest || b.BaseManifest != nil {
+			if err := b.addJobs(a, base, files); err != nil {
+				return err
+			}
+		} else {
+			// add each file to the .tar.gz
+			for _, file := range files {
+				if err := b.addPath(a, base, file); err != nil {
+					return err
+				}
+			}
+		}
+
+		a.progress.finish()
+		return nil
+	}
+}
+
+// The directory the names in the tar are relative to. If
+// the builder has none it is the deepest directory that
+// holds all the files, or the directory itself if only one
+// is walked
+func (b *VaultBuilder) baseDir(files []string) (string, error) {
+	if b.BaseDir != "" {
+		return filepath.Abs(b.BaseDir)
+	}
+
+	var base string
+	for i, file := range files {
+		dir, err := filepath.Abs(file)
+		if err != nil {
+			return "", err
+		}
+
+		// Directories that are not walked are like files.
+		// Missing files fail when they are added
+		if stat, err := os.Lstat(dir); err != nil || !stat.IsDir() || b.DisableRecursion {
+			dir = filepath.Dir(dir)
+		}
+
+		if i == 0 {
+			base = dir
+			continue
+		}
+
+		// Go up until base holds dir
+		for !within(base, dir) {
+			base = filepath.Dir(base)
+		}
+	}
+
+	return base, nil
+}
+
+// Whether path is base or is inside of it
+func within(base, path string) bool {
+	rel, err := filepath.Rel(base, path)
+	return err == nil && isLocal(rel)
+}
+
+// The name in the tar of the file at path
+func tarName(base, path string) (string, error) {
+	abs, err := filepath.Abs(path)
 	if err != nil {
 		return "", err
 	}
-	defer tmp.Close()
 
-	gzw := gzip.NewWriter(tmp)
-	defer gzw.Close()
+	rel, err := filepath.Rel(base, abs)
+	if err != nil || !isLocal(rel) {
+		return "", fmt.Errorf("arcsek: %s is not within %s", path, base)
+	}
 
-	tw := tar.NewWriter(gzw)
-	defer tw.Close()
+	return filepath.ToSlash(rel), nil
+}
 
-	// add each file to the .tar.gz
+// Add a path given to the builder. Directories are walked
+// unless the builder says otherwise
+func (b *VaultBuilder) addPath(a *archiveWriter, base, path string) error {
+	add := func(p, name string) error {
+		return a.addFile(p, name, b.FollowSymlinks)
+	}
+
+	return b.walkPath(base, path, add, b.failed(a))
+}
+
+// Add every file once all of them are listed, for what
+// needs the whole list first: reading the files ahead with
+// Concurrency and the name map of ObfuscateNames. The tar is
+// the same as adding them one by one
+func (b *VaultBuilder) addJobs(a *archiveWriter, base string, files []string) error {
+	failed := b.failed(a)
+
+	var jobs []fileJob
 	for _, file := range files {
-		// Add each file to the .tar.gz
-		if err = addFileToTar(file, tw); err != nil {
-			return "", err
+		collect := func(path, name string) error {
+			jobs = append(jobs, fileJob{path, name})
+			return nil
+		}
+
+		if err := b.walkPath(base, file, collect, failed); err != nil {
+			return err
+		}
+	}
+
+	if b.Manifest || b.BaseManifest != nil {
+		var base map[string]ManifestEntry
+		if b.BaseManifest != nil {
+			base = manifestByName(b.BaseManifest)
+		}
+
+		var err error
+		if jobs, err = a.writeManifest(jobs, b.FollowSymlinks, base, failed); err != nil {
+			return err
+		}
+	}
+
+	if b.ObfuscateNames {
+		names := make([]string, len(jobs))
+		for i, job := range jobs {
+			names[i] = job.name
+		}
+
+		if err := a.writeNames(names); err != nil {
+			return err
+		}
+	}
+
+	var p *prefetcher
+	if b.Concurrency > 1 {
+		p = b.readAhead(jobs)
+		defer p.stop()
+	}
+
+	for i, job := range jobs {
+		var err error
+		if res := p.take(i); res.ok {
+			err = a.addPrefetched(job.path, job.name, res)
+		} else {
+			err = a.addFile(job.path, job.name, b.FollowSymlinks)
+		}
+
+		if err != nil {
+			if err = failed(job.path, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Handle the error of a file, naming it. The files that
+// can be skipped are recorded in a
+func (b *VaultBuilder) failed(a *archiveWriter) func(path string, err error) error {
+	return func(p string, err error) error {
+		err = fmt.Errorf("%s: %w", p, err)
+		if !b.canSkip(err) {
+			return err
+		}
+
+		a.skipped = append(a.skipped, err)
+		return nil
+	}
+}
+
+// Whether the builder goes on without the file that failed
+// with err. Only errors of the file system before the file
+// is written to the tar can be skipped, anything else
+// leaves the tar broken or is not about a single file
+func (b *VaultBuilder) canSkip(err error) bool {
+	var pathErr *fs.PathError
+	var partial *partialEntryError
+	return b.ContinueOnError && errors.As(err, &pathErr) && !errors.As(err, &partial)
+}
+
+// An error after the header of an entry was written, the
+// tar can't go on
+type partialEntryError struct {
+	err error
+}
+
+func (p *partialEntryError) Error() string { return p.err.Error() }
+func (p *partialEntryError) Unwrap() error { return p.err }
+
+// Call fn with every file the builder archives for a path,
+// in order, with its name in the tar. The errors of each
+// file go through failed, which may return nil to skip it
+func (b *VaultBuilder) walkPath(base, path string, fn func(path, name string) error, failed func(path string, err error) error) error {
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return failed(path, notFound(err))
+	}
+
+	if b.Filter != nil && !b.Filter(path, stat) {
+		return nil
+	}
+
+	if !stat.IsDir() || b.DisableRecursion {
+		name, err := tarName(base, path)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(path, name); err != nil {
+			return failed(path, err)
+		}
+		return nil
+	}
+
+	// WalkDir does not follow symlinks to directories,
+	// so it can't loop
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		// Skipping a directory that can't be read skips
+		// its contents
+		if err != nil {
+			return failed(p, err)
 		}
+
+		// The root was already filtered
+		if b.Filter != nil && p != path {
+			info, err := d.Info()
+			if err != nil {
+				return failed(p, err)
+			}
+
+			if !b.Filter(p, info) {
+				// Prune it, its contents are never read
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+
+		name, err := tarName(base, p)
+		if err != nil {
+			return err
+		}
+
+		// The base itself is where the archive is extracted
+		if name == "." {
+			return nil
+		}
+
+		if err = fn(p, name); err != nil {
+			return failed(p, err)
+		}
+		return nil
+	})
+}
+
+// How many entries the builder archives and the total size
+// of the files, for the progress
+func (b *VaultBuilder) measure(base string, files []string) (int, int64, error) {
+	var count int
+	var total int64
+	for _, file := range files {
+		measure := func(path, _ string) error {
+			count++
+
+			stat, err := os.Lstat(path)
+			if err == nil && b.FollowSymlinks && stat.Mode()&os.ModeSymlink != 0 {
+				stat, err = os.Stat(path)
+			}
+			if err != nil {
+				return err
+			}
+
+			if stat.Mode().IsRegular() {
+				total += stat.Size()
+			}
+			return nil
+		}
+
+		// What is skipped is reported when it is added
+		err := b.walkPath(base, file, measure, func(path string, err error) error {
+			if b.canSkip(err) {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return count, total, nil
+}
+
+// ListDir lists the files in root, without directories,
+// sorted so archives of the same tree are reproducible.
+// With recursive it walks root the way the builder does,
+// without following symlinks to directories
+func ListDir(root string, recursive bool) ([]string, error) {
+	var ls []string
+
+	if !recursive {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if !e.IsDir() {
+				ls = append(ls, filepath.Join(root, e.Name()))
+			}
+		}
+
+		return ls, nil
+	}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			ls = append(ls, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// WalkDir sorts each directory, not the whole list
+	sort.Strings(ls)
+	return ls, nil
+}
+
+// Create a temporary compressed tar file, made by create,
+// which is given the extension of the compression. The level
+// must be valid for the compression
+func createFileArchive(create func(ext string) (*os.File, error), cmp compressor, level int, contents archiveContents) (*archive, error) {
+	// Create the temporary file to store the .tar.gz
+	tmp, err := create(cmp.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	if tmp == nil {
+		return nil, errNoTempFile
+	}
+
+	arc, err := writeArchive(tmp, cmp, level, contents)
+
+	// A failed close may have lost part of the archive
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		// Don't leave the partial archive behind
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	arc.path = tmp.Name()
+	return arc, nil
+}
+
+var errNoTempFile = errors.New("arcsek: TempFileFunc returned no file")
+
+// Remove the archive of a vault that could not be built,
+// from the disk or from memory
+func (a *archive) discard() {
+	if a.data != nil {
+		Wipe(a.data)
+		return
+	}
+
+	os.Remove(a.path)
+}
+
+// Like createFileArchive but the archive is kept in memory
+// and never touches the disk
+func createMemoryArchive(cmp compressor, level int, contents archiveContents) (*archive, error) {
+	buff := new(bytes.Buffer)
+	arc, err := writeArchive(buff, cmp, level, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	arc.data = buff.Bytes()
+	return arc, nil
+}
+
+// Write the compressed tar of the contents to w
+func writeArchive(w io.Writer, cmp compressor, level int, contents archiveContents) (*archive, error) {
+	// Count and hash what reaches w so we know the
+	// size and the checksum without a second pass
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(w, sum)}
+
+	cw, err := cmp.newWriter(counter, level)
+	if err != nil {
+		return nil, err
+	}
+	defer cw.Close()
+
+	tw := tar.NewWriter(cw)
+	defer tw.Close()
+
+	a := &archiveWriter{tw: tw}
+	if err = contents(a); err != nil {
+		return nil, err
+	}
+
+	// Flush the tar and the compression so everything
+	// is counted. Closing them again on return is harmless
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+
+	if err = cw.Close(); err != nil {
+		return nil, err
 	}
 
 	// Everything is on the tar.
-	return tmp.Name(), nil
+	arc := &archive{size: counter.n, info: a.info, skipped: errors.Join(a.skipped...)}
+	arc.info.ArchiveSize = counter.n
+	sum.Sum(arc.info.Checksum[:0])
+	return arc, nil
 }
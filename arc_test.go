@@ -2,9 +2,18 @@ package arcsek
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 // Test if the function can add existing files to a tar
@@ -44,7 +53,7 @@ func TestAddFileToTarGz(t *testing.T) {
 	// return an error if the file does not exist
 	for _, tc := range testCases {
 		// Try to adda file that does not exists
-		err := addFileToTar(tc.path, tw)
+		_, err := addFileToTar(tc.path, tc.path, tw, nil, nil, false)
 		// If the file exists, it should be added and err == nil,
 		// Otherwise, the error should should NOT be nil
 		if (tc.exists && err != nil) || (!tc.exists && err == nil) {
@@ -53,6 +62,19 @@ func TestAddFileToTarGz(t *testing.T) {
 	}
 }
 
+// Archive the contents with gzip in a temporal file like
+// Build does, which is removed once the test ends
+func createTestArchive(t *testing.T, level int, contents archiveContents) (*archive, error) {
+	t.Helper()
+
+	create := func(ext string) (*os.File, error) { return createTempFile("", ext) }
+	arc, err := createFileArchive(create, gzipCompressor{}, level, contents)
+	if err == nil {
+		t.Cleanup(func() { os.Remove(arc.path) })
+	}
+	return arc, err
+}
+
 // Testing the whole function that packages the files
 // in a temp dir
 func testCreateTmpBadFiles(t *testing.T) {
@@ -62,7 +84,7 @@ func testCreateTmpBadFiles(t *testing.T) {
 		"imaginary/file.txt",
 	}
 
-	if _, err := createTemporaryTarGz(files); err == nil {
+	if _, err := createTestArchive(t, gzip.DefaultCompression, new(VaultBuilder).addFiles(files)); err == nil {
 		t.Fatal("There is at least one file that does not exists but is being added")
 	}
 }
@@ -73,48 +95,773 @@ func testCreateTmpGoodFiles(t *testing.T) {
 		"testing-files/in/existance/testfile2.txt",
 	}
 
-	if tmpPath, err := createTemporaryTarGz(files); err != nil {
+	if arc, err := createTestArchive(t, gzip.DefaultCompression, new(VaultBuilder).addFiles(files)); err != nil {
 		t.Fatal("This files exist and there should be no error")
 	} else {
-		t.Logf("The tempral archive is located at: '%s'", tmpPath)
+		t.Logf("The tempral archive is located at: '%s'", arc.path)
 	}
 }
 
-// List all the files in test-files/in if they are not directories
-func lsDir(rootDir string) ([]string, error) {
-	// Allocate some space
-	fis, err := ioutil.ReadDir("testing-files/in")
+func TestCreateTempTarGz(t *testing.T) {
+	t.Run("Bad files that should fail", testCreateTmpBadFiles)
+	t.Run("Good files that should not fail", testCreateTmpGoodFiles)
+}
+
+func TestCreateFromDir(t *testing.T) {
+	paths, err := ListDir("testing-files/in", false)
 	if err != nil {
-		return nil, err
+		t.Fail()
 	}
 
-	ls := make([]string, 0, len(fis)+1)
+	// Create a temporal tar using all the files present in the inputs
+	if arc, err := createTestArchive(t, gzip.DefaultCompression, new(VaultBuilder).addFiles(paths)); err != nil {
+		t.Fatal("This files exist and there should be no error")
+	} else {
+		t.Logf("The tempral archive is located at: '%s'", arc.path)
+	}
+
+}
 
-	for _, fi := range fis {
-		if !fi.IsDir() {
-			ls = append(ls, "testing-files/in/"+fi.Name())
+func TestCreateTempTarGzLevels(t *testing.T) {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile4.txt",
+	}
+
+	levels := []int{gzip.HuffmanOnly, gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression}
+	for _, level := range levels {
+		if _, err := createTestArchive(t, level, new(VaultBuilder).addFiles(files)); err != nil {
+			t.Fatalf("Level %d should be valid. Instead got %v", level, err)
 		}
 	}
 
-	return ls, nil
+	if _, err := createTestArchive(t, 42, new(VaultBuilder).addFiles(files)); err == nil {
+		t.Fatal("Level 42 is not valid for gzip")
+	}
 }
 
-func TestCreateTempTarGz(t *testing.T) {
-	t.Run("Bad files that should fail", testCreateTmpBadFiles)
-	t.Run("Good files that should not fail", testCreateTmpGoodFiles)
+func TestBuilderCompressionLevel(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	tests := []struct {
+		name  string
+		level int
+		good  bool
+	}{
+		{"Default level", 0, true},
+		{"Best speed", gzip.BestSpeed, true},
+		{"Best compression", gzip.BestCompression, true},
+		{"Above the range", gzip.BestCompression + 1, false},
+		{"Below the range", gzip.HuffmanOnly - 1, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := VaultBuilder{CompressionLevel: tc.level}
+			v, err := b.Build(files, genKey("level"))
+			if (tc.good && err != nil) || (!tc.good && err == nil) {
+				t.Fatal("Error not corresponding to the level")
+			}
+
+			if err == nil {
+				v.Close()
+			}
+		})
+	}
 }
 
-func TestCreateFromDir(t *testing.T) {
-	paths, err := lsDir("testing-files/in")
+func TestCreateTempArchiveSize(t *testing.T) {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile4.txt",
+	}
+
+	arc, err := createTestArchive(t, 0, new(VaultBuilder).addFiles(files))
 	if err != nil {
-		t.Fail()
+		t.Fatal(err)
 	}
 
-	// Create a temporal tar using all the files present in the inputs
-	if tmpPath, err := createTemporaryTarGz(paths); err != nil {
-		t.Fatal("This files exist and there should be no error")
-	} else {
-		t.Logf("The tempral archive is located at: '%s'", tmpPath)
+	fi, err := os.Stat(arc.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != arc.size {
+		t.Fatalf("The archive has %d bytes but %d were reported", fi.Size(), arc.size)
 	}
+}
+
+func TestTempFileFunc(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	t.Run("Custom", func(t *testing.T) {
+		name := filepath.Join(t.TempDir(), "scratch")
+		b := VaultBuilder{TempFileFunc: func() (*os.File, error) { return os.Create(name) }}
+
+		v, err := b.Build(files, genKey("tmp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.tmpFile.Name() != name {
+			t.Fatalf("The archive is at %s instead of %s", v.tmpFile.Name(), name)
+		}
+
+		if err = v.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if fileExists(name) {
+			t.Fatal("The file was not removed on Close")
+		}
+	})
+
+	t.Run("Failing", func(t *testing.T) {
+		full := errors.New("no space left")
+		b := VaultBuilder{TempFileFunc: func() (*os.File, error) { return nil, full }}
+
+		if _, err := b.Build(files, genKey("tmp")); !errors.Is(err, full) {
+			t.Fatalf("Got %v instead of the error of the func", err)
+		}
+	})
+
+	t.Run("Unwritable", func(t *testing.T) {
+		// Writing fails like on a full filesystem
+		name := filepath.Join(t.TempDir(), "scratch")
+		if err := os.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		b := VaultBuilder{TempFileFunc: func() (*os.File, error) { return os.Open(name) }}
+
+		if _, err := b.Build(files, genKey("tmp")); err == nil {
+			t.Fatal("The archive could not be written")
+		}
+
+		if fileExists(name) {
+			t.Fatal("The file was not removed after the failure")
+		}
+	})
+}
+
+func TestBuilderTempDir(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	t.Run("Option", func(t *testing.T) {
+		dir := t.TempDir()
+		b := VaultBuilder{TempDir: dir}
+		v, err := b.Build(files, genKey("tmp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		if filepath.Dir(v.tmpFile.Name()) != dir {
+			t.Fatalf("The archive is at %s instead of %s", v.tmpFile.Name(), dir)
+		}
+	})
+
+	t.Run("TMPDIR", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("TMPDIR", dir)
+
+		v, err := NewVaultReader(files, genKey("tmp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		if filepath.Dir(v.tmpFile.Name()) != dir {
+			t.Fatalf("The archive is at %s instead of %s", v.tmpFile.Name(), dir)
+		}
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Windows has no unix permissions")
+		}
+
+		b := VaultBuilder{TempDir: t.TempDir()}
+		v, err := b.Build(files, genKey("tmp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		fi, err := v.tmpFile.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != 0600 {
+			t.Fatalf("The archive has mode %v instead of 0600", fi.Mode().Perm())
+		}
+	})
+
+	t.Run("Missing dir", func(t *testing.T) {
+		b := VaultBuilder{TempDir: "testing-files/imaginary"}
+		if _, err := b.Build(files, genKey("tmp")); err == nil {
+			t.Fatal("The temporal dir does not exist")
+		}
+	})
+
+	t.Run("Read error", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("TMPDIR", dir)
+
+		// The body fails once half of it has been archived
+		failing := io.MultiReader(strings.NewReader(strings.Repeat("a", 1<<16)), iotest.ErrReader(errors.New("disk gone")))
+		entries := []Entry{
+			{Name: "good.txt", Size: 5, Body: strings.NewReader("hello")},
+			{Name: "bad.txt", Size: 1 << 17, Body: failing},
+		}
+
+		if _, err := new(VaultBuilder).BuildEntries(entries, genKey("tmp")); err == nil {
+			t.Fatal("The archive could not be read")
+		}
+
+		left, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(left) != 0 {
+			t.Fatalf("%d scratch files were left in the temp dir", len(left))
+		}
+	})
+}
+
+func TestSymlinks(t *testing.T) {
+	key := genKey("symlinks")
+
+	dir, err := ioutil.TempDir("testing-files/out", "links-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target.txt")
+	link := filepath.Join(dir, "link.txt")
+	if err = ioutil.WriteFile(target, []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("target.txt", link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		follow bool
+	}{
+		{"As links", false},
+		{"Following them", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := VaultBuilder{FollowSymlinks: tc.follow}
+			vault, err := b.Build([]string{target, link}, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			dest := t.TempDir()
+			if _, err = ExtractTo(vault, key, dest); err != nil {
+				t.Fatal(err)
+			}
+
+			extracted := filepath.Join(dest, "link.txt")
+			fi, err := os.Lstat(extracted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if isLink := fi.Mode()&os.ModeSymlink != 0; isLink == tc.follow {
+				t.Fatalf("Expected a link: %v, got the mode %v", !tc.follow, fi.Mode())
+			}
+
+			contents, err := ioutil.ReadFile(extracted)
+			if err != nil || string(contents) != "target" {
+				t.Fatalf("The link does not lead to the target: %s, %v", contents, err)
+			}
+
+			if !tc.follow {
+				if got, _ := os.Readlink(extracted); got != "target.txt" {
+					t.Fatalf("The link points to %s", got)
+				}
+			}
+		})
+	}
+}
+
+func TestRecursiveDirs(t *testing.T) {
+	key := genKey("recursive")
+
+	root, err := ioutil.TempDir("testing-files/out", "tree-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"a/b", "a/empty", "c/d/empty"} {
+		if err = os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []string{"top.txt", "a/one.txt", "a/b/two.txt"}
+	for _, f := range files {
+		if err = ioutil.WriteFile(filepath.Join(root, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Recursive", func(t *testing.T) {
+		vault, err := NewVaultReader([]string{root}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
+
+		dest := t.TempDir()
+		n, err := ExtractTo(vault, key, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != len(files) {
+			t.Fatalf("Expected %d files, got %d", len(files), n)
+		}
+
+		for _, f := range files {
+			// A single directory is archived with the names of its contents
+			b, err := ioutil.ReadFile(filepath.Join(dest, f))
+			if err != nil || string(b) != f {
+				t.Fatalf("%s was not extracted: %v", f, err)
+			}
+		}
+
+		for _, dir := range []string{"a/empty", "c/d/empty"} {
+			if fi, err := os.Stat(filepath.Join(dest, dir)); err != nil || !fi.IsDir() {
+				t.Fatalf("The empty dir %s was not extracted: %v", dir, err)
+			}
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		b := VaultBuilder{DisableRecursion: true}
+		vault, err := b.Build([]string{root}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
 
+		dest := t.TempDir()
+		if n, err := ExtractTo(vault, key, dest); err != nil || n != 0 {
+			t.Fatalf("Expected only the directory, got %d files and %v", n, err)
+		}
+
+		if left, err := ioutil.ReadDir(filepath.Join(dest, filepath.Base(root))); err != nil || len(left) != 0 {
+			t.Fatal("The contents of the directory were archived")
+		}
+	})
+}
+
+func TestRelativeNames(t *testing.T) {
+	key := genKey("relative")
+
+	root, err := ioutil.TempDir("testing-files/out", "names-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"a", "b"} {
+		os.Mkdir(filepath.Join(root, dir), 0755)
+		if err = ioutil.WriteFile(filepath.Join(root, dir, "x.txt"), []byte(dir), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []string{filepath.Join(root, "a", "x.txt"), filepath.Join(root, "b", "x.txt")}
+
+	tests := []struct {
+		name    string
+		baseDir string
+		prefix  string
+	}{
+		{"Common directory", "", ""},
+		{"Base dir", "testing-files", strings.TrimPrefix(root, "testing-files/")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := VaultBuilder{BaseDir: tc.baseDir}
+			vault, err := b.Build(files, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			dest := t.TempDir()
+			if _, err = ExtractTo(vault, key, dest); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, dir := range []string{"a", "b"} {
+				got, err := ioutil.ReadFile(filepath.Join(dest, tc.prefix, dir, "x.txt"))
+				if err != nil || string(got) != dir {
+					t.Fatalf("%s/x.txt did not survive: %s, %v", dir, got, err)
+				}
+			}
+		})
+	}
+
+	t.Run("Outside of the base dir", func(t *testing.T) {
+		b := VaultBuilder{BaseDir: filepath.Join(root, "a")}
+		if _, err := b.Build(files, key); err == nil {
+			t.Fatal("b/x.txt is not within the base dir")
+		}
+	})
+}
+
+func TestDuplicateEntry(t *testing.T) {
+	key := genKey("duplicate")
+	tests := []struct {
+		name  string
+		b     VaultBuilder
+		files []string
+	}{
+		{
+			"Same file twice",
+			VaultBuilder{},
+			[]string{"testing-files/in/existance/testfile1.txt", "testing-files/in/existance/testfile1.txt"},
+		},
+		{
+			"Same name with a base dir",
+			VaultBuilder{BaseDir: "testing-files/in"},
+			[]string{"testing-files/in/existance", "testing-files/in/existance/testfile2.txt"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := tc.b.Build(tc.files, key); !errors.Is(err, ErrDuplicateEntry) {
+				t.Fatalf("Expected ErrDuplicateEntry, got '%v'", err)
+			}
+		})
+	}
+
+	entries := []Entry{{Name: "a.txt"}, {Name: "a.txt"}}
+	if _, err := NewVaultReaderEntries(entries, key); !errors.Is(err, ErrDuplicateEntry) {
+		t.Fatalf("Expected ErrDuplicateEntry, got '%v'", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	key := genKey("filter")
+
+	root := t.TempDir()
+	for _, dir := range []string{"src", "node_modules/dep", ".git"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+	}
+
+	files := []string{"src/main.go", "src/debug.log", "node_modules/dep/index.js", ".git/HEAD", "README"}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exclude := ExcludeGlobs("node_modules", ".git", "*.log")
+
+	// Record what the filter is asked about
+	var seen []string
+	b := VaultBuilder{Filter: func(path string, info os.FileInfo) bool {
+		seen = append(seen, path)
+		return exclude(path, info)
+	}}
+
+	vault, err := b.Build([]string{root}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	for _, path := range seen {
+		rel, _ := filepath.Rel(root, path)
+		if strings.HasPrefix(rel, "node_modules"+string(filepath.Separator)) || strings.HasPrefix(rel, ".git"+string(filepath.Separator)) {
+			t.Fatalf("%s is in an excluded directory but was read", rel)
+		}
+	}
+
+	dest := t.TempDir()
+	if _, err = ExtractTo(vault, key, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dest, f))
+		if included := f == "src/main.go" || f == "README"; included != (err == nil) {
+			t.Fatalf("%s included: %v, but got '%v'", f, included, err)
+		}
+	}
+
+	for _, dir := range []string{"node_modules", ".git"} {
+		if _, err := os.Stat(filepath.Join(dest, dir)); err == nil {
+			t.Fatalf("The excluded directory %s was archived", dir)
+		}
+	}
+}
+
+func TestListDir(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"b/c", "a"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+	}
+
+	for _, f := range []string{"z", "b.txt", "b/c/d", "b/x", "a/y"} {
+		if err := ioutil.WriteFile(filepath.Join(root, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name      string
+		recursive bool
+		want      []string
+	}{
+		{"Flat", false, []string{"b.txt", "z"}},
+		{"Recursive", true, []string{"a/y", "b.txt", "b/c/d", "b/x", "z"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ListDir(root, tc.recursive)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make([]string, len(tc.want))
+			for i, w := range tc.want {
+				want[i] = filepath.Join(root, w)
+			}
+
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Fatalf("Expected %v but got %v", want, got)
+			}
+		})
+	}
+
+	if _, err := ListDir(filepath.Join(root, "missing"), true); err == nil {
+		t.Fatal("Listing a missing directory should fail")
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	key := genKey("continue")
+	root := t.TempDir()
+
+	for _, f := range []string{"good1.txt", "good2.txt", "denied.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(root, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Followed, a dangling link can't be read
+	if err := os.Symlink("missing.txt", filepath.Join(root, "dangling.txt")); err != nil {
+		t.Skip("Symlinks are not supported:", err)
+	}
+	bad := []string{"dangling.txt"}
+
+	// Root reads anything
+	if os.Geteuid() != 0 && runtime.GOOS != "windows" {
+		os.Chmod(filepath.Join(root, "denied.txt"), 0)
+		bad = append(bad, "denied.txt")
+	}
+
+	t.Run("Failing", func(t *testing.T) {
+		b := VaultBuilder{FollowSymlinks: true}
+		if _, err := b.Build([]string{root}, key); err == nil || !strings.Contains(err.Error(), "dangling.txt") {
+			t.Fatalf("Expected an error naming the file, got %v", err)
+		}
+	})
+
+	t.Run("Continuing", func(t *testing.T) {
+		b := VaultBuilder{FollowSymlinks: true, ContinueOnError: true}
+		vault, err := b.Build([]string{root}, key)
+		if vault == nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
+
+		if err == nil {
+			t.Fatal("The files left out should be reported")
+		}
+
+		for _, f := range bad {
+			if !strings.Contains(err.Error(), f) {
+				t.Fatalf("%s is not in the error: %v", f, err)
+			}
+		}
+
+		dest := t.TempDir()
+		n, err := ExtractTo(vault, key, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := 4 - len(bad); n != want {
+			t.Fatalf("Expected %d files but got %d", want, n)
+		}
+
+		for _, f := range []string{"good1.txt", "good2.txt"} {
+			if _, err = os.Stat(filepath.Join(dest, f)); err != nil {
+				t.Fatalf("%s was not archived: %v", f, err)
+			}
+		}
+	})
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.txt")
+	big := filepath.Join(dir, "big.bin")
+	if err := os.WriteFile(small, []byte("tiny"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(big, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{0, 4} {
+		t.Run(fmt.Sprintf("Concurrency %d", concurrency), func(t *testing.T) {
+			b := VaultBuilder{MaxFileSize: 100, Concurrency: concurrency}
+			_, err := b.Build([]string{small, big}, genKey("max"))
+			if !errors.Is(err, ErrFileTooLarge) {
+				t.Fatalf("Got %v instead of ErrFileTooLarge", err)
+			}
+
+			if !strings.Contains(err.Error(), big) {
+				t.Fatalf("The error does not name the file: %v", err)
+			}
+
+			b.MaxFileSize = 1000
+			v, err := b.Build([]string{small, big}, genKey("max"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.Close()
+		})
+	}
+
+	t.Run("Entries", func(t *testing.T) {
+		b := VaultBuilder{MaxFileSize: 3}
+		_, err := b.BuildEntries([]Entry{entry("a.txt", "abcd")}, genKey("max"))
+		if !errors.Is(err, ErrFileTooLarge) || !strings.Contains(err.Error(), "a.txt") {
+			t.Fatalf("Got %v instead of ErrFileTooLarge", err)
+		}
+	})
+}
+
+func TestMaxVaultSize(t *testing.T) {
+	t.Run("Mid stream", func(t *testing.T) {
+		dir := t.TempDir()
+		b := VaultBuilder{TempDir: dir, MaxVaultSize: 1 << 19}
+
+		// The first entry fits, the second trips the quota
+		// half way
+		entries := []Entry{
+			{Name: "a.bin", Size: 1 << 18, Body: bytes.NewReader(make([]byte, 1<<18))},
+			{Name: "b.bin", Size: 1 << 19, Body: bytes.NewReader(make([]byte, 1<<19))},
+		}
+
+		if _, err := b.BuildEntries(entries, genKey("quota")); !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Got %v instead of ErrQuotaExceeded", err)
+		}
+
+		left, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(left) != 0 {
+			t.Fatal("The partial archive was left behind")
+		}
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		files := []string{"testing-files/in/existance/testfile1.txt", "testing-files/in/existance/testfile2.txt"}
+		b := VaultBuilder{MaxVaultSize: 1}
+		if err := b.EncryptTo(ioutil.Discard, files, genKey("quota")); !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Got %v instead of ErrQuotaExceeded", err)
+		}
+
+		b.MaxVaultSize = 1 << 20
+		if err := b.EncryptTo(ioutil.Discard, files, genKey("quota")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// Files that grow or shrink between the stat and the read
+func TestFileChanged(t *testing.T) {
+	path := "testing-files/in/existance/testfile1.txt"
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int(stat.Size())
+
+	testCases := []struct {
+		name     string
+		contents string
+		allow    bool
+		err      error
+		want     string
+	}{
+		{"Same size", strings.Repeat("a", size), false, nil, strings.Repeat("a", size)},
+		{"Shrank", "short", false, ErrFileChanged, ""},
+		{"Grew", strings.Repeat("b", size+10), false, ErrFileChanged, ""},
+		{"Shrank allowed", "short", true, nil, "short" + strings.Repeat("\x00", size-5)},
+		{"Grew allowed", strings.Repeat("b", size+10), true, nil, strings.Repeat("b", size)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			tw := tar.NewWriter(buf)
+
+			// A short read like the one of a truncated file
+			contents := iotest.HalfReader(strings.NewReader(tc.contents))
+			n, err := writeFileToTar(path, "file.txt", stat, contents, tw, nil, nil, tc.allow)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected %v but got %v", tc.err, err)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), path) {
+					t.Fatalf("The error doesn't name the file: %v", err)
+				}
+				return
+			}
+
+			if n != stat.Size() {
+				t.Fatalf("%d bytes were archived instead of %d", n, size)
+			}
+
+			// The tar is still whole
+			if err = tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tr := tar.NewReader(buf)
+			if _, err = tr.Next(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := io.ReadAll(tr)
+			if err != nil || string(got) != tc.want {
+				t.Fatalf("Expected %q but got %q, %v", tc.want, got, err)
+			}
+		})
+	}
 }
@@ -0,0 +1,221 @@
+package arcsek
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The lines around an armored vault, like PEM
+const (
+	armorBegin = "-----BEGIN ARCSEK VAULT-----"
+	armorEnd   = "-----END ARCSEK VAULT-----"
+
+	// Characters of base64 in every line
+	armorLineLen = 64
+)
+
+// ErrBadArmor is returned when an armored vault does not
+// start with the BEGIN line, does not end with the END one
+// or its base64 is broken
+var ErrBadArmor = errors.New("arcsek: bad armor")
+
+// ArmoredWriter returns a writer that encodes the vault
+// written to it in base64 between BEGIN and END ARCSEK VAULT
+// lines, so a small vault can be pasted in a chat or an email.
+//
+// It must be closed to write the end of the base64 and the
+// END line. w is not closed
+func ArmoredWriter(w io.Writer) io.WriteCloser {
+	lw := &lineWriter{w: w}
+	return &armorWriter{w: w, lw: lw, enc: base64.NewEncoder(base64.StdEncoding, lw)}
+}
+
+type armorWriter struct {
+	w       io.Writer
+	lw      *lineWriter
+	enc     io.WriteCloser
+	started bool
+	err     error
+}
+
+// The BEGIN line goes before the first byte, even if the
+// vault is empty
+func (a *armorWriter) begin() error {
+	if !a.started && a.err == nil {
+		a.started = true
+		_, a.err = io.WriteString(a.w, armorBegin+"\n")
+	}
+	return a.err
+}
+
+func (a *armorWriter) Write(p []byte) (int, error) {
+	if err := a.begin(); err != nil {
+		return 0, err
+	}
+
+	n, err := a.enc.Write(p)
+	if err != nil {
+		a.err = err
+	}
+	return n, err
+}
+
+func (a *armorWriter) Close() error {
+	if err := a.begin(); err != nil {
+		return err
+	}
+
+	if err := a.enc.Close(); err != nil {
+		return err
+	}
+
+	// End the last line of base64, unless it was full
+	end := armorEnd + "\n"
+	if a.lw.col > 0 {
+		end = "\n" + end
+	}
+
+	_, err := io.WriteString(a.w, end)
+	return err
+}
+
+// Breaks what is written into lines of armorLineLen
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), armorLineLen-l.col)
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+
+		if l.col += n; l.col == armorLineLen {
+			if _, err := l.w.Write([]byte{'\n'}); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+	}
+
+	return written, nil
+}
+
+// ArmoredReader returns the vault encoded in r by an
+// ArmoredWriter. Blank space before the BEGIN line is
+// skipped, and the reader ends at the END line.
+//
+// The vaults opened by this package are unarmored on their
+// own, so ArmoredReader is only needed to get the vault as it is
+func ArmoredReader(r io.Reader) io.Reader {
+	return &armorReader{br: bufio.NewReader(r)}
+}
+
+type armorReader struct {
+	br *bufio.Reader
+
+	// The decoder of the base64 once the BEGIN line was read
+	dec io.Reader
+	err error
+}
+
+func (a *armorReader) Read(p []byte) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+
+	if a.dec == nil {
+		if a.err = a.readBegin(); a.err != nil {
+			return 0, a.err
+		}
+		a.dec = base64.NewDecoder(base64.StdEncoding, &armorBody{br: a.br})
+	}
+
+	n, err := a.dec.Read(p)
+
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) {
+		err = fmt.Errorf("%w: %v", ErrBadArmor, err)
+	}
+	a.err = err
+	return n, err
+}
+
+func (a *armorReader) readBegin() error {
+	for {
+		line, err := a.br.ReadString('\n')
+		if strings.TrimSpace(line) == "" && err == nil {
+			// Blank lines before the vault
+			continue
+		}
+
+		if strings.TrimSpace(line) != armorBegin {
+			return fmt.Errorf("%w: no BEGIN line", ErrBadArmor)
+		}
+		return nil
+	}
+}
+
+// The lines of base64 up to the END line. The decoder skips
+// the new lines
+type armorBody struct {
+	br   *bufio.Reader
+	line []byte
+	done bool
+}
+
+func (b *armorBody) Read(p []byte) (int, error) {
+	for len(b.line) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+
+		line, err := b.br.ReadBytes('\n')
+		if string(bytes.TrimSpace(line)) == armorEnd {
+			b.done = true
+			continue
+		}
+
+		if err == io.EOF {
+			return 0, fmt.Errorf("%w: no END line", ErrBadArmor)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		b.line = line
+	}
+
+	n := copy(p, b.line)
+	b.line = b.line[n:]
+	return n, nil
+}
+
+// Unarmors r if it starts with the BEGIN line. Otherwise
+// what was read looking for it is given back. A vault that is
+// too short is left for the header to complain about
+func unarmor(r io.Reader) (io.Reader, error) {
+	start := make([]byte, len(armorBegin))
+	n, err := io.ReadFull(r, start)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	rest := io.MultiReader(bytes.NewReader(start[:n]), r)
+	if n < len(start) || string(start) != armorBegin {
+		return rest, nil
+	}
+
+	return ArmoredReader(rest), nil
+}
@@ -0,0 +1,98 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Armor the vault
+func armor(t *testing.T, vault []byte) string {
+	buff := new(strings.Builder)
+	w := ArmoredWriter(buff)
+	if _, err := w.Write(vault); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff.String()
+}
+
+func TestArmor(t *testing.T) {
+	key := genKey("armor")
+	vault := sealEntries(t, key, entry("a.txt", "pasted in a chat"))
+	armored := armor(t, vault)
+
+	t.Run("Layout", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSuffix(armored, "\n"), "\n")
+		if lines[0] != armorBegin || lines[len(lines)-1] != armorEnd {
+			t.Fatalf("The BEGIN and END lines are missing:\n%s", armored)
+		}
+
+		for _, l := range lines[1 : len(lines)-1] {
+			if len(l) > armorLineLen {
+				t.Fatalf("A line has %d characters", len(l))
+			}
+		}
+	})
+
+	t.Run("ArmoredReader", func(t *testing.T) {
+		got, err := io.ReadAll(ArmoredReader(strings.NewReader("\n\n" + armored)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, vault) {
+			t.Fatal("The vault changed through the armor")
+		}
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		_, contents, err := readEntries(strings.NewReader(armored), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if contents["a.txt"] != "pasted in a chat" {
+			t.Fatalf("Got %q from the armored vault", contents["a.txt"])
+		}
+	})
+
+	// Lines of every length, the last one full or not
+	t.Run("Sizes", func(t *testing.T) {
+		for _, size := range []int{0, 1, 47, 48, 49, 96, 1000} {
+			data := bytes.Repeat([]byte{0xa5}, size)
+			got, err := io.ReadAll(ArmoredReader(strings.NewReader(armor(t, data))))
+			if err != nil {
+				t.Fatalf("%d bytes: %v", size, err)
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%d bytes changed through the armor", size)
+			}
+		}
+	})
+
+	t.Run("Bad", func(t *testing.T) {
+		testCases := []struct {
+			name, armored string
+		}{
+			{"No BEGIN", "QUJD\n" + armorEnd + "\n"},
+			{"No END", armorBegin + "\nQUJD\n"},
+			{"Broken base64", armorBegin + "\nQU*D\n" + armorEnd + "\n"},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				if _, err := io.ReadAll(ArmoredReader(strings.NewReader(tc.armored))); !errors.Is(err, ErrBadArmor) {
+					t.Fatalf("Got %v instead of ErrBadArmor", err)
+				}
+			})
+		}
+	})
+}
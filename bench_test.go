@@ -0,0 +1,157 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/secure-io/sio-go"
+)
+
+// The sizes of the throughput benchmarks
+var benchSizes = []int{1 << 20, 10 << 20, 100 << 20}
+
+// A file of random data, which doesn't compress
+func benchFile(b *testing.B, size int) string {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	path := filepath.Join(b.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	return path
+}
+
+func BenchmarkNewVaultReader(b *testing.B) {
+	key := genKey("bench")
+
+	for _, size := range benchSizes {
+		path := benchFile(b, size)
+
+		for _, buf := range []int{sio.BufSize, 1 << 20} {
+			b.Run(fmt.Sprintf("%dMB/Buffer%dK", size>>20, buf>>10), func(b *testing.B) {
+				builder := VaultBuilder{Compression: None, BufferSize: buf}
+				b.SetBytes(int64(size))
+
+				for i := 0; i < b.N; i++ {
+					vault, err := builder.Build([]string{path}, key)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					io.Copy(io.Discard, vault)
+					vault.Close()
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	key := genKey("bench")
+
+	for _, size := range benchSizes {
+		path := benchFile(b, size)
+
+		for _, buf := range []int{sio.BufSize, 1 << 20} {
+			builder := VaultBuilder{Compression: None, BufferSize: buf}
+			sealed := new(bytes.Buffer)
+			if err := builder.EncryptTo(sealed, []string{path}, key); err != nil {
+				b.Fatal(err)
+			}
+
+			b.Run(fmt.Sprintf("%dMB/Buffer%dK", size>>20, buf>>10), func(b *testing.B) {
+				b.SetBytes(int64(size))
+
+				for i := 0; i < b.N; i++ {
+					tr, err := NewTarReader(bytes.NewReader(sealed.Bytes()), key)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					for {
+						if _, err = tr.Next(); err != nil {
+							break
+						}
+						io.Copy(io.Discard, tr)
+					}
+
+					if err != io.EOF {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Building many vaults, as a server does. Run with -benchmem
+func BenchmarkNewVaultReaderAllocs(b *testing.B) {
+	key := genKey("allocs")
+	root := manySmallFiles(b, 100)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vault, err := NewVaultReader([]string{root}, key)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		io.Copy(io.Discard, vault)
+		vault.Close()
+	}
+}
+
+// Sealing many small vaults under one key, with a cipher made
+// for each one or once by a Sealer
+func BenchmarkSealer(b *testing.B) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	testCases := []struct {
+		name    string
+		key     []byte
+		builder VaultBuilder
+	}{
+		{"Raw key", genKey("sealer"), VaultBuilder{InMemory: true}},
+		{"Password", []byte("correct horse"), VaultBuilder{InMemory: true, KeyDeriver: testScryptParams}},
+	}
+
+	seal := func(b *testing.B, vault *VaultReader, err error) {
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		io.Copy(io.Discard, vault)
+		vault.Close()
+	}
+
+	for _, tc := range testCases {
+		b.Run(tc.name+"/Per call", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				vault, err := tc.builder.Build(files, tc.key)
+				seal(b, vault, err)
+			}
+		})
+
+		b.Run(tc.name+"/Sealer", func(b *testing.B) {
+			s, err := tc.builder.NewSealer(tc.key)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				vault, err := s.Seal(files)
+				seal(b, vault, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,685 @@
+package arcsek
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/secure-io/sio-go"
+)
+
+// VaultBuilder holds the settings used to seal a vault.
+//
+// The zero value seals the files with the key as it is
+// given, exactly like NewVaultReader
+type VaultBuilder struct {
+	// KeyDeriver, if not nil, derives the vault key from the
+	// key passed to Build, which is then treated as a
+	// password. The deriver id, its params and a random salt
+	// are stored in the vault Header so the reader can
+	// derive the same key again
+	KeyDeriver KeyDeriver
+
+	// CipherSuite selects the AEAD that encrypts the vault.
+	// The key, after derivation, must fit the suite.
+	//
+	// If zero, AES128GCM or AES256GCM is chosen by the
+	// length of the key
+	CipherSuite CipherSuite
+
+	// AEADFactory, if not nil, creates the AEAD instead of
+	// the one registered for CipherSuite. It allows sealing
+	// with experimental or hardware AEADs.
+	//
+	// CipherSuite must still be set to a registered id, as
+	// that is what is stored in the header and what opens
+	// the vault again
+	AEADFactory AEADFactory
+
+	// CompressionLevel is the level of the compression.
+	// For Gzip it goes from gzip.HuffmanOnly to
+	// gzip.BestCompression. Use gzip.BestSpeed for media
+	// that barely compresses and gzip.BestCompression for
+	// text. For Zstd it goes from 1 to 22, like the zstd
+	// command line tool. None takes no level.
+	//
+	// If zero, the default level of the compression is used
+	CompressionLevel int
+
+	// Compression selects how the tar is compressed. The
+	// zero value is Gzip. Use None for data that is
+	// already compressed
+	Compression Compression
+
+	// Dictionary primes Zstd with data like the files it
+	// compresses, which shrinks small and similar files,
+	// like the configs of a fleet of hosts, far more than
+	// compressing them one after another. It is either a
+	// dictionary trained by zstd --train or content used as
+	// is, like a typical file. At most 60 KiB.
+	//
+	// The dictionary is sealed in the header, which grows by
+	// its size, so the vault opens without it. The archive
+	// of NewDecryptReader needs it to decompress
+	Dictionary []byte
+
+	// InMemory keeps the archive in memory instead of a
+	// temporal file, for read-only file systems or secrets
+	// that must never touch the disk. The whole compressed
+	// tar is held in memory until the vault is closed
+	InMemory bool
+
+	// TempDir is the directory of the temporal archive. If
+	// empty, os.TempDir is used, which honors TMPDIR
+	TempDir string
+
+	// TempFileFunc, if not nil, creates the temporal archive
+	// instead of a file in TempDir, like one on a memory
+	// backed filesystem.
+	//
+	// The file is owned by the VaultReader from then on: it is
+	// closed, reopened by its name and removed on Close, or as
+	// soon as building the vault fails
+	TempFileFunc func() (*os.File, error)
+
+	// FollowSymlinks archives the files symlinks point to
+	// instead of the links themselves
+	FollowSymlinks bool
+
+	// DisableRecursion adds the directories given to Build
+	// as empty directories. By default they are walked and
+	// everything in them is archived, empty directories
+	// included
+	DisableRecursion bool
+
+	// BaseDir is the directory the names in the archive are
+	// relative to, so extracting it rebuilds the tree below
+	// BaseDir. Every file must be within it.
+	//
+	// If empty, the deepest directory that holds all the
+	// files is used. A single directory is archived with
+	// the names of its contents
+	BaseDir string
+
+	// PreserveOwnership records the uid and gid of the files,
+	// and the names of their owners, for system backups.
+	// Only Unix systems have them, on Windows they are zero.
+	//
+	// By default the archive does not say who owned the files
+	PreserveOwnership bool
+
+	// IncludeXattrs records the extended attributes of the
+	// files, like SELinux labels or capabilities, as PAX
+	// records. They are only read on Linux and macOS
+	IncludeXattrs bool
+
+	// Filter, if not nil, is asked about every file before
+	// archiving it, including those found walking the
+	// directories. Returning false skips the file, or the
+	// whole directory
+	Filter Filter
+
+	// AllowEmptyGlobs lets BuildGlob patterns match no files
+	AllowEmptyGlobs bool
+
+	// Progress, if not nil, is called every few MB while
+	// the files are archived, and once they all are. The
+	// total is the size of the files, computed before
+	// archiving them
+	Progress Progress
+
+	// OnFile, if not nil, is called as each entry starts
+	// being archived, in the order they are written. The
+	// index goes from 1 to the total number of entries,
+	// directories and symlinks included, and size is the
+	// size of the file
+	OnFile func(name string, index, total int, size int64)
+
+	// Logger, if not nil, is told about the temporal
+	// archive, the key derivation and the nonce, to debug
+	// backup jobs. It never gets the key or the nonce
+	Logger Logger
+
+	// ContinueOnError leaves out the files that can't be
+	// read, like those without permission, instead of
+	// failing. The vault is built with the rest and
+	// returned along with an error that lists every file
+	// left out, so close the vault even if there is an
+	// error. A file that fails after it started being
+	// archived still fails the vault
+	ContinueOnError bool
+
+	// AllowChangedFiles archives the files whose size
+	// changed while they were read, like logs being written,
+	// with the size they had when they were listed: what a
+	// file grew by is left out and what it lost is filled
+	// with zeros. Otherwise the vault fails with
+	// ErrFileChanged, even with ContinueOnError, as the
+	// entry was already started
+	AllowChangedFiles bool
+
+	// AssociatedData binds the vault to a context, like the
+	// tenant a backup belongs to, so it can't be replayed
+	// in another one. It is authenticated with the header
+	// and the body but not stored: opening the vault needs
+	// the same VaultOpener.AssociatedData, or it fails
+	// with ErrAuthFailed
+	AssociatedData []byte
+
+	// Concurrency is how many files are read at the same
+	// time while archiving, for trees of many small files.
+	// The archive is the same, the files are still written
+	// in order. Zero or one reads them one by one
+	Concurrency int
+
+	// MaxFileSize is the largest file that can be archived,
+	// in bytes. A bigger one fails the vault with
+	// ErrFileTooLarge before any of it is read. Zero means
+	// no limit
+	MaxFileSize int64
+
+	// MaxVaultSize is the most bytes of files a vault can
+	// hold, before compression. The archiving stops with
+	// ErrQuotaExceeded as soon as the files add up to more,
+	// even if they grew after they were listed, and the
+	// partial archive is removed. Zero means no limit
+	MaxVaultSize int64
+
+	// ObfuscateNames writes the entries of the tar with
+	// opaque ids instead of their names, so the structure
+	// of the archive tells nothing about the files. The map
+	// from the ids to the names is the first entry, inside
+	// the encrypted stream like the rest, and TarReader and
+	// the extraction restore the names. The tar.Reader of
+	// NewTarReaderNonce gives the entries as they are stored.
+	// Symlink targets are kept as they are.
+	//
+	// The vaults can't be changed with AppendToVault or
+	// RemoveFromVault
+	ObfuscateNames bool
+
+	// Deduplicate stores the files with the same contents
+	// as another one already archived as a reference to it,
+	// a hard link in the tar. The references are inside the
+	// encrypted stream like the rest, and they are extracted
+	// as files of their own with their own mode and time.
+	//
+	// Files are only hashed when another one has the same
+	// size. Entries of BuildEntries are not deduplicated
+	Deduplicate bool
+
+	// Manifest writes the list of the entries with their
+	// size, time and SHA-256 as the first entry of the tar,
+	// inside the encrypted stream like the rest, so
+	// ReadManifest tells what a vault holds without reading
+	// the files. The files are hashed before they are
+	// archived, so they are read twice, and one that changed
+	// in between fails the vault with ErrFileChanged unless
+	// AllowChangedFiles.
+	//
+	// Only Build and the functions like it write one, and
+	// the vaults changed by AppendToVault or RemoveFromVault
+	// lose it. BuildFS and BuildEntries fail with it, like
+	// with BaseManifest
+	Manifest bool
+
+	// BaseManifest makes a differential vault, with only the
+	// files that changed since the vault of the manifest was
+	// sealed: those that are new or whose size, time or
+	// SHA-256 differ. Directories and links are always
+	// written. The vault has a manifest of all the files,
+	// and its header the ManifestID of the base, see
+	// ApplyDifferential. The base is a full vault, not
+	// another differential one
+	BaseManifest []ManifestEntry
+
+	// BufferSize is the size of the chunks the vault is
+	// sealed in, each one with its own 16 byte tag. Zero is
+	// sio.BufSize, 16 KiB.
+	//
+	// Bigger chunks mean less overhead but more memory to
+	// seal and open the vault, as a whole chunk is held to
+	// authenticate it. It must be at most sio.MaxBufSize.
+	// The size is stored in the vault, but vaults that
+	// don't use the default can't be opened by releases
+	// before this option
+	BufferSize int
+
+	// Keyfile is combined with the key, or the key derived
+	// from the password, so the vault needs both to be
+	// opened: something the user knows and something they
+	// have, like a file on a USB stick. Its contents are
+	// not stored, the header only records that one is
+	// needed. See VaultOpener.Keyfile
+	Keyfile []byte
+
+	// KeyID is stored in the clear in the header so the one
+	// opening the vault knows which key to try, like the
+	// name of the key in a key manager or the KeyFingerprint
+	// of a raw key. It is authenticated with the header but
+	// is not secret, so it must not be derived from a
+	// password. At most 64 bytes, see InspectVault
+	KeyID []byte
+
+	// The ManifestID of the base of the vault sealed again
+	// by Rekey
+	baseID []byte
+
+	// The content key wrapped for each recipient, set by
+	// BuildForRecipients on a copy of the builder
+	recipients [][]byte
+
+	// The ephemeral public key, set by BuildForPublicKey on
+	// a copy of the builder
+	ephemeral []byte
+
+	// The fixed nonce, set by BuildDeterministic on a copy
+	// of the builder
+	nonce []byte
+}
+
+// Filter decides whether the file at path is archived. The
+// info is the one of os.Lstat
+type Filter func(path string, info os.FileInfo) bool
+
+// ExcludeGlobs creates a Filter that skips the files whose
+// name or path matches any of the patterns, with the syntax
+// of filepath.Match. For example "node_modules", ".git" or
+// "*.log". Malformed patterns match nothing
+func ExcludeGlobs(patterns ...string) Filter {
+	return func(path string, info os.FileInfo) bool {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, info.Name()); ok {
+				return false
+			}
+
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Build packages the files and creates a VaultReader that
+// encrypts the archive with the settings of the builder.
+//
+// As with NewVaultReader, it is important to close the
+// returned reader to delete the temporal archive
+func (b *VaultBuilder) Build(files []string, key []byte) (*VaultReader, error) {
+	if err := checkInput(files, key); err != nil {
+		return nil, err
+	}
+
+	return b.build(b.addFiles(files), key)
+}
+
+// BuildContext is like Build but stops archiving once ctx
+// is done, between files and while copying them, and
+// returns the error of ctx. The partial archive is deleted
+func (b *VaultBuilder) BuildContext(ctx context.Context, files []string, key []byte) (*VaultReader, error) {
+	if err := checkInput(files, key); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return b.build(withContext(ctx, b.addFiles(files)), key)
+}
+
+// BuildEntries is like Build but packages the entries
+// instead of files of the disk
+func (b *VaultBuilder) BuildEntries(entries []Entry, key []byte) (*VaultReader, error) {
+	if len(key) == 0 {
+		return nil, errEmptyKey
+	}
+
+	if err := checkEntries(entries); err != nil {
+		return nil, err
+	}
+
+	if err := b.checkNoManifest(); err != nil {
+		return nil, err
+	}
+
+	return b.build(b.addEntries(entries), key)
+}
+
+// A vault without a key or without files is a mistake,
+// noticed before doing anything
+func checkInput(files []string, key []byte) error {
+	if len(files) == 0 {
+		return ErrEmptyFileList
+	}
+
+	if len(key) == 0 {
+		return errEmptyKey
+	}
+
+	return nil
+}
+
+var errEmptyKey = fmt.Errorf("%w: the key is empty", ErrInvalidKeyLength)
+
+// Only the files of the disk get a manifest. A differential
+// vault without one could not be applied
+func (b *VaultBuilder) checkNoManifest() error {
+	if b.Manifest || b.BaseManifest != nil {
+		return errors.New("arcsek: only Build and BuildContext write a manifest or a differential vault")
+	}
+	return nil
+}
+
+// Seal the contents into a new vault
+func (b *VaultBuilder) build(contents archiveContents, key []byte) (*VaultReader, error) {
+	level, err := b.compressionLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	h, aead, stream, err := b.newHeader(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.seal(level, contents, h, aead, stream)
+}
+
+// Seal the contents with the header and the cipher
+func (b *VaultBuilder) seal(level int, contents archiveContents, h *header, aead cipher.AEAD, stream *sio.Stream) (*VaultReader, error) {
+	// Get a temporal archive from which we will create an
+	// encrypted reader
+	arc, err := b.createArchive(level, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now we know what is in the archive the header
+	// can be completed
+	raw, err := h.complete(aead, arc.info)
+	if err != nil {
+		arc.discard()
+		return nil, err
+	}
+
+	vault := &VaultReader{nonce: h.nonce, header: raw, ad: h.withAAD(raw), size: arc.size, data: arc.data, stream: stream, log: b.logger()}
+
+	var src io.Reader = bytes.NewReader(arc.data)
+	if arc.data == nil {
+		// Open that file in read mode and encrypt its reader
+		if vault.tmpFile, err = os.Open(arc.path); err != nil {
+			arc.discard()
+			return nil, err
+		}
+		src = vault.tmpFile
+
+		// In case the caller forgets to close the vault
+		runtime.SetFinalizer(vault, (*VaultReader).finalize)
+	}
+
+	// Use that stream to make an enc reader according to sio docs.
+	// The header is authenticated as associated data
+	vault.EncReader = stream.EncryptReader(src, h.nonce, vault.ad)
+
+	return vault, arc.skipped
+}
+
+// EncryptTo packages and encrypts the files on the fly,
+// writing the header and then the encrypted archive to w.
+// Nothing is buffered, on disk or in memory, so it suits
+// network connections and uploads.
+//
+// As nothing is buffered the size is not known up front
+// and the header can't record the info of the vault: its
+// Files and Size are -1 and it has no checksum to verify.
+// To write the tar yourself use a VaultWriter.
+//
+// w is not closed
+func (b *VaultBuilder) EncryptTo(w io.Writer, files []string, key []byte) error {
+	if err := checkInput(files, key); err != nil {
+		return err
+	}
+
+	level, err := b.compressionLevel()
+	if err != nil {
+		return err
+	}
+
+	h, aead, stream, err := b.newHeader(key)
+	if err != nil {
+		return err
+	}
+
+	raw, err := h.complete(aead, unknownInfo)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(raw); err != nil {
+		return err
+	}
+	b.logger().Debugf("arcsek: streaming the vault, nothing is buffered")
+
+	cmp, err := b.compressor()
+	if err != nil {
+		return err
+	}
+
+	// sio closes the writer it wraps
+	ew := stream.EncryptWriter(struct{ io.Writer }{w}, h.nonce, h.withAAD(raw))
+	arc, err := writeArchive(ew, cmp, level, b.addFiles(files))
+	if err != nil {
+		return err
+	}
+
+	if err = ew.Close(); err != nil {
+		return err
+	}
+
+	return arc.skipped
+}
+
+// Prepare the header of a new vault and the cipher that
+// seals it. The key is derived if the builder says so
+func (b *VaultBuilder) newHeader(key []byte) (*header, cipher.AEAD, *sio.Stream, error) {
+	h, aead, stream, err := b.headerForKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err = b.setNonce(h, aead, stream); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return h, aead, stream, nil
+}
+
+// The header of the vaults sealed with the key, but for the
+// nonce, and the cipher
+func (b *VaultBuilder) headerForKey(key []byte) (*header, cipher.AEAD, *sio.Stream, error) {
+	if len(b.KeyID) > maxKeyIDLen {
+		return nil, nil, nil, errKeyIDTooLong
+	}
+
+	h := &header{compression: b.Compression, kdf: b.KeyDeriver, recipients: b.recipients, ephemeral: b.ephemeral, keyID: b.KeyID, base: b.baseID, aad: b.AssociatedData}
+	if b.BaseManifest != nil {
+		h.base = ManifestID(b.BaseManifest)
+	}
+	if b.BufferSize != sio.BufSize {
+		h.bufSize = b.BufferSize
+	}
+
+	// Derive the key first, there is no point in
+	// packaging anything if the deriver fails
+	var err error
+	chain := keyChain{key: key}
+	defer chain.wipe()
+
+	if b.KeyDeriver != nil {
+		if err = checkDeriverParams(b.KeyDeriver); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if b.nonce != nil {
+			h.salt, err = deterministicBytes(b.nonce, "salt", saltLenOf(b.KeyDeriver))
+		} else {
+			h.salt, err = newSalt(saltLenOf(b.KeyDeriver))
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		b.logger().Debugf("arcsek: deriving the key with %T", b.KeyDeriver)
+
+		if err = chain.next(b.KeyDeriver.Derive(chain.key, h.salt)); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if len(b.Keyfile) > 0 {
+		h.keyfile = true
+		if err = chain.next(combineKeyfile(chain.key, b.Keyfile)); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	h.suite = b.CipherSuite
+	if h.suite == 0 {
+		h.suite = defaultSuite(chain.key)
+	}
+
+	// The stream is created before packaging anything so a
+	// key that doesn't fit the suite fails without any I/O.
+	// We can create a vault thanks to sio
+	aead, err := b.newAEAD(h.suite, chain.key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stream, err := createStream(aead, b.BufferSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return h, aead, stream, nil
+}
+
+// Every vault gets a fresh random nonce, but those of
+// BuildDeterministic. The dictionary is sealed with one of
+// its own
+func (b *VaultBuilder) setNonce(h *header, aead cipher.AEAD, stream *sio.Stream) error {
+	var err error
+	var dictNonce []byte
+	if b.nonce != nil {
+		if h.nonce, h.infoNonce, err = fixedNonces(b.nonce, stream.NonceSize(), aead.NonceSize()); err != nil {
+			return err
+		}
+
+		if dictNonce, err = deterministicBytes(b.nonce, "dictionary", aead.NonceSize()); err != nil {
+			return err
+		}
+	} else if h.nonce, err = newNonce(stream.NonceSize()); err != nil {
+		return err
+	}
+
+	if len(b.Dictionary) > 0 {
+		if h.sealedDictionary, err = sealDictionary(aead, b.Dictionary, dictNonce); err != nil {
+			return err
+		}
+	}
+
+	b.logger().Debugf("arcsek: sealing with %s and a new %d byte nonce", h.suite, len(h.nonce))
+	return nil
+}
+
+// Create the archive where the builder says
+func (b *VaultBuilder) createArchive(level int, contents archiveContents) (*archive, error) {
+	cmp, err := b.compressor()
+	if err != nil {
+		return nil, err
+	}
+
+	if b.InMemory {
+		arc, err := createMemoryArchive(cmp, level, contents)
+		if err == nil {
+			b.logger().Debugf("arcsek: archived %d files in memory, %d bytes", arc.info.Files, arc.size)
+		}
+		return arc, err
+	}
+
+	create := func(ext string) (*os.File, error) { return createTempFile(b.TempDir, ext) }
+	if b.TempFileFunc != nil {
+		create = func(string) (*os.File, error) { return b.TempFileFunc() }
+	}
+
+	arc, err := createFileArchive(create, cmp, level, contents)
+	if err == nil {
+		b.logger().Debugf("arcsek: archived %d files in the temporal file %s, %d bytes", arc.info.Files, arc.path, arc.size)
+	}
+	return arc, err
+}
+
+// The compression level to use, validated along with the
+// compression before anything is written
+func (b *VaultBuilder) compressionLevel() (int, error) {
+	cmp, err := b.Compression.compressor()
+	if err != nil {
+		return 0, err
+	}
+
+	if b.CompressionLevel != 0 && !cmp.validLevel(b.CompressionLevel) {
+		return 0, fmt.Errorf("arcsek: invalid %s compression level %d", b.Compression, b.CompressionLevel)
+	}
+
+	if len(b.Dictionary) > maxDictionarySize {
+		return 0, errDictionaryTooLarge
+	}
+
+	if _, err = b.compressor(); err != nil {
+		return 0, err
+	}
+
+	return b.CompressionLevel, nil
+}
+
+// Create the AEAD with the factory of the builder, if
+// any, or the one registered for the suite
+func (b *VaultBuilder) newAEAD(suite CipherSuite, key []byte) (cipher.AEAD, error) {
+	if b.AEADFactory == nil {
+		return suite.newAEAD(key)
+	}
+
+	if b.CipherSuite == 0 {
+		return nil, errors.New("arcsek: AEADFactory needs a CipherSuite")
+	}
+
+	if _, err := lookupCipherSuite(suite); err != nil {
+		return nil, err
+	}
+
+	return b.AEADFactory(key)
+}
+
+// Generate a nonce with crypto/rand. sio derives the nonce
+// of each chunk from it, so the same key and nonce must
+// never seal two different archives: with GCM that leaks
+// the XOR of both plain texts and allows forging chunks.
+//
+// A random nonce of 8 bytes or more makes a repetition
+// unlikely enough for the number of vaults a key seals
+func newNonce(size int) ([]byte, error) {
+	nonce := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
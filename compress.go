@@ -0,0 +1,208 @@
+package arcsek
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how the tar is compressed before it
+// is encrypted. It is stored in the vault header so the
+// reader knows how to decompress it
+type Compression byte
+
+const (
+	// Gzip compresses the tar with gzip. It is the default
+	Gzip Compression = 0
+
+	// None stores the plain tar. Compressing data that is
+	// already compressed, like jpegs, mp4s or zip files,
+	// only wastes CPU
+	None Compression = 1
+
+	// Zstd compresses the tar with zstd, which has a
+	// better ratio and speed than gzip for most backups
+	Zstd Compression = 2
+)
+
+// A compressor wraps the tar stream as it is written and
+// read back. Both sides must stream, never buffering the
+// whole archive
+type compressor interface {
+	// Wraps w so everything written is compressed. Closing
+	// the returned writer flushes it but does not close w.
+	// level is already validated and 0 means the default
+	newWriter(w io.Writer, level int) (io.WriteCloser, error)
+	// Wraps r so everything read from it is decompressed
+	newReader(r io.Reader) (io.ReadCloser, error)
+	// Reports if the level can be used by newWriter
+	validLevel(level int) bool
+	// Extension of the compressed tar
+	ext() string
+}
+
+var compressors = map[Compression]compressor{
+	Gzip: gzipCompressor{},
+	None: noCompressor{},
+	Zstd: zstdCompressor{},
+}
+
+// String returns the name of the compression
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case None:
+		return "none"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Compression(%d)", byte(c))
+	}
+}
+
+// MarshalText returns the name of the compression
+func (c Compression) MarshalText() ([]byte, error) {
+	if _, err := c.compressor(); err != nil {
+		return nil, err
+	}
+
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText parses the name of a compression, ignoring
+// the case, for configs. An empty name is Gzip, the default
+func (c *Compression) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*c = Gzip
+		return nil
+	}
+
+	for cmp := range compressors {
+		if strings.EqualFold(string(text), cmp.String()) {
+			*c = cmp
+			return nil
+		}
+	}
+
+	return fmt.Errorf("arcsek: unknown compression %q", text)
+}
+
+// Find the compressor of the compression
+func (c Compression) compressor() (compressor, error) {
+	cmp, ok := compressors[c]
+	if !ok {
+		return nil, fmt.Errorf("arcsek: unknown compression %d", byte(c))
+	}
+	return cmp, nil
+}
+
+// Like compressor but with a dictionary, which only zstd
+// takes. A vault with one has it in the header
+func (c Compression) compressorWithDictionary(dict []byte) (compressor, error) {
+	if len(dict) == 0 {
+		return c.compressor()
+	}
+
+	if c != Zstd {
+		return nil, fmt.Errorf("arcsek: %s can't use a dictionary, only zstd", c)
+	}
+	return zstdCompressor{dict: dict}, nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCompressor) newReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCompressor) validLevel(level int) bool {
+	return level >= gzip.HuffmanOnly && level <= gzip.BestCompression
+}
+
+func (gzipCompressor) ext() string { return ".tar.gz" }
+
+type noCompressor struct{}
+
+func (noCompressor) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noCompressor) newReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+func (noCompressor) validLevel(level int) bool { return level == 0 }
+
+func (noCompressor) ext() string { return ".tar" }
+
+// The dictionary, if any, see VaultBuilder.Dictionary
+type zstdCompressor struct {
+	dict []byte
+}
+
+func (z zstdCompressor) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == 0 {
+		level = 3
+	}
+
+	opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level))}
+	if len(z.dict) > 0 {
+		if isZstdDictionary(z.dict) {
+			opts = append(opts, zstd.WithEncoderDict(z.dict))
+		} else {
+			opts = append(opts, zstd.WithEncoderDictRaw(0, z.dict))
+		}
+	}
+
+	return zstd.NewWriter(w, opts...)
+}
+
+func (z zstdCompressor) newReader(r io.Reader) (io.ReadCloser, error) {
+	// A single block in flight decodes in the calling
+	// goroutine, so nothing leaks if the reader is
+	// abandoned
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if len(z.dict) > 0 {
+		if isZstdDictionary(z.dict) {
+			opts = append(opts, zstd.WithDecoderDicts(z.dict))
+		} else {
+			opts = append(opts, zstd.WithDecoderDictRaw(0, z.dict))
+		}
+	}
+
+	d, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.IOReadCloser(), nil
+}
+
+// Whether the dictionary is in the format of zstd --train,
+// anything else is used as raw content
+func isZstdDictionary(dict []byte) bool {
+	return len(dict) >= 8 && bytes.Equal(dict[:4], []byte{0x37, 0xA4, 0x30, 0xEC})
+}
+
+// The levels of the zstd command line tool
+func (zstdCompressor) validLevel(level int) bool { return level >= 1 && level <= 22 }
+
+func (zstdCompressor) ext() string { return ".tar.zst" }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
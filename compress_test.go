@@ -0,0 +1,98 @@
+package arcsek
+
+import (
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile4.txt",
+	}
+
+	for _, c := range []Compression{Gzip, None, Zstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			key := genKey(c.String())
+
+			b := VaultBuilder{Compression: c}
+			vault, err := b.Build(files, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			h, _, err := parseHeader(bytes.NewReader(vault.Header()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.compression != c {
+				t.Fatalf("The header records %s instead of %s", h.compression, c)
+			}
+
+			buff := new(bytes.Buffer)
+			vault.WriteTo(buff)
+
+			tr, err := NewTarReaderNonce(buff, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range files {
+				hdr, err := tr.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// They are all in the same directory
+				if want = filepath.Base(want); hdr.Name != want {
+					t.Fatalf("Expected entry '%s', got '%s'", want, hdr.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	tests := []struct {
+		name        string
+		compression Compression
+		level       int
+		good        bool
+	}{
+		{"Gzip best speed", Gzip, gzip.BestSpeed, true},
+		{"Zstd default", Zstd, 0, true},
+		{"Zstd fastest", Zstd, 1, true},
+		{"Zstd best", Zstd, 22, true},
+		{"Zstd above the range", Zstd, 23, false},
+		{"Zstd below the range", Zstd, -1, false},
+		{"None takes no level", None, gzip.BestSpeed, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := VaultBuilder{Compression: tc.compression, CompressionLevel: tc.level}
+			v, err := b.Build(files, genKey("level"))
+			if (tc.good && err != nil) || (!tc.good && err == nil) {
+				t.Fatal("Error not corresponding to the level")
+			}
+
+			if err == nil {
+				v.Close()
+			}
+		})
+	}
+}
+
+func TestCompressionUnknown(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	b := VaultBuilder{Compression: 0xEE}
+	if _, err := b.Build(files, genKey("pw")); err == nil {
+		t.Fatal("An unknown compression should not build a vault")
+	}
+}
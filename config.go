@@ -0,0 +1,205 @@
+package arcsek
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/secure-io/sio-go"
+)
+
+// ErrInvalidConfig is returned by Config.Validate for
+// settings that can't seal a vault
+var ErrInvalidConfig = errors.New("arcsek: invalid config")
+
+// Config holds the settings of a vault as plain values, for
+// programs that read them from a file, like a backup daemon.
+// The suite and the compression are written by name, like
+// "AES-256-GCM" and "zstd", as they implement
+// encoding.TextUnmarshaler.
+//
+// Each field is the VaultBuilder field of the same name,
+// but for the key derivers, of which at most one is set,
+// and Exclude, which is ExcludeGlobs
+type Config struct {
+	CipherSuite      CipherSuite `json:"cipher_suite,omitempty" yaml:"cipher_suite,omitempty"`
+	Compression      Compression `json:"compression,omitempty" yaml:"compression,omitempty"`
+	CompressionLevel int         `json:"compression_level,omitempty" yaml:"compression_level,omitempty"`
+	BufferSize       int         `json:"buffer_size,omitempty" yaml:"buffer_size,omitempty"`
+
+	// The key derivers, the key is a password if one is set
+	Scrypt *ScryptParams `json:"scrypt,omitempty" yaml:"scrypt,omitempty"`
+	Argon2 *Argon2Params `json:"argon2,omitempty" yaml:"argon2,omitempty"`
+	PBKDF2 *PBKDF2Params `json:"pbkdf2,omitempty" yaml:"pbkdf2,omitempty"`
+
+	TempDir  string `json:"temp_dir,omitempty" yaml:"temp_dir,omitempty"`
+	InMemory bool   `json:"in_memory,omitempty" yaml:"in_memory,omitempty"`
+
+	BaseDir           string   `json:"base_dir,omitempty" yaml:"base_dir,omitempty"`
+	Exclude           []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	FollowSymlinks    bool     `json:"follow_symlinks,omitempty" yaml:"follow_symlinks,omitempty"`
+	DisableRecursion  bool     `json:"disable_recursion,omitempty" yaml:"disable_recursion,omitempty"`
+	PreserveOwnership bool     `json:"preserve_ownership,omitempty" yaml:"preserve_ownership,omitempty"`
+	IncludeXattrs     bool     `json:"include_xattrs,omitempty" yaml:"include_xattrs,omitempty"`
+	ContinueOnError   bool     `json:"continue_on_error,omitempty" yaml:"continue_on_error,omitempty"`
+	AllowChangedFiles bool     `json:"allow_changed_files,omitempty" yaml:"allow_changed_files,omitempty"`
+	ObfuscateNames    bool     `json:"obfuscate_names,omitempty" yaml:"obfuscate_names,omitempty"`
+	Deduplicate       bool     `json:"deduplicate,omitempty" yaml:"deduplicate,omitempty"`
+	Manifest          bool     `json:"manifest,omitempty" yaml:"manifest,omitempty"`
+	Concurrency       int      `json:"concurrency,omitempty" yaml:"concurrency,omitempty"`
+
+	MaxFileSize  int64 `json:"max_file_size,omitempty" yaml:"max_file_size,omitempty"`
+	MaxVaultSize int64 `json:"max_vault_size,omitempty" yaml:"max_vault_size,omitempty"`
+}
+
+// NewVaultReaderConfig is like NewVaultReader but seals the
+// files with the settings of cfg, which is validated first
+func NewVaultReaderConfig(files []string, key []byte, cfg Config) (*VaultReader, error) {
+	b, err := cfg.Builder()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Build(files, key)
+}
+
+// Builder validates the config and returns a VaultBuilder
+// with its settings, to set what a config can't hold
+func (c Config) Builder() (*VaultBuilder, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	b := &VaultBuilder{
+		KeyDeriver:        c.keyDeriver(),
+		CipherSuite:       c.CipherSuite,
+		CompressionLevel:  c.CompressionLevel,
+		Compression:       c.Compression,
+		InMemory:          c.InMemory,
+		TempDir:           c.TempDir,
+		FollowSymlinks:    c.FollowSymlinks,
+		DisableRecursion:  c.DisableRecursion,
+		BaseDir:           c.BaseDir,
+		PreserveOwnership: c.PreserveOwnership,
+		IncludeXattrs:     c.IncludeXattrs,
+		ContinueOnError:   c.ContinueOnError,
+		AllowChangedFiles: c.AllowChangedFiles,
+		Concurrency:       c.Concurrency,
+		MaxFileSize:       c.MaxFileSize,
+		MaxVaultSize:      c.MaxVaultSize,
+		ObfuscateNames:    c.ObfuscateNames,
+		Deduplicate:       c.Deduplicate,
+		Manifest:          c.Manifest,
+		BufferSize:        c.BufferSize,
+	}
+
+	if len(c.Exclude) > 0 {
+		b.Filter = ExcludeGlobs(c.Exclude...)
+	}
+
+	return b, nil
+}
+
+// Validate reports every setting that is out of range or
+// conflicts with another, like a suite that needs a 32 byte
+// key with a deriver of 16 byte keys. The errors match
+// ErrInvalidConfig.
+//
+// The key is not part of the config, a raw key that doesn't
+// fit the suite fails when the vault is built
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrInvalidConfig}, args...)...))
+	}
+
+	if cmp, err := c.Compression.compressor(); err != nil {
+		invalid("%v", err)
+	} else if c.CompressionLevel != 0 && !cmp.validLevel(c.CompressionLevel) {
+		invalid("invalid %s compression level %d", c.Compression, c.CompressionLevel)
+	}
+
+	if c.CipherSuite != 0 {
+		if _, err := lookupCipherSuite(c.CipherSuite); err != nil {
+			invalid("%v", err)
+		}
+	}
+
+	if c.BufferSize < 0 || c.BufferSize > sio.MaxBufSize {
+		invalid("the buffer size must be at most %d bytes", sio.MaxBufSize)
+	}
+
+	var derivers int
+	for _, set := range []bool{c.Scrypt != nil, c.Argon2 != nil, c.PBKDF2 != nil} {
+		if set {
+			derivers++
+		}
+	}
+
+	if derivers > 1 {
+		invalid("more than one key deriver")
+	} else if err := c.checkKeyDeriver(); err != nil {
+		invalid("%v", err)
+	}
+
+	if c.InMemory && c.TempDir != "" {
+		invalid("an archive in memory has no temp dir")
+	}
+
+	for _, pattern := range c.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			invalid("malformed exclude pattern %q", pattern)
+		}
+	}
+
+	if c.Concurrency < 0 || c.MaxFileSize < 0 || c.MaxVaultSize < 0 {
+		invalid("the concurrency and the limits can't be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+// The key deriver of the config, if any
+func (c Config) keyDeriver() KeyDeriver {
+	switch {
+	case c.Scrypt != nil:
+		return *c.Scrypt
+	case c.Argon2 != nil:
+		return *c.Argon2
+	case c.PBKDF2 != nil:
+		return *c.PBKDF2
+	}
+	return nil
+}
+
+// Check the params of the key deriver and that the keys it
+// derives fit the suite
+func (c Config) checkKeyDeriver() error {
+	// The params must be those a vault opens with
+	kd := c.keyDeriver()
+	if kd == nil {
+		return nil
+	}
+	if err := deriverParamsErr(kd); err != nil {
+		return err
+	}
+
+	keyLen := scryptKeyLen
+	if c.Argon2 != nil {
+		keyLen = int(c.Argon2.KeyLen)
+	}
+
+	if s, ok := kd.(interface{ saltLen() int }); ok && (s.saltLen() < 0 || s.saltLen() > 255) {
+		return errors.New("the salt length must be at most 255 bytes")
+	}
+
+	if n := c.CipherSuite.keySize(); n != 0 && keyLen != n {
+		return fmt.Errorf("%s needs a %d byte key, the deriver makes %d byte keys", c.CipherSuite, n, keyLen)
+	}
+
+	if (c.CipherSuite == 0 || c.CipherSuite == AESGCM) && keyLen != 16 && keyLen != 24 && keyLen != 32 {
+		return fmt.Errorf("AES-GCM can't take the %d byte keys of the deriver", keyLen)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package arcsek
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	files := []string{"testing-files/in/existance"}
+
+	t.Run("From JSON", func(t *testing.T) {
+		var cfg Config
+		doc := `{"cipher_suite": "aes-256-gcm", "compression": "Zstd", "pbkdf2": {"Iterations": 10000}, "in_memory": true, "exclude": ["testfile4.txt"]}`
+		if err := json.Unmarshal([]byte(doc), &cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := NewVaultReaderConfig(files, []byte("password"), cfg)
+		vault := vaultBytes(t, v, err)
+
+		h, err := InspectVault(bytes.NewReader(vault))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Suite != AES256GCM || h.Compression != Zstd || h.KDF != KDFPBKDF2 {
+			t.Fatalf("Wrong header:\n%s", h)
+		}
+
+		tr, err := NewTarReaderPassword(bytes.NewReader(vault), "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		for ; ; n++ {
+			if _, err = tr.Next(); err != nil {
+				break
+			}
+		}
+
+		if err != io.EOF || n != 3 {
+			t.Fatalf("Got %d entries from the vault: %v", n, err)
+		}
+
+		// And back to the same document
+		out, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var again Config
+		if err = json.Unmarshal(out, &again); err != nil || again.CipherSuite != AES256GCM || again.Compression != Zstd {
+			t.Fatalf("%s does not round trip: %v", out, err)
+		}
+	})
+
+	t.Run("Unknown names", func(t *testing.T) {
+		var cfg Config
+		if err := json.Unmarshal([]byte(`{"compression": "lzma"}`), &cfg); err == nil {
+			t.Fatal("lzma is not a compression")
+		}
+
+		if err := json.Unmarshal([]byte(`{"cipher_suite": "des"}`), &cfg); err == nil {
+			t.Fatal("DES is not a suite")
+		}
+	})
+
+	invalid := []struct {
+		name string
+		cfg  Config
+	}{
+		{"Suite and deriver", Config{CipherSuite: AES256GCM, Argon2: &Argon2Params{Time: 1, Memory: 64, Threads: 1, KeyLen: 16}}},
+		{"Two derivers", Config{Scrypt: &DefaultScryptParams, PBKDF2: &PBKDF2Params{Iterations: 10000}}},
+		{"Few iterations", Config{PBKDF2: &PBKDF2Params{Iterations: 100}}},
+		{"Scrypt N", Config{Scrypt: &ScryptParams{N: 1000, R: 8, P: 1}}},
+		// Valid for scrypt and argon2, but not for opening the vault
+		{"Scrypt memory", Config{Scrypt: &ScryptParams{N: 1 << 20, R: 8, P: 1}}},
+		{"Argon2 memory", Config{Argon2: &Argon2Params{Time: 1, Memory: 2 << 20, Threads: 4, KeyLen: 32}}},
+		{"Many iterations", Config{PBKDF2: &PBKDF2Params{Iterations: maxPBKDF2Iterations + 1}}},
+		{"Memory and temp dir", Config{InMemory: true, TempDir: "/tmp"}},
+		{"Compression level", Config{Compression: Gzip, CompressionLevel: 42}},
+		{"Unknown suite", Config{CipherSuite: 200}},
+		{"Buffer size", Config{BufferSize: -1}},
+		{"Exclude", Config{Exclude: []string{"[a-"}}},
+		{"Negative limit", Config{MaxVaultSize: -1}},
+	}
+
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("Got %v instead of ErrInvalidConfig", err)
+			}
+
+			if v, err := NewVaultReaderConfig(files, genKey("config"), tt.cfg); err == nil {
+				v.Close()
+				t.Fatal("The vault was built")
+			}
+		})
+	}
+
+	t.Run("Every error", func(t *testing.T) {
+		cfg := Config{InMemory: true, TempDir: "/tmp", Concurrency: -1}
+		err := cfg.Validate()
+		if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 2 {
+			t.Fatalf("Got %d errors instead of 2: %v", n, err)
+		}
+	})
+
+	t.Run("Raw key", func(t *testing.T) {
+		cfg := Config{CipherSuite: AES256GCM}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewVaultReaderConfig(files, genKey("config"), cfg); !errors.Is(err, ErrInvalidKeyLength) {
+			t.Fatalf("Got %v instead of ErrInvalidKeyLength", err)
+		}
+	})
+}
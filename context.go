@@ -0,0 +1,80 @@
+package arcsek
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Stops writing once the context is done
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c ctxWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.w.Write(p)
+}
+
+// Stops reading once the context is done, even if a read
+// is blocked. Reads run in their own goroutine, so a
+// stalled one is abandoned and returns the error of the
+// context instead. Sources with read deadlines, like a
+// net.Conn, are given the deadline of the context too
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+
+	// What the goroutines read into
+	buf []byte
+	res chan ctxRead
+}
+
+type ctxRead struct {
+	n   int
+	err error
+}
+
+func newCtxReader(ctx context.Context, r io.Reader) *ctxReader {
+	if d, ok := r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if deadline, ok := ctx.Deadline(); ok {
+			d.SetReadDeadline(deadline)
+		}
+	}
+
+	return &ctxReader{ctx: ctx, r: r, res: make(chan ctxRead, 1)}
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Contexts that are never done can't stall
+	if c.ctx.Done() == nil {
+		return c.r.Read(p)
+	}
+
+	// An abandoned read may still write to the buffer, but
+	// then the context is done and it is not used again
+	if cap(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+	buf := c.buf[:len(p)]
+
+	go func() {
+		n, err := c.r.Read(buf)
+		c.res <- ctxRead{n, err}
+	}()
+
+	select {
+	case res := <-c.res:
+		return copy(p, buf[:res.n]), res.err
+	case <-c.ctx.Done():
+		return 0, c.ctx.Err()
+	}
+}
@@ -0,0 +1,208 @@
+package arcsek
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewVaultReaderContext(t *testing.T) {
+	key := genKey("context")
+	root := t.TempDir()
+
+	// A big file to cancel while it is copied
+	for name, size := range map[string]int{"a": 100, "b": 16 << 20, "c": 100} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		builder func(cancel func()) VaultBuilder
+	}{
+		{"Between files", func(cancel func()) VaultBuilder {
+			return VaultBuilder{OnFile: func(name string, index, total int, size int64) {
+				if index == 1 {
+					cancel()
+				}
+			}}
+		}},
+		{"While copying", func(cancel func()) VaultBuilder {
+			return VaultBuilder{Progress: func(done, total int64) { cancel() }}
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			b := tc.builder(cancel)
+			b.TempDir = t.TempDir()
+
+			vault, err := b.BuildContext(ctx, []string{root}, key)
+			if !errors.Is(err, context.Canceled) {
+				if err == nil {
+					vault.Close()
+				}
+				t.Fatalf("Expected the context error but got %v", err)
+			}
+
+			left, err := os.ReadDir(b.TempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(left) != 0 {
+				t.Fatalf("The partial archive %s was not deleted", left[0].Name())
+			}
+		})
+	}
+
+	// One already cancelled does nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := NewVaultReaderContext(ctx, []string{root}, key); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the context error but got %v", err)
+	}
+}
+
+// Calls cancel once n bytes were read
+type cancellingReader struct {
+	r      io.Reader
+	n      int
+	cancel func()
+}
+
+func (c *cancellingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.n -= n; c.n <= 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestExtractToContext(t *testing.T) {
+	key := genKey("context")
+	entries := []Entry{
+		{Name: "a", Size: 100, Body: bytes.NewReader(make([]byte, 100))},
+		{Name: "b", Size: 4 << 20, Body: bytes.NewReader(make([]byte, 4<<20))},
+		{Name: "c", Size: 100, Body: bytes.NewReader(make([]byte, 100))},
+	}
+
+	// Not compressed, so reading 1 MB of the vault stops
+	// in the middle of b
+	b := VaultBuilder{Compression: None, InMemory: true}
+	vault, err := b.BuildEntries(entries, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dest := t.TempDir()
+	n, err := ExtractToContext(ctx, &cancellingReader{vault, 1 << 20, cancel}, key, dest)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the context error but got %v", err)
+	}
+
+	if n != 1 {
+		t.Fatalf("Expected 1 file written but got %d", n)
+	}
+
+	if _, err = os.Stat(filepath.Join(dest, "a")); err != nil {
+		t.Fatalf("The first entry should be kept: %v", err)
+	}
+
+	for _, name := range []string{"b", "c"} {
+		if _, err = os.Stat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should not be written, got %v", name, err)
+		}
+	}
+}
+
+func TestNewTarReaderContext(t *testing.T) {
+	key := genKey("context")
+
+	// Random so the vault is as big as the entry
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	vault, err := NewVaultReaderEntries([]Entry{{Name: "a", Size: 1 << 20, Body: bytes.NewReader(data)}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	b, err := ioutil.ReadAll(vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A source that stalls after some bytes, never
+	// returning from the read
+	stalling := func(n int) io.Reader {
+		pr, pw := io.Pipe()
+		go pw.Write(b[:n])
+		t.Cleanup(func() { pw.Close() })
+		return pr
+	}
+
+	t.Run("Header", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if _, err := NewTarReaderContext(ctx, stalling(10), key); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected a timeout but got %v", err)
+		}
+	})
+
+	t.Run("Body", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		tr, err := NewTarReaderContext(ctx, stalling(len(b)/2), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+
+		if _, err = tr.Next(); err == nil {
+			_, err = io.Copy(ioutil.Discard, tr)
+		}
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected a timeout but got %v", err)
+		}
+	})
+
+	t.Run("In time", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		tr, err := NewTarReaderContext(ctx, bytes.NewReader(b), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+
+		if _, err = tr.Next(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = tr.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// FileCreator is where a vault is extracted to, like memory
+// or an object store. The names are the cleaned paths of the
+// entries, slash separated and never leaving the root, with
+// their parents created before them.
+//
+// ExtractTo uses one that writes to a directory of the disk
+type FileCreator interface {
+	// Create a file with the mode and open it for writing.
+	// It is closed once its contents are written
+	Create(name string, mode os.FileMode) (io.WriteCloser, error)
+
+	// Mkdir creates a directory with the mode
+	Mkdir(name string, mode os.FileMode) error
+}
+
+// LinkCreator is a FileCreator that also takes links.
+// Without it the vaults with links fail to extract
+type LinkCreator interface {
+	FileCreator
+
+	// Symlink creates a symlink to target, which is relative
+	// to the directory of the link and stays in the root
+	Symlink(target, name string) error
+
+	// Link gives name the contents of target, an entry
+	// extracted before. It is used for hard links and for
+	// the copies of VaultBuilder.Deduplicate
+	Link(target, name string) error
+}
+
+// ExtractToCreator is like ExtractTo but extracts the vault
+// with fc instead of to a directory. It returns the number
+// of files created
+func ExtractToCreator(r io.Reader, key []byte, fc FileCreator) (int, error) {
+	return new(VaultOpener).ExtractToCreator(r, key, fc)
+}
+
+// ExtractToCreator is like the ExtractToCreator function
+// but opens the vault with the settings of the opener.
+// PreserveOwnership and IncludeXattrs don't apply
+func (o *VaultOpener) ExtractToCreator(r io.Reader, key []byte, fc FileCreator) (int, error) {
+	if fc == nil {
+		return 0, errNoCreator
+	}
+
+	return o.extract(context.Background(), r, key, fc)
+}
+
+var errNoCreator = errors.New("arcsek: no FileCreator to extract to")
+
+// Extract the entry with fc, reporting if it is a file
+func extractEntry(fc FileCreator, hdr *tar.Header, r io.Reader) (bool, error) {
+	if d, ok := fc.(*dirCreator); ok {
+		return d.extract(hdr, r)
+	}
+
+	name, err := localName(hdr.Name)
+	if err != nil {
+		return false, err
+	}
+	mode := hdr.FileInfo().Mode()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return false, fc.Mkdir(name, mode)
+
+	case tar.TypeReg:
+		w, err := fc.Create(name, mode)
+		if err != nil {
+			return false, err
+		}
+
+		if _, err = copyBuffer(w, r); err != nil {
+			w.Close()
+			return false, err
+		}
+		return true, w.Close()
+
+	case tar.TypeSymlink, tar.TypeLink:
+		lc, ok := fc.(LinkCreator)
+		if !ok {
+			return false, fmt.Errorf("arcsek: %s is a link and the FileCreator takes none", hdr.Name)
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			// The target must stay in the root from the link
+			if path.IsAbs(hdr.Linkname) {
+				return false, fmt.Errorf("%w: %s links to %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+			}
+
+			if _, err = localName(path.Join(path.Dir(name), hdr.Linkname)); err != nil {
+				return false, fmt.Errorf("%w: %s links to %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+			}
+			return false, lc.Symlink(hdr.Linkname, name)
+		}
+
+		target, err := localName(hdr.Linkname)
+		if err != nil || target == name {
+			return false, fmt.Errorf("%w: %s links to %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+		}
+		return isCopy(hdr), lc.Link(target, name)
+	}
+
+	// Anything else is not written by this package
+	return false, nil
+}
+
+// The cleaned name of an entry, which must stay in the root
+func localName(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+
+	return clean, nil
+}
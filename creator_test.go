@@ -0,0 +1,156 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Extracts to memory
+type memCreator struct {
+	files map[string]*bytes.Buffer
+	modes map[string]os.FileMode
+	links map[string]string
+}
+
+func newMemCreator() *memCreator {
+	return &memCreator{files: make(map[string]*bytes.Buffer), modes: make(map[string]os.FileMode), links: make(map[string]string)}
+}
+
+func (m *memCreator) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	m.files[name], m.modes[name] = new(bytes.Buffer), mode
+	return nopWriteCloser{m.files[name]}, nil
+}
+
+func (m *memCreator) Mkdir(name string, mode os.FileMode) error {
+	m.modes[name] = mode
+	return nil
+}
+
+func (m *memCreator) Symlink(target, name string) error {
+	m.links[name] = target
+	return nil
+}
+
+func (m *memCreator) Link(target, name string) error {
+	b, ok := m.files[target]
+	if !ok {
+		return errors.New("no such file")
+	}
+
+	m.files[name] = bytes.NewBuffer(b.Bytes())
+	return nil
+}
+
+// Only files and directories
+type plainCreator struct{ mem *memCreator }
+
+func (p plainCreator) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	return p.mem.Create(name, mode)
+}
+
+func (p plainCreator) Mkdir(name string, mode os.FileMode) error {
+	return p.mem.Mkdir(name, mode)
+}
+
+func TestExtractToCreator(t *testing.T) {
+	key := genKey("creator")
+
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"a.txt": "in memory", "sub/b.txt": "no disk", "sub/c.txt": "no disk"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(contents), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Files", func(t *testing.T) {
+		v, err := NewVaultReader([]string{dir}, key)
+		vault := vaultBytes(t, v, err)
+
+		mem := newMemCreator()
+		n, err := ExtractToCreator(bytes.NewReader(vault), key, plainCreator{mem})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 3 || mem.files["sub/b.txt"].String() != "no disk" || mem.files["a.txt"].String() != "in memory" {
+			t.Fatalf("Extracted %d files: %v", n, mem.files)
+		}
+
+		if mem.modes["a.txt"].Perm() != 0640 || !mem.modes["sub"].IsDir() {
+			t.Fatalf("Wrong modes %v", mem.modes)
+		}
+	})
+
+	t.Run("Copies", func(t *testing.T) {
+		b := VaultBuilder{Deduplicate: true}
+		v, err := b.Build([]string{dir}, key)
+		vault := vaultBytes(t, v, err)
+
+		mem := newMemCreator()
+		n, err := ExtractToCreator(bytes.NewReader(vault), key, mem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 3 || mem.files["sub/c.txt"].String() != "no disk" {
+			t.Fatalf("Extracted %d files: %v", n, mem.files)
+		}
+
+		// Without links the copy can't be made
+		if _, err = ExtractToCreator(bytes.NewReader(vault), key, plainCreator{newMemCreator()}); err == nil {
+			t.Fatal("The copy was extracted without Link")
+		}
+	})
+
+	t.Run("Symlinks", func(t *testing.T) {
+		links := t.TempDir()
+		if err := os.Symlink("sub/b.txt", filepath.Join(links, "inside")); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := NewVaultReader([]string{links}, key)
+		vault := vaultBytes(t, v, err)
+
+		mem := newMemCreator()
+		if _, err = ExtractToCreator(bytes.NewReader(vault), key, mem); err != nil {
+			t.Fatal(err)
+		}
+
+		if mem.links["inside"] != "sub/b.txt" {
+			t.Fatalf("Got the links %v", mem.links)
+		}
+
+		if err = os.Symlink("../../etc/passwd", filepath.Join(links, "outside")); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err = NewVaultReader([]string{links}, key)
+		vault = vaultBytes(t, v, err)
+
+		if _, err = ExtractToCreator(bytes.NewReader(vault), key, newMemCreator()); !errors.Is(err, ErrUnsafePath) {
+			t.Fatalf("Got %v instead of ErrUnsafePath", err)
+		}
+	})
+
+	t.Run("Unsafe names", func(t *testing.T) {
+		for _, name := range []string{"../evil", "/etc/passwd", "a/../../evil"} {
+			if _, err := localName(name); !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("%s was taken", name)
+			}
+		}
+
+		if name, err := localName("./a//b/"); err != nil || !strings.EqualFold(name, "a/b") {
+			t.Fatalf("Got %s, %v", name, err)
+		}
+	})
+}
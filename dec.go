@@ -2,8 +2,16 @@ package arcsek
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 
 	"github.com/secure-io/sio-go"
 )
@@ -15,29 +23,639 @@ reconstruction of encrypted and decrypted
 new files or to respond to http requests
 */
 
+// ErrChecksumMismatch is returned by TarReader.Verify when
+// the decrypted archive is not the one that was sealed
+var ErrChecksumMismatch = errors.New("arcsek: the archive does not match its checksum")
+
+// ErrEntryTooLarge is returned when an entry of the archive
+// is bigger than VaultOpener.MaxEntrySize
+var ErrEntryTooLarge = errors.New("arcsek: entry larger than the limit")
+
+// ErrArchiveTooLarge is returned when the archive has more
+// entries or bytes than VaultOpener.MaxEntries or
+// MaxTotalBytes allow
+var ErrArchiveTooLarge = errors.New("arcsek: archive larger than the limit")
+
+// ErrDecryptFailed is returned when the vault can't be
+// decrypted. ErrAuthFailed and ErrTruncated tell why,
+// when it is known
+var ErrDecryptFailed = errors.New("arcsek: decryption failed")
+
+// ErrAuthFailed is returned when the vault does not
+// authenticate: the key is wrong or it was modified. It
+// matches ErrDecryptFailed too
+var ErrAuthFailed = fmt.Errorf("%w: the key is wrong or the vault was modified", ErrDecryptFailed)
+
+// ErrTruncated is returned when the vault ends before it
+// should, like a download that got cut off. It matches
+// ErrDecryptFailed too.
+//
+// Only vaults that record the size of their archive can
+// tell it apart from ErrAuthFailed. For streamed vaults a
+// failure at the end of the source is just ErrDecryptFailed
+var ErrTruncated = fmt.Errorf("%w: the vault is truncated", ErrDecryptFailed)
+
+// Counts the encrypted bytes read, and whether the source
+// ran out
+type sourceReader struct {
+	r   io.Reader
+	n   int64
+	eof bool
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+// The decrypted body of a vault. The authentication
+// failures of sio are reported as ErrAuthFailed or
+// ErrTruncated
+type decReader struct {
+	dr  *sio.DecReader
+	src *sourceReader
+
+	// The length of the encrypted body, or -1 if unknown
+	size int64
+}
+
+func (d *decReader) Read(p []byte) (int, error) {
+	n, err := d.dr.Read(p)
+	if err != sio.ErrAuth {
+		return n, err
+	}
+
+	switch {
+	case d.size >= 0 && d.src.eof && d.src.n < d.size:
+		err = fmt.Errorf("%w: %d of %d bytes: %w", ErrTruncated, d.src.n, d.size, err)
+	case d.size >= 0 || !d.src.eof:
+		err = fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	default:
+		err = fmt.Errorf("%w: %w", ErrDecryptFailed, err)
+	}
+	return n, err
+}
+
+// TarReader is a tar.Reader over the decrypted vault that
+// can also verify the archive against the checksum stored
+// in the header.
+//
+// Like a VaultReader, it must be closed after using it to
+// release the decompression
+type TarReader struct {
+	*tar.Reader
+
+	// The decompression, nil once closed
+	cr io.ReadCloser
+
+	// The decrypted body, hashed as it is read
+	body io.Reader
+	sum  hash.Hash
+
+	// Nil for legacy vaults
+	info *VaultInfo
+
+	// The limits of the opener, if not zero, and how much
+	// of them the entries returned by Next used
+	maxEntrySize, maxTotalBytes int64
+	maxEntries                  int
+	entries                     int
+	total                       int64
+
+	// The size of each file, to count the copies against
+	// maxTotalBytes
+	sizes map[string]int64
+
+	// Whether Next was called, and the map from the ids to the
+	// names if they are obfuscated
+	started bool
+	names   map[string]string
+
+	// The manifest, if the vault has one
+	manifest []ManifestEntry
+
+	// The first entry that is not of the package, read by
+	// start for Next
+	first *tar.Header
+}
+
+// Read the entries the package adds at the start of the tar:
+// the manifest, then the name map
+func (t *TarReader) start() error {
+	if t.started {
+		return nil
+	}
+	t.started = true
+
+	hdr, err := t.Reader.Next()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := t.readManifest(hdr)
+	if err != nil {
+		return err
+	}
+
+	if manifest {
+		if hdr, err = t.Reader.Next(); err != nil {
+			return err
+		}
+	}
+
+	names, err := t.readNames(hdr)
+	if err != nil {
+		return err
+	}
+
+	if names {
+		if hdr, err = t.Reader.Next(); err != nil {
+			return err
+		}
+	}
+
+	t.first = hdr
+	return nil
+}
+
+// Next advances to the next entry like tar.Reader.Next,
+// enforcing the limits of the VaultOpener. They are checked
+// against the sizes the tar headers claim, which the tar
+// reader holds the entries to, so an entry is refused before
+// any of it is read
+//
+// The entries of vaults with obfuscated names get their
+// names back, see VaultBuilder.ObfuscateNames
+func (t *TarReader) Next() (*tar.Header, error) {
+	// Once started it doesn't read anything
+	var err error
+	if err = t.start(); err != nil {
+		return nil, err
+	}
+
+	hdr := t.first
+	if hdr != nil {
+		t.first = nil
+	} else if hdr, err = t.Reader.Next(); err != nil {
+		return nil, err
+	}
+
+	if t.names != nil {
+		if err = t.restoreNames(hdr); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.maxEntrySize > 0 && hdr.Size > t.maxEntrySize {
+		return nil, fmt.Errorf("%w: %s claims %d bytes, at most %d are allowed", ErrEntryTooLarge, hdr.Name, hdr.Size, t.maxEntrySize)
+	}
+
+	if t.entries++; t.maxEntries > 0 && t.entries > t.maxEntries {
+		return nil, fmt.Errorf("%w: more than %d entries", ErrArchiveTooLarge, t.maxEntries)
+	}
+
+	// Copies are extracted with the size of what they copy
+	size := hdr.Size
+	if t.maxTotalBytes > 0 {
+		if t.sizes == nil {
+			t.sizes = make(map[string]int64)
+		}
+
+		if isCopy(hdr) {
+			size = t.sizes[hdr.Linkname]
+		} else if hdr.Typeflag == tar.TypeReg {
+			t.sizes[hdr.Name] = hdr.Size
+		}
+	}
+
+	// Compared so the sum can't overflow
+	if t.maxTotalBytes > 0 && size > t.maxTotalBytes-t.total {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrArchiveTooLarge, t.maxTotalBytes)
+	}
+	t.total += size
+
+	return hdr, nil
+}
+
+// Verify reads what is left of the vault and compares the
+// SHA-256 of the whole compressed tar with the one recorded
+// when it was sealed. It returns ErrChecksumMismatch if
+// they differ.
+//
+// The chunks are already authenticated while reading, this
+// catches anything that slips past that. The tar reader
+// cannot be used after calling Verify.
+//
+// Legacy vaults and vaults streamed with EncryptTo have no
+// checksum, Verify returns an error for them
+func (t *TarReader) Verify() error {
+	if t.info == nil || !t.info.known() {
+		return errors.New("arcsek: the vault has no checksum")
+	}
+
+	if _, err := copyBuffer(ioutil.Discard, t.body); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(t.sum.Sum(nil), t.info.Checksum[:]) != 1 {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// Close releases the decompression and its buffers. The
+// encrypted source is not closed, it belongs to the caller.
+// Closing it again does nothing
+func (t *TarReader) Close() error {
+	if t.cr == nil {
+		return nil
+	}
+
+	err := t.cr.Close()
+	t.cr = nil
+	return err
+}
+
 // Uses a decrypted reader to construct a
-// .tar.gz reader that uses the dec reader
+// tar reader that uses the dec reader
 // to get the data. It assumes the reader
 // has been decrypted and authenticated
-func tarReader(dec *sio.DecReader) (*tar.Reader, error) {
-	gr, err := gzip.NewReader(dec)
+func tarReader(dec io.Reader, c Compression, dict []byte, info *VaultInfo) (*TarReader, error) {
+	cmp, err := c.compressorWithDictionary(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything the decompression reads is hashed
+	sum := sha256.New()
+	body := io.TeeReader(dec, sum)
+
+	cr, err := cmp.newReader(body)
 	if err != nil {
 		return nil, err
 	}
 
-	return tar.NewReader(gr), nil
+	return &TarReader{Reader: tar.NewReader(cr), cr: cr, body: body, sum: sum, info: info}, nil
 }
 
 // NewTarReaderNonce receives an encrypted stream
-// of data that starts with a nonce and a key to
+// of data that starts with a header and a key to
 // decrypt and authenticate it. Then it uses it to
-// create a tar.gz reader from which you can exract files
+// create a tar reader from which you can exract files.
+// The tar is decompressed if the header says so.
+//
+// If the vault was sealed with a password the key is
+// the password. Vaults armored by ArmoredWriter are
+// unarmored on their own.
+//
+// The decompression of the returned reader can't be
+// released. Long running programs should use NewTarReader
+// and close it
 func NewTarReaderNonce(enc io.Reader, key []byte) (*tar.Reader, error) {
+	tr, err := NewTarReader(enc, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return tr.Reader, nil
+}
+
+// NewTarReaderLegacy opens a vault written before the header
+// existed: a nonce of nonceLen bytes followed by the AES-GCM
+// encrypted tar.gz. Nothing is detected, enc must be one of
+// those. They were written with 8 byte nonces, the only
+// length sio takes for AES-GCM, so any other fails with
+// ErrNonceSize.
+//
+// To open both kinds of vault see VaultOpener.AllowLegacy,
+// which tells them apart by the magic
+func NewTarReaderLegacy(enc io.Reader, key []byte, nonceLen int) (*tar.Reader, error) {
+	dr, err := decryptLegacy(enc, key, nonceLen)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := tarReader(dr, Gzip, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return tr.Reader, nil
+}
+
+// NewTarReader is like NewTarReaderNonce but the returned
+// reader can also verify the checksum of the archive and
+// must be closed
+func NewTarReader(enc io.Reader, key []byte) (*TarReader, error) {
+	return new(VaultOpener).Open(enc, key)
+}
+
+// NewTarReaderContext is like NewTarReader but gives up
+// reading enc once ctx is done, see VaultOpener.OpenContext
+func NewTarReaderContext(ctx context.Context, enc io.Reader, key []byte) (*TarReader, error) {
+	return new(VaultOpener).OpenContext(ctx, enc, key)
+}
+
+// NewTarReaderPassword is like NewTarReaderNonce but for
+// vaults sealed with a password. The key is derived from
+// the password with the same function and params used to
+// seal the vault, which are read from the header
+func NewTarReaderPassword(enc io.Reader, password string) (*tar.Reader, error) {
+	return NewTarReaderNonce(enc, []byte(password))
+}
+
+// VaultOpener holds the settings used to open a vault.
+//
+// The zero value opens the vaults written by this package,
+// exactly like NewTarReaderNonce
+type VaultOpener struct {
+	// AllowLegacy also opens vaults written before the
+	// header existed, which are an 8 byte nonce followed by
+	// the AES-GCM encrypted tar.gz. They are recognized by
+	// the missing magic
+	AllowLegacy bool
+
+	// PreserveOwnership gives the extracted files the uid
+	// and gid recorded in the archive. It needs a privileged
+	// process, otherwise the files belong to the user that
+	// extracts them, as if it was not set. It does nothing
+	// on Windows
+	PreserveOwnership bool
+
+	// IncludeXattrs applies the extended attributes recorded
+	// in the archive to the extracted files, on Linux and
+	// macOS. Attributes the file system or the user can't
+	// set are skipped
+	IncludeXattrs bool
+
+	// AssociatedData must be the VaultBuilder.AssociatedData
+	// the vault was sealed with, or opening it fails with
+	// ErrAuthFailed
+	AssociatedData []byte
+
+	// Keyfile is the VaultBuilder.Keyfile the vault was
+	// sealed with. Vaults that need one fail to open with
+	// ErrKeyfileRequired without it, and with ErrAuthFailed
+	// with another one. It is ignored by the other vaults
+	Keyfile []byte
+
+	// MaxEntrySize is the largest entry that is extracted or
+	// read, in bytes. The size is the one the tar header
+	// claims, so a crafted vault fails with ErrEntryTooLarge
+	// before anything is written. Zero means no limit
+	MaxEntrySize int64
+
+	// MaxEntries and MaxTotalBytes cap how many entries the
+	// archive can have and how many bytes they can add up to
+	// once decompressed. A vault over them fails with
+	// ErrArchiveTooLarge, which stops tar bombs: a few KB of
+	// compressed zeros can expand to gigabytes. Zero means
+	// no limit
+	MaxEntries    int
+	MaxTotalBytes int64
+
+	// SafeExtract makes ExtractTo write the files to a
+	// staging directory in destDir first, and move them
+	// into place only once the whole vault authenticated
+	// and matched its checksum. The chunks are authenticated
+	// one by one, so without it the files before a tampered
+	// chunk are already on disk when the extraction fails.
+	// On any error the staging directory is removed and
+	// destDir is left as it was: nothing is moved if an
+	// entry is a directory where destDir has a file, or the
+	// other way around, and if a move fails the ones before
+	// it are undone.
+	//
+	// The directories that already exist in destDir get the
+	// new entries but keep their permissions and times. The
+	// files are replaced
+	SafeExtract bool
+}
+
+// Open decrypts and authenticates the vault in enc and
+// creates a tar reader from which you can extract files
+func (o *VaultOpener) Open(enc io.Reader, key []byte) (*TarReader, error) {
 	// We must create a decrypted reader from enc.
-	dr, err := DecryptVault(enc, key)
+	dr, h, info, err := o.decrypt(enc, key)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := tarReader(dr, h.compression, h.dictionary, info)
+	if err != nil {
+		return nil, err
+	}
+
+	tr.maxEntrySize, tr.maxEntries, tr.maxTotalBytes = o.MaxEntrySize, o.MaxEntries, o.MaxTotalBytes
+	return tr, nil
+}
+
+// VerifyVault decrypts the whole vault in r and parses the
+// tar to the end without writing anything, as a dry run of
+// the extraction for health checks. It returns nil only if
+// every chunk authenticated, the archive decompressed and
+// parsed, and it matches its checksum when it has one
+func VerifyVault(r io.Reader, key []byte) error {
+	return new(VaultOpener).VerifyVault(r, key)
+}
+
+// VerifyVault is like the VerifyVault function but opens
+// the vault with the settings of the opener
+func (o *VaultOpener) VerifyVault(r io.Reader, key []byte) error {
+	tr, err := o.Open(r, key)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err = copyBuffer(ioutil.Discard, tr); err != nil {
+			return err
+		}
+	}
+
+	// The end of the tar is not the end of the vault. The
+	// decompression checks what is left, like the CRC of
+	// gzip, and the last chunk must authenticate
+	if _, err = copyBuffer(ioutil.Discard, tr.cr); err != nil {
+		return err
+	}
+
+	if tr.info != nil && tr.info.known() {
+		return tr.Verify()
+	}
+
+	_, err = copyBuffer(ioutil.Discard, tr.body)
+	return err
+}
+
+// OpenContext is like Open but every read of enc gives up
+// once ctx is done, so a stalled network source can't
+// block forever. Use a context with a deadline or a
+// timeout to bound the read of the header.
+//
+// The context also covers the body: if it is done in the
+// middle of it, reading the tar returns the error of ctx,
+// like context.DeadlineExceeded, and the reader must be
+// closed as it can't go on
+func (o *VaultOpener) OpenContext(ctx context.Context, enc io.Reader, key []byte) (*TarReader, error) {
+	return o.Open(newCtxReader(ctx, enc), key)
+}
+
+// Reads the header of the vault and returns the decrypted
+// reader of the body, the header, which says how it is
+// compressed, and its info, which is nil for legacy vaults
+func (o *VaultOpener) decrypt(enc io.Reader, key []byte) (*decReader, *header, *VaultInfo, error) {
+	enc, err := unarmor(enc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	h, raw, aead, err := o.openHeader(enc, key)
+	if err == ErrBadMagic && o.AllowLegacy {
+		// Give back what was read looking for the magic,
+		// it was part of the nonce
+		dr, err := decryptLegacy(io.MultiReader(bytes.NewReader(raw), enc), key, legacyNonceLen)
+		return dr, &header{suite: AESGCM, compression: Gzip}, nil, err
+	}
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stream, info, err := openStream(h, raw, aead)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The size of the body tells a truncated vault apart
+	size := int64(-1)
+	if info.ArchiveSize >= 0 {
+		size = info.ArchiveSize + stream.Overhead(info.ArchiveSize)
+	}
+
+	// We use the key and the nonce to create a decrypted
+	// reader. The header is the associated data
+	src := &sourceReader{r: enc}
+	dr := &decReader{dr: stream.DecryptReader(src, h.nonce, h.withAAD(raw)), src: src, size: size}
+	return dr, h, &info, nil
+}
+
+// Creates the stream of the body of a vault and opens its
+// info, which checks the key, and its dictionary
+func openStream(h *header, raw []byte, aead cipher.AEAD) (*sio.Stream, VaultInfo, error) {
+	stream, err := createStream(aead, h.bufSize)
+	if err != nil {
+		return nil, VaultInfo{}, err
+	}
+
+	// The nonce must have the size the suite uses, or
+	// sio would panic
+	if len(h.nonce) != stream.NonceSize() {
+		return nil, VaultInfo{}, fmt.Errorf("%w: the vault has a %d byte nonce but %s uses %d bytes",
+			ErrNonceSize, len(h.nonce), h.suite, stream.NonceSize())
+	}
+
+	// A wrong key is noticed here, before any of the body is read
+	info, err := openInfo(aead, h.info, h.withAAD(h.prefix(raw)))
+	if err != nil {
+		return nil, VaultInfo{}, err
+	}
+
+	if h.sealedDictionary != nil {
+		if h.dictionary, err = openDictionary(aead, h.sealedDictionary); err != nil {
+			return nil, VaultInfo{}, err
+		}
+	}
+
+	return stream, info, nil
+}
+
+// Reads the header of the vault and creates the AEAD of
+// its suite, deriving the key from the password if the
+// header says so.
+//
+// Like parseHeader, the bytes read are returned even on error
+func (o *VaultOpener) openHeader(enc io.Reader, key []byte) (*header, []byte, cipher.AEAD, error) {
+	h, raw, err := parseHeader(enc)
+	if err != nil {
+		return nil, raw, nil, err
+	}
+
+	chain := keyChain{key: key}
+	defer chain.wipe()
+
+	if h.kdf != nil {
+		if err = chain.next(h.kdf.Derive(chain.key, h.salt)); err != nil {
+			return nil, raw, nil, err
+		}
+	}
+
+	if h.keyfile {
+		if len(o.Keyfile) == 0 {
+			return nil, raw, nil, ErrKeyfileRequired
+		}
+
+		if err = chain.next(combineKeyfile(chain.key, o.Keyfile)); err != nil {
+			return nil, raw, nil, err
+		}
+	}
+
+	if h.recipients != nil {
+		if err = chain.next(unwrapRecipients(h.recipients, chain.key)); err != nil {
+			return nil, raw, nil, err
+		}
+	}
+
+	if h.ephemeral != nil {
+		if err = chain.next(openerKey(chain.key, h.ephemeral)); err != nil {
+			return nil, raw, nil, err
+		}
+	}
+
+	aead, err := h.suite.newAEAD(chain.key)
+	if err != nil {
+		return nil, raw, nil, err
+	}
+
+	h.aad = o.AssociatedData
+	return h, raw, aead, nil
+}
+
+// The nonce length of the vaults without header
+const legacyNonceLen = 8
+
+// Headerless vaults always used AES-GCM and gzip
+func decryptLegacy(enc io.Reader, key []byte, nonceLen int) (*decReader, error) {
+	stream, err := createStreamFromKey(AESGCM, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// sio only takes nonces of its size
+	if nonceLen != stream.NonceSize() {
+		return nil, fmt.Errorf("%w: legacy vaults have a %d byte nonce, not %d", ErrNonceSize, stream.NonceSize(), nonceLen)
+	}
+
+	// We read the nonce from the er
+	src := &sourceReader{r: enc}
+	nonce, err := readNonce(src, nonceLen)
 	if err != nil {
 		return nil, err
 	}
 
-	return tarReader(dr)
+	return &decReader{dr: stream.DecryptReader(src, nonce, nil), src: src, size: -1}, nil
 }
@@ -0,0 +1,78 @@
+package arcsek
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"io"
+)
+
+// NewDecryptReader reads the header of the vault in r and
+// returns the decrypted body: the tar as it was compressed,
+// with gzip unless the vault says otherwise. It is the layer
+// below NewTarReader, for callers that handle the archive
+// themselves, like piping it to tar.
+//
+// Unlike DecryptVault, the errors are those of the package,
+// like ErrAuthFailed and ErrTruncated, and the archive is
+// checked against the checksum in the header once it is read
+// to the end: the last Read fails with ErrChecksumMismatch if
+// it does not match.
+//
+// Closing it does not close r
+func NewDecryptReader(r io.Reader, key []byte) (io.ReadCloser, error) {
+	return new(VaultOpener).NewDecryptReader(r, key)
+}
+
+// NewDecryptReader is like the NewDecryptReader function
+// but opens the vault with the settings of the opener
+func (o *VaultOpener) NewDecryptReader(r io.Reader, key []byte) (io.ReadCloser, error) {
+	dr, _, info, err := o.decrypt(r, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ar := &archiveReader{r: dr}
+	if info != nil && info.known() {
+		ar.info, ar.sum = info, sha256.New()
+	}
+
+	return ar, nil
+}
+
+var errArchiveReaderClosed = errors.New("arcsek: read of a closed decrypt reader")
+
+// The decrypted archive, hashed as it is read if the vault
+// has a checksum
+type archiveReader struct {
+	r io.Reader
+
+	info *VaultInfo
+	sum  hash.Hash
+
+	closed bool
+}
+
+func (a *archiveReader) Read(p []byte) (int, error) {
+	if a.closed {
+		return 0, errArchiveReaderClosed
+	}
+
+	n, err := a.r.Read(p)
+	if a.sum == nil {
+		return n, err
+	}
+
+	a.sum.Write(p[:n])
+	if err == io.EOF && subtle.ConstantTimeCompare(a.sum.Sum(nil), a.info.Checksum[:]) != 1 {
+		err = ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// Close stops the reads, the source is not closed
+func (a *archiveReader) Close() error {
+	a.closed = true
+	return nil
+}
@@ -0,0 +1,93 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestNewDecryptReader(t *testing.T) {
+	key := genKey("decrypt reader")
+
+	// The archive of a vault in memory is the plain tar.gz
+	b := VaultBuilder{InMemory: true}
+	v, err := b.Build([]string{"testing-files/in/existance"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := bytes.Clone(v.data)
+	vault := vaultBytes(t, v, err)
+
+	t.Run("Archive", func(t *testing.T) {
+		rc, err := NewDecryptReader(bytes.NewReader(vault), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, archive) {
+			t.Fatalf("Got %d bytes instead of the %d of the archive", len(got), len(archive))
+		}
+
+		// It is a tar.gz anyone can read
+		gz, err := gzip.NewReader(bytes.NewReader(got))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr, err := tar.NewReader(gz).Next(); err != nil || hdr.Name != "testfile1.txt" {
+			t.Fatalf("Got %v from the tar: %v", hdr, err)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		rc, err := NewDecryptReader(bytes.NewReader(vault[:len(vault)-100]), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = io.ReadAll(rc); !errors.Is(err, ErrTruncated) {
+			t.Fatalf("Got %v instead of ErrTruncated", err)
+		}
+	})
+
+	t.Run("Checksum", func(t *testing.T) {
+		rc, err := NewDecryptReader(bytes.NewReader(vault), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Emulate an archive that changed after it was hashed
+		rc.(*archiveReader).info.Checksum[0] ^= 1
+
+		if _, err = io.ReadAll(rc); err != ErrChecksumMismatch {
+			t.Fatalf("Got %v instead of ErrChecksumMismatch", err)
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		rc, err := NewDecryptReader(bytes.NewReader(vault), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+
+		if _, err = rc.Read(make([]byte, 10)); err == nil {
+			t.Fatal("Read after Close")
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		if _, err := NewDecryptReader(bytes.NewReader(vault), genKey("other")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Got %v instead of ErrAuthFailed", err)
+		}
+	})
+}
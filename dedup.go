@@ -0,0 +1,142 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The kind of the entries that are a copy of an earlier
+// one, see VaultBuilder.Deduplicate. They are hard links in
+// the tar, but they are extracted as files of their own
+const kindCopy = "copy"
+
+// The files already archived by their size and contents
+type dedup struct {
+	sizes map[int64]bool
+	names map[dedupKey]string
+}
+
+type dedupKey struct {
+	size int64
+	sum  [sha256.Size]byte
+}
+
+func newDedup() *dedup {
+	return &dedup{sizes: make(map[int64]bool), names: make(map[dedupKey]string)}
+}
+
+// The name in the tar of an archived file with the same
+// contents, or "" if there is none. The contents are only
+// hashed if a file of the same size was archived
+func (d *dedup) find(size int64, hash func() ([sha256.Size]byte, error)) (string, error) {
+	if d == nil || size == 0 || !d.sizes[size] {
+		return "", nil
+	}
+
+	sum, err := hash()
+	if err != nil {
+		return "", err
+	}
+
+	return d.names[dedupKey{size, sum}], nil
+}
+
+// Record an archived file. The first one with the contents
+// is the one the copies point to
+func (d *dedup) add(name string, size int64, sum [sha256.Size]byte) {
+	if d == nil {
+		return
+	}
+
+	d.sizes[size] = true
+	if key := (dedupKey{size, sum}); d.names[key] == "" {
+		d.names[key] = name
+	}
+}
+
+// The SHA-256 of the file at path
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	file, err := os.Open(path)
+	if err != nil {
+		return sum, notFound(err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err = copyBuffer(h, file); err != nil {
+		return sum, err
+	}
+
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// Write the entry of a file with the same contents as the
+// entry target, keeping its own mode, time and owner. The
+// name is already claimed
+func (a *archiveWriter) addCopy(path, name string, stat os.FileInfo, target string) error {
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	header.Name = a.entryName(name)
+	header.Typeflag, header.Linkname, header.Size = tar.TypeLink, target, 0
+
+	if err = a.fill(header, path); err != nil {
+		return err
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[paxKind] = kindCopy
+
+	paxLongNames(header)
+	if err = a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	a.info.Files++
+	return nil
+}
+
+// Whether the entry is a copy written by addCopy
+func isCopy(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeLink && hdr.PAXRecords[paxKind] == kindCopy
+}
+
+// Extract a copy of the file extracted before for the
+// entry it points to. Like a hard link, the target must be
+// in dest
+func (d *dirCreator) extractCopy(path string, hdr *tar.Header) error {
+	target, err := safeJoin(d.dest, hdr.Linkname)
+	if err != nil || target == path {
+		return fmt.Errorf("%w: %s is a copy of %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+	}
+
+	if err = checkNoSymlinks(d.dest, target); err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is a copy of %s, which is not a file", ErrUnsafePath, hdr.Name, hdr.Linkname)
+	}
+
+	src, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return d.writeFile(path, hdr, io.LimitReader(src, fi.Size()))
+}
@@ -0,0 +1,112 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeduplicate(t *testing.T) {
+	key := genKey("dedup")
+
+	// Random, so only deduplication makes it smaller
+	data := make([]byte, 1<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	names := []string{"a.bin", "b.bin", "c.bin", "other.txt"}
+	for _, name := range names[:3] {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other.txt"), []byte("not a copy"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, name)
+	}
+
+	for _, concurrency := range []int{0, 4} {
+		t.Run(fmt.Sprintf("Concurrency %d", concurrency), func(t *testing.T) {
+			b := VaultBuilder{Deduplicate: true, Concurrency: concurrency, Compression: None}
+			v, err := b.Build(paths, key)
+			vault := vaultBytes(t, v, err)
+
+			// One copy and a bit of overhead
+			if len(vault) > len(data)+len(data)/10 {
+				t.Fatalf("The vault has %d bytes for a file of %d", len(vault), len(data))
+			}
+
+			dest := t.TempDir()
+			n, err := ExtractTo(bytes.NewReader(vault), key, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != len(names) {
+				t.Fatalf("%d files were extracted instead of %d", n, len(names))
+			}
+
+			first, err := os.Stat(filepath.Join(dest, "a.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range names[1:3] {
+				got, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(got, data) {
+					t.Fatalf("%s is not the file", name)
+				}
+
+				// The copies are files of their own
+				if fi, _ := os.Stat(filepath.Join(dest, name)); os.SameFile(first, fi) {
+					t.Fatalf("%s is a hard link", name)
+				}
+			}
+
+			t.Run("ExtractFile", func(t *testing.T) {
+				rc, err := ExtractFile(bytes.NewReader(vault), key, "c.bin")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rc.Close()
+
+				got, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(got, data) {
+					t.Fatal("The copy is not the file")
+				}
+			})
+
+			t.Run("Copies count", func(t *testing.T) {
+				opener := VaultOpener{MaxTotalBytes: 2 << 20}
+				if _, err := opener.ExtractTo(bytes.NewReader(vault), key, t.TempDir()); !errors.Is(err, ErrArchiveTooLarge) {
+					t.Fatalf("Got %v instead of ErrArchiveTooLarge", err)
+				}
+			})
+
+			t.Run("Remove the original", func(t *testing.T) {
+				if _, err := RemoveFromVault(bytes.NewReader(vault), key, []string{"a.bin"}); err == nil {
+					t.Fatal("The copies would point to nothing")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The time of every entry of a deterministic vault
+var reproducibleTime = time.Unix(0, 0)
+
+// NewVaultReaderDeterministic is like NewVaultReader but the
+// vault is sealed with the nonce given instead of a random
+// one, and every entry gets the same time, so the same files,
+// key and nonce always give the same vault, byte for byte.
+// It is meant for tests and for checking builds are
+// reproducible. The nonce has the length of the Nonce of a
+// vault of the suite, 8 bytes for the AES-GCM ones.
+//
+// Don't use it to protect anything. A key and a nonce must
+// never seal two different archives: with GCM that leaks the
+// XOR of both plain texts and lets anyone forge chunks, and
+// this makes reusing them as easy as calling it twice
+func NewVaultReaderDeterministic(files []string, key, nonce []byte, opts ...Option) (*VaultReader, error) {
+	return newBuilder(opts).BuildDeterministic(files, key, nonce)
+}
+
+// BuildDeterministic is like Build but with a fixed nonce,
+// see NewVaultReaderDeterministic, which is just as unsafe.
+// The salt of KeyDeriver is derived from the nonce too.
+//
+// The vault is only reproducible with the same builder, and
+// Filter and ContinueOnError must select the same files
+func (b *VaultBuilder) BuildDeterministic(files []string, key, nonce []byte) (*VaultReader, error) {
+	if len(nonce) == 0 {
+		return nil, errEmptyNonce
+	}
+
+	// The nonce is set on a copy, the builder may be shared
+	withNonce := *b
+	withNonce.nonce = nonce
+	return withNonce.Build(files, key)
+}
+
+var errEmptyNonce = errors.New("arcsek: a deterministic vault needs a nonce")
+
+// The nonce of the stream, which must have the size sio
+// expects, and the one of the info, derived from it
+func fixedNonces(nonce []byte, streamSize, infoSize int) ([]byte, []byte, error) {
+	if len(nonce) != streamSize {
+		return nil, nil, fmt.Errorf("arcsek: the nonce has %d bytes instead of %d", len(nonce), streamSize)
+	}
+
+	info, err := deterministicBytes(nonce, "info", infoSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bytes.Clone(nonce), info, nil
+}
+
+// Derive n bytes from the nonce for what is random in other
+// vaults. They are all stored in the clear like the nonce
+func deterministicBytes(nonce []byte, label string, n int) ([]byte, error) {
+	return hkdf.Key(sha256.New, nonce, nil, "arcsek deterministic "+label, n)
+}
+
+// Give the entry the fixed time if the vault is reproducible
+func (a *archiveWriter) setTime(header *tar.Header) {
+	if !a.fixedTime {
+		return
+	}
+
+	header.ModTime = reproducibleTime
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+}
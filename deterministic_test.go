@@ -0,0 +1,91 @@
+package arcsek
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildDeterministic(t *testing.T) {
+	key := genKey("deterministic")
+	nonce := []byte("8 bytes!")
+
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"a.txt": "same", "sub/b.txt": "bytes"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Touch the files so only the contents are the same
+	touch := func(t *testing.T, when time.Time) {
+		for _, name := range []string{"a.txt", "sub/b.txt", "sub"} {
+			if err := os.Chtimes(filepath.Join(dir, name), when, when); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		builder VaultBuilder
+		key     []byte
+	}{
+		{"Default", VaultBuilder{}, key},
+		{"Zstd", VaultBuilder{Compression: Zstd, Concurrency: 4}, key},
+		{"ChaCha20", VaultBuilder{CipherSuite: ChaCha20Poly1305}, bytes.Repeat([]byte{7}, 32)},
+		{"Password", VaultBuilder{KeyDeriver: PBKDF2Params{Iterations: minPBKDF2Iterations}}, []byte("password")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			touch(t, time.Now().Add(-time.Hour))
+			v, err := tt.builder.BuildDeterministic([]string{dir}, tt.key, nonce)
+			first := vaultBytes(t, v, err)
+
+			touch(t, time.Now())
+			v, err = tt.builder.BuildDeterministic([]string{dir}, tt.key, nonce)
+			second := vaultBytes(t, v, err)
+
+			if !bytes.Equal(first, second) {
+				t.Fatal("The vaults are not the same")
+			}
+
+			if err = VerifyVault(bytes.NewReader(first), tt.key); err != nil {
+				t.Fatal(err)
+			}
+
+			// Any other nonce is another vault
+			v, err = tt.builder.BuildDeterministic([]string{dir}, tt.key, []byte("8 bytes?"))
+			if bytes.Equal(first, vaultBytes(t, v, err)) {
+				t.Fatal("The nonce is not used")
+			}
+		})
+	}
+
+	t.Run("Random by default", func(t *testing.T) {
+		v, err := NewVaultReader([]string{dir}, key)
+		first := vaultBytes(t, v, err)
+
+		v, err = NewVaultReader([]string{dir}, key)
+		if bytes.Equal(first, vaultBytes(t, v, err)) {
+			t.Fatal("Two vaults are the same")
+		}
+	})
+
+	t.Run("Bad nonce", func(t *testing.T) {
+		for _, n := range [][]byte{nil, {}, []byte("short"), []byte("more than 8 bytes")} {
+			if v, err := NewVaultReaderDeterministic([]string{dir}, key, n); err == nil {
+				v.Close()
+				t.Fatalf("A nonce of %d bytes was taken", len(n))
+			}
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+)
+
+// The largest VaultBuilder.Dictionary, so that sealed it
+// still fits in a header extension
+const maxDictionarySize = 60 << 10
+
+var errDictionaryTooLarge = fmt.Errorf("arcsek: the dictionary is larger than %d bytes", maxDictionarySize)
+
+// What the dictionary is sealed with, so it can't pass for
+// another field sealed with the key
+var dictionaryAD = []byte("arcsek dictionary")
+
+// Encrypt the dictionary with the AEAD of the vault, like
+// sealInfo. The header it is stored in is authenticated by
+// the info and the body, so it can't be swapped either
+func sealDictionary(aead cipher.AEAD, dict, nonce []byte) ([]byte, error) {
+	if nonce == nil {
+		var err error
+		if nonce, err = newNonce(aead.NonceSize()); err != nil {
+			return nil, err
+		}
+	}
+
+	return aead.Seal(bytes.Clone(nonce), nonce, dict, dictionaryAD), nil
+}
+
+// Decrypt and authenticate the dictionary sealed by
+// sealDictionary
+func openDictionary(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	ns := aead.NonceSize()
+	if len(sealed) < ns {
+		return nil, errors.New("arcsek: malformed dictionary in the header")
+	}
+
+	dict, err := aead.Open(nil, sealed[:ns], sealed[ns:], dictionaryAD)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+
+	return dict, nil
+}
+
+// The compressor of the builder, with its dictionary
+func (b *VaultBuilder) compressor() (compressor, error) {
+	return b.Compression.compressorWithDictionary(b.Dictionary)
+}
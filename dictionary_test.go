@@ -0,0 +1,178 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+
+	zstddict "github.com/klauspost/compress/dict"
+)
+
+// The configs of a host of a fleet, which only differ in the
+// names and addresses
+func hostFiles(host int) map[string]string {
+	return map[string]string{
+		"etc/hostname": fmt.Sprintf("node-%03d.cluster.example.com\n", host),
+		"etc/app/app.yaml": fmt.Sprintf(`server:
+  listen: 10.0.%d.%d:8443
+  workers: 16
+  read_timeout: 30s
+  write_timeout: 30s
+tls:
+  cert: /etc/app/tls/node-%03d.crt
+  key: /etc/app/tls/node-%03d.key
+  min_version: "1.3"
+logging:
+  level: info
+  format: json
+  output: /var/log/app/app.log
+database:
+  host: db.cluster.example.com
+  port: 5432
+  pool_size: 32
+  sslmode: verify-full
+`, host/256, host%256, host, host),
+		"etc/app/env": fmt.Sprintf("NODE_ID=node-%03d\nREGION=eu-west-1\nCLUSTER=prod\nMETRICS_ADDR=10.0.%d.%d:9100\n", host, host/256, host%256),
+	}
+}
+
+// The configs of the host as entries, sorted by name
+func hostConfigs(host int) []Entry {
+	files := hostFiles(host)
+
+	var entries []Entry
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		entries = append(entries, entry(name, files[name]))
+	}
+	return entries
+}
+
+func TestDictionary(t *testing.T) {
+	key := genKey("dictionary")
+
+	// The dictionary is the configs of another host
+	var dict []byte
+	for _, body := range hostFiles(0) {
+		dict = append(dict, body...)
+	}
+
+	seal := func(b VaultBuilder, entries []Entry) []byte {
+		v, err := b.BuildEntries(entries, key)
+		return vaultBytes(t, v, err)
+	}
+
+	t.Run("Ratio", func(t *testing.T) {
+		archiveSize := func(b VaultBuilder) int64 {
+			info, err := ReadVaultInfo(bytes.NewReader(seal(b, hostConfigs(1))), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return info.ArchiveSize
+		}
+
+		// Most of the configs are in the dictionary. It is the
+		// archive that shrinks, the header grows by the
+		// sealed dictionary
+		plain := archiveSize(VaultBuilder{Compression: Zstd})
+		primed := archiveSize(VaultBuilder{Compression: Zstd, Dictionary: dict})
+		if primed >= plain/2 {
+			t.Fatalf("The archive with the dictionary has %d bytes and the one without %d", primed, plain)
+		}
+	})
+
+	t.Run("Round trip", func(t *testing.T) {
+		vault := seal(VaultBuilder{Compression: Zstd, Dictionary: dict}, hostConfigs(7))
+
+		vh, err := InspectVault(bytes.NewReader(vault))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !vh.Dictionary {
+			t.Fatal("The header has no dictionary")
+		}
+
+		checkHostConfigs(t, vault, key, 7)
+	})
+
+	t.Run("Trained", func(t *testing.T) {
+		var samples [][]byte
+		for host := 10; host < 50; host++ {
+			for _, body := range hostFiles(host) {
+				samples = append(samples, []byte(body))
+			}
+		}
+
+		trained, err := zstddict.BuildZstdDict(samples, zstddict.Options{MaxDictSize: 4 << 10, HashBytes: 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isZstdDictionary(trained) {
+			t.Fatal("The trained dictionary is not in the zstd format")
+		}
+
+		checkHostConfigs(t, seal(VaultBuilder{Compression: Zstd, Dictionary: trained}, hostConfigs(2)), key, 2)
+	})
+
+	t.Run("Rekey", func(t *testing.T) {
+		vault := seal(VaultBuilder{Compression: Zstd, Dictionary: dict}, hostConfigs(3))
+
+		newKey := genKey("dictionary rekeyed")
+		v, err := Rekey(bytes.NewReader(vault), key, newKey)
+		checkHostConfigs(t, vaultBytes(t, v, err), newKey, 3)
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		vault := seal(VaultBuilder{Compression: Zstd, Dictionary: dict}, hostConfigs(4)[:2])
+
+		v, err := AppendToVault(bytes.NewReader(vault), key, hostConfigs(4)[2:])
+		checkHostConfigs(t, vaultBytes(t, v, err), key, 4)
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		vault := seal(VaultBuilder{Compression: Zstd, Dictionary: dict}, hostConfigs(5))
+
+		if _, err := NewTarReader(bytes.NewReader(vault), genKey("another key")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Opened with the wrong key: %v", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		testCases := map[string]VaultBuilder{
+			"Gzip":      {Dictionary: dict},
+			"None":      {Compression: None, Dictionary: dict},
+			"Too large": {Compression: Zstd, Dictionary: make([]byte, maxDictionarySize+1)},
+		}
+
+		for name, b := range testCases {
+			t.Run(name, func(t *testing.T) {
+				if _, err := b.BuildEntries(hostConfigs(6), key); err == nil {
+					t.Fatal("Sealed with an invalid dictionary")
+				}
+			})
+		}
+	})
+}
+
+// Check the vault holds the configs of the host
+func checkHostConfigs(t *testing.T, vault, key []byte, host int) {
+	t.Helper()
+
+	names, contents, err := readEntries(bytes.NewReader(vault), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := hostFiles(host)
+	if len(names) != len(want) {
+		t.Fatalf("The vault has %v", names)
+	}
+
+	for name, body := range want {
+		if contents[name] != body {
+			t.Fatalf("%s has %q instead of %q", name, contents[name], body)
+		}
+	}
+}
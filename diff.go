@@ -0,0 +1,181 @@
+package arcsek
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// ErrBaseMismatch is returned by ApplyDifferential when the
+// base vault is not the one the differential vault was
+// built on
+var ErrBaseMismatch = errors.New("arcsek: the vault is not the base of the differential vault")
+
+var errNotDifferential = errors.New("arcsek: not a differential vault")
+
+// ManifestID identifies a manifest, and so the vault it was
+// read from. It is the SHA-256 of the entries, recorded in
+// the header of the differential vaults built on it, see
+// VaultHeader.BaseManifest
+func ManifestID(entries []ManifestEntry) []byte {
+	h := sha256.New()
+	h.Write([]byte("arcsek manifest\x00"))
+
+	var n [8]byte
+	field := func(b []byte) {
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	number := func(v uint64) {
+		binary.BigEndian.PutUint64(n[:], v)
+		h.Write(n[:])
+	}
+
+	for _, e := range entries {
+		field([]byte(e.Name))
+		number(uint64(e.Size))
+		number(uint64(e.Mode))
+		number(uint64(e.ModTime.UnixNano()))
+		field(e.SHA256)
+	}
+
+	return h.Sum(nil)
+}
+
+// The entries of a manifest by name
+func manifestByName(entries []ManifestEntry) map[string]ManifestEntry {
+	byName := make(map[string]ManifestEntry, len(entries))
+	for _, e := range entries {
+		byName[e.Name] = e
+	}
+	return byName
+}
+
+// Whether the file of the entry is not the one in the base.
+// Only regular files are left out of differential vaults
+func changedSince(base map[string]ManifestEntry, e ManifestEntry) bool {
+	old, ok := base[e.Name]
+	return !ok || !e.Mode.IsRegular() || old.Mode != e.Mode || old.Size != e.Size ||
+		!old.ModTime.Equal(e.ModTime) || !bytes.Equal(old.SHA256, e.SHA256)
+}
+
+// ApplyDifferential restores to dest the files of a
+// differential vault, see VaultBuilder.BaseManifest: the
+// base vault is extracted, then the files of diff over it,
+// and the ones that are not in the manifest of diff are
+// removed. Both vaults are opened with the key.
+//
+// The base must be the vault the differential one was built
+// on, or it fails with ErrBaseMismatch before writing
+// anything
+func ApplyDifferential(base, diff io.Reader, key []byte, dest string) error {
+	return new(VaultOpener).ApplyDifferential(base, diff, key, dest)
+}
+
+// ApplyDifferential is like the ApplyDifferential function
+// but opens the vaults with the settings of the opener. With
+// SafeExtract both are extracted to a staging directory
+// first, so dest is left as it was if either fails
+func (o *VaultOpener) ApplyDifferential(base, diff io.Reader, key []byte, dest string) error {
+	diff, err := unarmor(diff)
+	if err != nil {
+		return err
+	}
+
+	// The header is given back to open the vault
+	h, raw, err := parseHeader(diff)
+	if err != nil {
+		return err
+	}
+	if h.base == nil {
+		return errNotDifferential
+	}
+
+	dtr, err := o.Open(io.MultiReader(bytes.NewReader(raw), diff), key)
+	if err != nil {
+		return err
+	}
+	defer dtr.Close()
+
+	btr, err := o.Open(base, key)
+	if err != nil {
+		return err
+	}
+	defer btr.Close()
+
+	// Both manifests come first
+	for _, tr := range []*TarReader{dtr, btr} {
+		if err = tr.start(); err != nil && err != io.EOF {
+			return err
+		}
+		if tr.manifest == nil {
+			return ErrNoManifest
+		}
+	}
+
+	if !bytes.Equal(ManifestID(btr.manifest), h.base) {
+		return ErrBaseMismatch
+	}
+
+	apply := func(d *dirCreator) error {
+		for _, tr := range []*TarReader{btr, dtr} {
+			if _, err := extractEntries(context.Background(), tr, d); err != nil {
+				return err
+			}
+
+			if err := verifyTar(tr); err != nil {
+				return err
+			}
+		}
+
+		if err := d.finish(); err != nil {
+			return err
+		}
+
+		return d.removeMissing(btr.manifest, dtr.manifest)
+	}
+
+	if !o.SafeExtract {
+		return apply(&dirCreator{dest: dest, opener: o})
+	}
+
+	if err = o.staged(dest, apply); err != nil {
+		return err
+	}
+
+	// What was removed may have been in dest already
+	return (&dirCreator{dest: dest, opener: o}).removeMissing(btr.manifest, dtr.manifest)
+}
+
+// Remove the entries of the base that are not in the manifest
+// of the differential vault, the deepest first
+func (d *dirCreator) removeMissing(base, diff []ManifestEntry) error {
+	kept := manifestByName(diff)
+
+	var removed []string
+	for _, e := range base {
+		if _, ok := kept[e.Name]; !ok {
+			removed = append(removed, e.Name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+
+	for _, name := range removed {
+		path, err := d.path(name)
+		if err != nil {
+			return err
+		}
+
+		if err = os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestDifferential(t *testing.T) {
+	key := genKey("differential")
+
+	src := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "first")
+	write("b.txt", "second")
+	write("c.txt", "third")
+
+	b := VaultBuilder{Manifest: true}
+	v, err := b.Build([]string{src}, key)
+	base := vaultBytes(t, v, err)
+
+	manifest, err := ReadManifest(bytes.NewReader(base), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("b.txt", "second, changed")
+	later := time.Now().Add(time.Hour)
+	if err = os.Chtimes(filepath.Join(src, "b.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	b = VaultBuilder{BaseManifest: manifest}
+	v, err = b.Build([]string{src}, key)
+	diff := vaultBytes(t, v, err)
+
+	t.Run("Only the changed file", func(t *testing.T) {
+		_, contents, err := readEntries(bytes.NewReader(diff), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(contents) != 1 || contents["b.txt"] != "second, changed" {
+			t.Fatalf("The differential vault has %v", contents)
+		}
+
+		// All the files are in its manifest
+		entries, err := ReadManifest(bytes.NewReader(diff), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(manifest) {
+			t.Fatalf("The manifest has %d entries instead of %d", len(entries), len(manifest))
+		}
+	})
+
+	t.Run("Header", func(t *testing.T) {
+		vh, err := InspectVault(bytes.NewReader(diff))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(vh.BaseManifest, ManifestID(manifest)) {
+			t.Fatalf("The base is %x instead of %x", vh.BaseManifest, ManifestID(manifest))
+		}
+
+		vh, err = InspectVault(bytes.NewReader(base))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vh.BaseManifest != nil {
+			t.Fatalf("A full vault has the base %x", vh.BaseManifest)
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		dest := t.TempDir()
+		if err := ApplyDifferential(bytes.NewReader(base), bytes.NewReader(diff), key, dest); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, want := range map[string]string{"a.txt": "first", "b.txt": "second, changed", "c.txt": "third"} {
+			got, err := os.ReadFile(filepath.Join(dest, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Fatalf("%s has %q instead of %q", name, got, want)
+			}
+		}
+	})
+
+	t.Run("Removed file", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(src, "c.txt")); err != nil {
+			t.Fatal(err)
+		}
+		defer write("c.txt", "third")
+
+		v, err := b.Build([]string{src}, key)
+		diff := vaultBytes(t, v, err)
+
+		dest := t.TempDir()
+		if err = ApplyDifferential(bytes.NewReader(base), bytes.NewReader(diff), key, dest); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = os.Stat(filepath.Join(dest, "c.txt")); !os.IsNotExist(err) {
+			t.Fatalf("The removed file is still there: %v", err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dest, "a.txt")); err != nil || string(got) != "first" {
+			t.Fatalf("a.txt has %q: %v", got, err)
+		}
+	})
+
+	t.Run("Wrong base", func(t *testing.T) {
+		other := VaultBuilder{Manifest: true}
+		v, err := other.Build([]string{"testing-files/in/existance/testfile1.txt"}, key)
+		wrong := vaultBytes(t, v, err)
+
+		err = ApplyDifferential(bytes.NewReader(wrong), bytes.NewReader(diff), key, t.TempDir())
+		if !errors.Is(err, ErrBaseMismatch) {
+			t.Fatalf("Applied over the wrong base: %v", err)
+		}
+
+		err = ApplyDifferential(bytes.NewReader(base), bytes.NewReader(base), key, t.TempDir())
+		if err == nil {
+			t.Fatal("Applied a full vault")
+		}
+	})
+}
+
+// The builders that write no manifest can't seal a
+// differential vault, ApplyDifferential would fail on it
+func TestDifferentialUnsupported(t *testing.T) {
+	key := genKey("differential")
+	base := []ManifestEntry{{Name: "a.txt", Size: 1, Mode: 0644}}
+	fsys := fstest.MapFS{"a.txt": {Data: []byte("a"), Mode: 0644}}
+
+	builders := []struct {
+		name    string
+		builder VaultBuilder
+	}{
+		{"Manifest", VaultBuilder{Manifest: true}},
+		{"Base manifest", VaultBuilder{BaseManifest: base}},
+	}
+
+	for _, tc := range builders {
+		t.Run(tc.name, func(t *testing.T) {
+			if v, err := tc.builder.BuildFS(fsys, []string{"."}, key); err == nil {
+				v.Close()
+				t.Fatal("BuildFS sealed a vault without its manifest")
+			}
+
+			entries := []Entry{{Name: "a.txt", Size: 1, Body: strings.NewReader("a")}}
+			if v, err := tc.builder.BuildEntries(entries, key); err == nil {
+				v.Close()
+				t.Fatal("BuildEntries sealed a vault without its manifest")
+			}
+		})
+	}
+}
+
+func TestDifferentialSafeExtract(t *testing.T) {
+	key := genKey("differential safe extract")
+
+	src := t.TempDir()
+	write := func(name string, body []byte) {
+		if err := os.WriteFile(filepath.Join(src, name), body, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", []byte("first"))
+	write("old.txt", []byte("removed later"))
+
+	b := VaultBuilder{Compression: None, Manifest: true}
+	v, err := b.Build([]string{src}, key)
+	base := vaultBytes(t, v, err)
+
+	manifest, err := ReadManifest(bytes.NewReader(base), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The changed file is in the first chunks and the new
+	// one spans many after it
+	data := make([]byte, 256<<10)
+	if _, err = rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	write("a.txt", []byte("first, changed"))
+	later := time.Now().Add(time.Hour)
+	if err = os.Chtimes(filepath.Join(src, "a.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	write("z.bin", data)
+	if err = os.Remove(filepath.Join(src, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	b = VaultBuilder{Compression: None, BaseManifest: manifest}
+	v, err = b.Build([]string{src}, key)
+	diff := vaultBytes(t, v, err)
+
+	o := VaultOpener{SafeExtract: true}
+
+	t.Run("Tampered", func(t *testing.T) {
+		tampered := bytes.Clone(diff)
+		tampered[len(tampered)-1] ^= 1
+
+		dest := t.TempDir()
+		if err := o.ApplyDifferential(bytes.NewReader(base), bytes.NewReader(tampered), key, dest); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+
+		entries, err := os.ReadDir(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("The destination is not empty: %v", entries)
+		}
+	})
+
+	t.Run("Applied", func(t *testing.T) {
+		// The removed file is there from a previous restore
+		dest := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dest, "old.txt"), []byte("removed later"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.ApplyDifferential(bytes.NewReader(base), bytes.NewReader(diff), key, dest); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, want := range map[string][]byte{"a.txt": []byte("first, changed"), "z.bin": data} {
+			got, err := os.ReadFile(filepath.Join(dest, name))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("%s has the wrong contents, %v", name, err)
+			}
+		}
+
+		entries, err := os.ReadDir(dest)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("Expected a.txt and z.bin but got %v, %v", entries, err)
+		}
+	})
+}
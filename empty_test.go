@@ -0,0 +1,140 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmptyEntries(t *testing.T) {
+	key := genKey("empty")
+
+	src := t.TempDir()
+	for _, dir := range []string{"empty dir", "nested/empty"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"empty.txt", "nested/empty.txt"} {
+		if err := os.WriteFile(filepath.Join(src, file), nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The type each entry must have in the tar
+	want := map[string]byte{
+		"empty dir/":       tar.TypeDir,
+		"empty.txt":        tar.TypeReg,
+		"nested/":          tar.TypeDir,
+		"nested/empty/":    tar.TypeDir,
+		"nested/empty.txt": tar.TypeReg,
+	}
+
+	testCases := []struct {
+		name    string
+		builder VaultBuilder
+	}{
+		{"Default", VaultBuilder{}},
+		{"Concurrency", VaultBuilder{Concurrency: 4}},
+		{"Deduplicate", VaultBuilder{Deduplicate: true}},
+		{"No compression", VaultBuilder{Compression: None}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := tc.builder.Build([]string{src}, key)
+			vault := vaultBytes(t, v, err)
+
+			checkEmptyEntries(t, vault, key, want)
+
+			dest := t.TempDir()
+			n, err := ExtractTo(bytes.NewReader(vault), key, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Fatalf("%d files were extracted instead of 2", n)
+			}
+
+			for name, typ := range want {
+				stat, err := os.Lstat(filepath.Join(dest, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				switch {
+				case typ == tar.TypeDir && !stat.IsDir():
+					t.Fatalf("%s is not a directory but %v", name, stat.Mode())
+				case typ == tar.TypeReg && (!stat.Mode().IsRegular() || stat.Size() != 0):
+					t.Fatalf("%s is not an empty file but %v of %d bytes", name, stat.Mode(), stat.Size())
+				}
+			}
+
+			// Nothing was put in the empty directory
+			entries, err := os.ReadDir(filepath.Join(dest, "empty dir"))
+			if err != nil || len(entries) != 0 {
+				t.Fatalf("Expected an empty directory but got %v, %v", entries, err)
+			}
+		})
+	}
+
+	t.Run("Without recursion", func(t *testing.T) {
+		b := VaultBuilder{DisableRecursion: true, BaseDir: src}
+		v, err := b.Build([]string{filepath.Join(src, "empty dir"), filepath.Join(src, "empty.txt")}, key)
+		vault := vaultBytes(t, v, err)
+
+		checkEmptyEntries(t, vault, key, map[string]byte{"empty dir/": tar.TypeDir, "empty.txt": tar.TypeReg})
+	})
+
+	t.Run("FS", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"empty.txt": {Mode: 0600},
+			"empty dir": {Mode: os.ModeDir | 0700},
+		}
+
+		v, err := NewVaultReaderFS(fsys, []string{"."}, key)
+		vault := vaultBytes(t, v, err)
+
+		checkEmptyEntries(t, vault, key, map[string]byte{"empty dir/": tar.TypeDir, "empty.txt": tar.TypeReg})
+	})
+}
+
+// Check the vault holds exactly the entries of want, with
+// their type and no contents
+func checkEmptyEntries(t *testing.T, vault, key []byte, want map[string]byte) {
+	t.Helper()
+
+	tr, err := NewTarReader(bytes.NewReader(vault), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	seen := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		typ, ok := want[hdr.Name]
+		if !ok {
+			t.Fatalf("Unexpected entry %q", hdr.Name)
+		}
+		if hdr.Typeflag != typ || hdr.Size != 0 || hdr.Linkname != "" {
+			t.Fatalf("%s has the type %q, size %d and link %q", hdr.Name, hdr.Typeflag, hdr.Size, hdr.Linkname)
+		}
+		seen++
+	}
+
+	if seen != len(want) {
+		t.Fatalf("The vault has %d entries instead of %d", seen, len(want))
+	}
+}
@@ -1,41 +1,276 @@
 package arcsek
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
 
 	"github.com/secure-io/sio-go"
 )
 
 // VaultReader is amazing :D
 //
+// It reads the whole vault, header included, so it can be
+// copied anywhere as it is,
 // but also implements io.Closer by deleting the underlying
 // temporal clean file.
-// It also stores the nonce if you need to use it later
+// It also stores the nonce if you need to use it later.
+// Its length depends on the cipher suite
 //
 // It is important to close the vault in order to prevent
 // the retrieval of the plain data from the temporal dir.
 type VaultReader struct {
 	*sio.EncReader
 	tmpFile *os.File
-	Nonce   []byte
+	nonce   []byte
+
+	// The archive of memory-backed vaults
+	data []byte
+
+	// Set if the archive is encrypted as it is read from
+	// another vault, like by Rekey. Then it is neither in
+	// memory nor in a temporal file
+	streamed bool
+
+	// The serialized header and how much of it was written
+	header    []byte
+	headerOff int
+
+	// The associated data of the body, the header and the
+	// one of the builder
+	ad []byte
+
+	// Size of the compressed tar
+	size int64
+
+	// Encrypts the archive again for DetachedMAC and Seek
+	stream *sio.Stream
+
+	// How much of the encrypted archive was read, and if
+	// Seek moved it so the next read has to go there first
+	bodyOff int64
+	seeked  bool
+
+	// Set by the first Close
+	closed bool
+
+	log Logger
+}
+
+// ArchiveSize returns the number of plain bytes, the
+// compressed tar, that are fed into the encryption.
+// The encrypted output is slightly larger.
+//
+// It returns -1 if the size is not known
+func (v *VaultReader) ArchiveSize() int64 {
+	return v.size
+}
+
+// Nonce returns a copy of the random nonce the vault is
+// sealed with, so it can be logged. It is also stored
+// in the Header.
+//
+// A new nonce is read from crypto/rand for every vault and
+// it cannot be chosen. Reusing a key and nonce pair would
+// be catastrophic for GCM
+func (v *VaultReader) Nonce() []byte {
+	return append([]byte(nil), v.nonce...)
+}
+
+// Header returns the bytes stored in front of the
+// encrypted data so the vault can be opened later.
+// WriteTo already writes them.
+//
+// It starts with the "ARCSEK" magic and the format version,
+// followed by the cipher suite, the compression, how the
+// key was derived from a password, if it was, and the nonce
+func (v *VaultReader) Header() []byte {
+	return append([]byte(nil), v.header...)
+}
+
+// Read reads the whole vault: first the header and then
+// the encrypted archive, like WriteTo
+func (v *VaultReader) Read(p []byte) (int, error) {
+	if err := v.reposition(); err != nil {
+		return 0, err
+	}
+
+	if v.headerOff < len(v.header) {
+		n := copy(p, v.header[v.headerOff:])
+		v.headerOff += n
+		return n, nil
+	}
+
+	n, err := v.EncReader.Read(p)
+	v.bodyOff += int64(n)
+	return n, err
+}
+
+// WriteTo writes the whole vault to w: the header and then
+// the encrypted archive, so io.Copy(dst, vault) produces a
+// vault that can be opened as it is. It returns the number
+// of bytes written, the header included.
+//
+// If w fails, the bytes it took are counted and the error
+// is returned. A failure within the header can be resumed
+// by calling WriteTo again, but the encryption stops at the
+// first failure within the body
+func (v *VaultReader) WriteTo(w io.Writer) (int64, error) {
+	if err := v.reposition(); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if rest := v.header[v.headerOff:]; len(rest) > 0 {
+		nn, err := w.Write(rest)
+		v.headerOff += nn
+		n += int64(nn)
+
+		if err == nil && nn < len(rest) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// sio doesn't count the bytes of a failed write
+	cw := &countingWriter{w: w}
+	_, err := v.EncReader.WriteTo(cw)
+	v.bodyOff += cw.n
+	return n + cw.n, err
+}
+
+// ErrNotSeekable is returned by Seek on vaults that are
+// kept in memory
+var ErrNotSeekable = errors.New("arcsek: only vaults in a temporal file can seek")
+
+// Seek implements io.Seeker for vaults in a temporal file,
+// so an upload that failed can rewind and resume. The
+// encryption is deterministic for the nonce of the vault,
+// so the bytes read again are the same.
+//
+// Seeking is cheap but the next read after it encrypts the
+// archive from the start up to the offset. Vaults in
+// memory return ErrNotSeekable
+func (v *VaultReader) Seek(offset int64, whence int) (int64, error) {
+	if v.tmpFile == nil || v.stream == nil {
+		return 0, ErrNotSeekable
+	}
+
+	hlen := int64(len(v.header))
+	pos := int64(v.headerOff) + v.bodyOff
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pos
+	case io.SeekEnd:
+		offset += hlen + v.size + v.stream.Overhead(v.size)
+	default:
+		return pos, errors.New("arcsek: invalid whence")
+	}
+
+	if offset < 0 {
+		return pos, errors.New("arcsek: negative position")
+	}
+
+	if offset != pos {
+		v.headerOff = int(min(offset, hlen))
+		v.bodyOff = max(offset-hlen, 0)
+		v.seeked = true
+	}
+
+	return offset, nil
+}
+
+// Encrypt the archive again up to where Seek left the body
+func (v *VaultReader) reposition() error {
+	if !v.seeked {
+		return nil
+	}
+	v.seeked = false
+
+	// Reading at offsets leaves the file where it is
+	src := io.NewSectionReader(v.tmpFile, 0, v.size)
+	v.EncReader = v.stream.EncryptReader(src, v.nonce, v.ad)
+
+	if _, err := io.CopyN(io.Discard, v.EncReader, v.bodyOff); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// InMemory reports whether the archive is held in memory
+// instead of a temporal file. Closing such a vault does
+// not touch the disk
+func (v *VaultReader) InMemory() bool {
+	return v.tmpFile == nil && !v.streamed
 }
 
 // Close errases the underlying tempora
 // file to prevent it's retrieval by an attacker
 // and save disk space
+//
+// If the vault is in memory, the archive is overwritten
+// with zeros instead.
+//
+// Only the first call does something, so a deferred Close
+// after an explicit one is fine. Later calls return nil
 func (v *VaultReader) Close() error {
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	runtime.SetFinalizer(v, nil)
+
+	log := v.log
+	if log == nil {
+		log = nopLogger{}
+	}
+
+	if v.tmpFile == nil {
+		Wipe(v.data)
+		v.data = nil
+		log.Debugf("arcsek: wiped the archive in memory")
+		return nil
+	}
+
 	// We have to remove the file from the
 	// disk. Once we do this we wont be able to
 	// read from it again
 	if err := v.tmpFile.Close(); err != nil {
+		log.Warnf("arcsek: closing the temporal file %s: %v", v.tmpFile.Name(), err)
+		return err
+	}
+
+	if err := os.Remove(v.tmpFile.Name()); err != nil {
+		log.Warnf("arcsek: the temporal file %s could not be deleted: %v", v.tmpFile.Name(), err)
 		return err
 	}
-	return os.Remove(v.tmpFile.Name())
+
+	log.Debugf("arcsek: deleted the temporal file %s", v.tmpFile.Name())
+	return nil
+}
+
+// Run by the garbage collector on a vault that was never
+// closed, so its temporal file does not stay until reboot.
+// It is only a backstop, the caller still has to Close
+func (v *VaultReader) finalize() {
+	if v.closed {
+		return
+	}
+
+	if v.log != nil {
+		v.log.Warnf("arcsek: a vault was not closed, deleting its temporal file %s", v.tmpFile.Name())
+	}
+	v.Close()
 }
 
 // Create a GCM from the key
@@ -43,6 +278,10 @@ func (v *VaultReader) Close() error {
 //
 // Separated for better test coverage
 func createAESGCMFromKey(key []byte) (cipher.AEAD, error) {
+	if n := len(key); n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("%w: AES needs a 16, 24 or 32 byte key, got %d bytes", ErrInvalidKeyLength, n)
+	}
+
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -59,92 +298,121 @@ func createAESGCMFromKey(key []byte) (cipher.AEAD, error) {
 // length of the key. If a key of different length is
 // provided, it will return an error.
 //
+// The options change how the vault is sealed, see Option.
+//
 // It is important that you close this reader after you
 // are done with it to delete any plain data
 // that might be left
-func NewVaultReader(files []string, key []byte) (*VaultReader, error) {
-	// Get a temporal path from which we will create an
-	// encrypted reader
-	tmpPath, err := createTemporaryTarGz(files)
-	if err != nil {
-		return nil, err
-	}
-
-	// Open that file in read mode and encrypt its reader
-	tmpFile, err := os.Open(tmpPath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create an encrypted reader from that file
-	gcm, err := createAESGCMFromKey(key)
-	if err != nil {
-		return nil, err
-	}
-
-	// We can now create a vault thanks to sio
-	stream := sio.NewStream(gcm, sio.BufSize)
+func NewVaultReader(files []string, key []byte, opts ...Option) (*VaultReader, error) {
+	return newBuilder(opts).Build(files, key)
+}
 
-	ns := stream.NonceSize()
+// NewVaultReaderContext is like NewVaultReader but can be
+// cancelled, see VaultBuilder.BuildContext
+func NewVaultReaderContext(ctx context.Context, files []string, key []byte, opts ...Option) (*VaultReader, error) {
+	return newBuilder(opts).BuildContext(ctx, files, key)
+}
 
-	nonce := make([]byte, ns)
+// NewVaultReaderMem is like NewVaultReader but keeps the
+// compressed archive in memory instead of a temporal file.
+// Use it for small secrets that must never touch the disk.
+//
+// Closing the vault wipes the archive from memory
+func NewVaultReaderMem(files []string, key []byte) (*VaultReader, error) {
+	return (&VaultBuilder{InMemory: true}).Build(files, key)
+}
 
-	if _, err = io.ReadFull(rand.Reader, nonce[:ns]); err != nil {
-		return nil, err
-	}
+// EncryptTo packages the files and encrypts them with the
+// key straight into w, without a temporal file. See
+// VaultBuilder.EncryptTo
+func EncryptTo(w io.Writer, files []string, key []byte, opts ...Option) error {
+	return newBuilder(opts).EncryptTo(w, files, key)
+}
 
-	//fmt.Println(nonce)
+// NewVaultReaderPassword creates a new Vault reader like
+// NewVaultReader but derives an AES-256 key from the
+// password using scrypt with a random salt.
+//
+// The params and the salt are part of the Header so the
+// vault can be opened with NewTarReaderPassword knowing
+// only the password
+func NewVaultReaderPassword(files []string, password string, params ScryptParams) (*VaultReader, error) {
+	return (&VaultBuilder{KeyDeriver: params}).Build(files, []byte(password))
+}
 
-	// Use that stream to make an enc reader according to sio docs
-	er := stream.EncryptReader(tmpFile, nonce[:ns], nil)
+// NewVaultReaderArgon2 is like NewVaultReaderPassword but
+// derives the key with Argon2id. The length of the key,
+// and hence the AES variant, is set by params.KeyLen
+func NewVaultReaderArgon2(files []string, password string, params Argon2Params) (*VaultReader, error) {
+	return (&VaultBuilder{KeyDeriver: params}).Build(files, []byte(password))
+}
 
-	return &VaultReader{er, tmpFile, nonce}, nil
+// NewVaultReaderPBKDF2 is like NewVaultReaderPassword but
+// derives an AES-256 key with PBKDF2-HMAC-SHA256, for
+// environments that only allow FIPS validated primitives.
+//
+// The iteration count is stored in the vault. Counts below
+// 10000 are rejected
+func NewVaultReaderPBKDF2(files []string, password string, iterations int) (*VaultReader, error) {
+	return (&VaultBuilder{KeyDeriver: PBKDF2Params{iterations}}).Build(files, []byte(password))
 }
 
 // Simplifies the creation of a stream by just asking for
-// the key
-func createStreamFromKey(key []byte) (*sio.Stream, error) {
-	// We need a block cipher first
-	AESGCM, err := createAESGCMFromKey(key)
+// the suite and the key
+func createStreamFromKey(suite CipherSuite, key []byte) (*sio.Stream, error) {
+	// We need an AEAD first
+	aead, err := suite.newAEAD(key)
 	if err != nil {
 		return nil, err
 	}
 
-	// With that we can create a Stream
-	s := sio.NewStream(AESGCM, sio.BufSize)
+	return createStream(aead, 0)
+}
+
+// Create a stream from the AEAD with chunks of bufSize
+// bytes, or sio.BufSize if it is zero. sio panics if the
+// nonce is too short or the size is out of range so they
+// are checked here
+func createStream(aead cipher.AEAD, bufSize int) (*sio.Stream, error) {
+	if ns := aead.NonceSize(); ns < minAEADNonceSize || ns > maxAEADNonceSize {
+		return nil, fmt.Errorf("arcsek: AEAD nonce size must be between %d and %d bytes, got %d",
+			minAEADNonceSize, maxAEADNonceSize, ns)
+	}
+
+	if bufSize == 0 {
+		bufSize = sio.BufSize
+	}
+
+	if bufSize < 0 || bufSize > sio.MaxBufSize {
+		return nil, ErrInvalidBufferSize
+	}
 
-	return s, nil
+	return sio.NewStream(aead, bufSize), nil
 }
 
 // DecryptVault receives an io.Reader that contains
-// an encrypted content and it's nonce at the start
+// an encrypted content and its header at the start
 // of it.
 //
-// If the key is not 128, 192 or 256 bits
-// long it will cause an error. If the data cannot be
-// authenticated it will also return an error
+// The decrypted data is the tar as it was compressed
+// when the vault was sealed.
+//
+// If the key is not valid for the suite it will cause
+// an error. If the data cannot be authenticated it will
+// also return an error
 func DecryptVault(er io.Reader, key []byte) (*sio.DecReader, error) {
-	stream, err := createStreamFromKey(key)
+	dr, _, _, err := new(VaultOpener).decrypt(er, key)
 	if err != nil {
 		return nil, err
 	}
 
-	// We read the nonce from the er
-	nonce, err := readNonce(er, stream.NonceSize())
-	if err != nil {
-		return nil, err
-	}
-
-	fmt.Printf("The nonce is: %x\n", nonce)
-	// We use the key and the nonce to create a decrypted reader
-	dr := stream.DecryptReader(er, nonce, nil)
-
-	return dr, nil
+	return dr.dr, nil
 }
 
-// Gets the nonce from a reader containing encrypted data
+// Gets the nonce from a reader containing encrypted data.
+// A single Read may return less than the whole nonce
 func readNonce(er io.Reader, nonceSize int) ([]byte, error) {
 	n := make([]byte, nonceSize)
-	_, err := er.Read(n)
+	_, err := io.ReadFull(er, n)
 	return n, err
 }
@@ -2,12 +2,17 @@ package arcsek
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/secure-io/sio-go"
 )
@@ -41,7 +46,7 @@ func testNormalClose(t *testing.T) {
 
 	// It doesn't matter if we have an enc reader or not.
 	// We are testing delete on close
-	v := VaultReader{nil, tmpFile, nil}
+	v := VaultReader{tmpFile: tmpFile}
 	if !fileExists(tmpPath) {
 		t.Fatal("The file was not created")
 	}
@@ -57,6 +62,11 @@ func testNormalClose(t *testing.T) {
 		t.Fatalf("The file '%s' was not deleted on close", tmpPath)
 	}
 
+	// Like a deferred Close after an explicit one
+	if err = v.Close(); err != nil {
+		t.Fatalf("The second Close failed: %v", err)
+	}
+
 	t.Logf("The file %s was deleted", tmpPath)
 }
 
@@ -66,6 +76,23 @@ func TestVaultReader_Close(t *testing.T) {
 		t.Run(fmt.Sprintf("Normal Close() %dth", i+1), testNormalClose)
 	}
 
+	// Closing twice is no error, on disk or in memory
+	for _, mem := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Twice InMemory=%v", mem), func(t *testing.T) {
+			b := VaultBuilder{InMemory: mem}
+			v, err := b.Build([]string{"testing-files/in/existance/testfile1.txt"}, genKey("twice"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				if err = v.Close(); err != nil {
+					t.Fatalf("Close %d failed: %v", i+1, err)
+				}
+			}
+		})
+	}
+
 	// Now remove the file WHILE still in use to test the error
 	tmpFile, err := ioutil.TempFile(".", "*.tar.gz")
 	if err != nil {
@@ -76,7 +103,7 @@ func TestVaultReader_Close(t *testing.T) {
 
 	// It doesn't matter if we have an enc reader or not.
 	// We are testing delete on close
-	v := VaultReader{nil, tmpFile, nil}
+	v := VaultReader{tmpFile: tmpFile}
 	if !fileExists(tmpPath) {
 		t.Fatal("The file was not created")
 	}
@@ -97,6 +124,60 @@ func TestVaultReader_Close(t *testing.T) {
 	}
 }
 
+// Tells the test about warnings from the finalizer, which
+// runs in its own goroutine
+type warnLogger chan string
+
+func (l warnLogger) Debugf(format string, args ...interface{}) {}
+
+func (l warnLogger) Warnf(format string, args ...interface{}) {
+	select {
+	case l <- fmt.Sprintf(format, args...):
+	default:
+	}
+}
+
+func TestVaultReaderFinalizer(t *testing.T) {
+	dir := t.TempDir()
+	warnings := make(warnLogger, 1)
+
+	// The vault is dropped as soon as this returns
+	func() {
+		b := VaultBuilder{TempDir: dir, Logger: warnings}
+		if _, err := b.Build([]string{"testing-files/in/existance/testfile1.txt"}, genKey("leak")); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runtime.GC()
+
+		left, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(left) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("The temporal file of the dropped vault was not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case w := <-warnings:
+		if !strings.Contains(w, "not closed") {
+			t.Fatalf("Unexpected warning: %s", w)
+		}
+	default:
+		t.Fatal("The leaked vault was not logged")
+	}
+}
+
 // Test if the GCM can be created with a good or a bad key
 
 func TestMakeGCMFromKey(t *testing.T) {
@@ -141,8 +222,8 @@ func testMakeVaultBad(t *testing.T, tc vaultTC) {
 }
 
 func TestCreateVaultReader(t *testing.T) {
-	goodFiles, _ := lsDir("testing-files/in")
-	otherGoodFiles, _ := lsDir("testing-files/in/existance")
+	goodFiles, _ := ListDir("testing-files/in", false)
+	otherGoodFiles, _ := ListDir("testing-files/in/existance", false)
 	tests := []vaultTC{
 		{
 			"Good files good key",
@@ -192,7 +273,7 @@ func TestCreateVaultReader(t *testing.T) {
 
 func TestEncDec(t *testing.T) {
 	// Create a vault
-	files, _ := lsDir("testing-files/in")
+	files, _ := ListDir("testing-files/in", false)
 	k := genKey("xdxdxdxd")
 	vr, err := NewVaultReader(files, k)
 
@@ -205,7 +286,12 @@ func TestEncDec(t *testing.T) {
 
 	aes128gcm, _ := createAESGCMFromKey(k)
 	s := sio.NewStream(aes128gcm, sio.BufSize)
-	dr := s.DecryptReader(vr, vr.Nonce, nil)
+
+	// Skip the header, we already know the nonce
+	if _, err = io.ReadFull(vr, make([]byte, len(vr.Header()))); err != nil {
+		t.Fatal(err)
+	}
+	dr := s.DecryptReader(vr, vr.Nonce(), vr.Header())
 
 	// copy the decrypted version
 	tmp, err := ioutil.TempFile("testing-files/out", "dec-*-large.tar.gz")
@@ -235,7 +321,6 @@ func TestNewTarReader(t *testing.T) {
 	// Since we are only using less than a MB we can just
 	// put everything in memory
 	buff := bytes.NewBuffer(make([]byte, 0, 20))
-	buff.Write(vault.Nonce)
 
 	// This emulates an output file, we can now copy the enc data
 	vault.WriteTo(buff)
@@ -247,3 +332,398 @@ func TestNewTarReader(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestArchiveSize(t *testing.T) {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+	}
+	k := genKey("size")
+
+	vault, err := NewVaultReader(files, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+
+	// The decrypted data is exactly what was fed to the encryption
+	dr, err := DecryptVault(buff, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := io.Copy(ioutil.Discard, dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != vault.ArchiveSize() {
+		t.Fatalf("Decrypted %d bytes but the archive size is %d", n, vault.ArchiveSize())
+	}
+}
+
+func TestNonceUniqueness(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	k := genKey("same key")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 64; i++ {
+		vault, err := NewVaultReader(files, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vault.Close()
+
+		nonce := vault.Nonce()
+		if bytes.Equal(nonce, make([]byte, len(nonce))) {
+			t.Fatal("The nonce is all zeros")
+		}
+
+		if seen[string(nonce)] {
+			t.Fatalf("The nonce %x was used twice", nonce)
+		}
+		seen[string(nonce)] = true
+
+		// Changing the copy must not change the vault
+		nonce[0]++
+		if bytes.Equal(nonce, vault.Nonce()) {
+			t.Fatal("The nonce of the vault can be modified")
+		}
+	}
+}
+
+func TestTarReaderClose(t *testing.T) {
+	key := genKey("close")
+
+	for _, c := range []Compression{Gzip, None, Zstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			b := VaultBuilder{Compression: c}
+			vault, err := b.Build([]string{"testing-files/in/existance/testfile1.txt"}, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			buff := new(bytes.Buffer)
+			vault.WriteTo(buff)
+
+			tr, err := NewTarReader(buff, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = tr.Next(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = tr.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// A second close does nothing
+			if err = tr.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestNewVaultReaderMem(t *testing.T) {
+	// Nothing must be written to the temporal dir
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+	}
+	k := genKey("memory")
+
+	vault, err := NewVaultReaderMem(files, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vault.InMemory() {
+		t.Fatal("The vault should be in memory")
+	}
+
+	if left, _ := ioutil.ReadDir(tmpDir); len(left) != 0 {
+		t.Fatalf("The vault wrote %d files to the temporal dir", len(left))
+	}
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+
+	if err = vault.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(vault.data, make([]byte, len(vault.data))) {
+		t.Fatal("Close did not wipe the archive")
+	}
+
+	if _, err = ExtractTo(buff, k, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Fails after accepting a few bytes
+type failingWriter struct {
+	left int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.left {
+		n := f.left
+		f.left = 0
+		return n, io.ErrShortWrite
+	}
+	f.left -= len(p)
+	return len(p), nil
+}
+
+func TestEncryptTo(t *testing.T) {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+	}
+	k := genKey("stream")
+
+	buff := new(bytes.Buffer)
+	if err := EncryptTo(buff, files, k); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ReadVaultInfo(bytes.NewReader(buff.Bytes()), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Files != -1 || info.Size != -1 {
+		t.Fatalf("A streamed vault can not know its info, got %+v", info)
+	}
+
+	n, err := ExtractTo(buff, k, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(files) {
+		t.Fatalf("Expected %d files, got %d", len(files), n)
+	}
+
+	// Errors of the writer reach the caller
+	if err = EncryptTo(&failingWriter{left: 100}, files, k); err == nil {
+		t.Fatal("The error of the writer was lost")
+	}
+}
+
+func TestVaultReaderWriteTo(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	k := genKey("write to")
+
+	vault, err := NewVaultReader(files, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	// io.Copy uses WriteTo, the result is a whole vault
+	buff := new(bytes.Buffer)
+	n, err := io.Copy(buff, vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buff.Len()) {
+		t.Fatalf("%d bytes were written but %d were reported", buff.Len(), n)
+	}
+
+	if !bytes.HasPrefix(buff.Bytes(), vault.Header()) {
+		t.Fatal("The vault does not start with its header")
+	}
+
+	if _, err = NewTarReaderNonce(buff, k); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultReaderWriteToFailing(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	k := genKey("write to")
+
+	// Fail within the header and within the body
+	for _, extra := range []int{-1000, -5, 10} {
+		t.Run(fmt.Sprint(extra), func(t *testing.T) {
+			vault, err := NewVaultReader(files, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			left := len(vault.Header()) + extra
+			if left < 0 {
+				left = 0
+			}
+
+			n, err := vault.WriteTo(&failingWriter{left: left})
+			if err == nil {
+				t.Fatal("The error of the writer was lost")
+			}
+
+			if n != int64(left) {
+				t.Fatalf("The writer took %d bytes but %d were reported", left, n)
+			}
+		})
+	}
+}
+
+// Reads a single byte at a time
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return b.r.Read(p[:1])
+}
+
+func TestVaultReaderRead(t *testing.T) {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+	}
+	k := genKey("read")
+
+	vault, err := NewVaultReader(files, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	// Hide WriteTo so only Read is used, one byte at a time
+	b, err := ioutil.ReadAll(byteReader{vault})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(b, vault.Header()) {
+		t.Fatal("The vault does not start with its header")
+	}
+
+	if _, err = ExtractTo(bytes.NewReader(b), k, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultReaderReadThenWriteTo(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	k := genKey("read")
+
+	vault, err := NewVaultReader(files, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	// Stop in the middle of the header and continue with WriteTo
+	buff := new(bytes.Buffer)
+	if _, err = io.CopyN(buff, byteReader{vault}, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = vault.WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ExtractTo(buff, k, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultReaderSeek(t *testing.T) {
+	k := genKey("seek")
+
+	// Random data so the body spans a few chunks
+	data := make([]byte, 100000)
+	rand.Read(data)
+	files := []string{filepath.Join(t.TempDir(), "random.bin")}
+	if err := ioutil.WriteFile(files[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vault, err := NewVaultReader(files, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	full, err := ioutil.ReadAll(vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if end, err := vault.Seek(0, io.SeekEnd); err != nil || end != int64(len(full)) {
+		t.Fatalf("The end is %d instead of %d: %v", end, len(full), err)
+	}
+
+	hlen := int64(len(vault.Header()))
+	testCases := []struct {
+		name   string
+		offset int64
+		whence int
+		want   int64
+	}{
+		{"Start", 0, io.SeekStart, 0},
+		{"Header", 3, io.SeekStart, 3},
+		{"Body", hlen + 20000, io.SeekStart, hlen + 20000},
+		{"Back", -100, io.SeekEnd, int64(len(full)) - 100},
+		{"End", 0, io.SeekEnd, int64(len(full))},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pos, err := vault.Seek(tc.offset, tc.whence)
+			if err != nil || pos != tc.want {
+				t.Fatalf("Expected to be at %d but got %d: %v", tc.want, pos, err)
+			}
+
+			if cur, _ := vault.Seek(0, io.SeekCurrent); cur != tc.want {
+				t.Fatalf("The current position is %d instead of %d", cur, tc.want)
+			}
+
+			rest, err := ioutil.ReadAll(vault)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(rest, full[tc.want:]) {
+				t.Fatal("The bytes read after seeking are different")
+			}
+		})
+	}
+
+	t.Run("Negative", func(t *testing.T) {
+		if _, err := vault.Seek(-1, io.SeekStart); err == nil {
+			t.Fatal("Seeking before the start should fail")
+		}
+	})
+
+	t.Run("Memory", func(t *testing.T) {
+		mem, err := NewVaultReaderMem(files, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mem.Close()
+
+		if _, err = mem.Seek(0, io.SeekStart); err != ErrNotSeekable {
+			t.Fatalf("Expected ErrNotSeekable but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Entry is a file of a vault that doesn't come from the
+// disk, like a rendered config or a database dump
+type Entry struct {
+	// Name of the file in the tar
+	Name string
+
+	// Size is the number of bytes Body yields. It must be
+	// exact, as the tar header is written before the body
+	Size int64
+
+	// Mode holds the permissions of the file. If zero,
+	// 0644 is used
+	Mode os.FileMode
+
+	// Body is read once while the vault is built. It may be
+	// nil for an empty file
+	Body io.Reader
+}
+
+// NewVaultReaderEntries is like NewVaultReader but seals
+// the entries without touching the file system for them.
+//
+// Reading an entry must yield exactly Size bytes, or
+// creating the vault fails
+func NewVaultReaderEntries(entries []Entry, key []byte, opts ...Option) (*VaultReader, error) {
+	return newBuilder(opts).BuildEntries(entries, key)
+}
+
+// Check the entries before doing any work
+func checkEntries(entries []Entry) error {
+	for _, e := range entries {
+		if e.Name == "" {
+			return errors.New("arcsek: entry without a name")
+		}
+
+		if e.Size < 0 || (e.Body == nil && e.Size != 0) {
+			return fmt.Errorf("arcsek: entry %s has an invalid size %d", e.Name, e.Size)
+		}
+	}
+
+	return nil
+}
+
+// The contents of an archive with the entries
+func (b *VaultBuilder) addEntries(entries []Entry) archiveContents {
+	return func(a *archiveWriter) error {
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+		}
+		a.progress = newProgress(b.Progress, total)
+		a.onFile, a.total = b.OnFile, len(entries)
+		a.maxFileSize, a.maxVaultSize = b.MaxFileSize, b.MaxVaultSize
+
+		if b.ObfuscateNames {
+			names := make([]string, len(entries))
+			for i, e := range entries {
+				names[i] = e.Name
+			}
+
+			if err := a.writeNames(names); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range entries {
+			if err := a.addEntry(e); err != nil {
+				return err
+			}
+		}
+
+		a.progress.finish()
+		return nil
+	}
+}
+
+// Add an entry to the archive, making sure its body has
+// the declared size
+func (a *archiveWriter) addEntry(e Entry) error {
+	mode := e.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     a.entryName(e.Name),
+		Size:     e.Size,
+		Mode:     int64(mode),
+		ModTime:  time.Now(),
+	}
+
+	if err := a.checkSize(e.Size); err != nil {
+		return fmt.Errorf("%s: %w", e.Name, err)
+	}
+
+	if err := a.claim(e.Name); err != nil {
+		return err
+	}
+
+	if err := a.begin(e.Name, e.Size); err != nil {
+		return err
+	}
+
+	paxLongNames(hdr)
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if e.Body != nil {
+		n, err := copyBuffer(a.body(a.tw), io.LimitReader(e.Body, e.Size))
+		if err != nil {
+			return err
+		}
+
+		if n < e.Size {
+			return fmt.Errorf("arcsek: entry %s has %d bytes but declares %d", e.Name, n, e.Size)
+		}
+
+		// There must be nothing left
+		if _, err = io.ReadFull(e.Body, make([]byte, 1)); err != io.EOF {
+			return fmt.Errorf("arcsek: entry %s has more than the %d bytes it declares", e.Name, e.Size)
+		}
+	}
+
+	a.info.Files++
+	a.info.Size += e.Size
+	return nil
+}
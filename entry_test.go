@@ -0,0 +1,72 @@
+package arcsek
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewVaultReaderEntries(t *testing.T) {
+	key := genKey("entries")
+	entries := []Entry{
+		{Name: "config.yml", Size: 9, Body: strings.NewReader("debug: no")},
+		{Name: "dumps/db.sql", Size: 13, Mode: 0600, Body: strings.NewReader("SELECT 1; --\n")},
+		{Name: "empty.txt"},
+	}
+
+	vault, err := NewVaultReaderEntries(entries, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+
+	dest := t.TempDir()
+	n, err := ExtractTo(buff, key, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(entries) {
+		t.Fatalf("Expected %d files, got %d", len(entries), n)
+	}
+
+	want := []string{"debug: no", "SELECT 1; --\n", ""}
+	for i, e := range entries {
+		b, err := ioutil.ReadFile(filepath.Join(dest, e.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != want[i] {
+			t.Fatalf("Expected '%s' in %s, got '%s'", want[i], e.Name, b)
+		}
+	}
+}
+
+func TestNewVaultReaderEntriesBadSize(t *testing.T) {
+	key := genKey("entries")
+	tests := []struct {
+		name  string
+		entry Entry
+	}{
+		{"Shorter body", Entry{Name: "a", Size: 10, Body: strings.NewReader("short")}},
+		{"Longer body", Entry{Name: "a", Size: 2, Body: strings.NewReader("longer")}},
+		{"Negative size", Entry{Name: "a", Size: -1, Body: strings.NewReader("")}},
+		{"Size without a body", Entry{Name: "a", Size: 1}},
+		{"No name", Entry{Size: 1, Body: strings.NewReader("a")}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if vault, err := NewVaultReaderEntries([]Entry{tc.entry}, key); err == nil {
+				vault.Close()
+				t.Fatal("The entry should have been rejected")
+			}
+		})
+	}
+}
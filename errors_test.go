@@ -0,0 +1,191 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSentinelErrors(t *testing.T) {
+	key := genKey("sentinels")
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	vault, err := NewVaultReaderEntries([]Entry{{Name: "a", Size: 1 << 16, Body: bytes.NewReader(make([]byte, 1<<16))}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := ioutil.ReadAll(vault)
+	vault.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Open the vault and read all of it
+	open := func(b []byte, key []byte) error {
+		tr, err := NewTarReader(bytes.NewReader(b), key)
+		if err != nil {
+			return err
+		}
+		defer tr.Close()
+
+		if _, err = tr.Next(); err != nil {
+			return err
+		}
+
+		_, err = io.Copy(ioutil.Discard, tr)
+		return err
+	}
+
+	tampered := append([]byte(nil), good...)
+	tampered[len(tampered)-100] ^= 1
+
+	testCases := []struct {
+		name  string
+		err   error
+		wants []error
+	}{
+		{"Short key", func() error { _, err := NewVaultReader(files, key[:10]); return err }(), []error{ErrInvalidKeyLength}},
+		{"Short AES key", func() error { _, err := createAESGCMFromKey(key[:20]); return err }(), []error{ErrInvalidKeyLength}},
+		{"Missing file", func() error { _, err := NewVaultReader([]string{"testing-files/in/missing.txt"}, key); return err }(), []error{ErrFileNotFound, fs.ErrNotExist}},
+		{"No files", func() error { _, err := NewVaultReader(nil, key); return err }(), []error{ErrEmptyFileList}},
+		{"Not a vault", open([]byte("definitely not a vault, just text"), key), []error{ErrBadMagic}},
+		{"Wrong key", open(good, genKey("other")), []error{ErrDecryptFailed}},
+		{"Tampered body", open(tampered, key), []error{ErrDecryptFailed}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, want := range tc.wants {
+				if !errors.Is(tc.err, want) {
+					t.Fatalf("Expected %v but got %v", want, tc.err)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncatedOrModified(t *testing.T) {
+	key := genKey("truncated")
+
+	// Not compressed, so the body has a few chunks
+	b := VaultBuilder{Compression: None, InMemory: true}
+	vault, err := b.BuildEntries([]Entry{{Name: "a", Size: 1 << 16, Body: bytes.NewReader(make([]byte, 1<<16))}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerLen := len(vault.Header())
+	good, err := ioutil.ReadAll(vault)
+	vault.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read all the vault, returning the first error
+	open := func(b []byte) error {
+		tr, err := NewTarReader(bytes.NewReader(b), key)
+		if err != nil {
+			return err
+		}
+		defer tr.Close()
+
+		if _, err = tr.Next(); err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+		return tr.Verify()
+	}
+
+	flip := func(i int) []byte {
+		b := append([]byte(nil), good...)
+		b[i] ^= 1
+		return b
+	}
+
+	// sio seals chunks of 16 KB and a 16 byte tag
+	chunk := 1<<14 + 16
+
+	testCases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"Empty", nil, ErrTruncated},
+		{"In the header", good[:headerLen-5], ErrTruncated},
+		{"Only the header", good[:headerLen], ErrTruncated},
+		{"In a chunk", good[:headerLen+chunk+100], ErrTruncated},
+		{"After a chunk", good[:headerLen+2*chunk], ErrTruncated},
+		{"Last byte", good[:len(good)-1], ErrTruncated},
+		{"First byte flipped", flip(headerLen), ErrAuthFailed},
+		{"Last byte flipped", flip(len(good) - 1), ErrAuthFailed},
+		{"Extra bytes", append(append([]byte(nil), good...), 0), ErrAuthFailed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := open(tc.data)
+			if !errors.Is(err, tc.want) || !errors.Is(err, ErrDecryptFailed) {
+				t.Fatalf("Expected %v but got %v", tc.want, err)
+			}
+
+			other := ErrAuthFailed
+			if tc.want == ErrAuthFailed {
+				other = ErrTruncated
+			}
+
+			if errors.Is(err, other) {
+				t.Fatalf("%v is also %v", err, other)
+			}
+		})
+	}
+
+	if err := open(good); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	key := genKey("empty")
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	testCases := []struct {
+		name  string
+		files []string
+		key   []byte
+		want  error
+	}{
+		{"Nil list", nil, key, ErrEmptyFileList},
+		{"Empty list", []string{}, key, ErrEmptyFileList},
+		{"Nil key", files, nil, ErrInvalidKeyLength},
+		{"Empty key", files, []byte{}, ErrInvalidKeyLength},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := VaultBuilder{TempDir: t.TempDir()}
+			if _, err := b.Build(tc.files, tc.key); !errors.Is(err, tc.want) {
+				t.Fatalf("Expected %v but got %v", tc.want, err)
+			}
+
+			// Nothing was written before failing
+			if left, _ := os.ReadDir(b.TempDir); len(left) != 0 {
+				t.Fatalf("A temporal file was created: %s", left[0].Name())
+			}
+
+			buff := new(bytes.Buffer)
+			if err := b.EncryptTo(buff, tc.files, tc.key); !errors.Is(err, tc.want) {
+				t.Fatalf("Expected %v but got %v", tc.want, err)
+			}
+
+			if buff.Len() != 0 {
+				t.Fatalf("%d bytes were written", buff.Len())
+			}
+		})
+	}
+}
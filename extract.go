@@ -0,0 +1,555 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafePath is returned when an entry of the archive
+// would be written outside of the destination directory
+var ErrUnsafePath = errors.New("arcsek: unsafe path in the archive")
+
+// ErrEntryNotFound is returned by ExtractFile and
+// RemoveFromVault when the archive has no entry with the name
+var ErrEntryNotFound = errors.New("arcsek: entry not found in the archive")
+
+// ExtractTo decrypts the vault in r and writes the files
+// in it to destDir, creating the directories as needed.
+// It returns the number of files written.
+//
+// Entries that would end up outside of destDir, like
+// "../passwd" or links pointing out of it, stop the
+// extraction with ErrUnsafePath.
+// The checksum of the archive is verified at the end.
+// To extract somewhere else see ExtractToCreator
+func ExtractTo(r io.Reader, key []byte, destDir string) (int, error) {
+	return new(VaultOpener).ExtractTo(r, key, destDir)
+}
+
+// ExtractToContext is like ExtractTo but stops once ctx is
+// done, returning its error. The file being written when
+// that happens is deleted, the ones before it are kept
+func ExtractToContext(ctx context.Context, r io.Reader, key []byte, destDir string) (int, error) {
+	return new(VaultOpener).ExtractToContext(ctx, r, key, destDir)
+}
+
+// ExtractTo is like the ExtractTo function but opens the
+// vault with the settings of the opener
+func (o *VaultOpener) ExtractTo(r io.Reader, key []byte, destDir string) (int, error) {
+	return o.ExtractToContext(context.Background(), r, key, destDir)
+}
+
+// ExtractToContext is like the ExtractToContext function
+// but opens the vault with the settings of the opener
+func (o *VaultOpener) ExtractToContext(ctx context.Context, r io.Reader, key []byte, destDir string) (int, error) {
+	if o.SafeExtract {
+		return o.safeExtract(ctx, r, key, destDir)
+	}
+
+	return o.extract(ctx, r, key, &dirCreator{dest: destDir, opener: o})
+}
+
+// Extract every entry of the vault with fc, counting the
+// files
+func (o *VaultOpener) extract(ctx context.Context, r io.Reader, key []byte, fc FileCreator) (int, error) {
+	tr, err := o.OpenContext(ctx, r, key)
+	if err != nil {
+		return 0, err
+	}
+	defer tr.Close()
+
+	files, err := extractEntries(ctx, tr, fc)
+	if err != nil {
+		return files, err
+	}
+
+	if d, ok := fc.(*dirCreator); ok {
+		if err = d.finish(); err != nil {
+			return files, err
+		}
+	}
+
+	return files, verifyTar(tr)
+}
+
+// Extract the entries left in tr with fc, counting the files
+func extractEntries(ctx context.Context, tr *TarReader, fc FileCreator) (int, error) {
+	files := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return files, err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+
+		file, err := extractEntry(fc, hdr, tr)
+		if err != nil {
+			return files, err
+		}
+
+		if file {
+			files++
+		}
+	}
+}
+
+// Verify the checksum of a tar read to the end
+func verifyTar(tr *TarReader) error {
+	// Legacy and streamed vaults have nothing to verify against
+	if tr.info == nil || !tr.info.known() {
+		return nil
+	}
+
+	return tr.Verify()
+}
+
+// The FileCreator of ExtractTo, which writes to a directory
+// of the disk. Besides creating the entries it restores what
+// the interface does not carry: times, owners, xattrs and
+// links
+type dirCreator struct {
+	dest   string
+	opener *VaultOpener
+
+	// Writing to a directory changes its modification time,
+	// so it is restored once everything is extracted
+	dirs []extractedDir
+
+	// dest is a staging directory, the directories are
+	// restored once moved out of it, see staged
+	staging bool
+}
+
+type extractedDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+// The path of the entry in dest. A link extracted before
+// could redirect it out of dest
+func (d *dirCreator) path(name string) (string, error) {
+	path, err := safeJoin(d.dest, name)
+	if err != nil {
+		return "", err
+	}
+
+	return path, checkNoSymlinks(d.dest, path)
+}
+
+// Create implements FileCreator
+func (d *dirCreator) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = prepareEntry(path); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+}
+
+// Mkdir implements FileCreator
+func (d *dirCreator) Mkdir(name string, mode os.FileMode) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	// A symlink left by a previous entry would be followed
+	// by MkdirAll, and later by the metadata of the dir
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	// The permissions are restored at the end, the contents
+	// must be written first
+	return os.MkdirAll(path, 0755)
+}
+
+// Extract the entry with everything it had
+func (d *dirCreator) extract(hdr *tar.Header, r io.Reader) (bool, error) {
+	path, err := d.path(hdr.Name)
+	if err != nil {
+		return false, err
+	}
+
+	var file bool
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err = d.Mkdir(hdr.Name, hdr.FileInfo().Mode()); err != nil {
+			return false, err
+		}
+		d.dirs = append(d.dirs, extractedDir{path, hdr})
+
+	case tar.TypeReg:
+		if err = d.writeFile(path, hdr, r); err != nil {
+			return false, err
+		}
+		file = true
+
+	case tar.TypeSymlink:
+		if err = extractSymlink(d.dest, path, hdr); err != nil {
+			return false, err
+		}
+
+	case tar.TypeLink:
+		if isCopy(hdr) {
+			if err = d.extractCopy(path, hdr); err != nil {
+				return false, err
+			}
+			file = true
+			break
+		}
+
+		if err = extractHardlink(d.dest, path, hdr); err != nil {
+			return false, err
+		}
+	}
+
+	// Anything else is not written by this package
+
+	if d.opener.PreserveOwnership {
+		if err = restoreOwner(path, hdr); err != nil {
+			return false, err
+		}
+	}
+
+	if d.opener.IncludeXattrs && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeDir) {
+		if err = restoreXattrs(path, hdr); err != nil {
+			return false, err
+		}
+	}
+
+	return file, nil
+}
+
+// Restore the directories once their contents are written.
+// In a staging directory it waits for them to be moved, a
+// read-only one could neither be moved nor removed
+func (d *dirCreator) finish() error {
+	if d.staging {
+		return nil
+	}
+	return d.restoreDirs(d.dest)
+}
+
+// Restore the directories extracted to d.dest, which are now
+// in dest
+func (d *dirCreator) restoreDirs(dest string) error {
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(d.dest, d.dirs[i].path)
+		if err != nil {
+			return err
+		}
+
+		if err = restoreMetadata(filepath.Join(dest, rel), d.dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractFile decrypts the vault in r and returns a reader
+// of the contents of the file with the name, as it was
+// archived. If there is no such file it returns
+// ErrEntryNotFound.
+//
+// The vault is a stream, so the entries before the file
+// are still decrypted and read, but nothing after it. A
+// deduplicated file is a copy of an earlier entry, which is
+// only found again if r is an io.Seeker
+func ExtractFile(r io.Reader, key []byte, name string) (io.ReadCloser, error) {
+	return new(VaultOpener).ExtractFile(r, key, name)
+}
+
+// ExtractFile is like the ExtractFile function but opens
+// the vault with the settings of the opener
+func (o *VaultOpener) ExtractFile(r io.Reader, key []byte, name string) (io.ReadCloser, error) {
+	// Where to start again for the entry a copy points to
+	var start int64 = -1
+	if s, ok := r.(io.Seeker); ok {
+		if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+			start = pos
+		}
+	}
+
+	return o.extractFile(r, key, path.Clean(name), start, make(map[string]bool))
+}
+
+// Find the file in the vault, following the copies, which
+// seek back to start. A copy that leads back to a name in
+// visited is an error, or a crafted vault would loop forever
+func (o *VaultOpener) extractFile(r io.Reader, key []byte, name string, start int64, visited map[string]bool) (io.ReadCloser, error) {
+	if visited[name] {
+		return nil, fmt.Errorf("arcsek: the copies of %s lead back to it", name)
+	}
+	visited[name] = true
+
+	tr, err := o.Open(r, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			tr.Close()
+			return nil, fmt.Errorf("%w: %s", ErrEntryNotFound, name)
+		}
+		if err != nil {
+			tr.Close()
+			return nil, err
+		}
+
+		if hdr.Typeflag == tar.TypeReg && path.Clean(hdr.Name) == name {
+			// Reading the tar reader reads the entry
+			return tr, nil
+		}
+
+		if isCopy(hdr) && path.Clean(hdr.Name) == name {
+			tr.Close()
+			if start < 0 {
+				return nil, fmt.Errorf("arcsek: %s is a copy of %s, which was already read", name, hdr.Linkname)
+			}
+
+			if _, err = r.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return o.extractFile(r, key, path.Clean(hdr.Linkname), start, visited)
+		}
+	}
+}
+
+// Join the name of an entry to the destination. The name
+// must be relative and stay inside of dest once cleaned,
+// otherwise ErrUnsafePath is returned.
+//
+// Every file materialized from an archive must get its
+// path from here
+func safeJoin(dest, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || !isLocal(clean) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+
+	return filepath.Join(dest, clean), nil
+}
+
+// Whether a cleaned relative path stays where it starts
+func isLocal(clean string) bool {
+	return clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// The directories between dest and path must not be
+// symlinks. A symlink that is safe by itself can still
+// point to a place where a relative path escapes dest
+func checkNoSymlinks(dest, path string) error {
+	rel, err := filepath.Rel(dest, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return err
+	}
+
+	dir := dest
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			// Nothing below can exist either
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s goes through a symlink", ErrUnsafePath, path)
+		}
+	}
+
+	return nil
+}
+
+// Write the contents of the current entry to its path in
+// dest
+func (d *dirCreator) writeFile(path string, hdr *tar.Header, r io.Reader) error {
+	file, err := d.Create(hdr.Name, hdr.FileInfo().Mode())
+	if err != nil {
+		return err
+	}
+
+	// A partial file would look like a good one
+	if _, err = copyBuffer(file, r); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return restoreMetadata(path, hdr)
+}
+
+// Give the file the permissions and the modification time
+// it had when it was archived. The umask may have changed
+// the permissions it was created with.
+//
+// The setuid, setgid and sticky bits are never restored.
+// Nothing here follows a symlink found at path
+func restoreMetadata(path string, hdr *tar.Header) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if err = os.Chmod(path, hdr.FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	if hdr.ModTime.IsZero() {
+		return nil
+	}
+
+	return lchtimes(path, hdr.ModTime)
+}
+
+// Give the extracted entry the owner it had. Only root can
+// do so, for everyone else it is skipped
+func restoreOwner(path string, hdr *tar.Header) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+		return os.Lchown(path, hdr.Uid, hdr.Gid)
+	}
+
+	return nil
+}
+
+// Create the symlink of the entry. The target is resolved
+// from the directory of the link and must stay in dest
+func extractSymlink(dest, path string, hdr *tar.Header) error {
+	target := filepath.FromSlash(hdr.Linkname)
+
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" || !linkStaysIn(dest, filepath.Dir(path), target) {
+		return fmt.Errorf("%w: %s links to %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+	}
+
+	if err := prepareEntry(path); err != nil {
+		return err
+	}
+
+	return os.Symlink(target, path)
+}
+
+// Whether the relative target of a link in dir stays in
+// dest once the links already extracted are followed. A
+// cleaned target is not enough: with d -> "." the target
+// d/.. is the parent of dest. So the target can only end
+// at a symlink, not go through one, and can only go up
+// from directories that exist, as a missing one may still
+// become a link
+func linkStaysIn(dest, dir, target string) bool {
+	rel, err := filepath.Rel(dest, dir)
+	if err != nil || !isLocal(rel) {
+		return false
+	}
+
+	depth := 0
+	if rel != "." {
+		depth = len(strings.Split(rel, string(filepath.Separator)))
+	}
+
+	// d.path already checked the directories between dest
+	// and the link
+	isDir, isLink := true, false
+	for _, part := range strings.Split(target, string(filepath.Separator)) {
+		if part == "" || part == "." {
+			continue
+		}
+		if isLink {
+			return false
+		}
+
+		if part == ".." {
+			if !isDir || depth == 0 {
+				return false
+			}
+			dir = filepath.Dir(dir)
+			depth--
+			continue
+		}
+
+		dir = filepath.Join(dir, part)
+		depth++
+
+		fi, err := os.Lstat(dir)
+		isDir = err == nil && fi.IsDir()
+		isLink = err == nil && fi.Mode()&os.ModeSymlink != 0
+	}
+
+	return true
+}
+
+// Create the hard link of the entry. The target is the
+// name of another entry, so it must stay in dest too
+func extractHardlink(dest, path string, hdr *tar.Header) error {
+	target, err := safeJoin(dest, hdr.Linkname)
+	if err != nil {
+		return fmt.Errorf("%w: %s links to %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+	}
+
+	if err = checkNoSymlinks(dest, target); err != nil {
+		return err
+	}
+
+	// A hard link to a symlink is another symlink, which
+	// may escape from its new directory
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %s links to the symlink %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+	}
+
+	if err = prepareEntry(path); err != nil {
+		return err
+	}
+
+	return os.Link(target, path)
+}
+
+// Create the parent of an entry and remove what a previous
+// entry left at its path, so an old symlink is not followed
+func prepareEntry(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+		return os.Remove(path)
+	}
+
+	return nil
+}
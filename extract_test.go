@@ -0,0 +1,578 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A crafted tar entry
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+// Seal a vault with the given entries like Build would.
+// It allows testing entries this package never writes
+func sealTarEntries(t *testing.T, key []byte, entries []tarEntry) *bytes.Buffer {
+	arc := new(bytes.Buffer)
+	gzw := gzip.NewWriter(arc)
+	tw := tar.NewWriter(gzw)
+
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+	gzw.Close()
+
+	h := &header{suite: defaultSuite(key), compression: Gzip}
+	aead, err := h.suite.newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := createStream(aead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.nonce, err = newNonce(stream.NonceSize()); err != nil {
+		t.Fatal(err)
+	}
+
+	info := VaultInfo{Files: len(entries), Checksum: sha256.Sum256(arc.Bytes())}
+	raw, err := h.complete(aead, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buff := bytes.NewBuffer(raw)
+	if _, err = stream.EncryptReader(arc, h.nonce, raw).WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff
+}
+
+func TestExtractTo(t *testing.T) {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+		"testing-files/in/existance/testfile4.txt",
+	}
+	key := genKey("extract")
+
+	vault, err := NewVaultReader(files, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+
+	dest := t.TempDir()
+	n, err := ExtractTo(buff, key, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(files) {
+		t.Fatalf("Expected %d files, %d were written", len(files), n)
+	}
+
+	for _, f := range files {
+		want, _ := ioutil.ReadFile(f)
+		got, err := ioutil.ReadFile(filepath.Join(dest, filepath.Base(f)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(want, got) {
+			t.Fatalf("The contents of %s changed", f)
+		}
+	}
+}
+
+func TestExtractToUnsafePath(t *testing.T) {
+	key := genKey("traversal")
+	names := []string{
+		"../evil.txt",
+		"a/../../evil.txt",
+		"..",
+		"../../etc/passwd",
+		"/etc/passwd",
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			vault := sealTarEntries(t, key, []tarEntry{
+				{tar.Header{Name: "good.txt"}, "good"},
+				{tar.Header{Name: name}, "evil"},
+			})
+
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+
+			if _, err := ExtractTo(vault, key, dest); !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("Expected ErrUnsafePath, got '%v'", err)
+			}
+
+			if _, err := ioutil.ReadFile(filepath.Join(parent, "evil.txt")); err == nil {
+				t.Fatal("A file was written outside of the destination")
+			}
+		})
+	}
+}
+
+func TestExtractToUnsafeLinks(t *testing.T) {
+	key := genKey("links")
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{
+			"Symlink out of the destination",
+			[]tarEntry{
+				{tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"}, ""},
+			},
+		},
+		{
+			"Absolute symlink",
+			[]tarEntry{
+				{tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, ""},
+			},
+		},
+		{
+			"Nested symlink out of the destination",
+			[]tarEntry{
+				{tar.Header{Name: "a/b/up", Typeflag: tar.TypeSymlink, Linkname: "../../.."}, ""},
+			},
+		},
+		{
+			"Writing through a symlink",
+			[]tarEntry{
+				// The link is safe by itself, but not what goes through it
+				{tar.Header{Name: "a/b/root", Typeflag: tar.TypeSymlink, Linkname: "../.."}, ""},
+				{tar.Header{Name: "a/b/root/up", Typeflag: tar.TypeSymlink, Linkname: "../evil"}, ""},
+			},
+		},
+		{
+			"Hardlink out of the destination",
+			[]tarEntry{
+				{tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}, ""},
+			},
+		},
+		{
+			"Hardlink to a symlink",
+			[]tarEntry{
+				{tar.Header{Name: "a/b/root", Typeflag: tar.TypeSymlink, Linkname: "../.."}, ""},
+				{tar.Header{Name: "root", Typeflag: tar.TypeLink, Linkname: "a/b/root"}, ""},
+			},
+		},
+		{
+			"Symlink out of the destination through another",
+			[]tarEntry{
+				// Cleaned, d/.. is dest, but followed it is its parent
+				{tar.Header{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."}, ""},
+				{tar.Header{Name: "e", Typeflag: tar.TypeSymlink, Linkname: "d/.."}, ""},
+			},
+		},
+		{
+			"Symlink up from a directory that may become a link",
+			[]tarEntry{
+				{tar.Header{Name: "e", Typeflag: tar.TypeSymlink, Linkname: "d/.."}, ""},
+				{tar.Header{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."}, ""},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := t.TempDir()
+			if _, err := ExtractTo(sealTarEntries(t, key, tc.entries), key, dest); !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("Expected ErrUnsafePath, got '%v'", err)
+			}
+		})
+	}
+}
+
+func TestExtractToSymlinkChain(t *testing.T) {
+	key := genKey("links")
+	vault := sealTarEntries(t, key, []tarEntry{
+		{tar.Header{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."}, ""},
+		{tar.Header{Name: "e", Typeflag: tar.TypeSymlink, Linkname: "d/.."}, ""},
+		{tar.Header{Name: "e", Typeflag: tar.TypeDir, Mode: 0700, ModTime: time.Unix(0, 0)}, ""},
+	})
+
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.Stat(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ExtractTo(vault, key, dest); !errors.Is(err, ErrUnsafePath) {
+		t.Fatalf("Expected ErrUnsafePath, got '%v'", err)
+	}
+
+	after, err := os.Stat(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("The parent of the destination went from %v %v to %v %v",
+			before.Mode(), before.ModTime(), after.Mode(), after.ModTime())
+	}
+}
+
+func TestExtractToDirOverSymlink(t *testing.T) {
+	key := genKey("links")
+	vault := sealTarEntries(t, key, []tarEntry{
+		{tar.Header{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."}, ""},
+		{tar.Header{Name: "d", Typeflag: tar.TypeDir, Mode: 0700, ModTime: time.Unix(0, 0)}, ""},
+	})
+
+	dest := t.TempDir()
+	if _, err := ExtractTo(vault, key, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory replaces the link instead of going through it
+	fi, err := os.Lstat(filepath.Join(dest, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Fatalf("d is %v, expected a directory with 0700", fi.Mode())
+	}
+
+	after, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.ModTime().Equal(time.Unix(0, 0)) {
+		t.Fatal("The metadata of d was applied to the destination")
+	}
+}
+
+func TestExtractToSafeLinks(t *testing.T) {
+	key := genKey("links")
+	vault := sealTarEntries(t, key, []tarEntry{
+		{tar.Header{Name: "dir/file.txt"}, "contents"},
+		{tar.Header{Name: "dir/sym.txt", Typeflag: tar.TypeSymlink, Linkname: "file.txt"}, ""},
+		{tar.Header{Name: "dir/chain.txt", Typeflag: tar.TypeSymlink, Linkname: "sym.txt"}, ""},
+		{tar.Header{Name: "other/sym.txt", Typeflag: tar.TypeSymlink, Linkname: "../dir/file.txt"}, ""},
+		{tar.Header{Name: "hard.txt", Typeflag: tar.TypeLink, Linkname: "dir/file.txt"}, ""},
+	})
+
+	dest := t.TempDir()
+	if _, err := ExtractTo(vault, key, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"dir/sym.txt", "dir/chain.txt", "other/sym.txt", "hard.txt"} {
+		b, err := ioutil.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "contents" {
+			t.Fatalf("%s does not have the contents of the file it links to", name)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		good bool
+	}{
+		{"file.txt", "dest/file.txt", true},
+		{"a/b/../c.txt", "dest/a/c.txt", true},
+		{"./a", "dest/a", true},
+		{"a/..", "dest", true},
+		{"..", "", false},
+		{"../a", "", false},
+		{"a/../../b", "", false},
+		{"/etc/passwd", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := safeJoin("dest", tc.name)
+			if tc.good && (err != nil || got != filepath.FromSlash(tc.want)) {
+				t.Fatalf("Expected %s, got %s and '%v'", tc.want, got, err)
+			}
+
+			if !tc.good && !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("Expected ErrUnsafePath, got %s and '%v'", got, err)
+			}
+		})
+	}
+}
+
+func TestExtractFile(t *testing.T) {
+	key := genKey("single")
+	entries := []tarEntry{
+		{tar.Header{Name: "first.txt"}, "first"},
+		{tar.Header{Name: "dir/second.txt"}, "second"},
+		{tar.Header{Name: "third.txt"}, "third"},
+	}
+
+	tests := []struct {
+		name string
+		want string
+		good bool
+	}{
+		{"first.txt", "first", true},
+		{"dir/second.txt", "second", true},
+		{"./dir/second.txt", "second", true},
+		{"third.txt", "third", true},
+		{"dir", "", false},
+		{"fourth.txt", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rc, err := ExtractFile(sealTarEntries(t, key, entries), key, tc.name)
+			if !tc.good {
+				if !errors.Is(err, ErrEntryNotFound) {
+					t.Fatalf("Expected ErrEntryNotFound, got '%v'", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+
+			b, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != tc.want {
+				t.Fatalf("Expected '%s', got '%s'", tc.want, b)
+			}
+		})
+	}
+}
+
+func TestExtractFileCopyCycle(t *testing.T) {
+	key := genKey("copy cycle")
+	copyOf := func(name, target string) tarEntry {
+		return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target, PAXRecords: map[string]string{paxKind: kindCopy}}, ""}
+	}
+
+	tests := map[string][]tarEntry{
+		"Itself": {copyOf("a", "a")},
+		"Loop":   {copyOf("a", "b"), copyOf("b", "./a")},
+		"Chain":  {{tar.Header{Name: "c"}, "c"}, copyOf("a", "b"), copyOf("b", "d"), copyOf("d", "a")},
+	}
+
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			vault := sealTarEntries(t, key, entries).Bytes()
+			if _, err := ExtractFile(bytes.NewReader(vault), key, "a"); err == nil {
+				t.Fatal("Extracted a copy that leads back to itself")
+			}
+		})
+	}
+}
+
+func TestExtractToModes(t *testing.T) {
+	key := genKey("modes")
+
+	tmp, err := ioutil.TempFile("testing-files/out", "mode-*.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.WriteString("#!/bin/sh\necho hi\n")
+	tmp.Close()
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err = os.Chmod(tmp.Name(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	vault, err := NewVaultReader([]string{tmp.Name()}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	dest := t.TempDir()
+	if _, err = ExtractTo(vault, key, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dest, filepath.Base(tmp.Name())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Perm() != 0755 {
+		t.Fatalf("Expected the mode 0755, got %o", fi.Mode().Perm())
+	}
+
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("Expected the modification time %v, got %v", mtime, fi.ModTime())
+	}
+}
+
+func TestExtractToDirModes(t *testing.T) {
+	key := genKey("modes")
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	vault := sealTarEntries(t, key, []tarEntry{
+		{tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime}, ""},
+		{tar.Header{Name: "dir/file.txt", Mode: 0600, ModTime: mtime}, "contents"},
+	})
+
+	dest := t.TempDir()
+	if _, err := ExtractTo(vault, key, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mode := range map[string]os.FileMode{"dir": 0750, "dir/file.txt": 0600} {
+		fi, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != mode || !fi.ModTime().Equal(mtime) {
+			t.Fatalf("%s has the mode %o and the time %v", name, fi.Mode().Perm(), fi.ModTime())
+		}
+	}
+}
+
+func TestMaxEntrySize(t *testing.T) {
+	key := genKey("bomb")
+
+	// The header claims a terabyte the vault does not have
+	buff := new(bytes.Buffer)
+	vw, err := NewVaultWriter(buff, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tw := tar.NewWriter(vw)
+	if err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "huge.bin", Mode: 0644, Size: 1 << 40}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(make([]byte, 1024))
+	if err = tw.Flush(); err == nil {
+		t.Fatal("The tar should be missing most of the entry")
+	}
+
+	if err = vw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	vault := buff.Bytes()
+
+	opener := VaultOpener{MaxEntrySize: 1 << 20}
+
+	t.Run("ExtractTo", func(t *testing.T) {
+		dest := t.TempDir()
+		if _, err := opener.ExtractTo(bytes.NewReader(vault), key, dest); !errors.Is(err, ErrEntryTooLarge) {
+			t.Fatalf("Got %v instead of ErrEntryTooLarge", err)
+		}
+
+		if fileExists(filepath.Join(dest, "huge.bin")) {
+			t.Fatal("The entry was written")
+		}
+	})
+
+	t.Run("ExtractFile", func(t *testing.T) {
+		if _, err := opener.ExtractFile(bytes.NewReader(vault), key, "huge.bin"); !errors.Is(err, ErrEntryTooLarge) {
+			t.Fatalf("Got %v instead of ErrEntryTooLarge", err)
+		}
+	})
+
+	t.Run("Under the limit", func(t *testing.T) {
+		files := []string{"testing-files/in/existance/testfile1.txt"}
+		v, err := NewVaultReader(files, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		if _, err = opener.ExtractTo(v, key, t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestExtractToBomb(t *testing.T) {
+	key := genKey("bomb")
+
+	// 64 MB of zeros compress to a few KB
+	zeros := make([]byte, 64<<20)
+	entries := []Entry{
+		{Name: "a.bin", Size: int64(len(zeros)), Body: bytes.NewReader(zeros)},
+		entry("b.txt", "small"),
+		entry("c.txt", "small"),
+	}
+	vault := sealEntries(t, key, entries...)
+
+	if len(vault) > 1<<20 {
+		t.Fatalf("The vault has %d bytes, it should be tiny", len(vault))
+	}
+
+	testCases := []struct {
+		name   string
+		opener VaultOpener
+		want   error
+	}{
+		{"Total bytes", VaultOpener{MaxTotalBytes: 1 << 20}, ErrArchiveTooLarge},
+		{"Entries", VaultOpener{MaxEntries: 2}, ErrArchiveTooLarge},
+		{"Within the limits", VaultOpener{MaxEntries: 3, MaxTotalBytes: 65 << 20}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := t.TempDir()
+			n, err := tc.opener.ExtractTo(bytes.NewReader(vault), key, dest)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Got %v instead of %v", err, tc.want)
+			}
+
+			if tc.want != nil && fileExists(filepath.Join(dest, "c.txt")) {
+				t.Fatalf("%d files were extracted past the limit", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package arcsek
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// EncryptFilesToFile seals the files into a new vault at
+// dest, with the options, in a single call. The vault is
+// written to a temporal file next to dest and renamed once
+// it is complete, so dest is never left half written and
+// nothing is left behind if it fails.
+//
+// With ContinueOnError the vault is written without the files
+// that failed, and the error lists them
+func EncryptFilesToFile(dest string, files []string, key []byte, opts ...Option) error {
+	return newBuilder(opts).EncryptFilesToFile(dest, files, key)
+}
+
+// EncryptFilesToFile is like the EncryptFilesToFile function
+// but seals the files with the settings of the builder
+func (b *VaultBuilder) EncryptFilesToFile(dest string, files []string, key []byte) error {
+	vault, err := b.Build(files, key)
+	if vault == nil {
+		return err
+	}
+	defer vault.Close()
+
+	// What was left out, if anything
+	skipped := err
+
+	tmp, err := createTempFile(filepath.Dir(dest), ".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = vault.WriteTo(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return skipped
+}
+
+// DecryptFileToDir extracts the vault at src to destDir, see
+// ExtractTo
+func DecryptFileToDir(src, destDir string, key []byte) error {
+	return new(VaultOpener).DecryptFileToDir(src, destDir, key)
+}
+
+// DecryptFileToDir is like the DecryptFileToDir function but
+// opens the vault with the settings of the opener
+func (o *VaultOpener) DecryptFileToDir(src, destDir string, key []byte) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = o.ExtractTo(file, key, destDir)
+	return err
+}
@@ -0,0 +1,70 @@
+package arcsek
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptFilesToFile(t *testing.T) {
+	key := genKey("one shot")
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "backup.arcsek")
+
+	if err := EncryptFilesToFile(dest, []string{"testing-files/in/existance"}, key, WithCompression(Zstd)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the vault is left
+	if ls, _ := os.ReadDir(dir); len(ls) != 1 {
+		t.Fatalf("%d files next to the vault", len(ls))
+	}
+
+	out := t.TempDir()
+	if err := DecryptFileToDir(dest, out, key); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		name := fmt.Sprintf("testfile%d.txt", i)
+		want, err := os.ReadFile(filepath.Join("testing-files/in/existance", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != string(want) {
+			t.Fatalf("%s was not restored", name)
+		}
+	}
+
+	t.Run("Failed", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "backup.arcsek")
+		if err := EncryptFilesToFile(dest, []string{"testing-files/in/missing"}, key); !errors.Is(err, ErrFileNotFound) {
+			t.Fatalf("Got %v instead of ErrFileNotFound", err)
+		}
+
+		if ls, _ := os.ReadDir(filepath.Dir(dest)); len(ls) != 0 {
+			t.Fatalf("%d files were left behind", len(ls))
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		if err := DecryptFileToDir(dest, t.TempDir(), genKey("other")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Got %v instead of ErrAuthFailed", err)
+		}
+	})
+
+	t.Run("Missing vault", func(t *testing.T) {
+		if err := DecryptFileToDir(filepath.Join(dir, "missing"), t.TempDir(), key); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Got %v instead of fs.ErrNotExist", err)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/fs"
+)
+
+// NewVaultReaderFS is like NewVaultReader but reads the
+// files from fsys instead of the disk, like an embed.FS or
+// an fstest.MapFS. The names are paths of fsys, see
+// fs.ValidPath, and "." is all of it. Directories are walked
+// with fs.WalkDir.
+//
+// The entries are named by their path in fsys
+func NewVaultReaderFS(fsys fs.FS, names []string, key []byte, opts ...Option) (*VaultReader, error) {
+	return newBuilder(opts).BuildFS(fsys, names, key)
+}
+
+// BuildFS is like Build but reads the files from fsys, see
+// NewVaultReaderFS. The options about the disk, like
+// BaseDir, the owners and the xattrs, don't apply, the
+// files are not deduplicated and there is no manifest. Symlinks are archived as what
+// fsys gives when they are opened
+func (b *VaultBuilder) BuildFS(fsys fs.FS, names []string, key []byte) (*VaultReader, error) {
+	if err := checkInput(names, key); err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("%w: %s is not a valid path of the fs", ErrFileNotFound, name)
+		}
+	}
+
+	if err := b.checkNoManifest(); err != nil {
+		return nil, err
+	}
+
+	return b.build(b.addFS(fsys, names), key)
+}
+
+// A file of an fs.FS to archive
+type fsJob struct {
+	name string
+	stat fs.FileInfo
+}
+
+// The contents of an archive with the files of fsys
+func (b *VaultBuilder) addFS(fsys fs.FS, names []string) archiveContents {
+	return func(a *archiveWriter) error {
+		a.maxFileSize, a.maxVaultSize = b.MaxFileSize, b.MaxVaultSize
+		a.fixedTime = b.nonce != nil
+		a.allowChanged = b.AllowChangedFiles
+		failed := b.failed(a)
+
+		// List them first, for the progress and the name map
+		var jobs []fsJob
+		for _, name := range names {
+			if err := b.walkFS(fsys, name, &jobs, failed); err != nil {
+				return err
+			}
+		}
+
+		var total int64
+		for _, job := range jobs {
+			if job.stat.Mode().IsRegular() {
+				total += job.stat.Size()
+			}
+		}
+		a.progress = newProgress(b.Progress, total)
+		a.onFile, a.total = b.OnFile, len(jobs)
+
+		if b.ObfuscateNames {
+			names := make([]string, len(jobs))
+			for i, job := range jobs {
+				names[i] = job.name
+			}
+
+			if err := a.writeNames(names); err != nil {
+				return err
+			}
+		}
+
+		for _, job := range jobs {
+			if err := a.addFSFile(fsys, job); err != nil {
+				if err = failed(job.name, err); err != nil {
+					return err
+				}
+			}
+		}
+
+		a.progress.finish()
+		return nil
+	}
+}
+
+// List the files of fsys the builder archives for name,
+// in order
+func (b *VaultBuilder) walkFS(fsys fs.FS, name string, jobs *[]fsJob, failed func(path string, err error) error) error {
+	add := func(p string) error {
+		stat, err := fs.Stat(fsys, p)
+		if err != nil {
+			return failed(p, notFound(err))
+		}
+
+		if b.Filter != nil && !b.Filter(p, stat) {
+			if stat.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// The root is where the archive is extracted
+		if p != "." {
+			*jobs = append(*jobs, fsJob{p, stat})
+		}
+		return nil
+	}
+
+	if b.DisableRecursion {
+		if err := add(name); err != fs.SkipDir {
+			return err
+		}
+		return nil
+	}
+
+	return fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return failed(p, notFound(err))
+		}
+
+		return add(p)
+	})
+}
+
+// Add a file or a directory of fsys to the archive
+func (a *archiveWriter) addFSFile(fsys fs.FS, job fsJob) error {
+	if job.stat.IsDir() {
+		header, err := tar.FileInfoHeader(job.stat, "")
+		if err != nil {
+			return err
+		}
+		header.Name = a.entryName(job.name) + "/"
+
+		// Nothing is read from the disk without xattrs
+		if err = a.fill(header, job.name); err != nil {
+			return err
+		}
+
+		return a.writeHeader(header)
+	}
+
+	if !job.stat.Mode().IsRegular() {
+		return fmt.Errorf("arcsek: %s is not a regular file", job.name)
+	}
+
+	if err := a.checkSize(job.stat.Size()); err != nil {
+		return err
+	}
+
+	if err := a.claim(job.name); err != nil {
+		return err
+	}
+
+	if err := a.begin(job.name, job.stat.Size()); err != nil {
+		return err
+	}
+
+	file, err := fsys.Open(job.name)
+	if err != nil {
+		return notFound(err)
+	}
+	defer file.Close()
+
+	n, err := writeFileToTar(job.name, a.entryName(job.name), job.stat, file, a.tw, a.fill, a.body, a.allowChanged)
+	if err != nil {
+		return err
+	}
+
+	a.info.Files++
+	a.info.Size += n
+	return nil
+}
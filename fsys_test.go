@@ -0,0 +1,84 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNewVaultReaderFS(t *testing.T) {
+	key := genKey("fs")
+	fsys := fstest.MapFS{
+		"a.txt":           {Data: []byte("from memory"), Mode: 0644},
+		"docs/b.md":       {Data: []byte("# no disk"), Mode: 0600},
+		"docs/deep/c.log": {Data: []byte("log"), Mode: 0644},
+	}
+
+	tests := []struct {
+		name    string
+		builder VaultBuilder
+		names   []string
+		want    []string
+	}{
+		{"Root", VaultBuilder{}, []string{"."}, []string{"a.txt", "docs/", "docs/b.md", "docs/deep/", "docs/deep/c.log"}},
+		{"Dir", VaultBuilder{}, []string{"docs/deep", "a.txt"}, []string{"docs/deep/", "docs/deep/c.log", "a.txt"}},
+		{"No recursion", VaultBuilder{DisableRecursion: true}, []string{"docs", "a.txt"}, []string{"docs/", "a.txt"}},
+		{"Filter", VaultBuilder{Filter: ExcludeGlobs("deep")}, []string{"."}, []string{"a.txt", "docs/", "docs/b.md"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.builder.BuildFS(fsys, tt.names, key)
+			vault := vaultBytes(t, v, err)
+
+			names, contents, err := readEntries(bytes.NewReader(vault), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(names, tt.want) {
+				t.Fatalf("Got %v instead of %v", names, tt.want)
+			}
+
+			for _, name := range names {
+				if f, ok := fsys[name]; ok && contents[name] != string(f.Data) {
+					t.Fatalf("%s has %q", name, contents[name])
+				}
+			}
+		})
+	}
+
+	t.Run("Extract", func(t *testing.T) {
+		v, err := NewVaultReaderFS(fsys, []string{"."}, key, WithCompression(Zstd))
+		vault := vaultBytes(t, v, err)
+
+		dest := t.TempDir()
+		if _, err = ExtractTo(bytes.NewReader(vault), key, dest); err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Stat(filepath.Join(dest, "docs", "b.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != 0600 {
+			t.Fatalf("b.md was extracted with %v", fi.Mode())
+		}
+	})
+
+	t.Run("Bad names", func(t *testing.T) {
+		for _, name := range []string{"missing.txt", "../a.txt", "/a.txt"} {
+			if v, err := NewVaultReaderFS(fsys, []string{name}, key); !errors.Is(err, ErrFileNotFound) {
+				if err == nil {
+					v.Close()
+				}
+				t.Fatalf("Got %v for %s", err, name)
+			}
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package arcsek
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewVaultReaderGlob is like NewVaultReader but archives
+// the files matched by the patterns, with the syntax of
+// filepath.Match. A "**" segment also matches any number
+// of directories, like "src/**/*.go".
+//
+// A file matched by more than one pattern is archived
+// once. A pattern that matches nothing is an error
+func NewVaultReaderGlob(patterns []string, key []byte, opts ...Option) (*VaultReader, error) {
+	return newBuilder(opts).BuildGlob(patterns, key)
+}
+
+// BuildGlob is like Build but archives the files matched by
+// the patterns, see NewVaultReaderGlob. A pattern that
+// matches nothing is an error unless AllowEmptyGlobs is set
+func (b *VaultBuilder) BuildGlob(patterns []string, key []byte) (*VaultReader, error) {
+	files, err := b.expandGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Build(files, key)
+}
+
+// Expand the patterns, without repeating files. Files
+// within a matched directory are dropped too when the
+// directory is walked, or they would be archived twice
+func (b *VaultBuilder) expandGlobs(patterns []string) ([]string, error) {
+	var matches []string
+	for _, pattern := range patterns {
+		m, err := glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(m) == 0 && !b.AllowEmptyGlobs {
+			return nil, fmt.Errorf("%w: the pattern %s matches no files", ErrFileNotFound, pattern)
+		}
+
+		matches = append(matches, m...)
+	}
+
+	seen := make(map[string]bool)
+	var dirs []string
+	if !b.DisableRecursion {
+		for _, m := range matches {
+			if fi, err := os.Lstat(m); err == nil && fi.IsDir() {
+				dirs = append(dirs, filepath.Clean(m))
+			}
+		}
+	}
+
+	var files []string
+	for _, m := range matches {
+		clean := filepath.Clean(m)
+		if seen[clean] || insideAny(dirs, clean) {
+			continue
+		}
+
+		seen[clean] = true
+		files = append(files, m)
+	}
+
+	return files, nil
+}
+
+// Whether path is strictly inside any of the dirs
+func insideAny(dirs []string, path string) bool {
+	for _, dir := range dirs {
+		if dir != path && within(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Like filepath.Glob, but "**" matches any number of
+// directories
+func glob(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+
+	// Walk from the part of the pattern that has no
+	// wildcards
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	i := 0
+	for i < len(segments) && !hasMeta(segments[i]) {
+		i++
+	}
+
+	root := filepath.FromSlash(strings.Join(segments[:i], "/"))
+	if root == "" {
+		root = "."
+	}
+	if strings.HasPrefix(pattern, "/") && root == "." {
+		root = "/"
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return fs.SkipDir
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		ok, err := matchSegments(segments[i:], strings.Split(filepath.ToSlash(rel), "/"))
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+
+	return matches, err
+}
+
+// Match the segments of a path against the segments of a
+// pattern, where "**" matches zero or more segments
+func matchSegments(pattern, path []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(path) == 0, nil
+	}
+
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(path); skip++ {
+			if ok, err := matchSegments(pattern[1:], path[skip:]); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+
+	if len(path) == 0 {
+		return false, nil
+	}
+
+	ok, err := filepath.Match(pattern[0], path[0])
+	if !ok || err != nil {
+		return false, err
+	}
+
+	return matchSegments(pattern[1:], path[1:])
+}
+
+// Whether the segment has wildcards
+func hasMeta(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
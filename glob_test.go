@@ -0,0 +1,111 @@
+package arcsek
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Make a small tree to match globs against
+func globTree(t *testing.T) string {
+	root := t.TempDir()
+	for _, dir := range []string{"src/pkg/internal", "docs"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+	}
+
+	files := []string{"README", "src/main.go", "src/pkg/pkg.go", "src/pkg/internal/x.go", "docs/guide.md"}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func TestExpandGlobs(t *testing.T) {
+	root := globTree(t)
+
+	testCases := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"Plain", []string{"src/*.go"}, []string{"src/main.go"}},
+		{"Overlapping", []string{"src/*.go", "src/m*", "src/main.go"}, []string{"src/main.go"}},
+		{"Double star", []string{"src/**/*.go"}, []string{"src/main.go", "src/pkg/internal/x.go", "src/pkg/pkg.go"}},
+		{"Double star and plain", []string{"src/pkg/*.go", "**/*.go"}, []string{"src/pkg/pkg.go", "src/main.go", "src/pkg/internal/x.go"}},
+		{"Inside a matched dir", []string{"src/pkg", "src/pkg/*.go"}, []string{"src/pkg"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			patterns := make([]string, len(tc.patterns))
+			for i, p := range tc.patterns {
+				patterns[i] = filepath.Join(root, p)
+			}
+
+			got, err := new(VaultBuilder).expandGlobs(patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make([]string, len(tc.want))
+			for i, w := range tc.want {
+				want[i] = filepath.Join(root, w)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("Expected %v but got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestNewVaultReaderGlob(t *testing.T) {
+	key := genKey("glob")
+	root := globTree(t)
+
+	// Both patterns match main.go
+	patterns := []string{filepath.Join(root, "src/**/*.go"), filepath.Join(root, "src/main.go")}
+	vault, err := NewVaultReaderGlob(patterns, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	dest := t.TempDir()
+	n, err := ExtractTo(vault, key, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"main.go", "pkg/pkg.go", "pkg/internal/x.go"} {
+		if _, err := os.Stat(filepath.Join(dest, f)); err != nil {
+			t.Fatalf("%s was not archived: %v", f, err)
+		}
+	}
+
+	if n != 3 {
+		t.Fatalf("Expected 3 files but got %d", n)
+	}
+}
+
+func TestNewVaultReaderGlobEmpty(t *testing.T) {
+	key := genKey("glob")
+	root := globTree(t)
+	patterns := []string{filepath.Join(root, "*.md"), filepath.Join(root, "README")}
+
+	if _, err := NewVaultReaderGlob(patterns, key); err == nil {
+		t.Fatal("A pattern matching nothing should fail")
+	}
+
+	b := VaultBuilder{AllowEmptyGlobs: true}
+	vault, err := b.BuildGlob(patterns, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.Close()
+}
@@ -1,5 +1,10 @@
 module github.com/eacp/arcsek
 
-go 1.12
+go 1.26.0
 
-require github.com/secure-io/sio-go v0.1.0
+require (
+	github.com/klauspost/compress v1.20.1
+	github.com/secure-io/sio-go v0.1.0
+	golang.org/x/crypto v0.57.0
+	golang.org/x/sys v0.48.0
+)
@@ -0,0 +1,625 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/secure-io/sio-go"
+)
+
+// The signature every vault starts with
+var magic = []byte("ARCSEK")
+
+// The version of the header written by this package
+const formatVersion = 1
+
+// The version with extensions, for what version 1 can't
+// hold. It is only written when there is one, so the
+// other vaults stay readable by older releases
+const extVersion = 2
+
+// Types of the extensions, they are written in this order
+const (
+	// The buffer size, 3 bytes
+	extBufSize byte = 1
+	// The content key wrapped for each recipient, see
+	// marshalRecipients
+	extRecipients byte = 2
+	// The ephemeral X25519 public key of the sender, 32 bytes
+	extEphemeral byte = 3
+	// Set if the key is combined with a keyfile, empty
+	extKeyfile byte = 4
+	// An id of the key chosen by the sender, 1 to 64 bytes
+	extKeyID byte = 5
+	// The ManifestID of the base of a differential vault,
+	// 32 bytes
+	extBase byte = 6
+	// The dictionary of the compression, sealed, see
+	// sealDictionary
+	extDictionary byte = 7
+)
+
+var (
+	// ErrBadMagic is returned when the data does not start
+	// with the signature of a vault
+	ErrBadMagic = errors.New("arcsek: not an arcsek vault")
+
+	// ErrUnsupportedVersion is returned when the vault was
+	// written with a format this package does not know
+	ErrUnsupportedVersion = errors.New("arcsek: unsupported vault version")
+
+	// ErrNonceSize is returned when the nonce length stored
+	// in the header is not the one of the cipher suite
+	ErrNonceSize = errors.New("arcsek: nonce size does not match the cipher suite")
+
+	// ErrInvalidBufferSize is returned when the buffer size
+	// is out of the range sio allows
+	ErrInvalidBufferSize = fmt.Errorf("arcsek: buffer size must be between 1 and %d bytes", sio.MaxBufSize)
+)
+
+// The header written in front of the encrypted data, with
+// the meaning of its fields. It is stored as a Header, see
+// wire and decode.
+//
+// Without extensions the buffer size is sio.BufSize and the
+// key is used as it is, or derived as the salt block says.
+// The info is the sealed VaultInfo, see sealInfo.
+//
+// The serialized header is the associated data of the
+// encryption, so it is authenticated along with the body
+type header struct {
+	suite       CipherSuite
+	compression Compression
+	// The size of the chunks of the stream. Zero is
+	// sio.BufSize
+	bufSize int
+	// The content key wrapped with the key of each recipient
+	recipients [][]byte
+	// The public key the content key is agreed with, see
+	// BuildForPublicKey
+	ephemeral []byte
+	// Whether the key is combined with a keyfile, see
+	// VaultBuilder.Keyfile
+	keyfile bool
+	// The id of the key, see VaultBuilder.KeyID
+	keyID []byte
+	// The id of the manifest of the base, see
+	// VaultBuilder.BaseManifest
+	base []byte
+	// The dictionary of the compression, see
+	// VaultBuilder.Dictionary, and how it is stored. It is
+	// sealed once the cipher is known and opened along with
+	// the info
+	dictionary       []byte
+	sealedDictionary []byte
+	// Nil if the vault is sealed with a raw key
+	kdf  KeyDeriver
+	salt []byte
+
+	nonce []byte
+
+	// The sealed VaultInfo, and the nonce it is sealed with
+	// if it is not random, see BuildDeterministic
+	info      []byte
+	infoNonce []byte
+
+	// Authenticated with the header but not stored in it,
+	// see VaultBuilder.AssociatedData
+	aad []byte
+}
+
+// Header is the plain header of a vault as it is stored,
+// byte for byte, for tools that read or write vaults
+// without this package. The layout is:
+//
+//	magic "ARCSEK" (6 bytes) | version (1 byte) |
+//	cipher suite (1 byte) | compression (1 byte) |
+//	[extensions] | salt block |
+//	nonce length (1 byte) | nonce |
+//	info length (2 bytes) | info
+//
+// Lengths are big endian. Only version 2 headers have the
+// extensions:
+//
+//	count (1 byte, at least 1) | count times:
+//	type (1 byte) | length (2 bytes) | value
+//
+// The salt block is a single zero byte for vaults sealed
+// with a raw key, and otherwise:
+//
+//	kdf id (1 byte) | params length (1 byte) | params |
+//	salt length (1 byte, at least 1) | salt
+//
+// The format is stable: a change gets a new version.
+// MarshalBinary and UnmarshalBinary only check the layout,
+// what the fields mean is checked when the vault is opened
+type Header struct {
+	// Version is 1, or 2 if there are extensions
+	Version     byte
+	Suite       CipherSuite
+	Compression Compression
+
+	// Extensions of version 2 headers, each type at most
+	// once and in increasing order
+	Extensions []HeaderExtension
+
+	// KDF is the id of the key derivation function, or 0 if
+	// the vault is sealed with a raw key and has no params
+	// nor salt
+	KDF       byte
+	KDFParams []byte
+	Salt      []byte
+
+	Nonce []byte
+
+	// Info is the sealed VaultInfo
+	Info []byte
+}
+
+// HeaderExtension is a field of version 2 headers. The
+// types known by this package are:
+//
+//	1: buffer size, 3 bytes
+//	2: content key wrapped for each recipient
+//	3: ephemeral X25519 public key, 32 bytes
+//	4: keyfile needed, empty
+//	5: key id, 1 to 64 bytes
+//	6: id of the base manifest, 32 bytes
+//	7: dictionary of the compression, encrypted
+type HeaderExtension struct {
+	Type  byte
+	Value []byte
+}
+
+// MarshalBinary serializes the header
+func (h *Header) MarshalBinary() ([]byte, error) {
+	b, err := h.marshalPrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(h.Info) > 0xFFFF {
+		return nil, errors.New("arcsek: vault info longer than 65535 bytes")
+	}
+
+	b = append(b, byte(len(h.Info)>>8), byte(len(h.Info)))
+	return append(b, h.Info...), nil
+}
+
+// Serialize the header up to the nonce. It is what the
+// info is authenticated with
+func (h *Header) marshalPrefix() ([]byte, error) {
+	if err := h.checkExtensions(); err != nil {
+		return nil, err
+	}
+
+	if len(h.KDFParams) > 255 {
+		return nil, errors.New("arcsek: key derivation params longer than 255 bytes")
+	}
+
+	if len(h.Salt) > 255 {
+		return nil, errors.New("arcsek: salt longer than 255 bytes")
+	}
+
+	if h.KDF == 0 && len(h.KDFParams)+len(h.Salt) > 0 {
+		return nil, errors.New("arcsek: vaults sealed with a raw key have no salt")
+	}
+
+	if len(h.Nonce) > 255 {
+		return nil, errors.New("arcsek: nonce longer than 255 bytes")
+	}
+
+	b := make([]byte, 0, len(magic)+10+len(h.KDFParams)+len(h.Salt)+len(h.Nonce)+len(h.Info))
+	b = append(b, magic...)
+	b = append(b, h.Version, byte(h.Suite), byte(h.Compression))
+
+	if h.Version == extVersion {
+		b = append(b, byte(len(h.Extensions)))
+		for _, ext := range h.Extensions {
+			b = append(b, ext.Type, byte(len(ext.Value)>>8), byte(len(ext.Value)))
+			b = append(b, ext.Value...)
+		}
+	}
+
+	b = appendSaltBlock(b, h.KDF, h.KDFParams, h.Salt)
+	b = append(b, byte(len(h.Nonce)))
+
+	return append(b, h.Nonce...), nil
+}
+
+// The extensions must match the version and be in order
+func (h *Header) checkExtensions() error {
+	switch h.Version {
+	case formatVersion:
+		if len(h.Extensions) > 0 {
+			return errors.New("arcsek: version 1 headers have no extensions")
+		}
+		return nil
+
+	case extVersion:
+		if len(h.Extensions) == 0 {
+			return errors.New("arcsek: version 2 header without extensions")
+		}
+
+		if len(h.Extensions) > 255 {
+			return errors.New("arcsek: more than 255 header extensions")
+		}
+
+	default:
+		return ErrUnsupportedVersion
+	}
+
+	var last byte
+	for i, ext := range h.Extensions {
+		if i > 0 && ext.Type <= last {
+			return fmt.Errorf("arcsek: header extension %d out of order", ext.Type)
+		}
+		last = ext.Type
+
+		if ext.Type == 0 {
+			return errors.New("arcsek: header extension with type 0")
+		}
+
+		if len(ext.Value) > 0xFFFF {
+			return fmt.Errorf("arcsek: header extension %d longer than 65535 bytes", ext.Type)
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalBinary parses a header serialized by MarshalBinary.
+// b must hold the header and nothing else. Data that ends too
+// soon is ErrTruncated, or ErrBadMagic if it is not a vault
+func (h *Header) UnmarshalBinary(b []byte) error {
+	r := bytes.NewReader(b)
+	w, _, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Len() > 0 {
+		return fmt.Errorf("arcsek: %d bytes after the header", r.Len())
+	}
+
+	*h = *w
+	return nil
+}
+
+// Read a Header from r, consuming exactly its bytes.
+//
+// It also returns the bytes read, which is the associated
+// data of the encryption. If the magic doesn't match they
+// are the bytes consumed before noticing, so the caller can
+// give them back to a reader of another format.
+//
+// The input is untrusted: every length is read before what
+// it measures, so nothing is indexed out of range. Input
+// that ends too soon is ErrTruncated, or ErrBadMagic if
+// what was read can't be the start of a vault
+func readHeader(r io.Reader) (*Header, []byte, error) {
+	raw := new(bytes.Buffer)
+	h, err := readHeaderFields(io.TeeReader(r, raw))
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		n := min(raw.Len(), len(magic))
+		if !bytes.Equal(raw.Bytes()[:n], magic[:n]) {
+			err = ErrBadMagic
+		} else {
+			err = fmt.Errorf("%w: %w", ErrTruncated, err)
+		}
+	}
+
+	if err != nil {
+		return nil, raw.Bytes(), err
+	}
+	return h, raw.Bytes(), nil
+}
+
+// The fields of the header, in order. See readHeader
+func readHeaderFields(tr io.Reader) (*Header, error) {
+	b := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(tr, b); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(b[:len(magic)], magic) {
+		return nil, ErrBadMagic
+	}
+
+	h := &Header{Version: b[len(magic)]}
+	if h.Version != formatVersion && h.Version != extVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	if _, err := io.ReadFull(tr, b[:2]); err != nil {
+		return nil, err
+	}
+	h.Suite, h.Compression = CipherSuite(b[0]), Compression(b[1])
+
+	if h.Version == extVersion {
+		if err := h.readExtensions(tr); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if h.KDF, h.KDFParams, h.Salt, err = readSaltFields(tr); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(tr, b[:1]); err != nil {
+		return nil, err
+	}
+
+	h.Nonce = make([]byte, b[0])
+	if _, err = io.ReadFull(tr, h.Nonce); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(tr, b[:2]); err != nil {
+		return nil, err
+	}
+
+	h.Info = make([]byte, int(b[0])<<8|int(b[1]))
+	if _, err = io.ReadFull(tr, h.Info); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Read the extensions of a version 2 header
+func (h *Header) readExtensions(tr io.Reader) error {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(tr, b[:1]); err != nil {
+		return err
+	}
+
+	count := int(b[0])
+	if count == 0 {
+		return errors.New("arcsek: version 2 header without extensions")
+	}
+
+	var last byte
+	for i := 0; i < count; i++ {
+		if _, err := io.ReadFull(tr, b); err != nil {
+			return err
+		}
+
+		typ := b[0]
+		if typ <= last {
+			return fmt.Errorf("arcsek: header extension %d out of order", typ)
+		}
+		last = typ
+
+		value := make([]byte, int(b[1])<<8|int(b[2]))
+		if _, err := io.ReadFull(tr, value); err != nil {
+			return err
+		}
+
+		h.Extensions = append(h.Extensions, HeaderExtension{Type: typ, Value: value})
+	}
+
+	return nil
+}
+
+// Serialize the header
+func (h *header) marshal() ([]byte, error) {
+	w, err := h.wire()
+	if err != nil {
+		return nil, err
+	}
+
+	return w.MarshalBinary()
+}
+
+// Seal the info into the header and serialize it
+func (h *header) complete(aead cipher.AEAD, info VaultInfo) ([]byte, error) {
+	prefix, err := h.marshalPrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	if h.info, err = sealInfo(aead, info, h.withAAD(prefix), h.infoNonce); err != nil {
+		return nil, err
+	}
+
+	return h.marshal()
+}
+
+// Serialize the header up to the nonce
+func (h *header) marshalPrefix() ([]byte, error) {
+	w, err := h.wire()
+	if err != nil {
+		return nil, err
+	}
+
+	return w.marshalPrefix()
+}
+
+// The Header the header is stored as. It is written in
+// version 1 unless it needs an extension, so the other
+// vaults stay readable by older releases
+func (h *header) wire() (*Header, error) {
+	w := &Header{Version: formatVersion, Suite: h.suite, Compression: h.compression, Nonce: h.nonce, Info: h.info}
+
+	if h.kdf != nil {
+		var err error
+		if w.KDFParams, err = kdfParams(h.kdf); err != nil {
+			return nil, err
+		}
+		w.KDF, w.Salt = h.kdf.ID(), h.salt
+	}
+
+	var err error
+	if w.Extensions, err = h.extensions(); err != nil {
+		return nil, err
+	}
+
+	if w.Extensions != nil {
+		w.Version = extVersion
+	}
+
+	return w, nil
+}
+
+// Append the associated data of the caller to b, the
+// serialized header or its prefix. Both know where they
+// end, so the pair is unambiguous
+func (h *header) withAAD(b []byte) []byte {
+	if len(h.aad) == 0 {
+		return b
+	}
+
+	return append(append(make([]byte, 0, len(b)+len(h.aad)), b...), h.aad...)
+}
+
+// Read a header from r, consuming exactly its bytes, and
+// check what its fields mean. Like readHeader, the bytes
+// read are returned even on error
+func parseHeader(r io.Reader) (*header, []byte, error) {
+	w, raw, err := readHeader(r)
+	if err != nil {
+		return nil, raw, err
+	}
+
+	h, err := w.decode()
+	if err != nil {
+		return nil, raw, err
+	}
+	return h, raw, nil
+}
+
+// The header of the fields stored in w
+func (w *Header) decode() (*header, error) {
+	h := &header{suite: w.Suite, compression: w.Compression, nonce: w.Nonce, info: w.Info}
+
+	for _, ext := range w.Extensions {
+		if err := h.setExtension(ext.Type, ext.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if h.kdf, err = deriverFor(w.KDF, w.KDFParams, w.Salt); err != nil {
+		return nil, err
+	}
+
+	if h.kdf != nil {
+		h.salt = w.Salt
+	}
+
+	return h, nil
+}
+
+// The header up to the nonce, from the bytes read by
+// parseHeader
+func (h *header) prefix(raw []byte) []byte {
+	return raw[:len(raw)-2-len(h.info)]
+}
+
+// The extensions the header needs, in order, or nil if
+// there are none
+func (h *header) extensions() ([]HeaderExtension, error) {
+	var exts []HeaderExtension
+	add := func(typ byte, value []byte) {
+		exts = append(exts, HeaderExtension{Type: typ, Value: value})
+	}
+
+	if h.bufSize != 0 {
+		add(extBufSize, []byte{byte(h.bufSize >> 16), byte(h.bufSize >> 8), byte(h.bufSize)})
+	}
+
+	if h.recipients != nil {
+		value, err := marshalRecipients(h.recipients)
+		if err != nil {
+			return nil, err
+		}
+		add(extRecipients, value)
+	}
+
+	if h.ephemeral != nil {
+		add(extEphemeral, h.ephemeral)
+	}
+
+	if h.keyfile {
+		add(extKeyfile, []byte{})
+	}
+
+	if len(h.keyID) > 0 {
+		add(extKeyID, h.keyID)
+	}
+
+	if h.base != nil {
+		add(extBase, h.base)
+	}
+
+	if h.sealedDictionary != nil {
+		add(extDictionary, h.sealedDictionary)
+	}
+
+	return exts, nil
+}
+
+// Set the field of an extension read from a header. A type
+// this package doesn't know may change how the vault is
+// opened, so it is not skipped
+func (h *header) setExtension(typ byte, value []byte) error {
+	switch typ {
+	case extBufSize:
+		if len(value) != 3 {
+			return ErrInvalidBufferSize
+		}
+
+		// The largest 3 byte size is sio.MaxBufSize
+		if h.bufSize = int(value[0])<<16 | int(value[1])<<8 | int(value[2]); h.bufSize == 0 {
+			return ErrInvalidBufferSize
+		}
+
+	case extRecipients:
+		var err error
+		if h.recipients, err = readRecipients(value); err != nil {
+			return err
+		}
+
+	case extEphemeral:
+		if len(value) != x25519KeyLen {
+			return errors.New("arcsek: malformed ephemeral key in the header")
+		}
+		h.ephemeral = value
+
+	case extKeyfile:
+		if len(value) != 0 {
+			return errors.New("arcsek: malformed keyfile flag in the header")
+		}
+		h.keyfile = true
+
+	case extKeyID:
+		if len(value) == 0 || len(value) > maxKeyIDLen {
+			return errors.New("arcsek: malformed key id in the header")
+		}
+		h.keyID = value
+
+	case extBase:
+		if len(value) != sha256.Size {
+			return errors.New("arcsek: malformed base manifest id in the header")
+		}
+		h.base = value
+
+	case extDictionary:
+		if len(value) == 0 {
+			return errors.New("arcsek: malformed dictionary in the header")
+		}
+		h.sealedDictionary = value
+
+	default:
+		return fmt.Errorf("%w: unknown header extension %d", ErrUnsupportedVersion, typ)
+	}
+
+	return nil
+}
@@ -0,0 +1,643 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/secure-io/sio-go"
+)
+
+// Seal the test files and return the serialized vault
+func sealTestVault(t testing.TB, key []byte) *bytes.Buffer {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+	}
+
+	vault, err := NewVaultReader(files, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	if _, err = vault.WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff
+}
+
+// Build a vault like the package did before the header
+// existed: an 8 byte nonce followed by the ciphertext
+func sealLegacyVault(t *testing.T, key []byte) *bytes.Buffer {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	arc, err := createTestArchive(t, 0, new(VaultBuilder).addFiles(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := os.Open(arc.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+
+	stream, err := createStreamFromKey(AESGCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, stream.NonceSize())
+	io.ReadFull(rand.Reader, nonce)
+
+	buff := bytes.NewBuffer(nonce)
+	if _, err = stream.EncryptReader(tmp, nonce, nil).WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff
+}
+
+func TestHeaderMagic(t *testing.T) {
+	buff := sealTestVault(t, genKey("magic"))
+
+	if !bytes.HasPrefix(buff.Bytes(), []byte("ARCSEK\x01")) {
+		t.Fatalf("The vault does not start with the magic: %x", buff.Bytes()[:7])
+	}
+}
+
+func TestHeaderBadMagic(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"Not a vault", []byte("PK\x03\x04 this is a zip file"), ErrBadMagic},
+		{"Future version", []byte("ARCSEK\x03\x03\x00\x00\x08"), ErrUnsupportedVersion},
+		{"Version 0", []byte("ARCSEK\x00"), ErrUnsupportedVersion},
+		{"No buffer size", []byte("ARCSEK\x02\x01\x00\x01\x01\x00\x03\x00\x00\x00\x00\x00\x00\x00"), ErrInvalidBufferSize},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewTarReaderNonce(bytes.NewReader(tc.data), genKey("pw"))
+			if err != tc.err {
+				t.Fatalf("Expected '%v', got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHeaderAuthenticated(t *testing.T) {
+	key := genKey("tamper")
+	buff := sealTestVault(t, key)
+
+	// Say the tar is not compressed. The authentication must
+	// fail before the reader tries to parse the gzip as a tar
+	buff.Bytes()[suiteOffset+1] = byte(None)
+
+	tr, err := NewTarReaderNonce(buff, key)
+	if err == nil {
+		_, err = tr.Next()
+	}
+
+	if err == nil {
+		t.Fatal("A tampered header should not be authenticated")
+	}
+}
+
+func TestHeaderLegacy(t *testing.T) {
+	key := genKey("legacy")
+
+	// Without the flag a legacy vault is not a vault
+	legacy := sealLegacyVault(t, key)
+	if _, err := NewTarReaderNonce(legacy, key); err != ErrBadMagic {
+		t.Fatalf("Expected ErrBadMagic, got '%v'", err)
+	}
+
+	opener := VaultOpener{AllowLegacy: true}
+
+	legacy = sealLegacyVault(t, key)
+	tr, err := opener.Open(legacy, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Name != "testfile1.txt" {
+		t.Fatalf("Unexpected entry '%s'", hdr.Name)
+	}
+
+	// The flag does not get in the way of current vaults
+	if _, err = opener.Open(sealTestVault(t, key), key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A vault sealed by a release before the header existed
+func TestNewTarReaderLegacy(t *testing.T) {
+	key := genKey("legacy fixture")
+	fixture, err := os.ReadFile("testing-files/legacy/testfile1.vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := os.ReadFile("testing-files/in/existance/testfile1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := map[string]func() (*tar.Reader, error){
+		"Legacy": func() (*tar.Reader, error) {
+			return NewTarReaderLegacy(bytes.NewReader(fixture), key, legacyNonceLen)
+		},
+		"Detected": func() (*tar.Reader, error) {
+			tr, err := (&VaultOpener{AllowLegacy: true}).Open(bytes.NewReader(fixture), key)
+			if err != nil {
+				return nil, err
+			}
+			return tr.Reader, nil
+		},
+	}
+
+	for name, open := range open {
+		t.Run(name, func(t *testing.T) {
+			tr, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hdr, err := tr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if hdr.Name != "testfile1.txt" || !bytes.Equal(got, want) {
+				t.Fatalf("Unexpected entry %q with %q", hdr.Name, got)
+			}
+
+			if _, err = tr.Next(); err != io.EOF {
+				t.Fatalf("Expected the end of the tar but got %v", err)
+			}
+		})
+	}
+
+	t.Run("Wrong key", func(t *testing.T) {
+		if _, err := NewTarReaderLegacy(bytes.NewReader(fixture), genKey("other"), legacyNonceLen); !errors.Is(err, ErrDecryptFailed) {
+			t.Fatalf("Expected ErrDecryptFailed but got %v", err)
+		}
+	})
+
+	t.Run("Nonce length", func(t *testing.T) {
+		if _, err := NewTarReaderLegacy(bytes.NewReader(fixture), key, 12); !errors.Is(err, ErrNonceSize) {
+			t.Fatalf("Expected ErrNonceSize but got %v", err)
+		}
+	})
+}
+
+func TestHeaderNonceLength(t *testing.T) {
+	key := genKey("nonce")
+	h := []byte("ARCSEK\x01\x03\x00\x00")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Empty nonce", append(h, 0, 0, 0)},
+		{"Nonce longer than the suite's", append(h, append([]byte{12}, make([]byte, 14)...)...)},
+		{"Nonce shorter than the suite's", append(h, append([]byte{4}, make([]byte, 6)...)...)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewTarReaderNonce(bytes.NewReader(tc.data), key)
+			if !errors.Is(err, ErrNonceSize) {
+				t.Fatalf("Expected ErrNonceSize, got '%v'", err)
+			}
+		})
+	}
+
+	// A length longer than the data left must not be
+	// mistaken for a nonce
+	_, err := NewTarReaderNonce(bytes.NewReader(append(h, 8, 1, 2)), key)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("Expected a truncated io.ErrUnexpectedEOF, got '%v'", err)
+	}
+}
+
+func TestHeaderConsumesExactly(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	b := VaultBuilder{CipherSuite: XChaCha20Poly1305}
+	vault, err := b.Build(files, []byte("0123456789ABCDEF0123456789ABCDEF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	n, _ := vault.WriteTo(buff)
+	body := n - int64(len(vault.Header()))
+
+	h, raw, err := parseHeader(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(h.nonce, vault.Nonce()) || !bytes.Equal(raw, vault.Header()) {
+		t.Fatal("The header read is not the one written")
+	}
+
+	if int64(buff.Len()) != body {
+		t.Fatalf("The header reader left %d bytes instead of %d", buff.Len(), body)
+	}
+}
+
+func TestAssociatedData(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	key := genKey("aad")
+
+	sealed := new(bytes.Buffer)
+	b := VaultBuilder{AssociatedData: []byte("tenant-a")}
+	vault, err := b.Build(files, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	if _, err = vault.WriteTo(sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	streamed := new(bytes.Buffer)
+	if err = b.EncryptTo(streamed, files, key); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := new(bytes.Buffer)
+	if err = EncryptTo(plain, files, key); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name  string
+		vault []byte
+		aad   []byte
+		ok    bool
+	}{
+		{"Matching", sealed.Bytes(), []byte("tenant-a"), true},
+		{"Matching streamed", streamed.Bytes(), []byte("tenant-a"), true},
+		{"Other tenant", sealed.Bytes(), []byte("tenant-b"), false},
+		{"Other tenant streamed", streamed.Bytes(), []byte("tenant-b"), false},
+		{"None", sealed.Bytes(), nil, false},
+		{"Vault without it", plain.Bytes(), []byte("tenant-a"), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := VaultOpener{AssociatedData: tc.aad}
+			_, err := o.ExtractTo(bytes.NewReader(tc.vault), key, t.TempDir())
+			if tc.ok && err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.ok && !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("Expected ErrAuthFailed but got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseHeaderBadInput(t *testing.T) {
+	vault := sealTestVault(t, genKey("parse")).Bytes()
+
+	testCases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"Empty", nil, ErrTruncated},
+		{"Part of the magic", magic[:3], ErrTruncated},
+		{"Short garbage", []byte("abc"), ErrBadMagic},
+		{"Garbage", []byte("definitely not a vault"), ErrBadMagic},
+		{"Cut in the nonce", vault[:len(magic)+8], ErrTruncated},
+		{"Cut in the info", vault[:len(magic)+40], ErrTruncated},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := parseHeader(bytes.NewReader(tc.data)); !errors.Is(err, tc.want) {
+				t.Fatalf("Expected %v but got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+// Headers come from untrusted storage, parsing them must
+// fail cleanly. Whatever parses is exactly what marshal
+// writes back
+func FuzzParseHeader(f *testing.F) {
+	vault := sealTestVault(f, genKey("fuzz")).Bytes()
+	f.Add(vault)
+	f.Add(vault[:40])
+	f.Add([]byte("ARCSEK"))
+	f.Add([]byte{})
+
+	// With extensions
+	recipients, err := (&VaultBuilder{BufferSize: 1000}).BuildForRecipients(
+		[]string{"testing-files/in/existance/testfile1.txt"}, [][]byte{genKey("a"), genKey("b")})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(recipients.Header())
+	recipients.Close()
+
+	// With each key deriver
+	for _, kd := range []KeyDeriver{testScryptParams, testArgon2Params, PBKDF2Params{Iterations: minPBKDF2Iterations}} {
+		b := VaultBuilder{KeyDeriver: kd}
+		v, err := b.BuildEntries([]Entry{entry("a.txt", "a")}, []byte("pw"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(v.Header())
+		v.Close()
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, raw, err := parseHeader(bytes.NewReader(data))
+		if !bytes.HasPrefix(data, raw) {
+			t.Fatal("The bytes read are not the start of the input")
+		}
+
+		if err != nil {
+			return
+		}
+
+		// The deriver is what opening the vault runs
+		if !kdfBounded(h.kdf) {
+			t.Fatalf("The header asks for a key derivation of %+v", h.kdf)
+		}
+
+		b, err := h.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, raw) {
+			t.Fatalf("The header marshals to %x but was %x", b, raw)
+		}
+	})
+}
+
+// Whether the key derivation of a header has the bounded
+// cost the package allows for untrusted params
+func kdfBounded(kd KeyDeriver) bool {
+	switch p := kd.(type) {
+	case ScryptParams:
+		return p.P <= maxScryptP && 128*int64(p.R)*(int64(p.N)+int64(p.P)) <= maxKDFMemory
+	case Argon2Params:
+		return p.Time <= maxArgon2Time && int64(p.Memory)*1024 <= maxKDFMemory
+	case PBKDF2Params:
+		return p.Iterations <= maxPBKDF2Iterations
+	}
+	return true
+}
+
+// A header can't make opening the vault derive the key with
+// whatever cost it asks for, it fails before deriving it
+func TestHeaderKDFCost(t *testing.T) {
+	testCases := []struct {
+		name string
+		kd   KeyDeriver
+	}{
+		{"Scrypt memory", ScryptParams{N: 1 << 30, R: 1 << 10, P: 1}},
+		{"Scrypt N", ScryptParams{N: 1 << 24, R: 1, P: 1}},
+		{"Scrypt p", ScryptParams{N: 2, R: 1, P: 1<<30 - 1}},
+		{"Scrypt r and p", ScryptParams{N: 2, R: 1<<31 - 1, P: 1<<31 - 1}},
+		{"Argon2 memory", Argon2Params{Time: 1, Memory: 1<<32 - 1, Threads: 1, KeyLen: 32}},
+		{"Argon2 time", Argon2Params{Time: maxArgon2Time + 1, Memory: 1024, Threads: 1, KeyLen: 32}},
+		{"Argon2 huge time", Argon2Params{Time: 1<<32 - 1, Memory: 1024, Threads: 1, KeyLen: 32}},
+		{"PBKDF2 iterations", PBKDF2Params{Iterations: maxPBKDF2Iterations + 1}},
+		{"PBKDF2 huge iterations", PBKDF2Params{Iterations: 1<<32 - 1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := parseDeriver(t, tc.kd); err == nil {
+				t.Fatalf("The header with %+v parsed", tc.kd)
+			}
+
+			params, err := kdfParams(tc.kd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			vault := append(kdfHeader(t, tc.kd.ID(), params), make([]byte, 64)...)
+			if _, err = NewTarReader(bytes.NewReader(vault), []byte("pw")); err == nil {
+				t.Fatalf("The vault with %+v opened", tc.kd)
+			}
+		})
+	}
+}
+
+// Any input only ever returns errors
+func FuzzNewTarReaderNonce(f *testing.F) {
+	key := genKey("fuzz")
+	vault := sealTestVault(f, key).Bytes()
+	f.Add(vault)
+	f.Add(vault[:len(vault)/2])
+	f.Add([]byte("ARCSEK\x01"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tr, err := NewTarReader(bytes.NewReader(data), key)
+		if err != nil {
+			return
+		}
+		defer tr.Close()
+
+		for {
+			if _, err = tr.Next(); err != nil {
+				return
+			}
+
+			if _, err = io.Copy(io.Discard, tr); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestBufferSize(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	key := genKey("bufsize")
+
+	testCases := []struct {
+		size    int
+		version byte
+		ok      bool
+	}{
+		{0, formatVersion, true},
+		{sio.BufSize, formatVersion, true},
+		{1, extVersion, true},
+		{1 << 20, extVersion, true},
+		{sio.MaxBufSize, extVersion, true},
+		{-1, 0, false},
+		{sio.MaxBufSize + 1, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.size), func(t *testing.T) {
+			b := VaultBuilder{BufferSize: tc.size}
+			vault, err := b.Build(files, key)
+			if !tc.ok {
+				if !errors.Is(err, ErrInvalidBufferSize) {
+					t.Fatalf("Expected ErrInvalidBufferSize but got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			sealed := new(bytes.Buffer)
+			if _, err = vault.WriteTo(sealed); err != nil {
+				t.Fatal(err)
+			}
+
+			if v := sealed.Bytes()[len(magic)]; v != tc.version {
+				t.Fatalf("Expected a version %d header, got %d", tc.version, v)
+			}
+
+			if _, err = ExtractTo(sealed, key, t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// The header every field of the format is in. Its bytes
+// are pinned in testdata/header.golden, a change of the
+// layout breaks the vaults already written
+func goldenHeader() *Header {
+	return &Header{
+		Version:     extVersion,
+		Suite:       AES256GCM,
+		Compression: Zstd,
+		Extensions: []HeaderExtension{
+			{Type: extBufSize, Value: []byte{0x00, 0x10, 0x00}},
+			{Type: extKeyfile, Value: []byte{}},
+		},
+		KDF:       KDFPBKDF2,
+		KDFParams: []byte{0x00, 0x09, 0x27, 0xc0},
+		Salt:      []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		Nonce:     []byte{0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7},
+		Info:      []byte("info"),
+	}
+}
+
+func TestHeaderGolden(t *testing.T) {
+	golden, err := os.ReadFile("testdata/header.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Marshal", func(t *testing.T) {
+		b, err := goldenHeader().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, golden) {
+			t.Fatalf("The layout changed:\n got %x\nwant %x", b, golden)
+		}
+	})
+
+	t.Run("Unmarshal", func(t *testing.T) {
+		h := new(Header)
+		if err := h.UnmarshalBinary(golden); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(h, goldenHeader()) {
+			t.Fatalf("Got %+v", h)
+		}
+	})
+
+	// The vaults of this package are written with the same
+	// layout
+	t.Run("Vault header", func(t *testing.T) {
+		w := goldenHeader()
+		h := &header{suite: AES256GCM, compression: Zstd, bufSize: 1 << 12, keyfile: true, kdf: PBKDF2Params{Iterations: 600000}, salt: w.Salt, nonce: w.Nonce, info: w.Info}
+
+		b, err := h.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, golden) {
+			t.Fatalf("The vault header is not the Header:\n got %x\nwant %x", b, golden)
+		}
+
+		parsed, _, err := parseHeader(bytes.NewReader(golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed.bufSize != 1<<12 || !parsed.keyfile || parsed.kdf != (PBKDF2Params{Iterations: 600000}) {
+			t.Fatalf("The fields were not decoded: %+v", parsed)
+		}
+	})
+
+	t.Run("Trailing bytes", func(t *testing.T) {
+		if err := new(Header).UnmarshalBinary(append(golden, 0)); err == nil {
+			t.Fatal("The byte after the header was accepted")
+		}
+	})
+}
+
+func TestHeaderMarshalBad(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(h *Header)
+	}{
+		{"Future version", func(h *Header) { h.Version = 3 }},
+		{"Version 1 with extensions", func(h *Header) { h.Version = formatVersion }},
+		{"Version 2 without extensions", func(h *Header) { h.Extensions = nil }},
+		{"Extensions out of order", func(h *Header) { h.Extensions[0].Type = extKeyfile }},
+		{"Raw key with salt", func(h *Header) { h.KDF = 0 }},
+		{"Long salt", func(h *Header) { h.Salt = make([]byte, 256) }},
+		{"Long nonce", func(h *Header) { h.Nonce = make([]byte, 256) }},
+		{"Long info", func(h *Header) { h.Info = make([]byte, 1<<16) }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := goldenHeader()
+			tc.modify(h)
+
+			if _, err := h.MarshalBinary(); err == nil {
+				t.Fatal("The header should not marshal")
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VaultInfo describes what was sealed in a vault. It is
+// stored encrypted in the header, so it can be read
+// without decrypting the whole body
+type VaultInfo struct {
+	// Number of entries in the tar, or -1 if the vault
+	// was streamed with EncryptTo
+	Files int
+
+	// Total size of the files, before compression, or -1
+	// if the vault was streamed with EncryptTo
+	Size int64
+
+	// SHA-256 of the compressed tar, exactly as it was
+	// encrypted. See TarReader.Verify
+	Checksum [sha256.Size]byte
+
+	// Size of the compressed tar, or -1 if the vault was
+	// streamed with EncryptTo or sealed before it was
+	// recorded. It tells a truncated vault from a modified one
+	ArchiveSize int64
+}
+
+// The info of vaults streamed before knowing what they hold
+var unknownInfo = VaultInfo{Files: -1, Size: -1, ArchiveSize: -1}
+
+// Whether the info was recorded when sealing the vault
+func (i *VaultInfo) known() bool {
+	return i.Files >= 0
+}
+
+// Length of the serialized info, and of the info written
+// before it had the size of the archive
+const (
+	infoLen    = 24 + sha256.Size
+	oldInfoLen = 16 + sha256.Size
+)
+
+// Serialize the info
+func (i VaultInfo) marshal() []byte {
+	b := make([]byte, infoLen)
+	binary.BigEndian.PutUint64(b[0:], uint64(i.Files))
+	binary.BigEndian.PutUint64(b[8:], uint64(i.Size))
+	copy(b[16:], i.Checksum[:])
+	binary.BigEndian.PutUint64(b[oldInfoLen:], uint64(i.ArchiveSize))
+	return b
+}
+
+// Read the info serialized by marshal
+func unmarshalInfo(b []byte) (VaultInfo, error) {
+	if len(b) != infoLen && len(b) != oldInfoLen {
+		return VaultInfo{}, errors.New("arcsek: malformed vault info")
+	}
+
+	info := VaultInfo{
+		Files:       int(binary.BigEndian.Uint64(b[0:])),
+		Size:        int64(binary.BigEndian.Uint64(b[8:])),
+		ArchiveSize: -1,
+	}
+	copy(info.Checksum[:], b[16:])
+
+	if len(b) == infoLen {
+		info.ArchiveSize = int64(binary.BigEndian.Uint64(b[oldInfoLen:]))
+	}
+
+	return info, nil
+}
+
+// Encrypt the info with the AEAD of the vault. The nonce
+// is random, unless one is given, and goes in front of the
+// sealed info. The prefix of the header is the associated
+// data, so the info can't be moved to another vault.
+//
+// The body is sealed by sio with the same key, but a
+// random nonce of the full AEAD size won't collide with
+// the nonces sio derives
+func sealInfo(aead cipher.AEAD, info VaultInfo, prefix, nonce []byte) ([]byte, error) {
+	if nonce == nil {
+		var err error
+		if nonce, err = newNonce(aead.NonceSize()); err != nil {
+			return nil, err
+		}
+	}
+
+	return aead.Seal(bytes.Clone(nonce), nonce, info.marshal(), prefix), nil
+}
+
+// Decrypt and authenticate the info sealed by sealInfo
+func openInfo(aead cipher.AEAD, sealed, prefix []byte) (VaultInfo, error) {
+	ns := aead.NonceSize()
+	if len(sealed) < ns {
+		return VaultInfo{}, errors.New("arcsek: malformed vault info")
+	}
+
+	b, err := aead.Open(nil, sealed[:ns], sealed[ns:], prefix)
+	if err != nil {
+		return VaultInfo{}, fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+
+	return unmarshalInfo(b)
+}
+
+// ReadVaultInfo reads the header of the vault in r and
+// returns what the vault holds, without decrypting the
+// body. The key is the same used to open the vault.
+//
+// Only the header is consumed. To open the vault
+// afterwards, seek r back to the start
+func ReadVaultInfo(r io.Reader, key []byte) (*VaultInfo, error) {
+	return new(VaultOpener).ReadVaultInfo(r, key)
+}
+
+// ReadVaultInfo is like the ReadVaultInfo function but
+// opens the header with the settings of the opener
+func (o *VaultOpener) ReadVaultInfo(r io.Reader, key []byte) (*VaultInfo, error) {
+	h, raw, aead, err := o.openHeader(r, key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := openInfo(aead, h.info, h.withAAD(h.prefix(raw)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
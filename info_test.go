@@ -0,0 +1,221 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadVaultInfo(t *testing.T) {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+		"testing-files/in/existance/testfile4.txt",
+	}
+
+	var size int64
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += fi.Size()
+	}
+
+	key := genKey("info")
+	vault, err := NewVaultReader(files, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+	r := bytes.NewReader(buff.Bytes())
+
+	info, err := ReadVaultInfo(r, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Files != len(files) || info.Size != size {
+		t.Fatalf("Expected %d files and %d bytes, got %+v", len(files), size, info)
+	}
+
+	// The vault can still be opened after going back
+	r.Seek(0, io.SeekStart)
+	if _, err = NewTarReaderNonce(r, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadVaultInfoBad(t *testing.T) {
+	key := genKey("info")
+	vault := sealTestVault(t, key).Bytes()
+
+	if _, err := ReadVaultInfo(bytes.NewReader(vault), genKey("other")); err == nil {
+		t.Fatal("The info must not be readable with another key")
+	}
+
+	h, raw, err := parseHeader(bytes.NewReader(vault))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last byte of the header is the tag of the info
+	tampered := append([]byte(nil), vault...)
+	tampered[len(raw)-1] ^= 1
+
+	if _, err := ReadVaultInfo(bytes.NewReader(tampered), key); err == nil {
+		t.Fatal("A tampered info must not be accepted")
+	}
+
+	// Moving the info to another vault must fail as well
+	other, _, err := parseHeader(sealTestVault(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other.info = h.info
+	moved, err := other.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadVaultInfo(bytes.NewReader(moved), key); err == nil {
+		t.Fatal("The info of another vault must not be accepted")
+	}
+}
+
+func TestTarReaderVerify(t *testing.T) {
+	key := genKey("verify")
+
+	t.Run("After reading the entries", func(t *testing.T) {
+		tr, err := NewTarReader(sealTestVault(t, key), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			if _, err := tr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(ioutil.Discard, tr)
+		}
+
+		if err := tr.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Without reading anything", func(t *testing.T) {
+		tr, err := NewTarReader(sealTestVault(t, key), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tr.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Wrong checksum", func(t *testing.T) {
+		tr, err := NewTarReader(sealTestVault(t, key), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Emulate an archive that changed after it was hashed
+		tr.info.Checksum[0] ^= 1
+
+		if err := tr.Verify(); err != ErrChecksumMismatch {
+			t.Fatalf("Expected ErrChecksumMismatch, got '%v'", err)
+		}
+	})
+
+	t.Run("Legacy vault", func(t *testing.T) {
+		opener := VaultOpener{AllowLegacy: true}
+		tr, err := opener.Open(sealLegacyVault(t, key), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tr.Verify(); err == nil {
+			t.Fatal("Legacy vaults have no checksum to verify")
+		}
+	})
+}
+
+func TestChecksumOfArchive(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	arc, err := createTestArchive(t, 0, new(VaultBuilder).addFiles(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(arc.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sha256.Sum256(b) != arc.info.Checksum {
+		t.Fatal("The checksum is not the one of the archive")
+	}
+}
+
+func TestVerifyVault(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt", "testing-files/in/existance/testfile2.txt"}
+	key := genKey("verify")
+
+	vault, err := NewVaultReader(files, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := ioutil.ReadAll(vault)
+	vault.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streamed vaults have no checksum but can be verified
+	streamed := new(bytes.Buffer)
+	if err = EncryptTo(streamed, files, key); err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := append([]byte(nil), good...)
+	flipped[len(flipped)-20] ^= 1
+
+	testCases := []struct {
+		name string
+		data []byte
+		key  []byte
+		want error
+	}{
+		{"Good", good, key, nil},
+		{"Streamed", streamed.Bytes(), key, nil},
+		{"Wrong key", good, genKey("other"), ErrAuthFailed},
+		{"Truncated", good[:len(good)-10], key, ErrTruncated},
+		{"Modified", flipped, key, ErrAuthFailed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyVault(bytes.NewReader(tc.data), tc.key)
+			if tc.want == nil && err != nil {
+				t.Fatal(err)
+			}
+
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Expected %v but got %v", tc.want, err)
+			}
+		})
+	}
+}
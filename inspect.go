@@ -0,0 +1,149 @@
+package arcsek
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/secure-io/sio-go"
+)
+
+// VaultHeader is what the plain header of a vault says,
+// for debugging vaults that won't open. See InspectVault
+type VaultHeader struct {
+	// Magic is the signature, always "ARCSEK"
+	Magic string
+
+	// Version of the header format
+	Version int
+
+	Suite       CipherSuite
+	Compression Compression
+
+	// BufferSize is the size of the chunks of the stream
+	BufferSize int
+
+	// KDF is the id of the key derivation function, or 0 if
+	// the vault was sealed with a raw key. Salt is its salt
+	KDF  byte
+	Salt string
+
+	// Nonce, in hex
+	Nonce string
+
+	// Recipients is how many keys can open the vault, or 0
+	// if it was not sealed for several recipients
+	Recipients int
+
+	// PublicKey is set if the vault was sealed for an X25519
+	// public key, Keyfile if a keyfile is needed too
+	PublicKey bool
+	Keyfile   bool
+
+	// KeyID is the id of the key set by VaultBuilder.KeyID,
+	// nil if there is none. The key is found with it but not
+	// checked: a vault can have any id
+	KeyID []byte
+
+	// BaseManifest is the ManifestID of the base of a
+	// differential vault, nil for the others
+	BaseManifest []byte
+
+	// Dictionary is whether the archive is compressed with
+	// a dictionary, which is sealed in the header, see
+	// VaultBuilder.Dictionary
+	Dictionary bool
+
+	// HeaderSize is the length of the whole header and
+	// InfoSize the one of the sealed VaultInfo in it. The
+	// info itself can only be read with the key, see
+	// ReadVaultInfo
+	HeaderSize int
+	InfoSize   int
+}
+
+// InspectVault parses the plain header of the vault in r,
+// without the key. Nothing is decrypted and only the header
+// is consumed, unless the vault is armored.
+//
+// It returns ErrBadMagic if r is not an arcsek vault
+func InspectVault(r io.Reader) (*VaultHeader, error) {
+	r, err := unarmor(r)
+	if err != nil {
+		return nil, err
+	}
+
+	h, raw, err := parseHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	vh := &VaultHeader{
+		Magic:        string(raw[:len(magic)]),
+		Version:      int(raw[len(magic)]),
+		Suite:        h.suite,
+		Compression:  h.compression,
+		BufferSize:   h.bufSize,
+		Salt:         hex.EncodeToString(h.salt),
+		Nonce:        hex.EncodeToString(h.nonce),
+		Recipients:   len(h.recipients),
+		PublicKey:    h.ephemeral != nil,
+		Keyfile:      h.keyfile,
+		KeyID:        h.keyID,
+		BaseManifest: h.base,
+		Dictionary:   h.sealedDictionary != nil,
+		HeaderSize:   len(raw),
+		InfoSize:     len(h.info),
+	}
+
+	if vh.BufferSize == 0 {
+		vh.BufferSize = sio.BufSize
+	}
+
+	if h.kdf != nil {
+		vh.KDF = h.kdf.ID()
+	}
+
+	return vh, nil
+}
+
+// String returns the fields of the header, one per line
+func (h *VaultHeader) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "magic:       %s\n", h.Magic)
+	fmt.Fprintf(&b, "version:     %d\n", h.Version)
+	fmt.Fprintf(&b, "suite:       %v (%d)\n", h.Suite, byte(h.Suite))
+	fmt.Fprintf(&b, "compression: %v (%d)\n", h.Compression, byte(h.Compression))
+	fmt.Fprintf(&b, "buffer size: %d\n", h.BufferSize)
+
+	if h.KDF == 0 {
+		fmt.Fprintf(&b, "kdf:         none, raw key\n")
+	} else {
+		fmt.Fprintf(&b, "kdf:         %d, salt %s\n", h.KDF, h.Salt)
+	}
+
+	fmt.Fprintf(&b, "nonce:       %s\n", h.Nonce)
+
+	if h.Recipients > 0 {
+		fmt.Fprintf(&b, "recipients:  %d\n", h.Recipients)
+	}
+	if h.PublicKey {
+		fmt.Fprintf(&b, "public key:  yes\n")
+	}
+	if h.Keyfile {
+		fmt.Fprintf(&b, "keyfile:     yes\n")
+	}
+	if h.KeyID != nil {
+		fmt.Fprintf(&b, "key id:      %x\n", h.KeyID)
+	}
+	if h.BaseManifest != nil {
+		fmt.Fprintf(&b, "base:        %x\n", h.BaseManifest)
+	}
+	if h.Dictionary {
+		fmt.Fprintf(&b, "dictionary:  yes\n")
+	}
+
+	fmt.Fprintf(&b, "header size: %d bytes, %d of sealed info\n", h.HeaderSize, h.InfoSize)
+	return b.String()
+}
@@ -0,0 +1,95 @@
+package arcsek
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/secure-io/sio-go"
+)
+
+// Serialize the vault and close it
+func vaultBytes(t *testing.T, vault *VaultReader, err error) []byte {
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	if _, err = vault.WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff.Bytes()
+}
+
+func TestInspectVault(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	t.Run("Raw key", func(t *testing.T) {
+		v, err := NewVaultReader(files, genKey("inspect"))
+		nonce := hex.EncodeToString(v.Nonce())
+		vault := vaultBytes(t, v, err)
+
+		r := bytes.NewReader(vault)
+		h, err := InspectVault(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Magic != "ARCSEK" || h.Version != formatVersion || h.Suite != AES128GCM || h.Compression != Gzip {
+			t.Fatalf("Wrong header:\n%s", h)
+		}
+
+		if h.Nonce != nonce || h.KDF != 0 || h.BufferSize != sio.BufSize {
+			t.Fatalf("Wrong header:\n%s", h)
+		}
+
+		// Only the header was read
+		if h.HeaderSize != len(vault)-r.Len() {
+			t.Fatalf("The header has %d bytes but %d were read", h.HeaderSize, len(vault)-r.Len())
+		}
+
+		// GCM nonce, info and tag
+		if h.InfoSize != 12+infoLen+16 {
+			t.Fatalf("The sealed info has %d bytes", h.InfoSize)
+		}
+	})
+
+	t.Run("Password", func(t *testing.T) {
+		b := VaultBuilder{KeyDeriver: PBKDF2Params{Iterations: minPBKDF2Iterations}, BufferSize: 1 << 12}
+		v, err := b.Build(files, []byte("password"))
+		vault := vaultBytes(t, v, err)
+
+		h, err := InspectVault(bytes.NewReader(vault))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.KDF != KDFPBKDF2 || h.Salt == "" || h.BufferSize != 1<<12 || h.Version != extVersion {
+			t.Fatalf("Wrong header:\n%s", h)
+		}
+	})
+
+	t.Run("Recipients", func(t *testing.T) {
+		v, err := NewVaultReaderMultiRecipient(files, [][]byte{genKey("a"), genKey("b")})
+		vault := vaultBytes(t, v, err)
+
+		h, err := InspectVault(strings.NewReader(armor(t, vault)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Recipients != 2 || !strings.Contains(h.String(), "recipients:  2") {
+			t.Fatalf("Wrong header:\n%s", h)
+		}
+	})
+
+	t.Run("Not a vault", func(t *testing.T) {
+		if _, err := InspectVault(strings.NewReader("PK\x03\x04 a zip file")); !errors.Is(err, ErrBadMagic) {
+			t.Fatalf("Got %v instead of ErrBadMagic", err)
+		}
+	})
+}
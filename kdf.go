@@ -0,0 +1,487 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Identifiers of the built-in key derivation functions.
+// The id is the first byte of the salt block so the vault
+// can be opened with the same function it was sealed with.
+//
+// Custom derivers must use other ids. The id 0 means the
+// vault was sealed with a raw key
+const (
+	KDFScrypt   byte = 1
+	KDFArgon2id byte = 2
+	KDFPBKDF2   byte = 3
+)
+
+// Length of the keys derived by scrypt and PBKDF2. Both
+// always produce an AES-256 key
+const scryptKeyLen = 32
+
+// The lowest PBKDF2 iteration count we accept. Anything
+// below it is too cheap to brute force
+const minPBKDF2Iterations = 10000
+
+// Upper bound for the PBKDF2 iterations read from a vault
+const maxPBKDF2Iterations = 1 << 24
+
+// Salt length used when the deriver does not specify one
+const defaultSaltLen = 16
+
+// Upper bound for the memory a key derivation may use when
+// reading its params from a vault. The params come from
+// untrusted data so we must not allocate whatever they ask for
+const maxKDFMemory = 1 << 30
+
+// Upper bound for the argon2 passes read from a vault
+const maxArgon2Time = 64
+
+// Upper bound for the scrypt parallelization read from a
+// vault. Each unit of p is another pass over the memory
+const maxScryptP = 16
+
+// KeyDeriver derives the key of a vault from a password.
+//
+// If the deriver also implements encoding.BinaryMarshaler
+// its params are stored in the vault next to the salt and
+// handed back to the function registered for its ID when
+// the vault is opened.
+type KeyDeriver interface {
+	// ID identifies the deriver in the vault header
+	ID() byte
+	// Derive returns the key for the password and salt.
+	// It must be 16 or 32 bytes long
+	Derive(password []byte, salt []byte) ([]byte, error)
+}
+
+// Builds a KeyDeriver from the params stored in a vault
+type keyDeriverFunc func(params []byte) (KeyDeriver, error)
+
+var (
+	derivers   = make(map[byte]keyDeriverFunc)
+	deriversMu sync.RWMutex
+)
+
+func init() {
+	RegisterKeyDeriver(KDFScrypt, func(params []byte) (KeyDeriver, error) {
+		return readScryptParams(bytes.NewReader(params))
+	})
+	RegisterKeyDeriver(KDFArgon2id, func(params []byte) (KeyDeriver, error) {
+		return readArgon2Params(bytes.NewReader(params))
+	})
+	RegisterKeyDeriver(KDFPBKDF2, func(params []byte) (KeyDeriver, error) {
+		return readPBKDF2Params(bytes.NewReader(params))
+	})
+}
+
+// RegisterKeyDeriver makes a key derivation function
+// available to open vaults whose header carries id.
+// fn receives the params the deriver marshaled when the
+// vault was sealed, which are empty if it doesn't
+// implement encoding.BinaryMarshaler.
+//
+// The id 0 is reserved for vaults sealed with a raw key.
+//
+// It panics if fn is nil or the id is 0 or already
+// registered, so it is meant to be called from init functions
+func RegisterKeyDeriver(id byte, fn func(params []byte) (KeyDeriver, error)) {
+	deriversMu.Lock()
+	defer deriversMu.Unlock()
+
+	if fn == nil {
+		panic("arcsek: RegisterKeyDeriver with a nil function")
+	}
+
+	if id == 0 {
+		panic("arcsek: RegisterKeyDeriver with the reserved id 0")
+	}
+
+	if _, dup := derivers[id]; dup {
+		panic(fmt.Sprintf("arcsek: RegisterKeyDeriver called twice for id %d", id))
+	}
+
+	derivers[id] = fn
+}
+
+// Find the deriver for the id and params of a vault
+func lookupKeyDeriver(id byte, params []byte) (KeyDeriver, error) {
+	deriversMu.RLock()
+	fn, ok := derivers[id]
+	deriversMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("arcsek: unknown key derivation function id %d", id)
+	}
+
+	return fn(params)
+}
+
+// ScryptParams are the cost parameters used to derive
+// a key from a password with scrypt.
+//
+// They are stored in the vault next to the salt so they
+// are not needed again to open it. As they come from the
+// vault, it only opens if they need at most 1 GiB of
+// memory, 128 * R * (N + P) bytes, and P is at most 16.
+// Sealing with params past those bounds fails
+type ScryptParams struct {
+	// CPU/memory cost. Must be a power of 2 greater than 1
+	N int
+	// Block size
+	R int
+	// Parallelization
+	P int
+	// Length of the random salt in bytes. If zero a 16
+	// byte salt is used
+	SaltLen int
+}
+
+// DefaultScryptParams takes roughly 100ms to derive a key
+// on a modern laptop and uses 32 MB of memory
+var DefaultScryptParams = ScryptParams{N: 1 << 15, R: 8, P: 1}
+
+// ID implements KeyDeriver
+func (p ScryptParams) ID() byte { return KDFScrypt }
+
+func (p ScryptParams) saltLen() int { return p.SaltLen }
+
+// Derive implements KeyDeriver. It always produces
+// an AES-256 key
+func (p ScryptParams) Derive(password, salt []byte) ([]byte, error) {
+	return scrypt.Key(password, salt, p.N, p.R, p.P, scryptKeyLen)
+}
+
+// MarshalBinary stores N, r and p as 4 byte big endian integers
+func (p ScryptParams) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:], uint32(p.N))
+	binary.BigEndian.PutUint32(b[4:], uint32(p.R))
+	binary.BigEndian.PutUint32(b[8:], uint32(p.P))
+	return b, nil
+}
+
+func readScryptParams(r *bytes.Reader) (ScryptParams, error) {
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(r, b); err != nil || r.Len() != 0 {
+		return ScryptParams{}, errors.New("arcsek: malformed scrypt params in vault")
+	}
+
+	p := ScryptParams{
+		N: int(binary.BigEndian.Uint32(b[0:])),
+		R: int(binary.BigEndian.Uint32(b[4:])),
+		P: int(binary.BigEndian.Uint32(b[8:])),
+	}
+
+	if err := p.check(); err != nil {
+		return ScryptParams{}, fmt.Errorf("arcsek: invalid scrypt params in vault: %v", err)
+	}
+
+	return p, nil
+}
+
+// Check the params are within the bounds of those read from
+// a vault, sealing with others would make a vault that
+// never opens
+func (p ScryptParams) check() error {
+	if p.N <= 1 || p.N&(p.N-1) != 0 || p.R <= 0 || p.P <= 0 {
+		return errors.New("scrypt N must be a power of 2 greater than 1, and r and p positive")
+	}
+
+	if p.P > maxScryptP {
+		return fmt.Errorf("scrypt p must be at most %d", maxScryptP)
+	}
+
+	// scrypt needs 128 * r * (N + p) bytes of memory, and
+	// its time grows with N * r * p. r is checked first so
+	// the product can't overflow
+	if p.R > maxKDFMemory/128 || int64(p.R)*(int64(p.N)+int64(p.P)) > maxKDFMemory/128 {
+		return errors.New("scrypt params must need at most 1 GiB of memory")
+	}
+
+	return nil
+}
+
+// Argon2Params are the cost parameters used to derive
+// a key from a password with Argon2id.
+//
+// Like ScryptParams, they are stored in the vault. It only
+// opens if Time is at most 64 and Memory at most 1 GiB, so
+// sealing with more fails. That rules out the first option
+// of RFC 9106, which takes 2 GiB
+type Argon2Params struct {
+	// Number of passes over the memory
+	Time uint32
+	// Memory used in KiB
+	Memory uint32
+	// Number of threads
+	Threads uint8
+	// Length of the derived key. 16 for AES-128 or 32
+	// for AES-256
+	KeyLen uint32
+	// Length of the random salt in bytes. If zero a 16
+	// byte salt is used
+	SaltLen int
+}
+
+// DefaultArgon2Params follows the second recommended option
+// of RFC 9106 and produces an AES-256 key
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4, KeyLen: 32}
+
+// ID implements KeyDeriver
+func (p Argon2Params) ID() byte { return KDFArgon2id }
+
+func (p Argon2Params) saltLen() int { return p.SaltLen }
+
+// Derive implements KeyDeriver
+func (p Argon2Params) Derive(password, salt []byte) ([]byte, error) {
+	// argon2 panics instead of returning an error
+	if p.Time == 0 || p.Threads == 0 {
+		return nil, errors.New("arcsek: argon2 time and threads must be greater than 0")
+	}
+
+	if p.KeyLen == 0 || p.KeyLen > 255 {
+		return nil, errors.New("arcsek: argon2 key length must be between 1 and 255 bytes")
+	}
+
+	return argon2.IDKey(password, salt, p.Time, p.Memory, p.Threads, p.KeyLen), nil
+}
+
+// MarshalBinary stores time (4 bytes), memory (4 bytes),
+// threads (1 byte) and the key length (1 byte)
+func (p Argon2Params) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 10)
+	binary.BigEndian.PutUint32(b[0:], p.Time)
+	binary.BigEndian.PutUint32(b[4:], p.Memory)
+	b[8] = p.Threads
+	b[9] = byte(p.KeyLen)
+	return b, nil
+}
+
+func readArgon2Params(r *bytes.Reader) (Argon2Params, error) {
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(r, b); err != nil || r.Len() != 0 {
+		return Argon2Params{}, errors.New("arcsek: malformed argon2 params in vault")
+	}
+
+	p := Argon2Params{
+		Time:    binary.BigEndian.Uint32(b[0:]),
+		Memory:  binary.BigEndian.Uint32(b[4:]),
+		Threads: b[8],
+		KeyLen:  uint32(b[9]),
+	}
+
+	if err := p.check(); err != nil {
+		return Argon2Params{}, fmt.Errorf("arcsek: invalid argon2 params in vault: %v", err)
+	}
+
+	return p, nil
+}
+
+// Check the params are within the bounds of those read from
+// a vault, like ScryptParams.check
+func (p Argon2Params) check() error {
+	if p.Time == 0 || p.Threads == 0 || p.KeyLen == 0 || p.KeyLen > 255 {
+		return errors.New("argon2 time and threads must be positive, and the key length between 1 and 255 bytes")
+	}
+
+	if p.Time > maxArgon2Time {
+		return fmt.Errorf("argon2 time must be at most %d", maxArgon2Time)
+	}
+
+	if int64(p.Memory)*1024 > maxKDFMemory {
+		return errors.New("argon2 memory must be at most 1 GiB")
+	}
+
+	return nil
+}
+
+// PBKDF2Params derive an AES-256 key with PBKDF2-HMAC-SHA256,
+// which only relies on FIPS approved primitives
+type PBKDF2Params struct {
+	// Must be at least 10000
+	Iterations int
+}
+
+// ID implements KeyDeriver
+func (p PBKDF2Params) ID() byte { return KDFPBKDF2 }
+
+// Derive implements KeyDeriver
+func (p PBKDF2Params) Derive(password, salt []byte) ([]byte, error) {
+	if p.Iterations < minPBKDF2Iterations {
+		return nil, fmt.Errorf("arcsek: %d PBKDF2 iterations are too few, use at least %d",
+			p.Iterations, minPBKDF2Iterations)
+	}
+
+	return pbkdf2.Key(sha256.New, string(password), salt, p.Iterations, scryptKeyLen)
+}
+
+// MarshalBinary stores the iterations as a 4 byte big
+// endian integer
+func (p PBKDF2Params) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(p.Iterations))
+	return b, nil
+}
+
+func readPBKDF2Params(r *bytes.Reader) (PBKDF2Params, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil || r.Len() != 0 {
+		return PBKDF2Params{}, errors.New("arcsek: malformed PBKDF2 params in vault")
+	}
+
+	p := PBKDF2Params{Iterations: int(binary.BigEndian.Uint32(b))}
+	if err := p.check(); err != nil {
+		return PBKDF2Params{}, fmt.Errorf("arcsek: invalid PBKDF2 params in vault: %v", err)
+	}
+
+	return p, nil
+}
+
+// Check the iterations are within the bounds of those read
+// from a vault, like ScryptParams.check
+func (p PBKDF2Params) check() error {
+	if p.Iterations < minPBKDF2Iterations || p.Iterations > maxPBKDF2Iterations {
+		return fmt.Errorf("PBKDF2 iterations must be between %d and %d", minPBKDF2Iterations, maxPBKDF2Iterations)
+	}
+	return nil
+}
+
+// The built-in derivers let the caller choose the salt length
+func saltLenOf(kd KeyDeriver) int {
+	if s, ok := kd.(interface{ saltLen() int }); ok && s.saltLen() != 0 {
+		return s.saltLen()
+	}
+	return defaultSaltLen
+}
+
+// Generate a random salt of the given length
+func newSalt(n int) ([]byte, error) {
+	if n <= 0 || n > 255 {
+		return nil, errors.New("arcsek: salt length must be between 1 and 255 bytes")
+	}
+
+	salt := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+// Check the params of a built-in deriver before sealing with
+// it. Custom derivers check their own
+func checkDeriverParams(kd KeyDeriver) error {
+	if err := deriverParamsErr(kd); err != nil {
+		return fmt.Errorf("arcsek: %v", err)
+	}
+	return nil
+}
+
+// The error of the bounds check of a built-in deriver, the
+// same one its params go through when read from a vault
+func deriverParamsErr(kd KeyDeriver) error {
+	if c, ok := kd.(interface{ check() error }); ok {
+		return c.check()
+	}
+	return nil
+}
+
+// The params of the deriver stored in the header
+func kdfParams(kd KeyDeriver) ([]byte, error) {
+	if kd.ID() == 0 {
+		return nil, errors.New("arcsek: key derivers can not use the id 0")
+	}
+
+	var params []byte
+	if m, ok := kd.(encoding.BinaryMarshaler); ok {
+		var err error
+		if params, err = m.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(params) > 255 {
+		return nil, errors.New("arcsek: key derivation params longer than 255 bytes")
+	}
+
+	return params, nil
+}
+
+// Append the salt block to b. The lengths must fit in a byte
+func appendSaltBlock(b []byte, id byte, params, salt []byte) []byte {
+	if id == 0 {
+		return append(b, 0)
+	}
+
+	b = append(b, id, byte(len(params)))
+	b = append(b, params...)
+	b = append(b, byte(len(salt)))
+
+	return append(b, salt...)
+}
+
+// The fields of the salt block, as they are stored
+func readSaltFields(r io.Reader) (id byte, params, salt []byte, err error) {
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(r, b[:1]); err != nil {
+		return 0, nil, nil, err
+	}
+
+	if b[0] == 0 {
+		return 0, nil, nil, nil
+	}
+
+	if _, err = io.ReadFull(r, b[1:]); err != nil {
+		return 0, nil, nil, err
+	}
+	id = b[0]
+
+	params = make([]byte, b[1])
+	if _, err = io.ReadFull(r, params); err != nil {
+		return 0, nil, nil, err
+	}
+
+	if _, err = io.ReadFull(r, b[:1]); err != nil {
+		return 0, nil, nil, err
+	}
+
+	salt = make([]byte, b[0])
+	if _, err = io.ReadFull(r, salt); err != nil {
+		return 0, nil, nil, err
+	}
+
+	return id, params, salt, nil
+}
+
+// The deriver of the id and params read from a vault, or nil
+// for the id 0 of raw keys
+func deriverFor(id byte, params, salt []byte) (KeyDeriver, error) {
+	if id == 0 {
+		return nil, nil
+	}
+
+	kd, err := lookupKeyDeriver(id, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(salt) == 0 {
+		return nil, errors.New("arcsek: the vault has an empty salt")
+	}
+
+	return kd, nil
+}
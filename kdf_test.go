@@ -0,0 +1,397 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Cheap params so the tests run fast
+var testScryptParams = ScryptParams{N: 1 << 10, R: 8, P: 1}
+
+// Seal some files with a password and store them like
+// they would be stored in a file
+func sealWithPassword(t *testing.T, password string, params ScryptParams) *bytes.Buffer {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+	}
+
+	vault, err := NewVaultReaderPassword(files, password, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	if _, err = vault.WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff
+}
+
+func TestPasswordRoundTrip(t *testing.T) {
+	buff := sealWithPassword(t, "correct horse", testScryptParams)
+
+	tr, err := NewTarReaderPassword(buff, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Name != "testfile1.txt" {
+		t.Fatalf("Unexpected first entry '%s'", hdr.Name)
+	}
+}
+
+func TestPasswordWrong(t *testing.T) {
+	buff := sealWithPassword(t, "correct horse", testScryptParams)
+
+	// The wrong key cannot authenticate the gzip header
+	if _, err := NewTarReaderPassword(buff, "battery staple"); err == nil {
+		t.Fatal("A wrong password should not open the vault")
+	}
+}
+
+func TestScryptParamsStored(t *testing.T) {
+	params := ScryptParams{N: 1 << 11, R: 4, P: 2, SaltLen: 24}
+	buff := sealWithPassword(t, "pw", params)
+
+	h, _, err := parseHeader(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kd, salt := h.kdf, h.salt
+
+	// The salt length is recorded by the salt itself
+	want := ScryptParams{N: params.N, R: params.R, P: params.P}
+	if stored, ok := kd.(ScryptParams); !ok || stored != want {
+		t.Fatalf("Stored params %+v do not match %+v", stored, params)
+	}
+
+	if len(salt) != 24 {
+		t.Fatalf("Expected a 24 byte salt, got %d", len(salt))
+	}
+}
+
+func TestScryptParamsBad(t *testing.T) {
+	tests := []struct {
+		name   string
+		params ScryptParams
+	}{
+		{"N not a power of 2", ScryptParams{N: 1000, R: 8, P: 1}},
+		{"Salt too long", ScryptParams{N: 1 << 10, R: 8, P: 1, SaltLen: 300}},
+	}
+
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewVaultReaderPassword(files, "pw", tc.params); err == nil {
+				t.Fatal("Bad params should return an error")
+			}
+		})
+	}
+}
+
+// The header of a vault sealed with the key derivation of
+// the id and params
+func kdfHeader(t testing.TB, id byte, params []byte) []byte {
+	w := &Header{Version: formatVersion, Suite: AES256GCM, KDF: id, KDFParams: params, Salt: []byte("salt"), Nonce: make([]byte, 8)}
+	raw, err := w.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// Parse the header of a vault sealed with kd, like opening
+// it does
+func parseDeriver(t testing.TB, kd KeyDeriver) error {
+	params, err := kdfParams(kd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = parseHeader(bytes.NewReader(kdfHeader(t, kd.ID(), params)))
+	return err
+}
+
+func TestScryptParamsUntrusted(t *testing.T) {
+	// A header asking for 2^30 blocks of 1 MB must be refused
+	// before scrypt tries to allocate it
+	if err := parseDeriver(t, ScryptParams{N: 1 << 30, R: 1 << 10, P: 1}); err == nil {
+		t.Fatal("Huge params from a vault should be rejected")
+	}
+
+	// And for p, which scrypt allocates 128 * r bytes for
+	// each, and runs that many passes
+	for _, params := range []ScryptParams{
+		{N: 2, R: 1, P: 1<<30 - 1},
+		{N: 1 << 10, R: 8, P: maxScryptP + 1},
+		{N: 2, R: 1<<31 - 1, P: 1<<31 - 1},
+	} {
+		if err := parseDeriver(t, params); err == nil {
+			t.Fatalf("The params %+v from a vault should be rejected", params)
+		}
+	}
+
+	// Same for argon2 asking for 4 TB of memory
+	if err := parseDeriver(t, Argon2Params{Time: 1, Memory: 1<<32 - 1, Threads: 1, KeyLen: 32}); err == nil {
+		t.Fatal("Huge params from a vault should be rejected")
+	}
+}
+
+// A vault sealed with params at the bounds opens, and one
+// with params past them is not sealed at all
+func TestScryptParamsSealBounds(t *testing.T) {
+	largest := []ScryptParams{
+		{N: 1 << 10, R: 8, P: maxScryptP},
+		{N: 1 << 19, R: 8, P: 1},
+	}
+
+	for _, params := range largest {
+		t.Run(fmt.Sprintf("Seal %+v", params), func(t *testing.T) {
+			if params.N > 1<<10 && testing.Short() {
+				t.Skip("Deriving with 512 MiB of memory is slow")
+			}
+
+			buff := sealWithPassword(t, "pw", params)
+			if _, err := NewTarReaderPassword(buff, "pw"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	rejected := []ScryptParams{
+		{N: 1 << 10, R: 8, P: maxScryptP + 1},
+		{N: 1 << 20, R: 8, P: 1},
+		{N: 1 << 19, R: 16, P: 1},
+	}
+
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	for _, params := range rejected {
+		t.Run(fmt.Sprintf("Reject %+v", params), func(t *testing.T) {
+			if _, err := NewVaultReaderPassword(files, "pw", params); err == nil {
+				t.Fatal("A vault was sealed with params it can't be opened with")
+			}
+		})
+	}
+}
+
+// Cheap params so the tests run fast
+var testArgon2Params = Argon2Params{Time: 1, Memory: 1024, Threads: 1, KeyLen: 16}
+
+func TestArgon2RoundTrip(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	vault, err := NewVaultReaderArgon2(files, "hunter2", testArgon2Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+
+	// The password is enough, the reader detects argon2
+	tr, err := NewTarReaderPassword(buff, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArgon2ParamsBad(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	tests := []struct {
+		name   string
+		params Argon2Params
+	}{
+		{"No threads", Argon2Params{Time: 1, Memory: 1024, KeyLen: 32}},
+		{"No passes", Argon2Params{Memory: 1024, Threads: 1, KeyLen: 32}},
+		{"Key not valid for AES", Argon2Params{Time: 1, Memory: 1024, Threads: 1, KeyLen: 20}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewVaultReaderArgon2(files, "pw", tc.params); err == nil {
+				t.Fatal("Bad params should return an error")
+			}
+		})
+	}
+}
+
+// Like TestScryptParamsSealBounds for argon2
+func TestArgon2ParamsSealBounds(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	largest := []Argon2Params{
+		{Time: maxArgon2Time, Memory: 1024, Threads: 1, KeyLen: 32},
+		{Time: 1, Memory: maxKDFMemory / 1024, Threads: 4, KeyLen: 32},
+	}
+
+	for _, params := range largest {
+		t.Run(fmt.Sprintf("Seal %+v", params), func(t *testing.T) {
+			if params.Memory > 1024 && testing.Short() {
+				t.Skip("Deriving with 1 GiB of memory is slow")
+			}
+
+			vault, err := NewVaultReaderArgon2(files, "pw", params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			buff := new(bytes.Buffer)
+			if _, err = vault.WriteTo(buff); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = NewTarReaderPassword(buff, "pw"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	rejected := []Argon2Params{
+		{Time: maxArgon2Time + 1, Memory: 1024, Threads: 1, KeyLen: 32},
+		{Time: 1, Memory: maxKDFMemory/1024 + 1, Threads: 1, KeyLen: 32},
+		// The first option of RFC 9106
+		{Time: 1, Memory: 2 << 20, Threads: 4, KeyLen: 32},
+	}
+
+	for _, params := range rejected {
+		t.Run(fmt.Sprintf("Reject %+v", params), func(t *testing.T) {
+			if _, err := NewVaultReaderArgon2(files, "pw", params); err == nil {
+				t.Fatal("A vault was sealed with params it can't be opened with")
+			}
+		})
+	}
+}
+
+func TestUnknownKDF(t *testing.T) {
+	if _, _, err := parseHeader(bytes.NewReader(kdfHeader(t, 0xEE, nil))); err == nil {
+		t.Fatal("An unknown kdf id should return an error")
+	}
+}
+
+func TestPBKDF2RoundTrip(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	vault, err := NewVaultReaderPBKDF2(files, "hunter2", 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+
+	// The iteration count comes from the vault
+	h, _, err := parseHeader(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, ok := h.kdf.(PBKDF2Params); !ok || p.Iterations != 12345 {
+		t.Fatalf("Unexpected deriver stored in the vault: %+v", h.kdf)
+	}
+
+	tr, err := NewTarReaderPassword(buff, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPBKDF2FewIterations(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	if _, err := NewVaultReaderPBKDF2(files, "pw", 9999); err == nil {
+		t.Fatal("Less than 10000 iterations should be rejected")
+	}
+
+	if err := parseDeriver(t, PBKDF2Params{100}); err == nil {
+		t.Fatal("Less than 10000 iterations should be rejected when reading")
+	}
+}
+
+// A deriver like the ones an enterprise would plug in. It
+// has no params so nothing but its id is stored
+type sha256Deriver struct{}
+
+const testKDFID byte = 0xA0
+
+func (sha256Deriver) ID() byte { return testKDFID }
+
+func (sha256Deriver) Derive(password, salt []byte) ([]byte, error) {
+	k := sha256.Sum256(append(append([]byte{}, salt...), password...))
+	return k[:], nil
+}
+
+func init() {
+	RegisterKeyDeriver(testKDFID, func(params []byte) (KeyDeriver, error) {
+		if len(params) != 0 {
+			return nil, errors.New("the sha256 deriver has no params")
+		}
+		return sha256Deriver{}, nil
+	})
+}
+
+func TestCustomKeyDeriver(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	b := VaultBuilder{KeyDeriver: sha256Deriver{}}
+	vault, err := b.Build(files, []byte("pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+
+	h, _, err := parseHeader(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := h.kdf.(sha256Deriver); !ok {
+		t.Fatal("The header does not record the deriver id")
+	}
+
+	tr, err := NewTarReaderPassword(buff, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterKeyDeriverTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Registering a built-in id again should panic")
+		}
+	}()
+
+	RegisterKeyDeriver(KDFScrypt, func(params []byte) (KeyDeriver, error) {
+		return sha256Deriver{}, nil
+	})
+}
@@ -0,0 +1,22 @@
+package arcsek
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+)
+
+// ErrKeyfileRequired is returned when the vault was sealed
+// with a keyfile and none was given
+var ErrKeyfileRequired = errors.New("arcsek: the vault needs a keyfile")
+
+// Binds the combined key to this package and its use
+const keyfileInfo = "arcsek keyfile"
+
+// Combine the key with the contents of a keyfile with
+// HKDF-SHA256. The key keeps its length, so it still fits
+// the cipher suite
+func combineKeyfile(key, keyfile []byte) ([]byte, error) {
+	sum := sha256.Sum256(keyfile)
+	return hkdf.Key(sha256.New, key, sum[:], keyfileInfo, len(key))
+}
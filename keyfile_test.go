@@ -0,0 +1,65 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeyfile(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	keyfile := []byte("the contents of a file on a usb stick")
+
+	b := VaultBuilder{KeyDeriver: testScryptParams, Keyfile: keyfile}
+	vault, err := b.Build(files, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	sealed := new(bytes.Buffer)
+	if _, err = vault.WriteTo(sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		password string
+		keyfile  []byte
+		err      error
+	}{
+		{"Both", "correct horse", keyfile, nil},
+		{"Password alone", "correct horse", nil, ErrKeyfileRequired},
+		{"Other keyfile", "correct horse", []byte("another file"), ErrAuthFailed},
+		{"Wrong password", "battery staple", keyfile, ErrAuthFailed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := VaultOpener{Keyfile: tc.keyfile}
+			_, err := o.ExtractTo(bytes.NewReader(sealed.Bytes()), []byte(tc.password), t.TempDir())
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected %v but got %v", tc.err, err)
+			}
+		})
+	}
+
+	t.Run("Raw key", func(t *testing.T) {
+		key := genKey("keyfile")
+		b := VaultBuilder{Keyfile: keyfile}
+
+		sealed := new(bytes.Buffer)
+		if err := b.EncryptTo(sealed, files, key); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ExtractTo(bytes.NewReader(sealed.Bytes()), key, t.TempDir()); err != ErrKeyfileRequired {
+			t.Fatalf("Expected ErrKeyfileRequired but got %v", err)
+		}
+
+		o := VaultOpener{Keyfile: keyfile}
+		if _, err := o.ExtractTo(bytes.NewReader(sealed.Bytes()), key, t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
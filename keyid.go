@@ -0,0 +1,27 @@
+package arcsek
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// The longest VaultBuilder.KeyID
+const maxKeyIDLen = 64
+
+// The length of the KeyFingerprint
+const fingerprintLen = 8
+
+var errKeyIDTooLong = errors.New("arcsek: the key id must be at most 64 bytes")
+
+// KeyFingerprint is a short id of a raw key to use as the
+// VaultBuilder.KeyID, the first 8 bytes of a SHA-256 of the
+// key with a label of its own. It tells the keys apart but
+// gives nothing to find the key with: it can't be reversed
+// and a random key is too long to be guessed from it.
+//
+// Don't use it for passwords, which can be guessed. Checking
+// a guess against it would skip the key derivation
+func KeyFingerprint(key []byte) []byte {
+	sum := sha256.Sum256(append([]byte("arcsek key id\x00"), key...))
+	return sum[:fingerprintLen]
+}
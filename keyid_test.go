@@ -0,0 +1,110 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeyID(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	key, other := genKey("key id"), genKey("other key id")
+	id := KeyFingerprint(key)
+
+	b := VaultBuilder{KeyID: id}
+	vault, err := b.Build(files, key)
+	sealed := vaultBytes(t, vault, err)
+
+	t.Run("Round trip", func(t *testing.T) {
+		vh, err := InspectVault(bytes.NewReader(sealed))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(vh.KeyID, id) || vh.Version != extVersion {
+			t.Fatalf("Expected the key id %x in a version %d header but got %x in version %d", id, extVersion, vh.KeyID, vh.Version)
+		}
+
+		if !strings.Contains(vh.String(), "key id:") {
+			t.Fatalf("The key id is not printed:\n%s", vh)
+		}
+
+		if err = VerifyVault(bytes.NewReader(sealed), key); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Fingerprint", func(t *testing.T) {
+		if !bytes.Equal(KeyFingerprint(key), id) || bytes.Equal(KeyFingerprint(other), id) {
+			t.Fatal("The fingerprints don't tell the keys apart")
+		}
+
+		if len(id) != fingerprintLen || bytes.Contains(key, id) {
+			t.Fatalf("Bad fingerprint %x", id)
+		}
+	})
+
+	// The id only says which key to try, the one it names is
+	// still needed
+	t.Run("Wrong key", func(t *testing.T) {
+		if err := VerifyVault(bytes.NewReader(sealed), other); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+
+	t.Run("Forged id", func(t *testing.T) {
+		forged := bytes.Clone(sealed)
+		i := bytes.Index(forged, id)
+		if i < 0 {
+			t.Fatal("The key id is not in the header")
+		}
+		copy(forged[i:], KeyFingerprint(other))
+
+		vh, err := InspectVault(bytes.NewReader(forged))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(vh.KeyID, KeyFingerprint(other)) {
+			t.Fatalf("Expected the forged id but got %x", vh.KeyID)
+		}
+
+		// The header is authenticated, so neither key opens it
+		for _, k := range [][]byte{key, other} {
+			if err := VerifyVault(bytes.NewReader(forged), k); !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("Expected ErrAuthFailed but got %v", err)
+			}
+		}
+	})
+
+	t.Run("Without id", func(t *testing.T) {
+		vault, err := NewVaultReader(files, key)
+		vh, err := InspectVault(bytes.NewReader(vaultBytes(t, vault, err)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if vh.KeyID != nil || vh.Version != 1 {
+			t.Fatalf("Expected a version 1 header without id but got %x in version %d", vh.KeyID, vh.Version)
+		}
+	})
+
+	t.Run("Too long", func(t *testing.T) {
+		b := VaultBuilder{KeyID: make([]byte, maxKeyIDLen+1)}
+		if _, err := b.Build(files, key); err != errKeyIDTooLong {
+			t.Fatalf("Expected errKeyIDTooLong but got %v", err)
+		}
+	})
+
+	t.Run("Rekey", func(t *testing.T) {
+		vault, err := Rekey(bytes.NewReader(sealed), key, other)
+		vh, err := InspectVault(bytes.NewReader(vaultBytes(t, vault, err)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if vh.KeyID != nil {
+			t.Fatalf("The new vault kept the id %x of the old key", vh.KeyID)
+		}
+	})
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package arcsek
+
+import (
+	"os"
+	"time"
+)
+
+// Set the access and modification times of path. The times
+// of a symlink can't be set on this platform, so it is left
+// alone instead of followed
+func lchtimes(path string, t time.Time) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+
+	return os.Chtimes(path, t, t)
+}
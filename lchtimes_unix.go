@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package arcsek
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set the access and modification times of path, or of the
+// symlink itself if it is one
+func lchtimes(path string, t time.Time) error {
+	ts := unix.NsecToTimespec(t.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,28 @@
+package arcsek
+
+// Logger receives diagnostics about the life of a vault:
+// when the key is derived, the nonce generated and the
+// temporal archive created or deleted. Keys, nonces and
+// the contents of the files are never logged.
+//
+// The standard *log.Logger does not implement it, but a
+// small adapter around it or any structured logger does
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// The logger used when there is none, it does nothing
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+
+// The logger of the builder, never nil
+func (b *VaultBuilder) logger() Logger {
+	if b.Logger == nil {
+		return nopLogger{}
+	}
+
+	return b.Logger
+}
@@ -0,0 +1,65 @@
+package arcsek
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Keeps what is logged
+type recordingLogger struct {
+	debug, warn []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.debug = append(l.debug, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.warn = append(l.warn, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	for _, inMemory := range []bool{false, true} {
+		t.Run(fmt.Sprintf("InMemory %v", inMemory), func(t *testing.T) {
+			log := new(recordingLogger)
+			b := VaultBuilder{InMemory: inMemory, Logger: log, KeyDeriver: PBKDF2Params{Iterations: minPBKDF2Iterations}}
+
+			vault, err := b.Build(files, []byte("password"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce := vault.Nonce()
+
+			if err = vault.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			all := strings.Join(log.debug, "\n")
+			for _, want := range []string{"deriving the key", "nonce", "archived"} {
+				if !strings.Contains(all, want) {
+					t.Fatalf("Nothing about %q was logged:\n%s", want, all)
+				}
+			}
+
+			if end := log.debug[len(log.debug)-1]; !strings.Contains(end, "deleted") && !strings.Contains(end, "wiped") {
+				t.Fatalf("Closing the vault was not logged:\n%s", all)
+			}
+
+			// The secrets never reach the log
+			for _, secret := range [][]byte{nonce, []byte("password")} {
+				if strings.Contains(all, hex.EncodeToString(secret)) || bytes.Contains([]byte(all), secret) {
+					t.Fatalf("A secret was logged:\n%s", all)
+				}
+			}
+
+			if len(log.warn) != 0 {
+				t.Fatalf("Nothing should be wrong, but got %v", log.warn)
+			}
+		})
+	}
+}
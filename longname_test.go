@@ -0,0 +1,96 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLongNames(t *testing.T) {
+	key := genKey("long names")
+
+	// 300 characters, in parts short enough for the disk
+	part := strings.Repeat("d", 49)
+	long := path.Join(part, part, part, part, part, part[:46]) + ".txt"
+	if len(long) != 300 {
+		t.Fatalf("The name has %d characters", len(long))
+	}
+
+	src := t.TempDir()
+	file := filepath.Join(src, filepath.FromSlash(long))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("deep down"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A copy with a short name links to the long one
+	if err := os.WriteFile(filepath.Join(src, "short.txt"), []byte("deep down"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name  string
+		build func() (*VaultReader, error)
+	}{
+		{"Files", func() (*VaultReader, error) {
+			b := VaultBuilder{Deduplicate: true}
+			return b.Build([]string{src}, key)
+		}},
+		{"Entries", func() (*VaultReader, error) {
+			return NewVaultReaderEntries([]Entry{entry(long, "deep down")}, key)
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := tc.build()
+			vault := vaultBytes(t, v, err)
+
+			tr, err := NewTarReader(bytes.NewReader(vault), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+
+			found := false
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if hdr.Name != long && hdr.Linkname != long {
+					continue
+				}
+
+				found = true
+				if hdr.Format&tar.FormatPAX == 0 {
+					t.Fatalf("%s was written as %v", hdr.Name, hdr.Format)
+				}
+			}
+
+			if !found {
+				t.Fatal("The long name was not archived whole")
+			}
+
+			dest := t.TempDir()
+			if _, err := ExtractTo(bytes.NewReader(vault), key, dest); err != nil {
+				t.Fatal(err)
+			}
+
+			contents, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(long)))
+			if err != nil || string(contents) != "deep down" {
+				t.Fatalf("Expected the contents back but got %q, %v", contents, err)
+			}
+		})
+	}
+}
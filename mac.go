@@ -0,0 +1,73 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// ErrMACMismatch is returned by VerifyVaultMAC when the
+// vault does not match the detached MAC
+var ErrMACMismatch = errors.New("arcsek: the vault does not match its MAC")
+
+var errEmptyMACKey = errors.New("arcsek: the MAC key is empty")
+
+// DetachedMAC computes the HMAC-SHA256 of the whole vault,
+// header included, exactly as it is read or written with
+// WriteTo. It is encrypt-then-MAC: the MAC covers what is
+// stored, so it can be checked with VerifyVaultMAC before
+// decrypting, without the key of the vault.
+//
+// Use a macKey independent of the key of the vault. The
+// vault is encrypted again to compute it, so it doesn't
+// matter if it was read already, but it must not be closed
+func (v *VaultReader) DetachedMAC(macKey []byte) ([]byte, error) {
+	if len(macKey) == 0 {
+		return nil, errEmptyMACKey
+	}
+
+	if v.stream == nil || (v.tmpFile == nil && v.data == nil) {
+		return nil, errors.New("arcsek: the vault can't be read again")
+	}
+
+	// Reading at offsets leaves the temporal file where
+	// the vault is being read
+	var src io.Reader = bytes.NewReader(v.data)
+	if v.tmpFile != nil {
+		src = io.NewSectionReader(v.tmpFile, 0, v.size)
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(v.header)
+
+	if _, err := v.stream.EncryptReader(src, v.nonce, v.ad).WriteTo(mac); err != nil {
+		return nil, err
+	}
+
+	return mac.Sum(nil), nil
+}
+
+// VerifyVaultMAC reads the vault in r to the end and checks
+// it matches the MAC computed by DetachedMAC with macKey.
+// It returns ErrMACMismatch if it doesn't.
+//
+// The vault is not decrypted, check it before opening it
+func VerifyVaultMAC(r io.Reader, macKey, mac []byte) error {
+	if len(macKey) == 0 {
+		return errEmptyMACKey
+	}
+
+	h := hmac.New(sha256.New, macKey)
+	if _, err := copyBuffer(h, r); err != nil {
+		return err
+	}
+
+	// In constant time
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return ErrMACMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package arcsek
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDetachedMAC(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt", "testing-files/in/existance/testfile2.txt"}
+	key, macKey := genKey("vault"), genKey("mac")
+
+	for _, inMemory := range []bool{false, true} {
+		t.Run(fmt.Sprintf("InMemory %v", inMemory), func(t *testing.T) {
+			b := VaultBuilder{InMemory: inMemory}
+			vault, err := b.Build(files, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			mac, err := vault.DetachedMAC(macKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadAll(vault)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Reading the vault changes nothing
+			again, err := vault.DetachedMAC(macKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(mac, again) {
+				t.Fatal("The MAC changed after reading the vault")
+			}
+
+			if err = VerifyVaultMAC(bytes.NewReader(data), macKey, mac); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = VerifyVaultMAC(bytes.NewReader(data), genKey("other"), mac); err != ErrMACMismatch {
+				t.Fatalf("Expected ErrMACMismatch with another key, got %v", err)
+			}
+
+			data[len(data)/2] ^= 1
+			if err = VerifyVaultMAC(bytes.NewReader(data), macKey, mac); err != ErrMACMismatch {
+				t.Fatalf("Expected ErrMACMismatch for a modified vault, got %v", err)
+			}
+
+			if _, err = vault.DetachedMAC(nil); err == nil {
+				t.Fatal("An empty MAC key should fail")
+			}
+
+			vault.Close()
+			if _, err = vault.DetachedMAC(macKey); err == nil {
+				t.Fatal("A closed vault can't have a MAC")
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The kind of the entry with the manifest of a vault
+const kindManifest = "manifest"
+
+// Upper bound for the manifest read from a vault
+const maxManifestSize = 256 << 20
+
+// ErrNoManifest is returned by ReadManifest for the vaults
+// sealed without VaultBuilder.Manifest
+var ErrNoManifest = errors.New("arcsek: the vault has no manifest")
+
+// ManifestEntry is what the manifest of a vault says about
+// one of its entries. See VaultBuilder.Manifest
+type ManifestEntry struct {
+	// Name of the entry in the tar, the directories end
+	// with a slash
+	Name string `json:"name"`
+
+	// Size, Mode and ModTime are the ones of the file when
+	// it was archived
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+
+	// SHA256 of the contents, only for regular files
+	SHA256 []byte `json:"sha256,omitempty"`
+}
+
+// ReadManifest decrypts the manifest of the vault in r,
+// the list of its entries with their size and SHA-256, to
+// know what is in a vault without extracting it. The
+// manifest is the first entry, so nothing after it is read.
+//
+// It returns ErrNoManifest if the vault was sealed without
+// one
+func ReadManifest(r io.Reader, key []byte) ([]ManifestEntry, error) {
+	return new(VaultOpener).ReadManifest(r, key)
+}
+
+// ReadManifest is like the ReadManifest function but opens
+// the vault with the settings of the opener
+func (o *VaultOpener) ReadManifest(r io.Reader, key []byte) ([]ManifestEntry, error) {
+	tr, err := o.Open(r, key)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	// A vault may have nothing but the manifest
+	if err = tr.start(); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if tr.manifest == nil {
+		return nil, ErrNoManifest
+	}
+	return tr.manifest, nil
+}
+
+// Hash the files of the jobs and write the manifest as the
+// first entry of the tar. It returns the jobs to archive,
+// without those that fail and can be skipped and, if base
+// is not nil, those that didn't change since it
+func (a *archiveWriter) writeManifest(jobs []fileJob, follow bool, base map[string]ManifestEntry, failed func(path string, err error) error) ([]fileJob, error) {
+	kept := jobs[:0:0]
+	entries := make([]ManifestEntry, 0, len(jobs))
+	a.sums = make(map[string][sha256.Size]byte)
+
+	for _, job := range jobs {
+		entry, err := manifestEntry(job, follow)
+		if err != nil {
+			if err = failed(job.path, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if a.fixedTime {
+			entry.ModTime = reproducibleTime
+		}
+		if entry.SHA256 != nil {
+			a.sums[job.name] = [sha256.Size]byte(entry.SHA256)
+		}
+
+		entries = append(entries, entry)
+		if base == nil || changedSince(base, entry) {
+			kept = append(kept, job)
+		}
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       kindManifest,
+		Size:       int64(len(b)),
+		Mode:       0600,
+		ModTime:    time.Unix(0, 0),
+		PAXRecords: map[string]string{paxKind: kindManifest},
+	}
+
+	if err = a.tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+
+	if _, err = a.tw.Write(b); err != nil {
+		return nil, err
+	}
+	return kept, nil
+}
+
+// What the manifest says about the file of the job
+func manifestEntry(job fileJob, follow bool) (ManifestEntry, error) {
+	stat, err := os.Lstat(job.path)
+	if err == nil && follow && stat.Mode()&os.ModeSymlink != 0 {
+		stat, err = os.Stat(job.path)
+	}
+	if err != nil {
+		return ManifestEntry{}, notFound(err)
+	}
+
+	entry := ManifestEntry{Name: job.name, Mode: stat.Mode(), ModTime: stat.ModTime()}
+	switch {
+	case stat.IsDir():
+		entry.Name += "/"
+	case stat.Mode().IsRegular():
+		sum, err := hashFile(job.path)
+		if err != nil {
+			return ManifestEntry{}, err
+		}
+		entry.Size, entry.SHA256 = stat.Size(), sum[:]
+	}
+
+	return entry, nil
+}
+
+// Check a file has the contents it was hashed with for the
+// manifest, if it was
+func (a *archiveWriter) checkSum(name string, sum [sha256.Size]byte) error {
+	want, ok := a.sums[name]
+	if !ok || want == sum || a.allowChanged {
+		return nil
+	}
+
+	// The entry is whole, but the manifest is wrong
+	return &partialEntryError{fmt.Errorf("%w: %s is not the file of the manifest", ErrFileChanged, name)}
+}
+
+// Read the manifest if hdr, the first entry, is one
+func (t *TarReader) readManifest(hdr *tar.Header) (bool, error) {
+	if hdr.PAXRecords[paxKind] != kindManifest {
+		return false, nil
+	}
+
+	if hdr.Size > maxManifestSize {
+		return true, fmt.Errorf("%w: the manifest claims %d bytes", ErrEntryTooLarge, hdr.Size)
+	}
+
+	b, err := io.ReadAll(t.Reader)
+	if err != nil {
+		return true, err
+	}
+
+	if err = json.Unmarshal(b, &t.manifest); err != nil {
+		return true, fmt.Errorf("arcsek: malformed manifest: %w", err)
+	}
+
+	// An empty manifest is still one
+	if t.manifest == nil {
+		t.manifest = []ManifestEntry{}
+	}
+	return true, nil
+}
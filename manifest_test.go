@@ -0,0 +1,133 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	key := genKey("manifest")
+
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":         "first",
+		"b.txt":         "second file",
+		"sub/c.txt":     "third, deeper",
+		"sub/empty.txt": "",
+	}
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []VaultBuilder{
+		{Manifest: true},
+		{Manifest: true, Concurrency: 4},
+		{Manifest: true, ObfuscateNames: true},
+		{Manifest: true, Deduplicate: true},
+	}
+
+	for _, b := range testCases {
+		t.Run(fmt.Sprintf("Concurrency %d obfuscated %v dedup %v", b.Concurrency, b.ObfuscateNames, b.Deduplicate), func(t *testing.T) {
+			v, err := b.Build([]string{src}, key)
+			vault := vaultBytes(t, v, err)
+
+			manifest, err := ReadManifest(bytes.NewReader(vault), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The manifest is not an entry of its own
+			names, contents, err := readEntries(bytes.NewReader(vault), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(manifest) != len(names) {
+				t.Fatalf("The manifest has %d entries but the vault %d: %v", len(manifest), len(names), names)
+			}
+
+			for i, entry := range manifest {
+				if entry.Name != names[i] {
+					t.Fatalf("Entry %d is %s in the manifest and %s in the vault", i, entry.Name, names[i])
+				}
+
+				if strings.HasSuffix(entry.Name, "/") {
+					if !entry.Mode.IsDir() || entry.SHA256 != nil {
+						t.Fatalf("%s is not a directory in the manifest: %+v", entry.Name, entry)
+					}
+					continue
+				}
+
+				want := files[entry.Name]
+				sum := sha256.Sum256([]byte(want))
+				if entry.Size != int64(len(want)) || subtle.ConstantTimeCompare(entry.SHA256, sum[:]) != 1 {
+					t.Fatalf("%s is wrong in the manifest: %+v", entry.Name, entry)
+				}
+
+				if contents[entry.Name] != want {
+					t.Fatalf("%s has the contents %q", entry.Name, contents[entry.Name])
+				}
+
+				stat, err := os.Stat(filepath.Join(src, filepath.FromSlash(entry.Name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !entry.ModTime.Equal(stat.ModTime()) || entry.Mode != stat.Mode() {
+					t.Fatalf("%s has the time %v and mode %v in the manifest", entry.Name, entry.ModTime, entry.Mode)
+				}
+			}
+
+			// Nor is it extracted
+			dest := t.TempDir()
+			n, err := ExtractTo(bytes.NewReader(vault), key, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(files) {
+				t.Fatalf("%d files were extracted instead of %d", n, len(files))
+			}
+			if _, err := os.Stat(filepath.Join(dest, kindManifest)); !os.IsNotExist(err) {
+				t.Fatalf("The manifest was extracted: %v", err)
+			}
+		})
+	}
+
+	t.Run("No manifest", func(t *testing.T) {
+		vault, err := NewVaultReader([]string{src}, key)
+		if _, err := ReadManifest(bytes.NewReader(vaultBytes(t, vault, err)), key); err != ErrNoManifest {
+			t.Fatalf("Expected ErrNoManifest but got %v", err)
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		b := VaultBuilder{Manifest: true}
+		vault, err := b.Build([]string{src}, key)
+		if _, err := ReadManifest(bytes.NewReader(vaultBytes(t, vault, err)), genKey("other")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+
+	// A file with other contents than when it was hashed
+	t.Run("Changed", func(t *testing.T) {
+		a := archiveWriter{sums: map[string][sha256.Size]byte{"a.txt": sha256.Sum256([]byte("first"))}}
+		if err := a.checkSum("a.txt", sha256.Sum256([]byte("changed"))); !errors.Is(err, ErrFileChanged) {
+			t.Fatalf("Expected ErrFileChanged but got %v", err)
+		}
+
+		if err := a.checkSum("a.txt", sha256.Sum256([]byte("first"))); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The PAX record that marks the entries this package adds
+// to the tar for itself, with what they hold. A record and
+// not a name, so no file of the caller is ever taken for one
+const paxKind = "ARCSEK.kind"
+
+// The kind of the entry with the name map of a vault with
+// obfuscated names
+const kindNames = "names"
+
+// Upper bound for the name map read from a vault
+const maxNamesSize = 64 << 20
+
+// Names are in the map of the vault or the vault is broken
+var errUnknownName = errors.New("arcsek: entry not in the name map")
+
+// Give every name an opaque id and write the map from the
+// ids to the names as the first entry of the tar. From then
+// on the entries are written with their ids
+func (a *archiveWriter) writeNames(names []string) error {
+	a.ids = make(map[string]string, len(names))
+	byID := make(map[string]string, len(names))
+	for _, name := range names {
+		if _, ok := a.ids[name]; ok {
+			// Duplicates fail when they are added
+			continue
+		}
+
+		id := fmt.Sprintf("%08x", len(a.ids)+1)
+		a.ids[name] = id
+		byID[id] = name
+	}
+
+	b, err := json.Marshal(byID)
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       kindNames,
+		Size:       int64(len(b)),
+		Mode:       0600,
+		ModTime:    time.Unix(0, 0),
+		PAXRecords: map[string]string{paxKind: kindNames},
+	}
+
+	if err = a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = a.tw.Write(b)
+	return err
+}
+
+// The name an entry is written with, its id if the names
+// are obfuscated
+func (a *archiveWriter) entryName(name string) string {
+	if id, ok := a.ids[name]; ok {
+		return id
+	}
+	return name
+}
+
+// Read the name map if hdr, the first entry, is one
+func (t *TarReader) readNames(hdr *tar.Header) (bool, error) {
+	if hdr.PAXRecords[paxKind] != kindNames {
+		return false, nil
+	}
+
+	if hdr.Size > maxNamesSize {
+		return true, fmt.Errorf("%w: the name map claims %d bytes", ErrEntryTooLarge, hdr.Size)
+	}
+
+	b, err := io.ReadAll(t.Reader)
+	if err != nil {
+		return true, err
+	}
+
+	if err = json.Unmarshal(b, &t.names); err != nil {
+		return true, fmt.Errorf("arcsek: malformed name map: %w", err)
+	}
+	return true, nil
+}
+
+// Give back the real names to an entry of a vault with
+// obfuscated names
+func (t *TarReader) restoreNames(hdr *tar.Header) error {
+	id, dir := strings.TrimSuffix(hdr.Name, "/"), strings.HasSuffix(hdr.Name, "/")
+	name, ok := t.names[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownName, hdr.Name)
+	}
+
+	if hdr.Name = name; dir {
+		hdr.Name += "/"
+	}
+
+	// Hard links point to other entries
+	if hdr.Typeflag == tar.TypeLink {
+		target, ok := t.names[hdr.Linkname]
+		if !ok {
+			return fmt.Errorf("%w: link to %s", errUnknownName, hdr.Linkname)
+		}
+		hdr.Linkname = target
+	}
+
+	return nil
+}
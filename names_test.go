@@ -0,0 +1,113 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestObfuscateNames(t *testing.T) {
+	key := genKey("names")
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "secret-project"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"salaries.csv":                "alice,100",
+		"secret-project/plans.txt":    "take over",
+		"secret-project/contacts.txt": "bob",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, concurrency := range []int{0, 4} {
+		b := VaultBuilder{ObfuscateNames: true, Compression: None, Concurrency: concurrency, BaseDir: root}
+		v, err := b.Build([]string{root}, key)
+		vault := vaultBytes(t, v, err)
+
+		t.Run("Not in the vault", func(t *testing.T) {
+			for _, leak := range []string{"salaries", "secret-project", "plans.txt"} {
+				if bytes.Contains(vault, []byte(leak)) {
+					t.Fatalf("%q is in the vault", leak)
+				}
+			}
+		})
+
+		t.Run("Not in the tar", func(t *testing.T) {
+			tr, err := NewTarReaderNonce(bytes.NewReader(vault), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if strings.Contains(hdr.Name, "secret") || strings.Contains(hdr.Name, ".") {
+					t.Fatalf("The tar has the name %s", hdr.Name)
+				}
+			}
+		})
+
+		t.Run("Wrong key", func(t *testing.T) {
+			if _, err := ExtractTo(bytes.NewReader(vault), genKey("other"), t.TempDir()); !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("Got %v instead of ErrAuthFailed", err)
+			}
+		})
+
+		t.Run("Extracted", func(t *testing.T) {
+			dest := t.TempDir()
+			n, err := ExtractTo(bytes.NewReader(vault), key, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != len(files) {
+				t.Fatalf("%d files were extracted instead of %d", n, len(files))
+			}
+
+			for name, body := range files {
+				got, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(got) != body {
+					t.Fatalf("%s has %q", name, got)
+				}
+			}
+		})
+	}
+
+	t.Run("Entries", func(t *testing.T) {
+		b := VaultBuilder{ObfuscateNames: true}
+		v, err := b.BuildEntries([]Entry{entry("a.txt", "first"), entry("b.txt", "second")}, key)
+		vault := vaultBytes(t, v, err)
+
+		names, contents, err := readEntries(bytes.NewReader(vault), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(names) != 2 || contents["a.txt"] != "first" || contents["b.txt"] != "second" {
+			t.Fatalf("Got %v", names)
+		}
+
+		if _, err = AppendToVault(bytes.NewReader(vault), key, []Entry{entry("c.txt", "third")}); err == nil {
+			t.Fatal("The names would be lost")
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package arcsek
+
+// Option changes a setting of the vault created by the
+// package functions, like
+//
+//	NewVaultReader(files, key, WithCompression(Zstd), WithTempDir(dir))
+//
+// Each one sets a field of VaultBuilder, which documents
+// what it does. Without options the functions behave as
+// they always did. When an option is given twice the last
+// one wins
+type Option func(*VaultBuilder)
+
+// The builder the options describe
+func newBuilder(opts []Option) *VaultBuilder {
+	b := new(VaultBuilder)
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// WithCompression sets VaultBuilder.Compression
+func WithCompression(c Compression) Option {
+	return func(b *VaultBuilder) { b.Compression = c }
+}
+
+// WithCompressionLevel sets VaultBuilder.CompressionLevel
+func WithCompressionLevel(level int) Option {
+	return func(b *VaultBuilder) { b.CompressionLevel = level }
+}
+
+// WithDictionary sets VaultBuilder.Dictionary
+func WithDictionary(dict []byte) Option {
+	return func(b *VaultBuilder) { b.Dictionary = dict }
+}
+
+// WithCipherSuite sets VaultBuilder.CipherSuite
+func WithCipherSuite(suite CipherSuite) Option {
+	return func(b *VaultBuilder) { b.CipherSuite = suite }
+}
+
+// WithKeyDeriver sets VaultBuilder.KeyDeriver, so the key
+// is taken as a password
+func WithKeyDeriver(kd KeyDeriver) Option {
+	return func(b *VaultBuilder) { b.KeyDeriver = kd }
+}
+
+// WithTempDir sets VaultBuilder.TempDir
+func WithTempDir(dir string) Option {
+	return func(b *VaultBuilder) { b.TempDir = dir }
+}
+
+// WithInMemory sets VaultBuilder.InMemory
+func WithInMemory() Option {
+	return func(b *VaultBuilder) { b.InMemory = true }
+}
+
+// WithProgress sets VaultBuilder.Progress
+func WithProgress(p Progress) Option {
+	return func(b *VaultBuilder) { b.Progress = p }
+}
+
+// WithFilter sets VaultBuilder.Filter
+func WithFilter(f Filter) Option {
+	return func(b *VaultBuilder) { b.Filter = f }
+}
+
+// WithBaseDir sets VaultBuilder.BaseDir
+func WithBaseDir(dir string) Option {
+	return func(b *VaultBuilder) { b.BaseDir = dir }
+}
+
+// WithLogger sets VaultBuilder.Logger
+func WithLogger(l Logger) Option {
+	return func(b *VaultBuilder) { b.Logger = l }
+}
+
+// WithConcurrency sets VaultBuilder.Concurrency
+func WithConcurrency(n int) Option {
+	return func(b *VaultBuilder) { b.Concurrency = n }
+}
+
+// WithBufferSize sets VaultBuilder.BufferSize
+func WithBufferSize(size int) Option {
+	return func(b *VaultBuilder) { b.BufferSize = size }
+}
+
+// WithAssociatedData sets VaultBuilder.AssociatedData
+func WithAssociatedData(ad []byte) Option {
+	return func(b *VaultBuilder) { b.AssociatedData = ad }
+}
+
+// WithKeyID sets VaultBuilder.KeyID
+func WithKeyID(id []byte) Option {
+	return func(b *VaultBuilder) { b.KeyID = id }
+}
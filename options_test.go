@@ -0,0 +1,98 @@
+package arcsek
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestOptions(t *testing.T) {
+	files := []string{"testing-files/in/existance"}
+
+	t.Run("None", func(t *testing.T) {
+		v, err := NewVaultReader(files, genKey("options"))
+		vault := vaultBytes(t, v, err)
+
+		h, err := InspectVault(bytes.NewReader(vault))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The defaults of the zero VaultBuilder
+		if h.Suite != AES128GCM || h.Compression != Gzip || h.KDF != 0 {
+			t.Fatalf("Wrong header:\n%s", h)
+		}
+	})
+
+	t.Run("Suite and compression", func(t *testing.T) {
+		key := bytes.Repeat([]byte{1}, 32)
+		v, err := NewVaultReader(files, key, WithCompression(Zstd), WithCompressionLevel(19), WithCipherSuite(ChaCha20Poly1305))
+		vault := vaultBytes(t, v, err)
+
+		h, err := InspectVault(bytes.NewReader(vault))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Suite != ChaCha20Poly1305 || h.Compression != Zstd {
+			t.Fatalf("Wrong header:\n%s", h)
+		}
+
+		names, _, err := readEntries(bytes.NewReader(vault), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(names) != 4 {
+			t.Fatalf("Got %v from the vault", names)
+		}
+	})
+
+	t.Run("Temp dir and progress", func(t *testing.T) {
+		dir := t.TempDir()
+		var done, total int64
+		progress := func(d, t int64) { done, total = d, t }
+
+		v, err := NewVaultReader(files, genKey("options"), WithTempDir(dir), WithProgress(progress))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		if ls, _ := os.ReadDir(dir); len(ls) != 1 {
+			t.Fatalf("%d temporal archives in the dir", len(ls))
+		}
+
+		if done == 0 || done != total {
+			t.Fatalf("The progress ended at %d of %d", done, total)
+		}
+	})
+
+	t.Run("Last wins", func(t *testing.T) {
+		v, err := NewVaultReader(files, genKey("options"), WithTempDir(t.TempDir()), WithInMemory(), WithCompression(Zstd), WithCompression(None))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+
+		if !v.InMemory() {
+			t.Fatal("The archive is on the disk")
+		}
+
+		h, err := InspectVault(bytes.NewReader(v.Header()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Compression != None {
+			t.Fatalf("The vault was compressed with %s", h.Compression)
+		}
+	})
+
+	t.Run("Bad option", func(t *testing.T) {
+		if v, err := NewVaultReader(files, genKey("options"), WithCompressionLevel(100)); err == nil {
+			v.Close()
+			t.Fatal("The level is out of range")
+		}
+	})
+}
@@ -0,0 +1,72 @@
+//go:build unix
+
+package arcsek
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreserveOwnershipArchive(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	key := genKey("owner")
+
+	for _, keep := range []bool{false, true} {
+		b := VaultBuilder{PreserveOwnership: keep}
+		vault, err := b.Build(files, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
+
+		tr, err := NewTarReaderNonce(vault, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := 0
+		if keep {
+			want = os.Getuid()
+		}
+
+		if hdr.Uid != want || (!keep && hdr.Uname != "") {
+			t.Fatalf("Preserving %v, expected the uid %d, got %d (%s)", keep, want, hdr.Uid, hdr.Uname)
+		}
+	}
+}
+
+func TestPreserveOwnershipExtract(t *testing.T) {
+	key := genKey("owner")
+	vault := sealTarEntries(t, key, []tarEntry{
+		{tar.Header{Name: "owned.txt", Uid: 4321, Gid: 4321}, "owned"},
+	})
+
+	dest := t.TempDir()
+	opener := VaultOpener{PreserveOwnership: true}
+	if _, err := opener.ExtractTo(vault, key, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dest, "owned.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without privileges the file is simply ours
+	want := uint32(os.Getuid())
+	if os.Geteuid() == 0 {
+		want = 4321
+	}
+
+	if uid := fi.Sys().(*syscall.Stat_t).Uid; uid != want {
+		t.Fatalf("Expected the uid %d, got %d", want, uid)
+	}
+}
@@ -0,0 +1,128 @@
+package arcsek
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// VaultPlan is what a vault of some files would hold, worked
+// out by PlanVault without archiving or encrypting anything
+type VaultPlan struct {
+	// The entries in the order they would be written
+	Entries []PlannedEntry
+
+	// Number of entries, directories and symlinks included,
+	// like VaultInfo.Files
+	Files int
+
+	// Total size of the files, like VaultInfo.Size
+	Size int64
+
+	// Why files would be left out with ContinueOnError, nil
+	// if none would
+	Skipped error
+}
+
+// PlannedEntry is an entry of a VaultPlan
+type PlannedEntry struct {
+	// The file on the disk
+	Path string
+
+	// Its name in the tar
+	Name string
+
+	// Its mode, with the type bits
+	Mode os.FileMode
+
+	// Its size if it is a regular file, or 0
+	Size int64
+}
+
+// PlanVault lists what NewVaultReader would archive for the
+// files with the options, for a dry run before a long
+// backup. The files are only listed, not read
+func PlanVault(files []string, opts ...Option) (*VaultPlan, error) {
+	return newBuilder(opts).Plan(files)
+}
+
+// Plan is like PlanVault but with the settings of the
+// builder: the Filter, the recursion, the symlinks and the
+// BaseDir select the entries exactly like Build. It fails
+// like Build would with MaxFileSize, MaxVaultSize and names
+// used twice.
+//
+// What is read with Build may still differ if the files
+// change in between
+func (b *VaultBuilder) Plan(files []string) (*VaultPlan, error) {
+	if len(files) == 0 {
+		return nil, ErrEmptyFileList
+	}
+
+	base, err := b.baseDir(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only to check the sizes and the names
+	a := &archiveWriter{maxFileSize: b.MaxFileSize}
+	failed := b.failed(a)
+
+	plan := new(VaultPlan)
+	for _, file := range files {
+		add := func(path, name string) error {
+			entry, err := b.planEntry(a, path, name)
+			if err != nil {
+				return err
+			}
+
+			plan.Entries = append(plan.Entries, entry)
+			plan.Size += entry.Size
+			return nil
+		}
+
+		if err = b.walkPath(base, file, add, failed); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.MaxVaultSize > 0 && plan.Size > b.MaxVaultSize {
+		return nil, fmt.Errorf("%w of %d bytes: the files have %d", ErrQuotaExceeded, b.MaxVaultSize, plan.Size)
+	}
+
+	plan.Files = len(plan.Entries)
+	plan.Skipped = errors.Join(a.skipped...)
+	return plan, nil
+}
+
+// PlanGlob is like Plan but for the files matched by the
+// patterns, see BuildGlob
+func (b *VaultBuilder) PlanGlob(patterns []string) (*VaultPlan, error) {
+	files, err := b.expandGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Plan(files)
+}
+
+// The entry addFile would write for the file
+func (b *VaultBuilder) planEntry(a *archiveWriter, path, name string) (PlannedEntry, error) {
+	stat, err := os.Lstat(path)
+	if err == nil && b.FollowSymlinks && stat.Mode()&os.ModeSymlink != 0 {
+		stat, err = os.Stat(path)
+	}
+	if err != nil {
+		return PlannedEntry{}, notFound(err)
+	}
+
+	entry := PlannedEntry{Path: path, Name: name, Mode: stat.Mode()}
+	if stat.Mode().IsRegular() {
+		entry.Size = stat.Size()
+		if err = a.checkSize(entry.Size); err != nil {
+			return PlannedEntry{}, err
+		}
+	}
+
+	return entry, a.claim(name)
+}
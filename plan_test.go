@@ -0,0 +1,110 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPlanVault(t *testing.T) {
+	key := genKey("plan")
+
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"a.txt": "plan", "sub/b.txt": "the backup", "sub/c.log": "left out", "sub/d/e.txt": "deep"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		builder VaultBuilder
+		files   []string
+	}{
+		{"Default", VaultBuilder{}, []string{dir}},
+		{"Filter", VaultBuilder{Filter: ExcludeGlobs("*.log", "d")}, []string{dir}},
+		{"No recursion", VaultBuilder{DisableRecursion: true}, []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub")}},
+		{"BaseDir", VaultBuilder{BaseDir: dir}, []string{filepath.Join(dir, "sub")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := tt.builder.Plan(tt.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The plan is what Build archives
+			v, err := tt.builder.Build(tt.files, key)
+			vault := vaultBytes(t, v, err)
+
+			info, err := ReadVaultInfo(bytes.NewReader(vault), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if plan.Files != info.Files || plan.Size != info.Size {
+				t.Fatalf("The plan has %d entries and %d bytes, the vault %d and %d", plan.Files, plan.Size, info.Files, info.Size)
+			}
+
+			names, _, err := readEntries(bytes.NewReader(vault), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var planned []string
+			for _, e := range plan.Entries {
+				if e.Mode.IsDir() {
+					planned = append(planned, e.Name+"/")
+				} else {
+					planned = append(planned, e.Name)
+				}
+			}
+
+			if !slices.Equal(planned, names) {
+				t.Fatalf("The plan has %v, the vault %v", planned, names)
+			}
+		})
+	}
+
+	t.Run("Glob", func(t *testing.T) {
+		plan, err := new(VaultBuilder).PlanGlob([]string{filepath.Join(dir, "**", "*.txt")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if plan.Files != 3 || plan.Size != int64(len("plan")+len("the backup")+len("deep")) {
+			t.Fatalf("The plan has %d entries and %d bytes", plan.Files, plan.Size)
+		}
+	})
+
+	t.Run("Too large", func(t *testing.T) {
+		b := VaultBuilder{MaxFileSize: 5}
+		if _, err := b.Plan([]string{dir}); !errors.Is(err, ErrFileTooLarge) {
+			t.Fatalf("Got %v instead of ErrFileTooLarge", err)
+		}
+
+		b = VaultBuilder{MaxVaultSize: 10}
+		if _, err := b.Plan([]string{dir}); !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Got %v instead of ErrQuotaExceeded", err)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		if _, err := PlanVault([]string{filepath.Join(dir, "missing")}); !errors.Is(err, ErrFileNotFound) {
+			t.Fatalf("Got %v instead of ErrFileNotFound", err)
+		}
+
+		if _, err := PlanVault(nil); err != ErrEmptyFileList {
+			t.Fatalf("Got %v instead of ErrEmptyFileList", err)
+		}
+	})
+}
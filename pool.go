@@ -0,0 +1,42 @@
+package arcsek
+
+import (
+	"io"
+	"sync"
+
+	"github.com/secure-io/sio-go"
+)
+
+// A buffer for copying, with the wrappers that hide the
+// reader and the writer from io.CopyBuffer, so it does not
+// skip the buffer for a WriteTo or a ReadFrom that
+// allocates its own
+type copyBuf struct {
+	buf []byte
+	r   onlyReader
+	w   onlyWriter
+}
+
+type onlyReader struct{ io.Reader }
+
+type onlyWriter struct{ io.Writer }
+
+// Buffers reused across files and vaults to avoid an
+// allocation for each copy
+var bufPool = sync.Pool{
+	New: func() any {
+		return &copyBuf{buf: make([]byte, sio.BufSize)}
+	},
+}
+
+// Like io.Copy with a buffer from the pool
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	c := bufPool.Get().(*copyBuf)
+	c.r.Reader, c.w.Writer = src, dst
+
+	n, err := io.CopyBuffer(&c.w, &c.r, c.buf)
+
+	c.r.Reader, c.w.Writer = nil, nil
+	bufPool.Put(c)
+	return n, err
+}
@@ -0,0 +1,177 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// Files up to this size are read ahead of the tar when
+// archiving concurrently. Bigger ones are streamed when
+// their turn comes, so the memory stays bounded
+const maxPrefetchSize = 1 << 20
+
+// A file to archive, with its name in the tar
+type fileJob struct {
+	path, name string
+}
+
+// A file read ahead. If ok is false it was not, and it
+// is added like without concurrency
+type prefetched struct {
+	ok   bool
+	stat os.FileInfo
+	data []byte
+}
+
+// Reads small files ahead with a few workers, in order.
+// At most a window of files is held in memory
+type prefetcher struct {
+	results []chan prefetched
+	window  chan struct{}
+	done    chan struct{}
+}
+
+// Start reading the files of the jobs with n workers. Files
+// bigger than maxSize are not read ahead
+func startPrefetch(jobs []fileJob, n int, follow bool, maxSize int64) *prefetcher {
+	p := &prefetcher{
+		results: make([]chan prefetched, len(jobs)),
+		window:  make(chan struct{}, 2*n),
+		done:    make(chan struct{}),
+	}
+
+	for i := range p.results {
+		p.results[i] = make(chan prefetched, 1)
+	}
+
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := range jobs {
+			select {
+			case p.window <- struct{}{}:
+			case <-p.done:
+				return
+			}
+
+			select {
+			case next <- i:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < n; w++ {
+		go func() {
+			for i := range next {
+				p.results[i] <- prefetch(jobs[i].path, follow, maxSize)
+			}
+		}()
+	}
+
+	return p
+}
+
+// Wait for the i-th file, they must be taken in order.
+// Without a prefetcher nothing was read ahead
+func (p *prefetcher) take(i int) prefetched {
+	if p == nil {
+		return prefetched{}
+	}
+
+	res := <-p.results[i]
+	<-p.window
+	return res
+}
+
+// Stop reading ahead
+func (p *prefetcher) stop() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+}
+
+// Read a regular file of up to maxSize bytes. Anything else,
+// or any error, is left for when the file is added
+func prefetch(path string, follow bool, maxSize int64) prefetched {
+	stat, err := os.Lstat(path)
+	if err == nil && follow && stat.Mode()&os.ModeSymlink != 0 {
+		stat, err = os.Stat(path)
+	}
+
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() > maxSize {
+		return prefetched{}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return prefetched{}
+	}
+	defer file.Close()
+
+	if stat, err = file.Stat(); err != nil {
+		return prefetched{}
+	}
+
+	// It may have grown since
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil || int64(len(data)) > maxSize || int64(len(data)) != stat.Size() {
+		return prefetched{}
+	}
+
+	return prefetched{ok: true, stat: stat, data: data}
+}
+
+// Start reading the files of the jobs ahead with the
+// concurrency of the builder
+func (b *VaultBuilder) readAhead(jobs []fileJob) *prefetcher {
+	// Files over the limit fail once their turn comes
+	maxSize := int64(maxPrefetchSize)
+	if b.MaxFileSize > 0 {
+		maxSize = min(maxSize, b.MaxFileSize)
+	}
+
+	return startPrefetch(jobs, b.Concurrency, b.FollowSymlinks, maxSize)
+}
+
+// Like addFile for a file read ahead
+func (a *archiveWriter) addPrefetched(path, name string, res prefetched) error {
+	if err := a.claim(name); err != nil {
+		return err
+	}
+
+	if err := a.begin(name, res.stat.Size()); err != nil {
+		return err
+	}
+
+	if a.dedup != nil {
+		sum := func() ([sha256.Size]byte, error) { return sha256.Sum256(res.data), nil }
+		target, _ := a.dedup.find(res.stat.Size(), sum)
+		if target != "" {
+			return a.addCopy(path, name, res.stat, target)
+		}
+	}
+
+	n, err := writeFileToTar(path, a.entryName(name), res.stat, bytes.NewReader(res.data), a.tw, a.fill, a.body, a.allowChanged)
+	if err != nil {
+		return err
+	}
+
+	if a.sums != nil {
+		if err = a.checkSum(name, sha256.Sum256(res.data)); err != nil {
+			return err
+		}
+	}
+
+	if a.dedup != nil {
+		a.dedup.add(a.entryName(name), n, sha256.Sum256(res.data))
+	}
+
+	a.info.Files++
+	a.info.Size += n
+	return nil
+}
@@ -0,0 +1,127 @@
+package arcsek
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A tree of n small files, and a big one that is not read ahead
+func manySmallFiles(tb testing.TB, n int) string {
+	root := tb.TempDir()
+
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i%10))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+
+		name := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	big := make([]byte, maxPrefetchSize+1)
+	rand.Read(big)
+	if err := ioutil.WriteFile(filepath.Join(root, "big.bin"), big, 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	return root
+}
+
+// The names and contents in the vault, in order
+func vaultEntries(t *testing.T, vault io.Reader, key []byte) ([]string, map[string]string) {
+	tr, err := NewTarReader(vault, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	contents := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names, contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, h.Name)
+		contents[h.Name] = string(b)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	key := genKey("concurrency")
+	root := manySmallFiles(t, 200)
+
+	var want []string
+	var wantContents map[string]string
+	for _, n := range []int{0, 1, 2, 8, 64} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			b := VaultBuilder{Concurrency: n}
+			vault, err := b.Build([]string{root}, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			names, contents := vaultEntries(t, vault, key)
+			// With the 10 directories
+			if len(contents) != 211 {
+				t.Fatalf("Expected 211 entries, got %d", len(contents))
+			}
+
+			if want == nil {
+				want, wantContents = names, contents
+				return
+			}
+
+			if len(names) != len(want) {
+				t.Fatalf("Expected %d entries, got %d", len(want), len(names))
+			}
+
+			for i := range names {
+				if names[i] != want[i] {
+					t.Fatalf("Entry %d is %s instead of %s", i, names[i], want[i])
+				}
+
+				if contents[names[i]] != wantContents[names[i]] {
+					t.Fatalf("The contents of %s are different", names[i])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBuildManySmallFiles(b *testing.B) {
+	key := genKey("bench")
+	root := manySmallFiles(b, 2000)
+
+	for _, n := range []int{1, 8} {
+		b.Run(fmt.Sprintf("Concurrency%d", n), func(b *testing.B) {
+			builder := VaultBuilder{Concurrency: n}
+			for i := 0; i < b.N; i++ {
+				vault, err := builder.Build([]string{root}, key)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				io.Copy(io.Discard, vault)
+				vault.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package arcsek
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// The callback is called at most once every progressInterval
+// bytes, so it does not slow down the archiving
+const progressInterval = 4 << 20
+
+// Progress is told how many bytes of the files have been
+// archived, out of the total size of the files
+type Progress func(bytesDone, bytesTotal int64)
+
+// Keeps track of the bytes archived for a Progress
+type progress struct {
+	fn          Progress
+	done, total int64
+
+	// Done when it was last reported
+	reported int64
+}
+
+// A progress calling fn, or nil if fn is nil. A nil
+// progress does nothing
+func newProgress(fn Progress, total int64) *progress {
+	if fn == nil {
+		return nil
+	}
+
+	return &progress{fn: fn, total: total}
+}
+
+// Count n more bytes, reporting them if enough have passed
+func (p *progress) add(n int64) {
+	if p == nil {
+		return
+	}
+
+	p.done += n
+	if p.done-p.reported >= progressInterval {
+		p.report()
+	}
+}
+
+// Report what is left once everything is archived
+func (p *progress) finish() {
+	if p != nil && (p.done != p.reported || p.done == 0) {
+		p.report()
+	}
+}
+
+func (p *progress) report() {
+	p.reported = p.done
+	p.fn(p.done, p.total)
+}
+
+// A writer counting what goes through it in p
+func (p *progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+
+	return progressWriter{w, p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.add(int64(n))
+	return n, err
+}
+
+// CountingReader counts the bytes read through it, to drive
+// a progress bar of a vault or of what is decrypted. Count
+// can be called from other goroutines while it is read
+type CountingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+// NewCountingReader counts what is read from r
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{r: r}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Count returns the bytes read so far
+func (c *CountingReader) Count() int64 {
+	return c.n.Load()
+}
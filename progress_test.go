@@ -0,0 +1,183 @@
+package arcsek
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	key := genKey("progress")
+	root := t.TempDir()
+
+	// Big enough to be reported a few times
+	sizes := map[string]int{"big": 9 << 20, "small": 100}
+	var want int64
+	for name, size := range sizes {
+		if err := ioutil.WriteFile(filepath.Join(root, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want += int64(size)
+	}
+
+	var calls []int64
+	b := VaultBuilder{InMemory: true, Progress: func(done, total int64) {
+		if total != want {
+			t.Fatalf("Expected a total of %d but got %d", want, total)
+		}
+		calls = append(calls, done)
+	}}
+
+	vault, err := b.Build([]string{root}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.Close()
+
+	if len(calls) < 3 {
+		t.Fatalf("Expected a few calls but got %v", calls)
+	}
+
+	for i := 1; i < len(calls); i++ {
+		if calls[i] <= calls[i-1] {
+			t.Fatalf("The bytes done must increase, got %v", calls)
+		}
+	}
+
+	if last := calls[len(calls)-1]; last != want {
+		t.Fatalf("Expected to end at %d but got %d", want, last)
+	}
+}
+
+func TestProgressEntries(t *testing.T) {
+	var done, total int64
+	b := VaultBuilder{InMemory: true, Progress: func(d, t int64) { done, total = d, t }}
+
+	vault, err := b.BuildEntries([]Entry{{Name: "a", Size: 3, Body: strings.NewReader("abc")}}, genKey("progress"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.Close()
+
+	if done != 3 || total != 3 {
+		t.Fatalf("Expected 3 of 3 bytes but got %d of %d", done, total)
+	}
+}
+
+func TestOnFile(t *testing.T) {
+	key := genKey("progress")
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+
+	sizes := map[string]int64{"a": 1, "dir/b": 20, "z": 300}
+	for name, size := range sizes {
+		if err := ioutil.WriteFile(filepath.Join(root, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	b := VaultBuilder{OnFile: func(name string, index, total int, size int64) {
+		if index != len(names)+1 || total != 4 {
+			t.Fatalf("%s is %d of %d, expected %d of 4", name, index, total, len(names)+1)
+		}
+
+		if size != sizes[name] {
+			t.Fatalf("Expected %s to have %d bytes but got %d", name, sizes[name], size)
+		}
+		names = append(names, name)
+	}}
+
+	vault, err := b.Build([]string{root}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	// The same order as the tar
+	tr, err := NewTarReader(vault, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name := strings.TrimSuffix(hdr.Name, "/"); i >= len(names) || names[i] != name {
+			t.Fatalf("Entry %d of the tar is %s, but got %v", i, name, names)
+		}
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	key := genKey("progress")
+	vault, err := NewVaultReaderEntries([]Entry{{Name: "a", Size: 5000, Body: bytes.NewReader(make([]byte, 5000))}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	cr := NewCountingReader(vault)
+
+	// Poll it like a UI would while it is read
+	done := make(chan struct{})
+	polled := make(chan int64)
+	go func() {
+		var last int64
+		for {
+			select {
+			case <-done:
+				polled <- last
+				return
+			default:
+				if n := cr.Count(); n < last {
+					t.Error("The count went back")
+				} else {
+					last = n
+				}
+			}
+		}
+	}()
+
+	b, err := ioutil.ReadAll(cr)
+	close(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-polled
+
+	if cr.Count() != int64(len(b)) {
+		t.Fatalf("Read %d bytes but counted %d", len(b), cr.Count())
+	}
+
+	// What is decrypted can be counted too
+	tr, err := NewTarReader(bytes.NewReader(b), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	if _, err = tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := NewCountingReader(tr)
+	if _, err = io.Copy(ioutil.Discard, body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Count() != 5000 {
+		t.Fatalf("Expected 5000 bytes but counted %d", body.Count())
+	}
+}
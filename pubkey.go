@@ -0,0 +1,122 @@
+package arcsek
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Length of X25519 public and private keys
+const x25519KeyLen = 32
+
+// Binds the content key to this package and its use
+const x25519Info = "arcsek x25519 content key"
+
+// GenerateX25519Key returns a new X25519 key pair for
+// SealForPublicKey and OpenWithPrivateKey
+func GenerateX25519Key() (pub, priv []byte, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key.PublicKey().Bytes(), key.Bytes(), nil
+}
+
+// SealForPublicKey is like NewVaultReader but seals the
+// vault to the X25519 public key of the recipient, so no
+// secret has to be shared. See VaultBuilder.BuildForPublicKey
+func SealForPublicKey(files []string, recipientPub []byte) (*VaultReader, error) {
+	return new(VaultBuilder).BuildForPublicKey(files, recipientPub)
+}
+
+// BuildForPublicKey is like Build but seals the vault to the
+// X25519 public key of the recipient, like the box of
+// libsodium.
+//
+// An ephemeral key pair is generated for the vault and its
+// public key stored in the header. The content key is
+// derived with HKDF-SHA256 from the ECDH of the ephemeral
+// private key and recipientPub, which is then forgotten. Only
+// the private key of the recipient opens the vault, see
+// OpenWithPrivateKey. The vault is not signed: anyone
+// with the public key can seal a vault for it.
+//
+// It can't be combined with a KeyDeriver or a Keyfile
+func (b *VaultBuilder) BuildForPublicKey(files []string, recipientPub []byte) (*VaultReader, error) {
+	if len(files) == 0 {
+		return nil, ErrEmptyFileList
+	}
+
+	if b.KeyDeriver != nil || len(b.Keyfile) > 0 {
+		return nil, errors.New("arcsek: public keys can't be derived or use a keyfile")
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(recipientPub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKeyLength, err)
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(shared)
+
+	c := *b
+	c.ephemeral = eph.PublicKey().Bytes()
+
+	cek, err := x25519ContentKey(shared, c.ephemeral, recipientPub)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(cek)
+
+	return c.build(c.addFiles(files), cek)
+}
+
+// OpenWithPrivateKey opens a vault sealed by SealForPublicKey
+// with the X25519 private key of the recipient. Like any
+// vault, it is also opened by the other functions of the
+// package with the private key as the key
+func OpenWithPrivateKey(r io.Reader, priv []byte) (*TarReader, error) {
+	return NewTarReader(r, priv)
+}
+
+// The content key the recipient agrees with the ephemeral
+// public key of the vault
+func openerKey(priv, ephemeral []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKeyLength, err)
+	}
+
+	eph, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := key.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(shared)
+
+	return x25519ContentKey(shared, ephemeral, key.PublicKey().Bytes())
+}
+
+// Derive the content key from the shared secret. Both
+// public keys are the salt, so it is bound to the pair
+func x25519ContentKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte(nil), ephemeral...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, x25519Info, contentKeyLen)
+}
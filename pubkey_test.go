@@ -0,0 +1,85 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealForPublicKey(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	pub, priv, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault, err := SealForPublicKey(files, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	sealed := new(bytes.Buffer)
+	if _, err = vault.WriteTo(sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Private key", func(t *testing.T) {
+		tr, err := OpenWithPrivateKey(bytes.NewReader(sealed.Bytes()), priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+
+		h, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, _ := ioutil.ReadFile(files[0])
+		got, _ := ioutil.ReadAll(tr)
+		if h.Name != filepath.Base(files[0]) || !bytes.Equal(got, want) {
+			t.Fatalf("Expected %s but got %s", files[0], h.Name)
+		}
+
+		if err = tr.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Other private key", func(t *testing.T) {
+		_, other, _ := GenerateX25519Key()
+		if _, err := OpenWithPrivateKey(bytes.NewReader(sealed.Bytes()), other); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+
+	t.Run("Public key", func(t *testing.T) {
+		if _, err := OpenWithPrivateKey(bytes.NewReader(sealed.Bytes()), pub); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+
+	t.Run("Fresh ephemeral key", func(t *testing.T) {
+		again, err := SealForPublicKey(files, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer again.Close()
+
+		h1, _, _ := parseHeader(bytes.NewReader(vault.Header()))
+		h2, _, _ := parseHeader(bytes.NewReader(again.Header()))
+		if bytes.Equal(h1.ephemeral, h2.ephemeral) {
+			t.Fatal("Two vaults have the same ephemeral key")
+		}
+	})
+
+	t.Run("Bad public key", func(t *testing.T) {
+		if _, err := SealForPublicKey(files, pub[:31]); !errors.Is(err, ErrInvalidKeyLength) {
+			t.Fatalf("Expected ErrInvalidKeyLength but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package arcsek
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/secure-io/sio-go"
+)
+
+// DecryptRange decrypts length bytes of the archive in r
+// starting at off, without reading the rest of the vault.
+// See VaultOpener.DecryptRange
+func DecryptRange(r io.ReadSeeker, key []byte, off, length int64) (io.Reader, error) {
+	return new(VaultOpener).DecryptRange(r, key, off, length)
+}
+
+// DecryptRange decrypts length bytes of the archive in r
+// starting at off. The offsets are in the archive as
+// DecryptVault returns it, the compressed tar, so it suits
+// vaults with no compression: a single huge file can be
+// restored in parts.
+//
+// The vault starts at the current position of r, which must
+// be seekable. The body is sealed in chunks of the buffer
+// size of the vault, each one authenticated on its own, so
+// only the chunks the range covers are read and decrypted.
+// That is up to a chunk more than asked for at each end.
+//
+// The header and the key are checked before returning. A
+// chunk that was modified fails the read with ErrAuthFailed.
+// A range past the end of the archive is cut short.
+// Legacy vaults can't be read in ranges
+func (o *VaultOpener) DecryptRange(r io.ReadSeeker, key []byte, off, length int64) (io.Reader, error) {
+	if off < 0 || length < 0 {
+		return nil, errors.New("arcsek: negative range")
+	}
+
+	base, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	h, raw, aead, err := o.openHeader(r, key)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := archiveAt(h, raw, aead, &seekerAt{r: r, base: base + int64(len(raw))})
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NewSectionReader(archive, off, length), nil
+}
+
+// NewRangeReader opens the vault in r, which starts at
+// offset 0, and returns its archive as an io.ReaderAt, like
+// DecryptRange but without a shared cursor: every read finds
+// the chunks of its range on its own, so any number of
+// goroutines can read ranges of the same vault at once.
+// See VaultOpener.NewRangeReader
+func NewRangeReader(r io.ReaderAt, key []byte) (io.ReaderAt, error) {
+	return new(VaultOpener).NewRangeReader(r, key)
+}
+
+// NewRangeReader is like the NewRangeReader function but
+// opens the vault with the settings of the opener. Only the
+// header is read before returning, the rest is read and
+// authenticated chunk by chunk as the ranges ask for it
+func (o *VaultOpener) NewRangeReader(r io.ReaderAt, key []byte) (io.ReaderAt, error) {
+	h, raw, aead, err := o.openHeader(io.NewSectionReader(r, 0, math.MaxInt64), key)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(len(raw))
+	return archiveAt(h, raw, aead, io.NewSectionReader(r, size, math.MaxInt64-size))
+}
+
+// The archive of the vault whose body is in r, to read at
+// any offset
+func archiveAt(h *header, raw []byte, aead cipher.AEAD, body io.ReaderAt) (io.ReaderAt, error) {
+	stream, _, err := openStream(h, raw, aead)
+	if err != nil {
+		return nil, err
+	}
+
+	return authReaderAt{stream.DecryptReaderAt(body, h.nonce, h.withAAD(raw))}, nil
+}
+
+// An io.ReaderAt over a seeker, for the body that starts
+// at base. It moves the seeker so it can't be shared
+type seekerAt struct {
+	mu   sync.Mutex
+	r    io.ReadSeeker
+	base int64
+}
+
+func (s *seekerAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.r.Seek(s.base+off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(s.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Names the errors of sio like the rest of the package
+type authReaderAt struct {
+	r io.ReaderAt
+}
+
+func (a authReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := a.r.ReadAt(p, off)
+	if err == sio.ErrAuth {
+		err = fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	return n, err
+}
@@ -0,0 +1,196 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecryptRange(t *testing.T) {
+	key := genKey("range")
+
+	// Random data so the archive spans many chunks
+	data := make([]byte, 200000)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "random.bin")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := new(bytes.Buffer)
+	b := VaultBuilder{Compression: None}
+	if err := b.EncryptTo(sealed, []string{path}, key); err != nil {
+		t.Fatal(err)
+	}
+
+	dr, err := DecryptVault(bytes.NewReader(sealed.Bytes()), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ioutil.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(archive))
+
+	testCases := []struct {
+		name        string
+		off, length int64
+		want        []byte
+	}{
+		{"Start", 0, 10, archive[:10]},
+		{"Across chunks", 16380, 10, archive[16380:16390]},
+		{"Many chunks", 100000, 50000, archive[100000:150000]},
+		{"Everything", 0, size, archive},
+		{"Past the end", size - 5, 100, archive[size-5:]},
+		{"After the end", size + 10, 10, nil},
+		{"Nothing", 500, 0, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := DecryptRange(bytes.NewReader(sealed.Bytes()), key, tc.off, tc.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, tc.want) {
+				t.Fatalf("Expected %d bytes of the archive, got %d different ones", len(tc.want), len(got))
+			}
+		})
+	}
+
+	t.Run("Offset in the source", func(t *testing.T) {
+		src := bytes.NewReader(append([]byte("something before"), sealed.Bytes()...))
+		src.Seek(int64(len("something before")), io.SeekStart)
+
+		r, err := DecryptRange(src, key, 50000, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, archive[50000:50100]) {
+			t.Fatalf("The range is wrong: %v", err)
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		_, err := DecryptRange(bytes.NewReader(sealed.Bytes()), genKey("other"), 0, 10)
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+
+	t.Run("Modified", func(t *testing.T) {
+		modified := append([]byte(nil), sealed.Bytes()...)
+		modified[len(modified)-50000] ^= 1
+
+		// Only the chunks read are authenticated
+		r, err := DecryptRange(bytes.NewReader(modified), key, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err = DecryptRange(bytes.NewReader(modified), key, size-60000, 20000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = ioutil.ReadAll(r); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+
+	t.Run("Negative", func(t *testing.T) {
+		if _, err := DecryptRange(bytes.NewReader(sealed.Bytes()), key, -1, 10); err == nil {
+			t.Fatal("A negative offset should fail")
+		}
+	})
+}
+
+func TestNewRangeReader(t *testing.T) {
+	key := genKey("range at")
+
+	data := make([]byte, 300000)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "random.bin")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := VaultBuilder{Compression: None}
+	v, err := b.Build([]string{path}, key)
+	vault := vaultBytes(t, v, err)
+
+	dr, err := DecryptVault(bytes.NewReader(vault), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ioutil.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only ReadAt, there is no cursor to share
+	ra, err := NewRangeReader(struct{ io.ReaderAt }{bytes.NewReader(vault)}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := []struct{ off, length int64 }{{1000, 120000}, {150000, 100000}}
+	errs := make(chan error, len(ranges))
+	for _, rg := range ranges {
+		go func() {
+			// Read each range many times, while the other is read
+			for range 20 {
+				got := make([]byte, rg.length)
+				if _, err := ra.ReadAt(got, rg.off); err != nil {
+					errs <- err
+					return
+				}
+
+				if !bytes.Equal(got, archive[rg.off:rg.off+rg.length]) {
+					errs <- fmt.Errorf("the range at %d is wrong", rg.off)
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	for range ranges {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("End", func(t *testing.T) {
+		got := make([]byte, 100)
+		n, err := ra.ReadAt(got, int64(len(archive))-10)
+		if n != 10 || err != io.EOF || !bytes.Equal(got[:n], archive[len(archive)-10:]) {
+			t.Fatalf("Read %d bytes at the end: %v", n, err)
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		if _, err := NewRangeReader(bytes.NewReader(vault), genKey("other")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package arcsek
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The most recipients a vault can have
+const maxRecipients = 255
+
+// Length of the random content key of vaults for recipients.
+// It seals them with AES-256-GCM by default
+const contentKeyLen = 32
+
+// ErrNotRecipient is returned when the key is not the one
+// of any recipient of the vault. It is an ErrAuthFailed
+var ErrNotRecipient = fmt.Errorf("%w: the key is not the one of a recipient", ErrAuthFailed)
+
+// NewVaultReaderMultiRecipient is like NewVaultReader but
+// the vault can be opened with any of the recipient keys.
+// See VaultBuilder.BuildForRecipients
+func NewVaultReaderMultiRecipient(files []string, recipientKeys [][]byte) (*VaultReader, error) {
+	return new(VaultBuilder).BuildForRecipients(files, recipientKeys)
+}
+
+// BuildForRecipients is like Build but the vault can be
+// opened with any of the recipient keys, without storing a
+// copy of it for each one.
+//
+// The vault is sealed with a random content key, which is
+// wrapped with AES-KW (RFC 3394) once for each recipient
+// and stored in the header. Opening the vault tries the
+// wrapped keys with the key of the caller, it fails with
+// ErrNotRecipient if none fits.
+//
+// The recipient keys must be AES keys, 16, 24 or 32 bytes
+// long. They can't be combined with a KeyDeriver or a
+// Keyfile
+func (b *VaultBuilder) BuildForRecipients(files []string, recipientKeys [][]byte) (*VaultReader, error) {
+	if len(files) == 0 {
+		return nil, ErrEmptyFileList
+	}
+
+	c, cek, err := b.forRecipients(recipientKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(cek)
+
+	return c.build(c.addFiles(files), cek)
+}
+
+// A copy of the builder that stores the content key wrapped
+// for the recipients, and the content key
+func (b *VaultBuilder) forRecipients(recipientKeys [][]byte) (*VaultBuilder, []byte, error) {
+	if len(recipientKeys) == 0 {
+		return nil, nil, errors.New("arcsek: no recipient keys")
+	}
+
+	if len(recipientKeys) > maxRecipients {
+		return nil, nil, fmt.Errorf("arcsek: at most %d recipients, got %d", maxRecipients, len(recipientKeys))
+	}
+
+	if b.KeyDeriver != nil || len(b.Keyfile) > 0 {
+		return nil, nil, errors.New("arcsek: recipient keys can't be derived or use a keyfile")
+	}
+
+	cek, err := newSalt(contentKeyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := *b
+	c.recipients = make([][]byte, len(recipientKeys))
+	for i, kek := range recipientKeys {
+		if c.recipients[i], err = wrapKey(kek, cek); err != nil {
+			Wipe(cek)
+			return nil, nil, fmt.Errorf("arcsek: recipient %d: %w", i, err)
+		}
+	}
+
+	return &c, cek, nil
+}
+
+// The content key wrapped for one of the recipients with kek
+func unwrapRecipients(recipients [][]byte, kek []byte) ([]byte, error) {
+	for _, wrapped := range recipients {
+		cek, err := unwrapKey(kek, wrapped)
+		if err == nil {
+			return cek, nil
+		}
+
+		if errors.Is(err, ErrInvalidKeyLength) {
+			return nil, err
+		}
+	}
+
+	return nil, ErrNotRecipient
+}
+
+// Serialize the wrapped keys for the header:
+//
+//	count (1 byte) | count times: length (1 byte) | wrapped key
+func marshalRecipients(recipients [][]byte) ([]byte, error) {
+	if len(recipients) == 0 || len(recipients) > maxRecipients {
+		return nil, fmt.Errorf("arcsek: a vault has between 1 and %d recipients", maxRecipients)
+	}
+
+	b := []byte{byte(len(recipients))}
+	for _, r := range recipients {
+		if len(r) > 255 {
+			return nil, errors.New("arcsek: wrapped key longer than 255 bytes")
+		}
+
+		b = append(append(b, byte(len(r))), r...)
+	}
+
+	return b, nil
+}
+
+// Read the wrapped keys written by marshalRecipients
+func readRecipients(b []byte) ([][]byte, error) {
+	bad := errors.New("arcsek: malformed recipients in the header")
+	if len(b) == 0 || b[0] == 0 {
+		return nil, bad
+	}
+
+	recipients := make([][]byte, b[0])
+	b = b[1:]
+	for i := range recipients {
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			return nil, bad
+		}
+
+		recipients[i] = b[1 : 1+int(b[0])]
+		b = b[1+int(b[0]):]
+	}
+
+	if len(b) != 0 {
+		return nil, bad
+	}
+
+	return recipients, nil
+}
+
+// The initial value of RFC 3394
+var kwIV = []byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+// Wrap the key with the key encryption key, AES-KW as in
+// RFC 3394 section 2.2.1
+func wrapKey(kek, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, errors.New("arcsek: the wrapped key must be a multiple of 8 bytes, at least 16")
+	}
+
+	block, err := newKWCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out, kwIV)
+	copy(out[8:], key)
+
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, out[:8])
+			copy(buf[8:], out[8*i:])
+			block.Encrypt(buf, buf)
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out, binary.BigEndian.Uint64(buf)^t)
+			copy(out[8*i:], buf[8:])
+		}
+	}
+
+	return out, nil
+}
+
+// Unwrap a key wrapped by wrapKey, RFC 3394 section 2.2.2.
+// It fails if the key encryption key is not the one that
+// wrapped it
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("arcsek: malformed wrapped key")
+	}
+
+	block, err := newKWCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := binary.BigEndian.Uint64(wrapped)
+	r := append([]byte(nil), wrapped[8:]...)
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(buf, a^uint64(n*j+i))
+			copy(buf[8:], r[8*(i-1):8*i])
+			block.Decrypt(buf, buf)
+
+			a = binary.BigEndian.Uint64(buf)
+			copy(r[8*(i-1):], buf[8:])
+		}
+	}
+
+	iv := make([]byte, 8)
+	binary.BigEndian.PutUint64(iv, a)
+	if subtle.ConstantTimeCompare(iv, kwIV) != 1 {
+		return nil, errors.New("arcsek: the key does not unwrap the content key")
+	}
+
+	return r, nil
+}
+
+// The block cipher of AES-KW
+func newKWCipher(kek []byte) (cipher.Block, error) {
+	if n := len(kek); n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("%w: AES-KW needs a 16, 24 or 32 byte key, got %d bytes", ErrInvalidKeyLength, n)
+	}
+
+	return aes.NewCipher(kek)
+}
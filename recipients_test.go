@@ -0,0 +1,125 @@
+package arcsek
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// The test vectors of RFC 3394 section 4
+func TestWrapKey(t *testing.T) {
+	testCases := []struct {
+		name, kek, key, wrapped string
+	}{
+		{"128 bit KEK", "000102030405060708090A0B0C0D0E0F", "00112233445566778899AABBCCDDEEFF",
+			"1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5"},
+		{"256 bit KEK", "000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			"28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kek, _ := hex.DecodeString(tc.kek)
+			key, _ := hex.DecodeString(tc.key)
+			want, _ := hex.DecodeString(tc.wrapped)
+
+			wrapped, err := wrapKey(kek, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(wrapped, want) {
+				t.Fatalf("Expected %x but got %x", want, wrapped)
+			}
+
+			unwrapped, err := unwrapKey(kek, wrapped)
+			if err != nil || !bytes.Equal(unwrapped, key) {
+				t.Fatalf("The key was not unwrapped: %v", err)
+			}
+
+			wrapped[5] ^= 1
+			if _, err = unwrapKey(kek, wrapped); err == nil {
+				t.Fatal("A modified key should not unwrap")
+			}
+		})
+	}
+}
+
+func TestMultiRecipient(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	alice, bob, carol := genKey("alice"), genKey("bob"), append(genKey("carol"), genKey("carol")...)
+
+	vault, err := NewVaultReaderMultiRecipient(files, [][]byte{alice, bob, carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	sealed := new(bytes.Buffer)
+	if _, err = vault.WriteTo(sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		key  []byte
+		err  error
+	}{
+		{"Alice", alice, nil},
+		{"Bob", bob, nil},
+		{"Carol", carol, nil},
+		{"Mallory", genKey("mallory"), ErrNotRecipient},
+		{"Bad key", []byte("short"), ErrInvalidKeyLength},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ExtractTo(bytes.NewReader(sealed.Bytes()), tc.key, t.TempDir())
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected %v but got %v", tc.err, err)
+			}
+		})
+	}
+
+	t.Run("Only one recipient", func(t *testing.T) {
+		vault, err := NewVaultReaderMultiRecipient(files, [][]byte{bob})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
+
+		sealed := new(bytes.Buffer)
+		vault.WriteTo(sealed)
+
+		opened := 0
+		for _, key := range [][]byte{alice, bob, carol} {
+			_, err := ExtractTo(bytes.NewReader(sealed.Bytes()), key, t.TempDir())
+			if err == nil {
+				opened++
+			} else if !errors.Is(err, ErrAuthFailed) {
+				t.Fatal(err)
+			}
+		}
+
+		if opened != 1 {
+			t.Fatalf("Expected one key to open the vault, %d did", opened)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		if _, err := NewVaultReaderMultiRecipient(files, nil); err == nil {
+			t.Fatal("A vault without recipients should fail")
+		}
+
+		if _, err := NewVaultReaderMultiRecipient(files, [][]byte{alice, []byte("bad")}); !errors.Is(err, ErrInvalidKeyLength) {
+			t.Fatalf("Expected ErrInvalidKeyLength but got %v", err)
+		}
+
+		b := VaultBuilder{KeyDeriver: ScryptParams{}}
+		if _, err := b.BuildForRecipients(files, [][]byte{alice}); err == nil {
+			t.Fatal("Recipients with a key deriver should fail")
+		}
+	})
+}
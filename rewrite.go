@@ -0,0 +1,321 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+)
+
+// AppendToVault seals a new vault with the entries of the
+// vault in src followed by the new entries. Tars can be
+// appended to, but the encryption can't: the body is sealed
+// again with a fresh nonce, as reusing the nonce of src for
+// other data would break GCM.
+//
+// The new vault keeps the cipher suite, the compression and
+// the key derivation of src and is opened with the same
+// key. Discard the old vault once the new one is stored.
+//
+// A new entry with the name of an old one fails with
+// ErrDuplicateEntry. src is read from its current position.
+// Like with Rekey, vaults with a keyfile or sealed with
+// AssociatedData can't be sealed again
+func AppendToVault(src io.ReadSeeker, key []byte, newEntries []Entry) (*VaultReader, error) {
+	if len(key) == 0 {
+		return nil, errEmptyKey
+	}
+
+	if err := checkEntries(newEntries); err != nil {
+		return nil, err
+	}
+
+	tr, b, err := openToRewrite(src, key)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	return b.build(func(a *archiveWriter) error {
+		if err := a.copyEntries(tr, nil); err != nil {
+			return err
+		}
+
+		return b.addEntries(newEntries)(a)
+	}, key)
+}
+
+// RemoveFromVault seals a new vault with the entries of the
+// vault in src but the named ones, for retention policies
+// that prune files. Like AppendToVault, the new vault is
+// sealed like src with a fresh nonce and the old one must
+// be discarded.
+//
+// The names are the ones in the tar, directories with or
+// without the trailing slash. Only the entry itself is
+// removed, not what is inside a directory. It returns
+// ErrEntryNotFound if a name is not in the vault, see
+// RemoveFromVaultIfExists
+func RemoveFromVault(src io.ReadSeeker, key []byte, names []string) (*VaultReader, error) {
+	return removeFromVault(src, key, names, false)
+}
+
+// RemoveFromVaultIfExists is like RemoveFromVault but the
+// names that are not in the vault are ignored
+func RemoveFromVaultIfExists(src io.ReadSeeker, key []byte, names []string) (*VaultReader, error) {
+	return removeFromVault(src, key, names, true)
+}
+
+func removeFromVault(src io.ReadSeeker, key []byte, names []string, ignoreMissing bool) (*VaultReader, error) {
+	if len(key) == 0 {
+		return nil, errEmptyKey
+	}
+
+	remove := make(map[string]bool)
+	for _, name := range names {
+		remove[strings.TrimSuffix(name, "/")] = false
+	}
+
+	tr, b, err := openToRewrite(src, key)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	return b.build(func(a *archiveWriter) error {
+		err := a.copyEntries(tr, func(hdr *tar.Header) bool {
+			name := strings.TrimSuffix(hdr.Name, "/")
+			if _, ok := remove[name]; ok {
+				remove[name] = true
+				return false
+			}
+			return true
+		})
+		if err != nil || ignoreMissing {
+			return err
+		}
+
+		var missing []string
+		for name, found := range remove {
+			if !found {
+				missing = append(missing, name)
+			}
+		}
+
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return fmt.Errorf("%w: %s", ErrEntryNotFound, strings.Join(missing, ", "))
+		}
+		return nil
+	}, key)
+}
+
+// Rekey seals the vault in src again with newKey and a
+// fresh nonce, for key rotation. The archive is decrypted
+// with oldKey and encrypted again as the new vault is
+// read, so nothing is written to disk, in the clear or not.
+//
+// The new vault is a standard one, opened only with newKey
+// and without the KeyID of src. It keeps the cipher suite,
+// the compression, with its dictionary, and the key
+// derivation of src, with a new salt. For password vaults
+// the keys are the passwords.
+//
+// Vaults with a keyfile can't be rekeyed, nor those sealed
+// with AssociatedData: src is opened without it, so it fails
+// with ErrAuthFailed, and the new vault wouldn't keep it.
+//
+// src is read from its current position and must not be
+// moved until the new vault is read to the end, which
+// fails if src was modified. The new vault can't Seek
+func Rekey(src io.ReadSeeker, oldKey, newKey []byte) (*VaultReader, error) {
+	if len(oldKey) == 0 || len(newKey) == 0 {
+		return nil, errEmptyKey
+	}
+
+	b, err := rewriteBuilder(src)
+	if err != nil {
+		return nil, err
+	}
+	// The id was the one of the old key
+	b.KeyID = nil
+
+	dr, old, info, err := new(VaultOpener).decrypt(src, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	// The archive is compressed with it
+	b.Dictionary = old.dictionary
+
+	h, aead, stream, err := b.newHeader(newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The archive is the same, and so is its info
+	raw, err := h.complete(aead, *info)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = dr
+	if info.known() {
+		body = &checkedReader{r: dr, sum: sha256.New(), want: info.Checksum}
+	}
+
+	vault := &VaultReader{nonce: h.nonce, header: raw, ad: h.withAAD(raw), size: info.ArchiveSize, streamed: true, stream: stream, log: b.logger()}
+	vault.EncReader = stream.EncryptReader(body, h.nonce, vault.ad)
+	return vault, nil
+}
+
+// Compares the SHA-256 of what is read with the checksum of
+// the vault once it ends
+type checkedReader struct {
+	r    io.Reader
+	sum  hash.Hash
+	want [sha256.Size]byte
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.sum.Write(p[:n])
+
+	if err == io.EOF && subtle.ConstantTimeCompare(c.sum.Sum(nil), c.want[:]) != 1 {
+		err = ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// Open the vault in src to seal what it holds again, and
+// a builder that seals it like src was
+func openToRewrite(src io.ReadSeeker, key []byte) (*TarReader, *VaultBuilder, error) {
+	b, err := rewriteBuilder(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The manifest is not copied, so the vault is no longer
+	// a differential one
+	b.baseID = nil
+
+	dr, h, info, err := new(VaultOpener).decrypt(src, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.Dictionary = h.dictionary
+
+	tr, err := tarReader(dr, h.compression, h.dictionary, info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tr, b, nil
+}
+
+// A builder with the settings of the header of the vault
+// in src. src is left where it was
+func rewriteBuilder(src io.ReadSeeker) (*VaultBuilder, error) {
+	start, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	h, _, err := parseHeader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.recipients != nil || h.ephemeral != nil {
+		return nil, errors.New("arcsek: vaults for recipients can't be sealed again")
+	}
+
+	// The keyfile is not given, and a new vault without it
+	// would be weaker than src
+	if h.keyfile {
+		return nil, errors.New("arcsek: vaults with a keyfile can't be sealed again")
+	}
+
+	if _, err = src.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	b := &VaultBuilder{
+		CipherSuite: h.suite,
+		Compression: h.compression,
+		KeyDeriver:  h.kdf,
+		BufferSize:  h.bufSize,
+		KeyID:       h.keyID,
+		baseID:      h.base,
+	}
+	return b, nil
+}
+
+// Copy the entries of the tar as they are, the ones keep
+// accepts if it is not nil. Then check the checksum of the
+// old vault if it has one
+func (a *archiveWriter) copyEntries(tr *TarReader, keep func(*tar.Header) bool) error {
+	// Copies of a file left out would point to nothing
+	dropped := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// The new vault would have the real names
+		if tr.names != nil {
+			return errors.New("arcsek: vaults with obfuscated names can't be sealed again")
+		}
+
+		if keep != nil && !keep(hdr) {
+			dropped[hdr.Name] = true
+			continue
+		}
+
+		if isCopy(hdr) && dropped[hdr.Linkname] {
+			return fmt.Errorf("arcsek: %s is a copy of %s, which is removed", hdr.Name, hdr.Linkname)
+		}
+
+		if err = a.copyEntry(hdr, tr); err != nil {
+			return err
+		}
+	}
+
+	if tr.info == nil || !tr.info.known() {
+		return nil
+	}
+
+	return tr.Verify()
+}
+
+// Copy an entry of another tar with its body
+func (a *archiveWriter) copyEntry(hdr *tar.Header, body io.Reader) error {
+	if err := a.claim(strings.TrimSuffix(hdr.Name, "/")); err != nil {
+		return err
+	}
+
+	if err := a.begin(hdr.Name, hdr.Size); err != nil {
+		return err
+	}
+
+	paxLongNames(hdr)
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	n, err := copyBuffer(a.body(a.tw), body)
+	if err != nil {
+		return err
+	}
+
+	a.info.Files++
+	a.info.Size += n
+	return nil
+}
@@ -0,0 +1,285 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Seal the entries and return the serialized vault
+func sealEntries(t *testing.T, key []byte, entries ...Entry) []byte {
+	vault, err := NewVaultReaderEntries(entries, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	if _, err = vault.WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff.Bytes()
+}
+
+// The names and contents of the entries, in order, or
+// the first error reading them
+func readEntries(enc io.Reader, key []byte) ([]string, map[string]string, error) {
+	tr, err := NewTarReader(enc, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tr.Close()
+
+	var names []string
+	contents := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names, contents, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, h.Name)
+		contents[h.Name] = string(b)
+	}
+}
+
+func entry(name, body string) Entry {
+	return Entry{Name: name, Size: int64(len(body)), Body: strings.NewReader(body)}
+}
+
+func TestAppendToVault(t *testing.T) {
+	key := genKey("append")
+	old := sealEntries(t, key, entry("a.txt", "first"), entry("b.txt", "second"))
+
+	t.Run("Appended", func(t *testing.T) {
+		vault, err := AppendToVault(bytes.NewReader(old), key, []Entry{entry("c.txt", "third")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
+
+		h, _, err := parseHeader(bytes.NewReader(old))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Equal(vault.Nonce(), h.nonce) {
+			t.Fatal("The nonce was reused")
+		}
+
+		names, contents, err := readEntries(vault, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{"a.txt": "first", "b.txt": "second", "c.txt": "third"}
+		if strings.Join(names, ",") != "a.txt,b.txt,c.txt" {
+			t.Fatalf("Expected the old entries and then the new one, got %v", names)
+		}
+
+		for name, body := range want {
+			if contents[name] != body {
+				t.Fatalf("Expected '%s' in %s, got '%s'", body, name, contents[name])
+			}
+		}
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		_, err := AppendToVault(bytes.NewReader(old), key, []Entry{entry("a.txt", "again")})
+		if !errors.Is(err, ErrDuplicateEntry) {
+			t.Fatalf("Expected ErrDuplicateEntry but got %v", err)
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		_, err := AppendToVault(bytes.NewReader(old), genKey("other"), []Entry{entry("c.txt", "third")})
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+
+	t.Run("Keeps the settings", func(t *testing.T) {
+		b := VaultBuilder{Compression: Zstd, CipherSuite: ChaCha20Poly1305}
+		k := append(key, key...)
+
+		vault, err := b.BuildEntries([]Entry{entry("a.txt", "first")}, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
+
+		src := new(bytes.Buffer)
+		vault.WriteTo(src)
+
+		appended, err := AppendToVault(bytes.NewReader(src.Bytes()), k, []Entry{entry("b.txt", "second")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer appended.Close()
+
+		h, _, err := parseHeader(bytes.NewReader(appended.Header()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.suite != ChaCha20Poly1305 || h.compression != Zstd {
+			t.Fatalf("The vault is sealed with %s and %s", h.suite, h.compression)
+		}
+	})
+}
+
+func TestRemoveFromVault(t *testing.T) {
+	key := genKey("remove")
+	old := sealEntries(t, key, entry("a.txt", "first"), entry("b.txt", "second"), entry("c.txt", "third"))
+
+	testCases := []struct {
+		name   string
+		remove []string
+		ignore bool
+		want   string
+		err    error
+	}{
+		{"One", []string{"b.txt"}, false, "a.txt,c.txt", nil},
+		{"Missing", []string{"b.txt", "d.txt"}, false, "", ErrEntryNotFound},
+		{"Ignored", []string{"b.txt", "d.txt"}, true, "a.txt,c.txt", nil},
+		{"All", []string{"a.txt", "b.txt", "c.txt"}, false, "", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			remove := RemoveFromVault
+			if tc.ignore {
+				remove = RemoveFromVaultIfExists
+			}
+
+			vault, err := remove(bytes.NewReader(old), key, tc.remove)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("Expected %v but got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			names, contents, err := readEntries(vault, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(names, ",") != tc.want {
+				t.Fatalf("Expected %s to be left, got %v", tc.want, names)
+			}
+
+			for name, body := range map[string]string{"a.txt": "first", "c.txt": "third"} {
+				if _, ok := contents[name]; ok && contents[name] != body {
+					t.Fatalf("%s was modified: '%s'", name, contents[name])
+				}
+			}
+		})
+	}
+}
+
+func TestRekey(t *testing.T) {
+	oldKey, newKey := genKey("old"), genKey("new")
+	entries := []Entry{entry("a.txt", "first"), entry("b.txt", "second")}
+
+	sealed := sealEntries(t, oldKey, entries...)
+
+	streamed := new(bytes.Buffer)
+	if err := EncryptTo(streamed, []string{"testing-files/in/existance/testfile1.txt"}, oldKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, old := range map[string][]byte{"Sealed": sealed, "Streamed": streamed.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			vault, err := Rekey(bytes.NewReader(old), oldKey, newKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			rotated := new(bytes.Buffer)
+			if _, err = vault.WriteTo(rotated); err != nil {
+				t.Fatal(err)
+			}
+
+			want, _, err := readEntries(bytes.NewReader(old), oldKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names, _, err := readEntries(bytes.NewReader(rotated.Bytes()), newKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(names, ",") != strings.Join(want, ",") {
+				t.Fatalf("Expected %v but the rotated vault has %v", want, names)
+			}
+
+			if _, _, err = readEntries(bytes.NewReader(rotated.Bytes()), oldKey); !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("The old key should not open the vault: %v", err)
+			}
+		})
+	}
+
+	t.Run("Wrong key", func(t *testing.T) {
+		if _, err := Rekey(bytes.NewReader(sealed), newKey, oldKey); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+	})
+
+	t.Run("Modified", func(t *testing.T) {
+		modified := append([]byte(nil), sealed...)
+		modified[len(modified)-20] ^= 1
+
+		vault, err := Rekey(bytes.NewReader(modified), oldKey, newKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
+
+		if _, err = vault.WriteTo(io.Discard); !errors.Is(err, ErrDecryptFailed) {
+			t.Fatalf("Expected the vault to fail, got %v", err)
+		}
+	})
+}
+
+func TestRekeyUnsupported(t *testing.T) {
+	oldKey, newKey := genKey("old"), genKey("new")
+
+	testCases := map[string]VaultBuilder{
+		"Keyfile":         {Keyfile: []byte("the keyfile")},
+		"Associated data": {AssociatedData: []byte("bucket/object")},
+	}
+
+	for name, b := range testCases {
+		t.Run(name, func(t *testing.T) {
+			v, err := b.BuildEntries([]Entry{entry("a.txt", "first")}, oldKey)
+			vault := vaultBytes(t, v, err)
+
+			if _, err = Rekey(bytes.NewReader(vault), oldKey, newKey); err == nil {
+				t.Fatal("Rekeyed a vault whose settings it doesn't have")
+			}
+
+			if _, err = AppendToVault(bytes.NewReader(vault), oldKey, []Entry{entry("b.txt", "second")}); err == nil {
+				t.Fatal("Appended to a vault whose settings it doesn't have")
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package arcsek
+
+import (
+	"crypto/cipher"
+
+	"github.com/secure-io/sio-go"
+)
+
+// Sealer seals many vaults under the same key, like a server
+// that builds one for each request. The key is derived and
+// the cipher created once, instead of for every vault.
+//
+// Each Seal still gets a fresh random nonce, so no two
+// vaults share their stream. With a KeyDeriver they all share
+// the salt, the key is derived only once.
+//
+// A Sealer can be used by several goroutines at once, with
+// the ciphers of this package
+type Sealer struct {
+	b      VaultBuilder
+	level  int
+	h      header
+	aead   cipher.AEAD
+	stream *sio.Stream
+}
+
+// NewSealer is like NewVaultReader but returns a Sealer for
+// the key, which seals the vaults
+func NewSealer(key []byte, opts ...Option) (*Sealer, error) {
+	return newBuilder(opts).NewSealer(key)
+}
+
+// NewSealer returns a Sealer that seals the vaults with the
+// key and the settings of the builder. Later changes to the
+// builder don't change the Sealer
+func (b *VaultBuilder) NewSealer(key []byte) (*Sealer, error) {
+	if len(key) == 0 {
+		return nil, errEmptyKey
+	}
+
+	level, err := b.compressionLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	h, aead, stream, err := b.headerForKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sealer{b: *b, level: level, h: *h, aead: aead, stream: stream}, nil
+}
+
+// Seal is like NewVaultReader with the key of the Sealer
+func (s *Sealer) Seal(files []string) (*VaultReader, error) {
+	if len(files) == 0 {
+		return nil, ErrEmptyFileList
+	}
+
+	// The header of each vault is its own, for its nonce
+	h := s.h
+	if err := s.b.setNonce(&h, s.aead, s.stream); err != nil {
+		return nil, err
+	}
+
+	return s.b.seal(s.level, s.b.addFiles(files), &h, s.aead, s.stream)
+}
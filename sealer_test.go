@@ -0,0 +1,79 @@
+package arcsek
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestSealer(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	testCases := []struct {
+		name string
+		key  []byte
+		opts []Option
+	}{
+		{"Raw key", genKey("sealer"), nil},
+		{"Password", []byte("correct horse"), []Option{WithKeyDeriver(testScryptParams), WithCompression(Zstd)}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewSealer(tc.key, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Several at once, each with its own nonce
+			sealed := make([]*VaultReader, 8)
+			errs := make([]error, len(sealed))
+			var wg sync.WaitGroup
+			for i := range sealed {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					sealed[i], errs[i] = s.Seal(files)
+				}()
+			}
+			wg.Wait()
+
+			nonces := make(map[string]bool)
+			for i := range sealed {
+				vault := vaultBytes(t, sealed[i], errs[i])
+				vh, err := InspectVault(bytes.NewReader(vault))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if nonces[vh.Nonce] {
+					t.Fatalf("The nonce %s was used twice", vh.Nonce)
+				}
+				nonces[vh.Nonce] = true
+
+				if err = VerifyVault(bytes.NewReader(vault), tc.key); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		if _, err := NewSealer(nil); !errors.Is(err, ErrInvalidKeyLength) {
+			t.Fatalf("Expected ErrInvalidKeyLength but got %v", err)
+		}
+
+		if _, err := NewSealer(genKey("sealer"), WithCipherSuite(AES256GCM)); !errors.Is(err, ErrInvalidKeyLength) {
+			t.Fatalf("Expected ErrInvalidKeyLength but got %v", err)
+		}
+
+		s, err := NewSealer(genKey("sealer"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.Seal(nil); err != ErrEmptyFileList {
+			t.Fatalf("Expected ErrEmptyFileList but got %v", err)
+		}
+	})
+}
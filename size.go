@@ -0,0 +1,50 @@
+package arcsek
+
+import "github.com/secure-io/sio-go"
+
+// EncryptedSize returns the exact length of a vault, header
+// included, whose archive is plaintextSize bytes long, like
+// VaultReader.ArchiveSize, sealed in chunks of bufSize
+// bytes. Zero is the default buffer size, see
+// VaultBuilder.BufferSize.
+//
+// It is what WriteTo writes, so it can be sent as the
+// Content-Length before streaming the vault. It holds for
+// vaults sealed with a raw key and any of the AES-GCM or
+// ChaCha20-Poly1305 suites. XChaCha20-Poly1305 has a longer
+// nonce and password vaults store the parameters of the
+// deriver in the header as well.
+//
+// It returns -1 if the size is negative or bufSize is out
+// of range
+func EncryptedSize(plaintextSize int64, bufSize int) int64 {
+	if plaintextSize < 0 {
+		return -1
+	}
+
+	// All those suites have the overhead and nonce of GCM
+	aead, err := createAESGCMFromKey(make([]byte, 16))
+	if err != nil {
+		return -1
+	}
+
+	stream, err := createStream(aead, bufSize)
+	if err != nil {
+		return -1
+	}
+
+	h := header{nonce: make([]byte, stream.NonceSize())}
+	if bufSize != sio.BufSize {
+		h.bufSize = bufSize
+	}
+
+	// The info is sealed with its own nonce
+	h.info = make([]byte, aead.NonceSize()+infoLen+aead.Overhead())
+
+	raw, err := h.marshal()
+	if err != nil {
+		return -1
+	}
+
+	return int64(len(raw)) + plaintextSize + stream.Overhead(plaintextSize)
+}
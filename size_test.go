@@ -0,0 +1,80 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/secure-io/sio-go"
+)
+
+func TestEncryptedSize(t *testing.T) {
+	key := genKey("size")
+	dir := t.TempDir()
+
+	for _, size := range []int{0, 1, 1000, 16000, 100000} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		path := filepath.Join(dir, fmt.Sprint(size))
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, bufSize := range []int{0, sio.BufSize, 1000, 1 << 20} {
+			for _, suite := range []CipherSuite{AESGCM, ChaCha20Poly1305} {
+				t.Run(fmt.Sprintf("%d/%d/%s", size, bufSize, suite), func(t *testing.T) {
+					k := key
+					if suite == ChaCha20Poly1305 {
+						k = append(k, k...)
+					}
+
+					b := VaultBuilder{Compression: None, BufferSize: bufSize, CipherSuite: suite}
+					vault, err := b.Build([]string{path}, k)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer vault.Close()
+
+					sealed := new(bytes.Buffer)
+					if _, err = vault.WriteTo(sealed); err != nil {
+						t.Fatal(err)
+					}
+
+					if got := EncryptedSize(vault.ArchiveSize(), bufSize); got != int64(sealed.Len()) {
+						t.Fatalf("Predicted %d bytes but the vault has %d", got, sealed.Len())
+					}
+				})
+			}
+		}
+	}
+
+	// Around the end of the chunks, the body is what sio writes
+	stream, err := createStreamFromKey(AESGCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := EncryptedSize(0, 0) - stream.Overhead(0)
+
+	for _, n := range []int64{1, sio.BufSize - 1, sio.BufSize, sio.BufSize + 1, 3 * sio.BufSize} {
+		t.Run(fmt.Sprint("Chunks", n), func(t *testing.T) {
+			body := new(bytes.Buffer)
+			w := stream.EncryptWriter(body, make([]byte, stream.NonceSize()), nil)
+			w.Write(make([]byte, n))
+			w.Close()
+
+			if got := EncryptedSize(n, 0); got != header+int64(body.Len()) {
+				t.Fatalf("Predicted %d bytes but sio wrote a %d byte body", got, body.Len())
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		if EncryptedSize(-1, 0) != -1 || EncryptedSize(10, -1) != -1 || EncryptedSize(10, sio.MaxBufSize+1) != -1 {
+			t.Fatal("Invalid sizes should be -1")
+		}
+	})
+}
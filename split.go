@@ -0,0 +1,203 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The signature every part of a split vault starts with
+var partMagic = []byte("ARCSEKP")
+
+// The version of the part header
+const partVersion = 1
+
+// ErrBadPart is returned when joining parts that are not
+// the parts of one vault, in order
+var ErrBadPart = errors.New("arcsek: not the next part of the vault")
+
+// The plain header in front of each part:
+//
+//	magic "ARCSEKP" (7 bytes) | version (1 byte) |
+//	index (4 bytes) | total (4 bytes) | vault id (16 bytes)
+//
+// The id is the start of the SHA-256 of the header of the
+// vault, so parts of different vaults are not mixed. The
+// parts themselves are not authenticated, the vault is
+type partHeader struct {
+	index, total uint32
+	id           [16]byte
+}
+
+const partHeaderLen = 7 + 1 + 4 + 4 + 16
+
+func (p *partHeader) marshal() []byte {
+	b := make([]byte, 0, partHeaderLen)
+	b = append(b, partMagic...)
+	b = append(b, partVersion)
+	b = binary.BigEndian.AppendUint32(b, p.index)
+	b = binary.BigEndian.AppendUint32(b, p.total)
+	return append(b, p.id[:]...)
+}
+
+func readPartHeader(r io.Reader) (*partHeader, error) {
+	b := make([]byte, partHeaderLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadPart, err)
+	}
+
+	if !bytes.Equal(b[:len(partMagic)], partMagic) || b[len(partMagic)] != partVersion {
+		return nil, fmt.Errorf("%w: no part header", ErrBadPart)
+	}
+
+	p := &partHeader{
+		index: binary.BigEndian.Uint32(b[8:]),
+		total: binary.BigEndian.Uint32(b[12:]),
+	}
+	copy(p.id[:], b[16:])
+
+	return p, nil
+}
+
+// WriteParts writes the vault split in parts of at most
+// partSize bytes each, for storage that caps the size of
+// an object. create is called for each part in order, with
+// its index from 0 and the number of parts, and the part
+// is closed once written.
+//
+// Every part starts with a small header naming its place
+// in the vault. JoinVaultParts puts them back together.
+//
+// The vault must not have been read, unless it can Seek
+func (v *VaultReader) WriteParts(partSize int64, create func(index, total int) (io.WriteCloser, error)) error {
+	if partSize <= partHeaderLen {
+		return fmt.Errorf("arcsek: parts must be longer than their %d byte header", partHeaderLen)
+	}
+
+	if v.stream == nil || v.size < 0 {
+		return errors.New("arcsek: the size of the vault is not known")
+	}
+
+	if v.headerOff != 0 || v.bodyOff != 0 {
+		if _, err := v.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("arcsek: the vault was read already: %w", err)
+		}
+	}
+
+	size := int64(len(v.header)) + v.size + v.stream.Overhead(v.size)
+	payload := partSize - partHeaderLen
+	total := (size + payload - 1) / payload
+	if total > 1<<32-1 {
+		return errors.New("arcsek: too many parts")
+	}
+
+	head := partHeader{total: uint32(total)}
+	sum := sha256.Sum256(v.header)
+	copy(head.id[:], sum[:])
+
+	for i := 0; i < int(total); i++ {
+		head.index = uint32(i)
+		if err := v.writePart(&head, payload, create); err != nil {
+			return fmt.Errorf("arcsek: part %d of %d: %w", i, total, err)
+		}
+	}
+
+	return nil
+}
+
+// Write the part with the next payload bytes of the vault
+func (v *VaultReader) writePart(head *partHeader, payload int64, create func(index, total int) (io.WriteCloser, error)) error {
+	w, err := create(int(head.index), int(head.total))
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(head.marshal()); err == nil {
+		_, err = io.CopyN(w, v, payload)
+		if err == io.EOF && head.index == head.total-1 {
+			err = nil
+		}
+	}
+
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// JoinVaultParts returns the vault written in parts by
+// WriteParts, to open it like any other. The parts must be
+// all of them and in order, or reading fails with ErrBadPart.
+// Each part is read to the end before the next one
+func JoinVaultParts(parts ...io.Reader) io.Reader {
+	return &partsReader{parts: parts}
+}
+
+type partsReader struct {
+	parts []io.Reader
+	next  int
+
+	// The part being read, nil before the first part and
+	// between parts
+	cur   io.Reader
+	first *partHeader
+
+	err error
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for p.err == nil {
+		if p.cur == nil {
+			if p.next == len(p.parts) {
+				p.err = io.EOF
+				break
+			}
+
+			p.err = p.open()
+			continue
+		}
+
+		n, err := p.cur.Read(b)
+		if err == io.EOF {
+			p.cur, err = nil, nil
+		}
+
+		if n > 0 || err != nil {
+			p.err = err
+			return n, err
+		}
+	}
+
+	return 0, p.err
+}
+
+// Check the header of the next part and start reading it
+func (p *partsReader) open() error {
+	r := p.parts[p.next]
+	head, err := readPartHeader(r)
+	if err != nil {
+		return fmt.Errorf("part %d: %w", p.next, err)
+	}
+
+	if p.first == nil {
+		p.first = head
+		if int64(head.total) != int64(len(p.parts)) {
+			return fmt.Errorf("%w: the vault has %d parts, got %d", ErrBadPart, head.total, len(p.parts))
+		}
+	}
+
+	switch {
+	case head.id != p.first.id:
+		return fmt.Errorf("%w: part %d is from another vault", ErrBadPart, p.next)
+	case int(head.index) != p.next || head.total != p.first.total:
+		return fmt.Errorf("%w: expected part %d of %d, got part %d of %d",
+			ErrBadPart, p.next, p.first.total, head.index, head.total)
+	}
+
+	p.cur = r
+	p.next++
+	return nil
+}
@@ -0,0 +1,137 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// A buffer that is its own WriteCloser
+type partBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (p *partBuffer) Close() error {
+	p.closed = true
+	return nil
+}
+
+// Split a vault of the file in three parts
+func splitTestVault(t *testing.T, path string, key []byte) ([]*partBuffer, []byte) {
+	vault, err := NewVaultReader([]string{path}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	whole, err := ioutil.ReadAll(vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parts []*partBuffer
+	partSize := int64(len(whole))/3 + partHeaderLen + 1
+	err = vault.WriteParts(partSize, func(index, total int) (io.WriteCloser, error) {
+		if index != len(parts) || total != 3 {
+			t.Fatalf("Asked for part %d of %d", index, total)
+		}
+
+		parts = append(parts, new(partBuffer))
+		return parts[index], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, p := range parts {
+		if !p.closed || int64(p.Len()) > partSize {
+			t.Fatalf("Part %d was not closed or is too long: %d bytes", i, p.Len())
+		}
+	}
+
+	return parts, whole
+}
+
+func TestSplitVault(t *testing.T) {
+	key := genKey("split")
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "random.bin")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parts, whole := splitTestVault(t, path, key)
+	other, _ := splitTestVault(t, path, key)
+
+	readers := func(parts ...*partBuffer) []io.Reader {
+		var r []io.Reader
+		for _, p := range parts {
+			r = append(r, bytes.NewReader(p.Bytes()))
+		}
+		return r
+	}
+
+	t.Run("Joined", func(t *testing.T) {
+		joined, err := ioutil.ReadAll(JoinVaultParts(readers(parts...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(joined, whole) {
+			t.Fatal("The parts are not the vault")
+		}
+
+		dest := t.TempDir()
+		if _, err = ExtractTo(bytes.NewReader(joined), key, dest); err != nil {
+			t.Fatal(err)
+		}
+
+		if b, err := ioutil.ReadFile(filepath.Join(dest, "random.bin")); err != nil || !bytes.Equal(b, data) {
+			t.Fatalf("The file was not restored: %v", err)
+		}
+	})
+
+	notPart := new(partBuffer)
+	notPart.Write(whole)
+
+	testCases := []struct {
+		name  string
+		parts []*partBuffer
+	}{
+		{"Swapped", []*partBuffer{parts[1], parts[0], parts[2]}},
+		{"Missing", []*partBuffer{parts[0], parts[2]}},
+		{"Other vault", []*partBuffer{parts[0], other[1], parts[2]}},
+		{"Not a part", []*partBuffer{parts[0], notPart, parts[2]}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ioutil.ReadAll(JoinVaultParts(readers(tc.parts...)...))
+			if !errors.Is(err, ErrBadPart) {
+				t.Fatalf("Expected ErrBadPart but got %v", err)
+			}
+		})
+	}
+
+	t.Run("Too small", func(t *testing.T) {
+		vault, err := NewVaultReader([]string{path}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vault.Close()
+
+		err = vault.WriteParts(partHeaderLen, func(int, int) (io.WriteCloser, error) {
+			return new(partBuffer), nil
+		})
+		if err == nil {
+			t.Fatal("Parts that only fit the header should fail")
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package arcsek
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The prefix of the staging directories of SafeExtract
+const stagingPrefix = ".arcsek-staging-"
+
+// Extract the vault to a staging directory in destDir, in
+// the same file system so its entries can be renamed, and
+// move them to destDir once nothing failed
+func (o *VaultOpener) safeExtract(ctx context.Context, r io.Reader, key []byte, destDir string) (int, error) {
+	var files int
+	err := o.staged(destDir, func(d *dirCreator) error {
+		var err error
+		files, err = o.extract(ctx, r, key, d)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return files, nil
+}
+
+// Run extract with a dirCreator of a staging directory in
+// destDir and move what it writes to destDir if it doesn't
+// fail, see moveEntries. The directories get their metadata
+// once moved. Nothing of the staging directory is kept
+func (o *VaultOpener) staged(destDir string, extract func(d *dirCreator) error) error {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp(destDir, stagingPrefix)
+	if err != nil {
+		return err
+	}
+	// Once moved it is empty, otherwise nothing of it is kept
+	defer os.RemoveAll(staging)
+
+	d := &dirCreator{dest: staging, opener: o, staging: true}
+	if err = extract(d); err != nil {
+		return err
+	}
+
+	// What the entries replace is kept until all are moved
+	backups, err := os.MkdirTemp(destDir, stagingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(backups)
+
+	if err = moveEntries(staging, destDir, backups); err != nil {
+		return err
+	}
+
+	return d.restoreDirs(destDir)
+}
+
+// An entry moved by moveEntries, and where what it replaced
+// was moved to, if anything
+type move struct {
+	from, to, backup string
+}
+
+// Move the entries of src to dest. The directories that
+// exist in both are merged, anything else in dest with the
+// name of an entry is replaced. Nothing is moved if an entry
+// is a directory where dest has something else or the other
+// way around, and if a move fails the ones before it are
+// undone, so dest is left as it was
+func moveEntries(src, dest, backups string) error {
+	if err := checkMoves(src, dest); err != nil {
+		return err
+	}
+
+	var done []move
+	if err := moveInto(src, dest, backups, &done); err != nil {
+		return errors.Join(err, undoMoves(done))
+	}
+
+	return nil
+}
+
+// Check that no entry of src is a directory where dest has
+// something else, or the other way around, which rename
+// can't replace
+func checkMoves(src, dest string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		from, to := filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())
+
+		// Lstat, a symlink in dest must not be followed
+		fi, err := os.Lstat(to)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() != entry.IsDir() {
+			return fmt.Errorf("arcsek: can't extract %s, only one of it and the entry of the vault is a directory", to)
+		}
+
+		if fi.IsDir() {
+			if err = checkMoves(from, to); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Move the entries of src to dest, the directories of both
+// merged, recording each move in done. What an entry
+// replaces is moved to backups first
+func moveInto(src, dest, backups string, done *[]move) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		m := move{from: filepath.Join(src, entry.Name()), to: filepath.Join(dest, entry.Name())}
+
+		fi, err := os.Lstat(m.to)
+		if err == nil && fi.IsDir() && entry.IsDir() {
+			if err = moveInto(m.from, m.to, backups, done); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err == nil {
+			m.backup = filepath.Join(backups, strconv.Itoa(len(*done)))
+			if err = os.Rename(m.to, m.backup); err != nil {
+				return err
+			}
+		}
+
+		if err = os.Rename(m.from, m.to); err != nil {
+			if m.backup != "" {
+				err = errors.Join(err, os.Rename(m.backup, m.to))
+			}
+			return err
+		}
+		*done = append(*done, m)
+	}
+
+	return nil
+}
+
+// Put back the entries moved and what they replaced, the
+// last first
+func undoMoves(done []move) error {
+	var errs []error
+	for i := len(done) - 1; i >= 0; i-- {
+		m := done[i]
+		if err := os.Rename(m.to, m.from); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if m.backup != "" {
+			if err := os.Rename(m.backup, m.to); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,227 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeExtract(t *testing.T) {
+	key := genKey("safe extract")
+
+	// The small file is in the first chunks and the random one
+	// spans many after it
+	src := t.TempDir()
+	data := make([]byte, 256<<10)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "dir", "z.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := VaultBuilder{Compression: None}
+	v, err := b.Build([]string{src}, key)
+	vault := vaultBytes(t, v, err)
+
+	// The tag of the last chunk
+	tampered := bytes.Clone(vault)
+	tampered[len(tampered)-1] ^= 1
+
+	t.Run("Tampered tail", func(t *testing.T) {
+		// Without it the first file is already on disk
+		dest := t.TempDir()
+		if _, err := ExtractTo(bytes.NewReader(tampered), key, dest); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "a.txt")); err != nil {
+			t.Fatalf("Expected a partial extraction but got %v", err)
+		}
+
+		dest = t.TempDir()
+		o := VaultOpener{SafeExtract: true}
+		if n, err := o.ExtractTo(bytes.NewReader(tampered), key, dest); !errors.Is(err, ErrAuthFailed) || n != 0 {
+			t.Fatalf("Expected ErrAuthFailed and no files but got %d, %v", n, err)
+		}
+
+		entries, err := os.ReadDir(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("The destination is not empty: %v", entries)
+		}
+	})
+
+	t.Run("Read-only directory", func(t *testing.T) {
+		ro := sealTarEntries(t, key, []tarEntry{
+			{tar.Header{Name: "ro/", Typeflag: tar.TypeDir, Mode: 0500}, ""},
+			{tar.Header{Name: "ro/a.txt"}, "first"},
+			{tar.Header{Name: "z.bin"}, string(data)},
+		}).Bytes()
+		tampered := bytes.Clone(ro)
+		tampered[len(tampered)-1] ^= 1
+
+		// Nothing is left behind, even under a directory that
+		// can't be written to
+		dest := t.TempDir()
+		o := VaultOpener{SafeExtract: true}
+		if _, err := o.ExtractTo(bytes.NewReader(tampered), key, dest); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed but got %v", err)
+		}
+
+		entries, err := os.ReadDir(dest)
+		if err != nil || len(entries) != 0 {
+			t.Fatalf("The destination is not empty: %v, %v", entries, err)
+		}
+
+		// Once moved, the directory gets its mode
+		if _, err = o.ExtractTo(bytes.NewReader(ro), key, dest); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(filepath.Join(dest, "ro"), 0755)
+
+		fi, err := os.Stat(filepath.Join(dest, "ro"))
+		if err != nil || fi.Mode().Perm() != 0500 {
+			t.Fatalf("ro was extracted with %v, %v", fi.Mode(), err)
+		}
+		if _, err = os.Stat(filepath.Join(dest, "ro", "a.txt")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		dest := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dest, "dir"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dest, "dir", "kept.txt"), []byte("kept"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dest, "a.txt"), []byte("replaced"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		o := VaultOpener{SafeExtract: true}
+		n, err := o.ExtractTo(bytes.NewReader(vault), key, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("%d files were extracted instead of 2", n)
+		}
+
+		for name, want := range map[string][]byte{"a.txt": []byte("first"), "dir/z.bin": data, "dir/kept.txt": []byte("kept")} {
+			got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("%s has the wrong contents, %v", name, err)
+			}
+		}
+
+		// The staging directory is gone
+		entries, err := os.ReadDir(dest)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("Expected a.txt and dir but got %v, %v", entries, err)
+		}
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		b := VaultBuilder{}
+		v, err := b.BuildEntries([]Entry{entry("a", "new a"), entry("b", "new b")}, key)
+		vault := vaultBytes(t, v, err)
+
+		// b can't replace a directory, a must not be replaced
+		dest := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dest, "a"), []byte("old a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(dest, "b"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dest, "b", "kept.txt"), []byte("kept"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		o := VaultOpener{SafeExtract: true}
+		if _, err := o.ExtractTo(bytes.NewReader(vault), key, dest); err == nil {
+			t.Fatal("A file replaced a directory")
+		}
+
+		for name, want := range map[string]string{"a": "old a", "b/kept.txt": "kept"} {
+			got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+			if err != nil || string(got) != want {
+				t.Fatalf("%s has %q instead of %q, %v", name, got, want, err)
+			}
+		}
+
+		entries, err := os.ReadDir(dest)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("Expected a and b but got %v, %v", entries, err)
+		}
+	})
+
+	t.Run("New destination", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "new")
+		o := VaultOpener{SafeExtract: true}
+		if _, err := o.ExtractTo(bytes.NewReader(vault), key, dest); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dest, "dir", "z.bin")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUndoMoves(t *testing.T) {
+	src, dest, backups := t.TempDir(), t.TempDir(), t.TempDir()
+	write := func(path, body string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(src, "a"), "new a")
+	write(filepath.Join(src, "dir", "b"), "new b")
+	write(filepath.Join(src, "c"), "new c")
+	write(filepath.Join(dest, "a"), "old a")
+	write(filepath.Join(dest, "dir", "kept"), "kept")
+
+	var done []move
+	if err := moveInto(src, dest, backups, &done); err != nil {
+		t.Fatal(err)
+	}
+	if err := undoMoves(done); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		filepath.Join(dest, "a"):           "old a",
+		filepath.Join(dest, "dir", "kept"): "kept",
+		filepath.Join(src, "a"):            "new a",
+		filepath.Join(src, "dir", "b"):     "new b",
+		filepath.Join(src, "c"):            "new c",
+	} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != want {
+			t.Fatalf("%s has %q instead of %q, %v", path, got, want, err)
+		}
+	}
+
+	for _, path := range []string{filepath.Join(dest, "c"), filepath.Join(dest, "dir", "b")} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s was not moved back: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package arcsek
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Bounds for the nonce size of the AEADs. sio takes 4
+// bytes of the nonce for its chunk counter and the header
+// stores the rest in a single byte. We want at least 4
+// random bytes left
+const (
+	minAEADNonceSize = 8
+	maxAEADNonceSize = 255 + 4
+)
+
+// ErrInvalidKeyLength is returned when the key does not
+// have a length the cipher suite accepts
+var ErrInvalidKeyLength = errors.New("arcsek: invalid key length")
+
+// CipherSuite identifies the AEAD used to encrypt a vault.
+// It is stored in the vault header so the vault can be
+// decrypted with the same AEAD
+type CipherSuite byte
+
+const (
+	// AESGCM uses AES 128, 192 or 256 in GCM mode depending
+	// on the length of the key
+	AESGCM CipherSuite = 1
+
+	// ChaCha20Poly1305 is much faster than AES-GCM on
+	// platforms without AES hardware acceleration. It
+	// needs a 256 bit (32 byte) key
+	ChaCha20Poly1305 CipherSuite = 2
+
+	// AES128GCM is AES-GCM with a 128 bit (16 byte) key
+	AES128GCM CipherSuite = 3
+
+	// AES256GCM is AES-GCM with a 256 bit (32 byte) key
+	AES256GCM CipherSuite = 4
+
+	// XChaCha20Poly1305 is ChaCha20-Poly1305 with a 192 bit
+	// nonce, long enough to pick it at random without fear
+	// of collisions when many vaults share the same key.
+	// It needs a 256 bit (32 byte) key
+	XChaCha20Poly1305 CipherSuite = 5
+)
+
+// String returns the name of the suite
+func (s CipherSuite) String() string {
+	switch s {
+	case AESGCM:
+		return "AES-GCM"
+	case ChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	case AES128GCM:
+		return "AES-128-GCM"
+	case AES256GCM:
+		return "AES-256-GCM"
+	case XChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	default:
+		return fmt.Sprintf("CipherSuite(%d)", byte(s))
+	}
+}
+
+// The suites with a name
+var namedSuites = []CipherSuite{AESGCM, ChaCha20Poly1305, AES128GCM, AES256GCM, XChaCha20Poly1305}
+
+// MarshalText returns the name of the suite, "" for the
+// zero suite, which picks one by the key, or the id of
+// those registered with RegisterCipherSuite
+func (s CipherSuite) MarshalText() ([]byte, error) {
+	if s == 0 {
+		return nil, nil
+	}
+
+	if !slices.Contains(namedSuites, s) {
+		return strconv.AppendUint(nil, uint64(s), 10), nil
+	}
+
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses what MarshalText returns, ignoring
+// the case of the names, for configs
+func (s *CipherSuite) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*s = 0
+		return nil
+	}
+
+	for _, suite := range namedSuites {
+		if strings.EqualFold(string(text), suite.String()) {
+			*s = suite
+			return nil
+		}
+	}
+
+	id, err := strconv.ParseUint(string(text), 10, 8)
+	if err != nil {
+		return fmt.Errorf("arcsek: unknown cipher suite %q", text)
+	}
+
+	*s = CipherSuite(id)
+	return nil
+}
+
+// The length of the keys the suite accepts, or 0 if
+// it takes more than one
+func (s CipherSuite) keySize() int {
+	switch s {
+	case AES128GCM:
+		return 16
+	case AES256GCM, ChaCha20Poly1305, XChaCha20Poly1305:
+		return 32
+	default:
+		return 0
+	}
+}
+
+// Choose the suite used when none is specified. The
+// length of the key decides between AES-128 and AES-256
+// like it always did, but the header records the one
+// actually used
+func defaultSuite(key []byte) CipherSuite {
+	switch len(key) {
+	case 16:
+		return AES128GCM
+	case 32:
+		return AES256GCM
+	default:
+		return AESGCM
+	}
+}
+
+// Create the AEAD of the suite from the key. A key whose
+// length doesn't match the suite is an error rather than
+// a silent change of the suite
+func (s CipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	if n := s.keySize(); n != 0 && len(key) != n {
+		return nil, fmt.Errorf("%w: %s needs a %d byte key, got %d bytes", ErrInvalidKeyLength, s, n, len(key))
+	}
+
+	factory, err := lookupCipherSuite(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return factory(key)
+}
+
+// AEADFactory creates the AEAD of a cipher suite from a key.
+//
+// The NonceSize() of the AEAD it returns must be between 8
+// and 259 bytes. sio uses the last 4 bytes of the nonce as
+// a chunk counter, so the random part stored in the vault
+// header is NonceSize() - 4 bytes long. Suites whose random
+// part is short, like the 8 bytes of AES-GCM, should not
+// seal too many vaults under the same key.
+//
+// Keys derived by the package are wiped once it returns,
+// so the AEAD must keep a copy of the key, not the slice
+type AEADFactory func(key []byte) (cipher.AEAD, error)
+
+var (
+	suites   = make(map[CipherSuite]AEADFactory)
+	suitesMu sync.RWMutex
+)
+
+func init() {
+	RegisterCipherSuite(AESGCM, createAESGCMFromKey)
+	RegisterCipherSuite(ChaCha20Poly1305, createChaCha20Poly1305FromKey)
+	RegisterCipherSuite(AES128GCM, createAESGCMFromKey)
+	RegisterCipherSuite(AES256GCM, createAESGCMFromKey)
+	RegisterCipherSuite(XChaCha20Poly1305, createXChaCha20Poly1305FromKey)
+}
+
+// RegisterCipherSuite makes an AEAD available to seal and
+// open vaults whose header carries id. Custom suites should
+// use ids from 128 on to stay clear of the built-in ones.
+//
+// It panics if factory is nil or the id is already
+// registered, so it is meant to be called from init functions
+func RegisterCipherSuite(id CipherSuite, factory AEADFactory) {
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+
+	if factory == nil {
+		panic("arcsek: RegisterCipherSuite with a nil factory")
+	}
+
+	if _, dup := suites[id]; dup {
+		panic(fmt.Sprintf("arcsek: RegisterCipherSuite called twice for %s", id))
+	}
+
+	suites[id] = factory
+}
+
+// Find the factory registered for the suite
+func lookupCipherSuite(s CipherSuite) (AEADFactory, error) {
+	suitesMu.RLock()
+	factory, ok := suites[s]
+	suitesMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("arcsek: unknown cipher suite %d", byte(s))
+	}
+
+	return factory, nil
+}
+
+// Create a ChaCha20-Poly1305 AEAD from the key.
+// This will fail if the key is not 32 bytes long
+func createChaCha20Poly1305FromKey(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+// Create an XChaCha20-Poly1305 AEAD from the key.
+// This will fail if the key is not 32 bytes long
+func createXChaCha20Poly1305FromKey(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
@@ -0,0 +1,278 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+)
+
+// Position of the suite in the header, after the magic
+// and the version
+const suiteOffset = 7
+
+func TestMakeChaCha20Poly1305FromKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  []byte
+		good bool
+	}{
+		{"Good 256 bit (32 byte) key",
+			[]byte("0123456789ABCDEF0123456789ABCDEF"), true},
+		{"Bad 128 bit (16 byte) key", []byte("0123456789ABCDEF"), false},
+		{"Bad key with len 4 bytes (16 bit)", []byte("1234"), false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := createChaCha20Poly1305FromKey(tc.key)
+			if (tc.good && err != nil) || (!tc.good && err == nil) {
+				t.Fatal("Error not corresponing to key")
+			}
+		})
+	}
+}
+
+// Seal a couple of files with a suite and return the
+// serialized vault
+func sealWithSuite(t *testing.T, suite CipherSuite, key []byte) *bytes.Buffer {
+	files := []string{
+		"testing-files/in/existance/testfile1.txt",
+		"testing-files/in/existance/testfile2.txt",
+	}
+
+	b := VaultBuilder{CipherSuite: suite}
+	vault, err := b.Build(files, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	buff := new(bytes.Buffer)
+	if _, err = vault.WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff
+}
+
+func TestCipherSuiteRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		suite CipherSuite
+		key   []byte
+	}{
+		{"Default suite", 0, genKey("default")},
+		{"AES-GCM", AESGCM, genKey("aes")},
+		{"ChaCha20-Poly1305", ChaCha20Poly1305,
+			[]byte("0123456789ABCDEF0123456789ABCDEF")},
+		{"AES-128-GCM", AES128GCM, genKey("aes128")},
+		{"AES-256-GCM", AES256GCM,
+			[]byte("0123456789ABCDEF0123456789ABCDEF")},
+		{"XChaCha20-Poly1305", XChaCha20Poly1305,
+			[]byte("0123456789ABCDEF0123456789ABCDEF")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			buff := sealWithSuite(t, tc.suite, tc.key)
+
+			// The suite is recorded in the header
+			want := tc.suite
+			if want == 0 {
+				want = AES128GCM
+			}
+
+			h, _, err := parseHeader(bytes.NewReader(buff.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.suite != want {
+				t.Fatalf("The header records %s instead of %s", h.suite, want)
+			}
+
+			tr, err := NewTarReaderNonce(buff, tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = tr.Next(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCipherSuiteUnknown(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	b := VaultBuilder{CipherSuite: 0xEE}
+	if _, err := b.Build(files, genKey("pw")); err == nil {
+		t.Fatal("An unknown suite should not build a vault")
+	}
+
+	// Change the suite of a good vault
+	buff := sealWithSuite(t, AESGCM, genKey("pw"))
+	buff.Bytes()[suiteOffset] = 0xEE
+
+	if _, err := NewTarReaderNonce(buff, genKey("pw")); err == nil {
+		t.Fatal("An unknown suite should not open a vault")
+	}
+}
+
+func TestCipherSuiteKeyLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		suite CipherSuite
+		key   []byte
+		good  bool
+	}{
+		{"AES-128 with a 16 byte key", AES128GCM, []byte("0123456789ABCDEF"), true},
+		{"AES-128 with a 32 byte key", AES128GCM,
+			[]byte("0123456789ABCDEF0123456789ABCDEF"), false},
+		{"AES-256 with a 16 byte key", AES256GCM, []byte("0123456789ABCDEF"), false},
+		{"AES-256 with a 32 byte key", AES256GCM,
+			[]byte("0123456789ABCDEF0123456789ABCDEF"), true},
+		{"ChaCha20 with a 16 byte key", ChaCha20Poly1305, []byte("0123456789ABCDEF"), false},
+	}
+
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := VaultBuilder{CipherSuite: tc.suite}
+			v, err := b.Build(files, tc.key)
+			if (tc.good && err != nil) || (!tc.good && err == nil) {
+				t.Fatal("Error not corresponing to key and suite")
+			}
+
+			if err == nil {
+				v.Close()
+			}
+		})
+	}
+}
+
+func TestDefaultSuite(t *testing.T) {
+	if s := defaultSuite(make([]byte, 16)); s != AES128GCM {
+		t.Fatalf("A 16 byte key should use AES-128-GCM, got %s", s)
+	}
+
+	if s := defaultSuite(make([]byte, 32)); s != AES256GCM {
+		t.Fatalf("A 32 byte key should use AES-256-GCM, got %s", s)
+	}
+}
+
+func TestXChaCha20Poly1305Nonce(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	key := []byte("0123456789ABCDEF0123456789ABCDEF")
+
+	b := VaultBuilder{CipherSuite: XChaCha20Poly1305}
+	vault, err := b.Build(files, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	// sio takes 4 bytes of the 24 byte nonce for its counter
+	if len(vault.Nonce()) != 20 {
+		t.Fatalf("Expected a 20 byte nonce, got %d bytes", len(vault.Nonce()))
+	}
+
+	// magic | version | suite | compression | no kdf | nonce size | nonce |
+	// info size | info nonce | info | tag
+	h := vault.Header()
+	if len(h) != 31+2+24+infoLen+16 || h[10] != 20 {
+		t.Fatalf("The header does not record the nonce size: %x", h)
+	}
+}
+
+func TestNonceSizeMismatch(t *testing.T) {
+	key := []byte("0123456789ABCDEF0123456789ABCDEF")
+	buff := sealWithSuite(t, XChaCha20Poly1305, key)
+
+	// Claim the vault uses ChaCha20-Poly1305 with an 8 byte nonce
+	buff.Bytes()[suiteOffset] = byte(ChaCha20Poly1305)
+
+	if _, err := NewTarReaderNonce(buff, key); !errors.Is(err, ErrNonceSize) {
+		t.Fatalf("Expected ErrNonceSize, got '%v'", err)
+	}
+}
+
+// AES-GCM with a 16 byte nonce, as an experimental suite
+func newWideGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCMWithNonceSize(block, 16)
+}
+
+const testSuiteID CipherSuite = 0x90
+
+func init() {
+	RegisterCipherSuite(testSuiteID, newWideGCM)
+}
+
+func TestAEADFactory(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+	key := genKey("factory")
+
+	b := VaultBuilder{CipherSuite: testSuiteID, AEADFactory: newWideGCM}
+	vault, err := b.Build(files, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	if len(vault.Nonce()) != 12 {
+		t.Fatalf("Expected a 12 byte nonce, got %d bytes", len(vault.Nonce()))
+	}
+
+	buff := new(bytes.Buffer)
+	vault.WriteTo(buff)
+
+	// The reader finds the registered factory by the id
+	tr, err := NewTarReaderNonce(buff, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAEADFactoryBad(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	shortNonce := func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.NewGCMWithNonceSize(block, 4)
+	}
+
+	tests := []struct {
+		name    string
+		builder VaultBuilder
+	}{
+		{"Factory without a suite", VaultBuilder{AEADFactory: newWideGCM}},
+		{"Factory with an unregistered suite",
+			VaultBuilder{CipherSuite: 0xEE, AEADFactory: newWideGCM}},
+		{"Factory with a nonce too short for sio",
+			VaultBuilder{CipherSuite: testSuiteID, AEADFactory: shortNonce}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := tc.builder.Build(files, genKey("pw")); err == nil {
+				t.Fatal("The builder should return an error")
+			}
+		})
+	}
+}
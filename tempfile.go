@@ -0,0 +1,42 @@
+package arcsek
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// The scratch archive is only for this process. Other users
+// on the host can't read it
+const tempFileMode = 0600
+
+// Create a new scratch file in dir, or in os.TempDir if it
+// is empty. The name is random and the file is opened with
+// O_EXCL, so an existing file is never clobbered and a file
+// planted by someone else is never reused.
+//
+// O_TMPFILE is not used: the vault reopens the archive by
+// its name, so it must have one
+func createTempFile(dir, suffix string) (*os.File, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	var id [12]byte
+	for try := 0; try < 100; try++ {
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, "arcsek-"+hex.EncodeToString(id[:])+suffix)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, tempFileMode)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+
+	return nil, &os.PathError{Op: "createtemp", Path: dir, Err: os.ErrExist}
+}
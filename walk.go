@@ -0,0 +1,74 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// WalkVault decrypts the vault in r and calls fn with every
+// entry of the archive, in order, and a reader of its
+// contents. The reader is only valid during the call, what
+// fn leaves unread is skipped.
+//
+// The walk stops at the first error of fn, which is
+// returned, except fs.SkipAll that stops it without one.
+// Once every entry is walked the checksum of the archive
+// is verified, like ExtractTo does
+func WalkVault(r io.Reader, key []byte, fn func(hdr *tar.Header, body io.Reader) error) error {
+	return new(VaultOpener).WalkVault(r, key, fn)
+}
+
+// WalkVault is like the WalkVault function but opens the
+// vault with the settings of the opener
+func (o *VaultOpener) WalkVault(r io.Reader, key []byte, fn func(hdr *tar.Header, body io.Reader) error) error {
+	tr, err := o.Open(r, key)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		body := &walkBody{tr}
+		err = fn(hdr, body)
+		body.r = nil
+
+		if err == fs.SkipAll {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Legacy and streamed vaults have nothing to verify against
+	if tr.info == nil || !tr.info.known() {
+		return nil
+	}
+
+	return tr.Verify()
+}
+
+var errBodyDone = errors.New("arcsek: entry read after its WalkVault callback")
+
+// The contents of an entry, until the callback returns
+type walkBody struct {
+	r io.Reader
+}
+
+func (b *walkBody) Read(p []byte) (int, error) {
+	if b.r == nil {
+		return 0, errBodyDone
+	}
+
+	return b.r.Read(p)
+}
@@ -0,0 +1,95 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func TestWalkVault(t *testing.T) {
+	key := genKey("walk")
+	v, err := NewVaultReader([]string{"testing-files/in/existance"}, key)
+	vault := vaultBytes(t, v, err)
+
+	info, err := ReadVaultInfo(bytes.NewReader(vault), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Count", func(t *testing.T) {
+		var count int
+		var sizes, read int64
+		err := WalkVault(bytes.NewReader(vault), key, func(hdr *tar.Header, body io.Reader) error {
+			count++
+			sizes += hdr.Size
+
+			n, err := io.Copy(io.Discard, body)
+			read += n
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != info.Files || sizes != info.Size || read != info.Size {
+			t.Fatalf("Walked %d entries of %d bytes, read %d. The vault has %d of %d", count, sizes, read, info.Files, info.Size)
+		}
+	})
+
+	t.Run("Unread", func(t *testing.T) {
+		// Skipping the bodies still verifies the vault
+		var count int
+		err := WalkVault(bytes.NewReader(vault), key, func(*tar.Header, io.Reader) error {
+			count++
+			return nil
+		})
+		if err != nil || count != info.Files {
+			t.Fatalf("Walked %d entries: %v", count, err)
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		stop := errors.New("stop")
+		for _, tt := range []struct {
+			ret, want error
+		}{{stop, stop}, {fs.SkipAll, nil}} {
+			var count int
+			err := WalkVault(bytes.NewReader(vault), key, func(*tar.Header, io.Reader) error {
+				count++
+				return tt.ret
+			})
+
+			if err != tt.want || count != 1 {
+				t.Fatalf("Walked %d entries and got %v instead of %v", count, err, tt.want)
+			}
+		}
+	})
+
+	t.Run("Body after return", func(t *testing.T) {
+		var kept io.Reader
+		err := WalkVault(bytes.NewReader(vault), key, func(_ *tar.Header, body io.Reader) error {
+			kept = body
+			return fs.SkipAll
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = kept.Read(make([]byte, 1)); err != errBodyDone {
+			t.Fatalf("Got %v instead of errBodyDone", err)
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		err := WalkVault(bytes.NewReader(vault), genKey("other"), func(*tar.Header, io.Reader) error {
+			t.Fatal("An entry was walked")
+			return nil
+		})
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Got %v instead of ErrAuthFailed", err)
+		}
+	})
+}
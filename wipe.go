@@ -0,0 +1,43 @@
+package arcsek
+
+// Wipe overwrites b with zeros, for callers to clear their
+// own keys and passwords once the vault is sealed or opened.
+// The package wipes the keys it derives itself once the
+// cipher has its own copy.
+//
+// It is a best effort: the garbage collector may have moved
+// and copied the slice before, strings can't be wiped and
+// the memory may have been swapped to disk. It only shortens
+// the time a key is around
+func Wipe(b []byte) {
+	clear(b)
+}
+
+// A key that goes through the steps of its derivation. The
+// key of the caller is theirs, but every key derived from
+// it is wiped when the next one replaces it
+type keyChain struct {
+	key     []byte
+	derived bool
+}
+
+// Replace the key with the result of the next step
+func (c *keyChain) next(key []byte, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if c.derived {
+		Wipe(c.key)
+	}
+
+	c.key, c.derived = key, true
+	return nil
+}
+
+// Wipe the last key if the package derived it
+func (c *keyChain) wipe() {
+	if c.derived {
+		Wipe(c.key)
+	}
+}
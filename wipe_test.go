@@ -0,0 +1,66 @@
+package arcsek
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"testing"
+)
+
+func TestWipe(t *testing.T) {
+	b := []byte("a secret key")
+	Wipe(b)
+
+	if !bytes.Equal(b, make([]byte, len(b))) {
+		t.Fatalf("The key was not wiped: %q", b)
+	}
+}
+
+// The keys derived to seal or open a vault are wiped, the
+// one of the caller is left alone
+func TestDerivedKeysWiped(t *testing.T) {
+	files := []string{"testing-files/in/existance/testfile1.txt"}
+
+	var seen [][]byte
+	factory := func(key []byte) (cipher.AEAD, error) {
+		seen = append(seen, key)
+		return createAESGCMFromKey(key)
+	}
+
+	testCases := []struct {
+		name    string
+		builder VaultBuilder
+		wiped   bool
+	}{
+		{"Raw key", VaultBuilder{CipherSuite: AES128GCM, AEADFactory: factory}, false},
+		{"Password", VaultBuilder{CipherSuite: AES256GCM, AEADFactory: factory, KeyDeriver: testScryptParams}, true},
+		{"Keyfile", VaultBuilder{CipherSuite: AES128GCM, AEADFactory: factory, Keyfile: []byte("keyfile")}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			seen = nil
+			key := genKey("wipe")
+
+			vault, err := tc.builder.Build(files, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vault.Close()
+
+			if !bytes.Equal(key, genKey("wipe")) {
+				t.Fatal("The key of the caller was wiped")
+			}
+
+			zero := bytes.Equal(seen[0], make([]byte, len(seen[0])))
+			if zero != tc.wiped {
+				t.Fatalf("Expected the key of the AEAD to be wiped: %v, got %x", tc.wiped, seen[0])
+			}
+
+			// The vault still works
+			o := VaultOpener{Keyfile: tc.builder.Keyfile}
+			if _, err = o.ExtractTo(vault, key, t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package arcsek
+
+import (
+	"errors"
+	"io"
+
+	"github.com/secure-io/sio-go"
+)
+
+// ErrWriterClosed is returned when a VaultWriter is written
+// after Close
+var ErrWriterClosed = errors.New("arcsek: write to a closed VaultWriter")
+
+// VaultWriter is the writing counterpart of VaultReader.
+// The caller writes the plain tar, for example with a
+// tar.Writer, and it is compressed and encrypted on the fly
+// into the underlying writer, after the header.
+//
+// Close must be called once the tar is complete: it seals the
+// last chunk and writes its authentication tag. A vault whose
+// writer was never closed is truncated and won't open.
+//
+// Like EncryptTo nothing is buffered, so the info of the
+// vault is not known and its Files and Size are -1
+type VaultWriter struct {
+	// Compresses into ew
+	cw io.WriteCloser
+	ew *sio.EncWriter
+
+	closed bool
+}
+
+// NewVaultWriter writes the header of a new vault sealed
+// with key to w and returns the writer of its tar. w is
+// not closed
+func NewVaultWriter(w io.Writer, key []byte) (*VaultWriter, error) {
+	return new(VaultBuilder).NewVaultWriter(w, key)
+}
+
+// NewVaultWriter is like the NewVaultWriter function but
+// seals the vault with the settings of the builder. The
+// options about the files to archive don't apply
+func (b *VaultBuilder) NewVaultWriter(w io.Writer, key []byte) (*VaultWriter, error) {
+	if len(key) == 0 {
+		return nil, errEmptyKey
+	}
+
+	level, err := b.compressionLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	cmp, err := b.compressor()
+	if err != nil {
+		return nil, err
+	}
+
+	h, aead, stream, err := b.newHeader(key)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := h.complete(aead, unknownInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(raw); err != nil {
+		return nil, err
+	}
+
+	// sio closes the writer it wraps
+	vw := &VaultWriter{ew: stream.EncryptWriter(struct{ io.Writer }{w}, h.nonce, h.withAAD(raw))}
+	if vw.cw, err = cmp.newWriter(vw.ew, level); err != nil {
+		return nil, err
+	}
+
+	return vw, nil
+}
+
+// Write compresses and encrypts p, the next bytes of the tar
+func (v *VaultWriter) Write(p []byte) (int, error) {
+	if v.closed {
+		return 0, ErrWriterClosed
+	}
+
+	return v.cw.Write(p)
+}
+
+// Close flushes the compression and seals the last chunk
+// with its authentication tag. The underlying writer is not
+// closed. Closing it again does nothing
+func (v *VaultWriter) Close() error {
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+
+	if err := v.cw.Close(); err != nil {
+		return err
+	}
+
+	return v.ew.Close()
+}
@@ -0,0 +1,99 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Write the files into a tar through the vault writer
+func writeTar(t *testing.T, vw *VaultWriter, files map[string]string) {
+	tw := tar.NewWriter(vw)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultWriter(t *testing.T) {
+	key := genKey("writer")
+	files := map[string]string{"a.txt": "driven by the caller", "b.txt": string(bytes.Repeat([]byte("b"), 100000))}
+
+	for _, c := range []Compression{Gzip, None, Zstd} {
+		t.Run(fmt.Sprint(c), func(t *testing.T) {
+			buff := new(bytes.Buffer)
+			b := VaultBuilder{Compression: c}
+			vw, err := b.NewVaultWriter(buff, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeTar(t, vw, files)
+			if err = vw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			names, contents, err := readEntries(bytes.NewReader(buff.Bytes()), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(names) != 2 || contents["a.txt"] != files["a.txt"] || contents["b.txt"] != files["b.txt"] {
+				t.Fatalf("Got %v from the vault", names)
+			}
+
+			if err = VerifyVault(bytes.NewReader(buff.Bytes()), key); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("Not closed", func(t *testing.T) {
+		buff := new(bytes.Buffer)
+		vw, err := NewVaultWriter(buff, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTar(t, vw, files)
+
+		// Without the last chunk the vault does not open
+		if err = VerifyVault(bytes.NewReader(buff.Bytes()), key); err == nil {
+			t.Fatal("The vault was never closed")
+		}
+	})
+
+	t.Run("Write after Close", func(t *testing.T) {
+		vw, err := NewVaultWriter(new(bytes.Buffer), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = vw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = vw.Close(); err != nil {
+			t.Fatalf("The second Close failed: %v", err)
+		}
+
+		if _, err = vw.Write([]byte("late")); err != ErrWriterClosed {
+			t.Fatalf("Got %v instead of ErrWriterClosed", err)
+		}
+	})
+
+	t.Run("Empty key", func(t *testing.T) {
+		if _, err := NewVaultWriter(new(bytes.Buffer), nil); err == nil {
+			t.Fatal("A vault needs a key")
+		}
+	})
+}
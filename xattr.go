@@ -0,0 +1,32 @@
+package arcsek
+
+import (
+	"archive/tar"
+	"strings"
+)
+
+// The prefix of the PAX records holding extended
+// attributes, the same GNU tar and bsdtar use
+const xattrPrefix = "SCHILY.xattr."
+
+// Get the xattrs recorded in the header
+func headerXattrs(hdr *tar.Header) map[string]string {
+	xattrs := make(map[string]string)
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, xattrPrefix) {
+			xattrs[strings.TrimPrefix(k, xattrPrefix)] = v
+		}
+	}
+	return xattrs
+}
+
+// Record an xattr in the header
+func setHeaderXattr(hdr *tar.Header, name string, value []byte) {
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+
+	// Only PAX can hold them
+	hdr.Format = tar.FormatPAX
+	hdr.PAXRecords[xattrPrefix+name] = string(value)
+}
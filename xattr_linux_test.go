@@ -0,0 +1,84 @@
+//go:build linux
+
+package arcsek
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrsRoundTrip(t *testing.T) {
+	key := genKey("xattrs")
+
+	src := t.TempDir()
+	file := filepath.Join(src, "labeled.txt")
+	if err := ioutil.WriteFile(file, []byte("labeled"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := unix.Setxattr(file, "user.arcsek.test", []byte("value"), 0)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skip("The file system has no user xattrs")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := VaultBuilder{IncludeXattrs: true}
+	vault, err := b.Build([]string{file}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	dest := t.TempDir()
+	opener := VaultOpener{IncludeXattrs: true}
+	if _, err = opener.ExtractTo(vault, key, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	value := make([]byte, 64)
+	n, err := unix.Getxattr(filepath.Join(dest, "labeled.txt"), "user.arcsek.test", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value[:n]) != "value" {
+		t.Fatalf("Expected the xattr 'value', got '%s'", value[:n])
+	}
+}
+
+func TestXattrsNotIncluded(t *testing.T) {
+	key := genKey("xattrs")
+
+	src := t.TempDir()
+	file := filepath.Join(src, "labeled.txt")
+	ioutil.WriteFile(file, []byte("labeled"), 0644)
+	if err := unix.Setxattr(file, "user.arcsek.test", []byte("value"), 0); err != nil {
+		t.Skip("The file system has no user xattrs")
+	}
+
+	vault, err := NewVaultReader([]string{file}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vault.Close()
+
+	tr, err := NewTarReaderNonce(vault, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headerXattrs(hdr)) != 0 {
+		t.Fatal("The xattrs were recorded without IncludeXattrs")
+	}
+}
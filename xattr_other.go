@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package arcsek
+
+import "archive/tar"
+
+// There are no xattrs to record on this platform
+func addXattrs(hdr *tar.Header, path string) error {
+	return nil
+}
+
+// There are no xattrs to restore on this platform
+func restoreXattrs(path string, hdr *tar.Header) error {
+	return nil
+}
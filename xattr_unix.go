@@ -0,0 +1,93 @@
+//go:build linux || darwin
+
+package arcsek
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Record the xattrs of the file at path in the header
+func addXattrs(hdr *tar.Header, path string) error {
+	names, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		if errors.Is(err, unix.ENODATA) {
+			// Removed while we were reading
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		setHeaderXattr(hdr, name, value)
+	}
+
+	return nil
+}
+
+// The names of the xattrs of the file
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	if isXattrUnsupported(err) || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// The value of an xattr of the file
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	if size, err = unix.Getxattr(path, name, value); err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// Apply the xattrs recorded in the header to the file,
+// not to what a symlink there points to. Those that can't
+// be set here are skipped
+func restoreXattrs(path string, hdr *tar.Header) error {
+	for name, value := range headerXattrs(hdr) {
+		err := unix.Lsetxattr(path, name, []byte(value), 0)
+		if isXattrUnsupported(err) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the file system has no xattrs
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}